@@ -16,6 +16,9 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"os/signal"
 
 	_ "github.com/benthosdev/benthos/v4/public/components/all"
 	"github.com/benthosdev/benthos/v4/public/service"
@@ -25,10 +28,23 @@ import (
 	_ "github.com/united-manufacturing-hub/benthos-umh/v2/plugins/influxdb"
 	_ "github.com/united-manufacturing-hub/benthos-umh/v2/plugins/jsontosp"
 	_ "github.com/united-manufacturing-hub/benthos-umh/v2/plugins/modbus_plugin"
-	_ "github.com/united-manufacturing-hub/benthos-umh/v2/plugins/opcua_plugin"
+	"github.com/united-manufacturing-hub/benthos-umh/v2/plugins/opcua_plugin"
 	_ "github.com/united-manufacturing-hub/benthos-umh/v2/plugins/s7comm_plugin"
 )
 
 func main() {
+	// benthos-umh opcua browse exports the node trees of an OPC UA server, see opcua_plugin.RunBrowseCommand
+	if len(os.Args) > 2 && os.Args[1] == "opcua" && os.Args[2] == "browse" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		if err := opcua_plugin.RunBrowseCommand(ctx, os.Args[3:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "opcua browse: %v\n", err)
+			stop()
+			os.Exit(1)
+		}
+		return
+	}
+
 	service.RunCLI(context.Background())
 }
@@ -0,0 +1,342 @@
+package ab_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTestBatch(t *testing.T, input service.BatchInput) []map[string]any {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	batch, _, err := input.ReadBatch(ctx)
+	require.NoError(t, err)
+
+	var bodies []map[string]any
+	for _, msg := range batch {
+		body, err := msg.AsBytes()
+		require.NoError(t, err)
+		var decoded map[string]any
+		require.NoError(t, json.Unmarshal(body, &decoded))
+		bodies = append(bodies, decoded)
+	}
+	return bodies
+}
+
+func TestABSubscriptionChangeDetection(t *testing.T) {
+	plc := newTestLogixController(t, map[string]any{
+		"Pressure":                 int16(42),
+		"Program:MainProgram.Temp": float32(21.5),
+		"Running":                  true,
+	})
+
+	input := &ABCommInputSub{
+		tcpDevice: plc.Address(),
+		timeout:   2 * time.Second,
+		log:       service.MockResources().Logger(),
+		subscription: []subscriptionD{
+			{ID: 1, Address: "Pressure", Name: "pressure", Group: "D001", DataType: "int16"},
+			{ID: 2, Address: "Program:MainProgram.Temp", Name: "temp"},
+			{ID: 3, Address: "Running", Name: "running"},
+		},
+	}
+	require.NoError(t, input.Connect(context.Background()))
+	defer input.Close(context.Background())
+
+	// the first read emits every tag
+	bodies := readTestBatch(t, input)
+	require.Len(t, bodies, 3)
+	assert.Equal(t, "pressure", bodies[0]["name"])
+	assert.Equal(t, float64(42), bodies[0]["value"])
+	assert.Equal(t, "int16", bodies[0]["datatype"])
+	assert.Equal(t, float64(21.5), bodies[1]["value"])
+	assert.Equal(t, "float32", bodies[1]["datatype"])
+	assert.Equal(t, true, bodies[2]["value"])
+
+	// nothing changed
+	assert.Empty(t, readTestBatch(t, input))
+
+	plc.SetTag("Pressure", int16(43))
+	bodies = readTestBatch(t, input)
+	require.Len(t, bodies, 1)
+	assert.Equal(t, "pressure", bodies[0]["name"])
+	assert.Equal(t, float64(43), bodies[0]["value"])
+}
+
+func TestABSubscriptionUnknownTag(t *testing.T) {
+	plc := newTestLogixController(t, map[string]any{"Pressure": int16(42)})
+
+	input := &ABCommInputSub{
+		tcpDevice:    plc.Address(),
+		timeout:      2 * time.Second,
+		log:          service.MockResources().Logger(),
+		subscription: []subscriptionD{{ID: 1, Address: "Missing", Name: "missing"}},
+	}
+	require.NoError(t, input.Connect(context.Background()))
+	defer input.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err := input.ReadBatch(ctx)
+	assert.Error(t, err)
+	assert.NotEqual(t, service.ErrNotConnected, err)
+}
+
+func TestABStrings(t *testing.T) {
+	plc := newTestLogixController(t, map[string]any{
+		"Batch":    "B-2024-001",
+		"Operator": "",
+		"Recipe":   "Mix",
+	})
+
+	input := &ABCommInputSub{
+		tcpDevice: plc.Address(),
+		timeout:   2 * time.Second,
+		log:       service.MockResources().Logger(),
+		subscription: []subscriptionD{
+			{ID: 1, Address: "Batch", Name: "batch", DataType: "string"},
+			{ID: 2, Address: "Operator", Name: "operator", DataType: "str"},
+			{ID: 3, Address: "Recipe", Name: "recipe"},
+		},
+	}
+	require.NoError(t, input.Connect(context.Background()))
+	defer input.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	batch, _, err := input.ReadBatch(ctx)
+	require.NoError(t, err)
+	require.Len(t, batch, 3)
+
+	tests := []struct {
+		value    string
+		datatype string
+	}{
+		{"B-2024-001", "string"},
+		{"", "string"},
+	}
+	for i, tc := range tests {
+		body, err := batch[i].AsBytes()
+		require.NoError(t, err)
+		var decoded map[string]any
+		require.NoError(t, json.Unmarshal(body, &decoded))
+		assert.Equal(t, tc.value, decoded["value"])
+		assert.Equal(t, tc.datatype, decoded["datatype"])
+
+		value, _ := batch[i].MetaGet("value")
+		assert.Equal(t, tc.value, value)
+	}
+
+	// without a datatype, the structure is not taken for a string
+	body, err := batch[2].AsBytes()
+	require.NoError(t, err)
+	var decoded map[string]any
+	require.NoError(t, json.Unmarshal(body, &decoded))
+	assert.Equal(t, "bytes", decoded["datatype"])
+	assert.Equal(t, []any{float64(3), float64(0), float64(0), float64(0), float64('M'), float64('i'), float64('x')}, decoded["value"].([]any)[:7])
+	value, _ := batch[2].MetaGet("value")
+	assert.True(t, strings.HasPrefix(value, "030000004d6978"), value)
+}
+
+func TestDecodeValue(t *testing.T) {
+	// a user defined type whose first DINT is small looks like a Logix STRING
+	udt := []byte{0x02, 0x00, 0x00, 0x00, 0x41, 0x42, 0x00, 0x00}
+
+	value, err := decodeValue(udt, "")
+	require.NoError(t, err)
+	assert.Equal(t, rawBytes(udt), value)
+	value, err = decodeValue(udt, "MyUDT")
+	require.NoError(t, err)
+	assert.Equal(t, rawBytes(udt), value)
+
+	// undecoded structures are numbers in the body instead of base64
+	body, err := abValue{Value: value, DataType: dataTypeOf(value, "MyUDT")}.marshal(time.UnixMilli(1712243694046))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"value": [2, 0, 0, 0, 65, 66, 0, 0], "datatype": "bytes", "timestamp_ms": 1712243694046}`, string(body))
+	value, err = decodeValue(udt, "STRING")
+	require.NoError(t, err)
+	assert.Equal(t, "AB", value)
+
+	_, err = decodeValue([]byte{0x10, 0x00, 0x00, 0x00, 0x41}, "string")
+	assert.Error(t, err)
+
+	value, err = decodeValue(int16(42), "")
+	require.NoError(t, err)
+	assert.Equal(t, int16(42), value)
+}
+
+func TestABTriggerBatching(t *testing.T) {
+	plc := newTestLogixController(t, map[string]any{
+		"PartDone":   int32(1),
+		"PartID":     "P-1",
+		"Weight":     float32(12.5),
+		"Motor.Amps": int16(7),
+	})
+
+	input := &ABCommInput{
+		tcpDevice: plc.Address(),
+		timeout:   2 * time.Second,
+		log:       service.MockResources().Logger(),
+		pollRate:  10 * time.Millisecond,
+		subscription: []subscriptionDef{
+			{ID: 1, Address: "PartDone", Group: "D001", DB: "mssql"},
+		},
+		tSubscription: []tSubscriptionsDef{
+			{ID: 1, tSub: []tSubscription{
+				{Name: "part_id", Address: "PartID", DataType: "string"},
+				{Name: "weight", Address: "Weight"},
+				{Name: "Motor.Amps", Address: "Motor.Amps"},
+			}},
+		},
+	}
+	require.NoError(t, input.Connect(context.Background()))
+	defer input.Close(context.Background())
+
+	bodies := readTestBatch(t, input)
+	require.Len(t, bodies, 1)
+	assert.Equal(t, float64(1), bodies[0]["value"])
+	assert.Equal(t, "int32", bodies[0]["datatype"])
+	assert.Equal(t, map[string]any{
+		"part_id":    "P-1",
+		"weight":     12.5,
+		"Motor_Amps": float64(7),
+	}, bodies[0]["values"])
+
+	// the batch tags are only read when the trigger changes
+	reads := plc.Reads("PartID")
+	plc.SetTag("PartID", "P-2")
+	assert.Empty(t, readTestBatch(t, input))
+	assert.Equal(t, reads, plc.Reads("PartID"))
+
+	plc.SetTag("PartDone", int32(2))
+	bodies = readTestBatch(t, input)
+	require.Len(t, bodies, 1)
+	assert.Equal(t, "P-2", bodies[0]["values"].(map[string]any)["part_id"])
+}
+
+func TestABTriggerPollRate(t *testing.T) {
+	plc := newTestLogixController(t, map[string]any{"PartDone": int32(1), "Weight": float32(12.5)})
+
+	input := &ABCommInput{
+		tcpDevice:     plc.Address(),
+		timeout:       2 * time.Second,
+		log:           service.MockResources().Logger(),
+		pollRate:      100 * time.Millisecond,
+		subscription:  []subscriptionDef{{ID: 1, Address: "PartDone"}},
+		tSubscription: []tSubscriptionsDef{{ID: 1, tSub: []tSubscription{{Name: "weight", Address: "Weight"}}}},
+	}
+	require.NoError(t, input.Connect(context.Background()))
+	defer input.Close(context.Background())
+	require.Len(t, readTestBatch(t, input), 1)
+
+	// reads without changes wait for the next check instead of reading the trigger tags in a loop
+	reads := plc.Reads("PartDone")
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.Empty(t, readTestBatch(t, input))
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+	assert.Equal(t, reads+3, plc.Reads("PartDone"))
+}
+
+func TestABTriggerSubscribeEnabled(t *testing.T) {
+	plc := newTestLogixController(t, map[string]any{"PartDone": int32(1), "PartID": "P-1", "Weight": float32(12.5)})
+
+	input := &ABCommInput{
+		tcpDevice:        plc.Address(),
+		timeout:          2 * time.Second,
+		log:              service.MockResources().Logger(),
+		pollRate:         10 * time.Millisecond,
+		subscribeEnabled: true,
+		subscription:     []subscriptionDef{{ID: 1, Address: "PartDone"}},
+		tSubscription: []tSubscriptionsDef{{ID: 1, tSub: []tSubscription{
+			{Name: "part_id", Address: "PartID", DataType: "string"},
+			{Name: "weight", Address: "Weight"},
+		}}},
+	}
+	require.NoError(t, input.Connect(context.Background()))
+	defer input.Close(context.Background())
+
+	// the first batch has every tag
+	bodies := readTestBatch(t, input)
+	require.Len(t, bodies, 1)
+	assert.Equal(t, map[string]any{"part_id": "P-1", "weight": 12.5}, bodies[0]["values"])
+
+	// then only the changed ones
+	plc.SetTag("PartID", "P-2")
+	plc.SetTag("PartDone", int32(2))
+	bodies = readTestBatch(t, input)
+	require.Len(t, bodies, 1)
+	assert.Equal(t, map[string]any{"part_id": "P-2"}, bodies[0]["values"])
+}
+
+func TestABTriggerConfig(t *testing.T) {
+	for yaml, valid := range map[string]bool{
+		"pollRate: 0":            false,
+		"subscribeEnabled: true": true,
+		// insecure is ignored instead of failing existing configs
+		"insecure: true": true,
+	} {
+		conf, err := ABCommInputCommConfigSpec.ParseYAML("tcpDevice: localhost\nsubscriptions: []\ntsubscriptions: []\n"+yaml, nil)
+		require.NoError(t, err)
+		_, err = newABCommInput(conf, service.MockResources())
+		assert.Equal(t, valid, err == nil, yaml)
+	}
+}
+
+func TestABTriggerVerifiesTags(t *testing.T) {
+	plc := newTestLogixController(t, map[string]any{"PartDone": int32(1)})
+
+	input := &ABCommInput{
+		tcpDevice:     plc.Address(),
+		timeout:       2 * time.Second,
+		log:           service.MockResources().Logger(),
+		verifyTags:    true,
+		subscription:  []subscriptionDef{{ID: 1, Address: "PartDone"}},
+		tSubscription: []tSubscriptionsDef{{ID: 1, tSub: []tSubscription{{Name: "missing", Address: "Missing"}}}},
+	}
+	assert.Error(t, input.Connect(context.Background()))
+	assert.Nil(t, input.client)
+
+	input.verifyTags = false
+	assert.NoError(t, input.Connect(context.Background()))
+	input.Close(context.Background())
+}
+
+func TestABReconnect(t *testing.T) {
+	plc := newTestLogixController(t, map[string]any{"Pressure": int16(42)})
+
+	input := &ABCommInputSub{
+		tcpDevice:    plc.Address(),
+		timeout:      time.Second,
+		log:          service.MockResources().Logger(),
+		subscription: []subscriptionD{{ID: 1, Address: "Pressure", Name: "pressure"}},
+	}
+	require.NoError(t, input.Connect(context.Background()))
+	defer input.Close(context.Background())
+	require.Len(t, readTestBatch(t, input), 1)
+
+	plc.Reboot()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err := input.ReadBatch(ctx)
+	assert.Equal(t, service.ErrNotConnected, err)
+	assert.Nil(t, input.client)
+	assert.Error(t, input.Connect(context.Background()))
+
+	plc.SetTag("Pressure", int16(50))
+	plc.Restart()
+	require.NoError(t, input.Connect(context.Background()))
+	bodies := readTestBatch(t, input)
+	require.Len(t, bodies, 1)
+	assert.Equal(t, float64(50), bodies[0]["value"])
+}
@@ -4,10 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"log"
 	"reflect"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -38,7 +35,9 @@ type subscriptionD struct {
 	Historian string
 	SqlSp     string
 	DataType  string
-	Value     any
+	// Description is taken from the L5X export, if one is configured
+	Description string
+	Value       any
 }
 
 func ParseSubscriptionDef(subscription []string) []subscriptionD {
@@ -80,7 +79,11 @@ var ABCommSubInputCommConfigSpec = service.NewConfigSpec().
 		"Configure the plugin by specifying the PLC's IP address, rack and slot numbers, and the data blocks to read.").
 	Field(service.NewStringField("tcpDevice").Description("IP address of the Allen Bradly PLC.")).
 	Field(service.NewIntField("timeout").Description("The timeout duration in seconds for connection attempts and read requests.").Default(10)).
-	Field(service.NewStringListField("subscriptions").Description("List of AB addresses Address formats include direct area access"))
+	Field(service.NewStringListField("subscriptions").Description("List of AB addresses Address formats include direct area access").Default([]string{})).
+	Field(service.NewStringField("l5x_file").Description("Path to a Studio 5000 L5X export. Its controller and program tags are added to the subscriptions and their descriptions are set as metadata.").Default("")).
+	Field(service.NewStringListField("l5x_include").Description("Glob patterns of the L5X tag addresses to subscribe to, e.g. Program:MainProgram.*. If not set, all tags are subscribed.").Default([]string{})).
+	Field(service.NewStringListField("l5x_exclude").Description("Glob patterns of the L5X tag addresses to skip.").Default([]string{})).
+	Field(service.NewStringField("l5x_defaults").Description(`group, db, historian and sqlSp of the subscriptions created from the L5X file, e.g. {"group": "D001", "db": "mssql", "historian": "influx", "sqlSp": "sp_sql_logging"}`).Default(""))
 
 // newS7CommInput is the constructor function for S7CommInput. It parses the plugin configuration,
 // establishes a connection with the S7 PLC, and initializes the input plugin instance.
@@ -103,6 +106,23 @@ func newABCommSubInput(conf *service.ParsedConfig, mgr *service.Resources) (serv
 
 	sub := ParseSubscriptionDef(subscriptions)
 
+	l5xFile, err := conf.FieldString("l5x_file")
+	if err != nil {
+		return nil, err
+	}
+
+	if l5xFile != "" {
+		sub, err = addL5XSubscriptions(conf, l5xFile, sub)
+		if err != nil {
+			return nil, err
+		}
+		mgr.Logger().Infof("Subscribing to %d tags including the L5X file %s", len(sub), l5xFile)
+	}
+
+	if len(sub) == 0 {
+		return nil, errors.New("no subscriptions provided")
+	}
+
 	m := &ABCommInputSub{
 		tcpDevice:    tcpDevice,
 		subscription: sub,
@@ -113,6 +133,69 @@ func newABCommSubInput(conf *service.ParsedConfig, mgr *service.Resources) (serv
 	return service.AutoRetryNacksBatched(m), nil
 }
 
+// addL5XSubscriptions completes the configured subscriptions with datatype and description from the L5X file
+// and appends every other tag of the file matching the include/exclude patterns.
+func addL5XSubscriptions(conf *service.ParsedConfig, l5xFile string, sub []subscriptionD) ([]subscriptionD, error) {
+	include, err := conf.FieldStringList("l5x_include")
+	if err != nil {
+		return nil, err
+	}
+
+	exclude, err := conf.FieldStringList("l5x_exclude")
+	if err != nil {
+		return nil, err
+	}
+
+	defaultsStr, err := conf.FieldString("l5x_defaults")
+	if err != nil {
+		return nil, err
+	}
+
+	defaults, err := parseL5XDefaults(defaultsStr)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := loadL5XTags(l5xFile, include, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	tagsByAddress := l5xTagsByAddress(tags)
+	for i, subs := range sub {
+		tag, ok := tagsByAddress[strings.ToLower(subs.Address)]
+		if !ok {
+			continue
+		}
+		if sub[i].DataType == "" {
+			sub[i].DataType = tag.DataType
+		}
+		sub[i].Description = tag.Description
+		delete(tagsByAddress, strings.ToLower(subs.Address))
+	}
+
+	nextID := len(sub) + 1
+	for _, tag := range tags {
+		if _, ok := tagsByAddress[strings.ToLower(tag.Address)]; !ok {
+			continue
+		}
+		sub = append(sub, subscriptionD{
+			ID:          nextID,
+			Address:     tag.Address,
+			Name:        tag.Address,
+			Group:       defaults.Group,
+			DB:          defaults.DB,
+			Historian:   defaults.Historian,
+			SqlSp:       defaults.SqlSp,
+			DataType:    tag.DataType,
+			Description: tag.Description,
+		})
+		delete(tagsByAddress, strings.ToLower(tag.Address))
+		nextID++
+	}
+	return sub, nil
+}
+
 //------------------------------------------------------------------------------
 
 func init() {
@@ -133,12 +216,13 @@ func (g *ABCommInputSub) Connect(ctx context.Context) error {
 	if g.client != nil {
 		return nil
 	}
-	client := gologix.NewClient(g.tcpDevice)
-	err := client.Connect()
+	client := newABClient(g.tcpDevice, g.timeout)
+	err := connectABClient(ctx, client)
 	if err != nil {
-		//log.Printf("Error opening client. %v", err)
+		g.log.Errorf("Failed to connect to %s: %v", g.tcpDevice, err)
 		return err
 	}
+	g.log.Infof("Connected to %s", g.tcpDevice)
 	g.client = client
 	return nil
 }
@@ -148,44 +232,39 @@ func (g *ABCommInputSub) ReadBatch(ctx context.Context) (service.MessageBatch, s
 		return nil, nil, errors.New("emptyCtx is invalid for ReadBatchSubscribe")
 	}
 
+	if g.client == nil {
+		return nil, nil, service.ErrNotConnected
+	}
+
 	msgs := service.MessageBatch{}
 	for i, subs := range g.subscription {
 
 		value, err := g.client.Read_single(subs.Address, gologix.CIPTypeUnknown, 1)
 		if err != nil {
-			//log.Printf("error reading %s: %v", subs.Address, err)
+			g.log.Errorf("Error reading %s: %v", subs.Address, err)
+			// the controller dropped the connection (e.g. reboot), so throw the
+			// session away and let benthos reconnect
+			if isTransportError(g.client, err) {
+				g.client.Disconnect()
+				g.client = nil
+				return nil, nil, service.ErrNotConnected
+			}
 			return nil, func(ctx context.Context, err error) error {
 				return nil // Acknowledgment handling here if needed
 			}, err
 		}
 
-		if subs.DataType == "str" {
-			v, ok := value.([]byte)
-			if !ok {
-				log.Println("Can not convert to byte")
-			}
-			subs.Value = string(v)
-
-		} else {
-			subs.Value = value
+		subs.Value, err = decodeValue(value, subs.DataType)
+		if err != nil {
+			g.log.Errorf("Error decoding %s: %v", subs.Address, err)
+			continue
 		}
-		//log.Println("current str value:", g.subscription[i].Value, " New Value:", subs.Value, " Address:", subs.Address, "comparission:", !reflect.DeepEqual(g.subscription[i].Value, subs.Value))
 
 		if !reflect.DeepEqual(g.subscription[i].Value, subs.Value) {
-
-			if subs.DataType == "str" {
-				v, ok := value.([]byte)
-				if !ok {
-					log.Println("Can not convert to byte")
-				}
-				subs.Value = string(v)
-
-			} else {
-				subs.Value = value
+			msg := g.createMessageFromValue(subs)
+			if msg != nil {
+				msgs = append(msgs, msg)
 			}
-			val := fmt.Sprint(subs.Value)
-			msg := g.createMessageFromValue(subs, strings.TrimSpace(val))
-			msgs = append(msgs, msg)
 			g.subscription[i] = subs
 		}
 
@@ -200,25 +279,37 @@ func (g *ABCommInputSub) Close(ctx context.Context) error {
 
 	if g.client != nil {
 		g.client.Disconnect()
+		g.client = nil
 	}
 	return nil
 }
 
 // createMessageFromValue creates a benthos messages from a given variant and nodeID
 // theoretically nodeID can be extracted from variant, but not in all cases (e.g., when subscribing), so it it left to the calling function
-func (g *ABCommInputSub) createMessageFromValue(subscriptionD subscriptionD, tagValue string) *service.Message {
+func (g *ABCommInputSub) createMessageFromValue(subscriptionD subscriptionD) *service.Message {
+	dataType := dataTypeOf(subscriptionD.Value, subscriptionD.DataType)
+
+	body, err := abValue{
+		Name:     subscriptionD.Name,
+		Value:    subscriptionD.Value,
+		DataType: dataType,
+	}.marshal(time.Now())
+	if err != nil {
+		g.log.Errorf("Could not create the message body for %s: %v", subscriptionD.Address, err)
+		return nil
+	}
 
-	//log.Println("value is:", cleanSubString(tagValue), "L")
-	message := service.NewMessage(nil)
-	message.MetaSet("value", cleanSubString(tagValue))
+	message := service.NewMessage(body)
+	message.MetaSet("value", formatValue(subscriptionD.Value))
 	message.MetaSet("tag_name", subscriptionD.Address)
 	message.MetaSet("group", subscriptionD.Group)
 	message.MetaSet("db", subscriptionD.DB)
 	message.MetaSet("historian", subscriptionD.Historian)
 	message.MetaSet("sqlSp", subscriptionD.SqlSp)
-	message.MetaSet("datatype", subscriptionD.DataType)
-	trigMap := make(map[string]string)
-	trigMap[subscriptionD.Name] = cleanSubString(tagValue)
+	message.MetaSet("datatype", dataType)
+	message.MetaSet("description", subscriptionD.Description)
+	trigMap := make(map[string]any)
+	trigMap[subscriptionD.Name] = subscriptionD.Value
 	jsonMsg, err := json.Marshal(trigMap)
 	if err != nil {
 		g.log.Errorf("Could not change benthos message to json object")
@@ -229,9 +320,3 @@ func (g *ABCommInputSub) createMessageFromValue(subscriptionD subscriptionD, tag
 	return message
 
 }
-func cleanSubString(str string) string {
-	re := regexp.MustCompile("[\b\a\x00 ]+") //split according to \s, \t, \r, \t and whitespace. Edit this regex for other 'conditions'
-
-	split := re.ReplaceAllLiteralString(str, "")
-	return split
-}
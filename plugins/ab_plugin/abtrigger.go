@@ -1,15 +1,14 @@
 package ab_plugin
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"reflect"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/benthosdev/benthos/v4/public/service"
@@ -22,14 +21,19 @@ import (
 // It holds the configuration necessary to establish a connection with a Siemens S7 PLC,
 // along with the read requests to fetch data from the PLC.
 type ABCommInput struct {
-	tcpDevice     string        // IP address of the S7 PLC.
-	timeout       time.Duration // Time duration before a connection attempt or read request times out.
-	subscription  []subscriptionDef
-	tSubscription []tSubscriptionsDef
-	log           *service.Logger // Logger for logging plugin activity.
-	client        *gologix.Client
+	tcpDevice        string        // IP address of the S7 PLC.
+	timeout          time.Duration // Time duration before a connection attempt or read request times out.
+	subscription     []subscriptionDef
+	tSubscription    []tSubscriptionsDef
+	log              *service.Logger // Logger for logging plugin activity.
+	client           *gologix.Client
+	verifyTags       bool          // Read every configured tag once on connect.
+	pollRate         time.Duration // Time between two checks of the trigger tags.
+	subscribeEnabled bool          // Emit only the batch tags that changed since the last batch of the trigger.
+	nextPoll         time.Time
 	//OldSub        subscriptionDef
 }
+
 type subscriptionDef struct {
 	ID        int
 	Address   string
@@ -38,17 +42,20 @@ type subscriptionDef struct {
 	Historian string
 	SqlSp     string
 	DataType  string
-	Value     any
+	// Description is taken from the L5X export, if one is configured
+	Description string
+	Value       any
 }
 type tSubscriptionsDef struct {
 	ID   int
 	tSub []tSubscription
 }
 type tSubscription struct {
-	Name     string
-	Address  string
-	DataType string
-	Value    string
+	Name        string
+	Address     string
+	DataType    string
+	Description string
+	Value       any
 }
 
 func ParseSubscription(subscription []string) []subscriptionDef {
@@ -138,8 +145,13 @@ var ABCommInputCommConfigSpec = service.NewConfigSpec().
 	Field(service.NewIntField("timeout").Description("The timeout duration in seconds for connection attempts and read requests.").Default(10)).
 	Field(service.NewStringListField("subscriptions").Description("List of AB addresses Address formats include direct area access")).
 	Field(service.NewStringListField("tsubscriptions").Description("List of AB trigger node IDs.")).
-	Field(service.NewBoolField("insecure").Description("Set to true to bypass secure connections, useful in case of SSL or certificate issues. Default is secure (false).").Default(false)).
-	Field(service.NewBoolField("subscribeEnabled").Description("Set to true to subscribe to AB nodes instead of fetching them every seconds. Default is pulling messages every second (false).").Default(false))
+	Field(service.NewStringField("l5x_file").Description("Path to a Studio 5000 L5X export. Its controller and program tags matching l5x_include are read together with every trigger and their descriptions are set as metadata.").Default("")).
+	Field(service.NewStringListField("l5x_include").Description("Glob patterns of the L5X tag addresses to read on every trigger, e.g. Program:MainProgram.*. If not set, no tags are added to the batches, and the L5X file only completes the datatypes and descriptions of the configured tags.").Default([]string{})).
+	Field(service.NewStringListField("l5x_exclude").Description("Glob patterns of the L5X tag addresses to skip.").Default([]string{})).
+	Field(service.NewBoolField("verifyTags").Description("Set to true to read every configured tag once on connect, so that typos in the tag addresses fail the connect instead of every read. Default is not to verify (false).").Default(false)).
+	Field(service.NewBoolField("insecure").Description("Has no effect and is ignored with a warning, as EtherNet/IP connections to Logix controllers are not secured.").Default(false).Deprecated()).
+	Field(service.NewIntField("pollRate").Description("The time in milliseconds between two checks of the trigger tags.").Default(1000)).
+	Field(service.NewBoolField("subscribeEnabled").Description("Set to true to emit only the batch tags that changed since the last batch of the trigger, like a subscription. The trigger tags are still checked every pollRate, as Logix controllers do not report tag changes. Default is to emit every batch tag (false).").Default(false))
 
 // newS7CommInput is the constructor function for S7CommInput. It parses the plugin configuration,
 // establishes a connection with the S7 PLC, and initializes the input plugin instance.
@@ -164,6 +176,32 @@ func newABCommInput(conf *service.ParsedConfig, mgr *service.Resources) (service
 	if err != nil {
 		return nil, err
 	}
+	verifyTags, err := conf.FieldBool("verifyTags")
+	if err != nil {
+		return nil, err
+	}
+
+	pollRate, err := conf.FieldInt("pollRate")
+	if err != nil {
+		return nil, err
+	}
+	if pollRate <= 0 {
+		return nil, fmt.Errorf("pollRate must be positive, got %d", pollRate)
+	}
+
+	subscribeEnabled, err := conf.FieldBool("subscribeEnabled")
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := conf.FieldBool("insecure")
+	if err != nil {
+		return nil, err
+	}
+	if insecure {
+		mgr.Logger().Warn("insecure has no effect and is ignored, as EtherNet/IP connections to Logix controllers are not secured")
+	}
+
 	//log.Println(tsubscriptions)
 	if len(tsubscriptions) != len(subscriptions) {
 		return nil, errors.New("subscription and tsubscription fields must be the same length")
@@ -172,17 +210,102 @@ func newABCommInput(conf *service.ParsedConfig, mgr *service.Resources) (service
 
 	tSub := ParseTSubscription(tsubscriptions)
 
+	l5xFile, err := conf.FieldString("l5x_file")
+	if err != nil {
+		return nil, err
+	}
+
+	if l5xFile != "" {
+		if err := addL5XTSubscriptions(conf, l5xFile, sub, tSub); err != nil {
+			return nil, err
+		}
+	}
+
 	m := &ABCommInput{
-		tcpDevice:     tcpDevice,
-		subscription:  sub,
-		tSubscription: tSub,
-		log:           mgr.Logger(),
-		timeout:       time.Duration(timeoutInt) * time.Second,
+		tcpDevice:        tcpDevice,
+		subscription:     sub,
+		tSubscription:    tSub,
+		log:              mgr.Logger(),
+		timeout:          time.Duration(timeoutInt) * time.Second,
+		verifyTags:       verifyTags,
+		pollRate:         time.Duration(pollRate) * time.Millisecond,
+		subscribeEnabled: subscribeEnabled,
 	}
 
 	return service.AutoRetryNacksBatched(m), nil
 }
 
+// addL5XTSubscriptions completes the configured triggers and batch tags with datatype and description
+// from the L5X file and adds every other tag of the file matching the include/exclude patterns to the batch of each trigger.
+// As every batch tag is read on every trigger change, tags are only added if include patterns are configured.
+func addL5XTSubscriptions(conf *service.ParsedConfig, l5xFile string, sub []subscriptionDef, tSub []tSubscriptionsDef) error {
+	include, err := conf.FieldStringList("l5x_include")
+	if err != nil {
+		return err
+	}
+
+	exclude, err := conf.FieldStringList("l5x_exclude")
+	if err != nil {
+		return err
+	}
+
+	allTags, err := loadL5XTags(l5xFile, nil, nil)
+	if err != nil {
+		return err
+	}
+	tags, err := FilterL5XTags(allTags, include, exclude)
+	if err != nil {
+		return err
+	}
+	if len(include) == 0 {
+		tags = nil
+	}
+
+	tagsByAddress := l5xTagsByAddress(allTags)
+	triggers := make(map[string]bool, len(sub))
+	for i, subs := range sub {
+		triggers[strings.ToLower(subs.Address)] = true
+		tag, ok := tagsByAddress[strings.ToLower(subs.Address)]
+		if !ok {
+			continue
+		}
+		if sub[i].DataType == "" {
+			sub[i].DataType = tag.DataType
+		}
+		sub[i].Description = tag.Description
+	}
+
+	for i := range tSub {
+		configured := make(map[string]bool, len(tSub[i].tSub))
+		for j, tsubs := range tSub[i].tSub {
+			configured[strings.ToLower(tsubs.Address)] = true
+			tag, ok := tagsByAddress[strings.ToLower(tsubs.Address)]
+			if !ok {
+				continue
+			}
+			if tSub[i].tSub[j].DataType == "" {
+				tSub[i].tSub[j].DataType = tag.DataType
+			}
+			tSub[i].tSub[j].Description = tag.Description
+		}
+
+		for _, tag := range tags {
+			address := strings.ToLower(tag.Address)
+			if triggers[address] || configured[address] {
+				continue
+			}
+			tSub[i].tSub = append(tSub[i].tSub, tSubscription{
+				Name:        tag.Address,
+				Address:     tag.Address,
+				DataType:    tag.DataType,
+				Description: tag.Description,
+			})
+			configured[address] = true
+		}
+	}
+	return nil
+}
+
 //------------------------------------------------------------------------------
 
 func init() {
@@ -203,71 +326,121 @@ func (g *ABCommInput) Connect(ctx context.Context) error {
 	if g.client != nil {
 		return nil
 	}
-	client := gologix.NewClient(g.tcpDevice)
-	err := client.Connect()
+	client := newABClient(g.tcpDevice, g.timeout)
+	err := connectABClient(ctx, client)
 	if err != nil {
-		//log.Printf("Error opening client. %v", err)
+		g.log.Errorf("Failed to connect to %s: %v", g.tcpDevice, err)
 		return err
 	}
+
+	if g.verifyTags {
+		if err := verifyTags(client, g.addresses()); err != nil {
+			g.log.Errorf("Tag verification failed: %v", err)
+			client.Disconnect()
+			return err
+		}
+	}
+
+	g.log.Infof("Connected to %s", g.tcpDevice)
 	g.client = client
 	return nil
 }
 
+// addresses returns all trigger and batch tag addresses of the input.
+func (g *ABCommInput) addresses() []string {
+	var addresses []string
+	for _, subs := range g.subscription {
+		addresses = append(addresses, subs.Address)
+	}
+	for _, tSubs := range g.tSubscription {
+		for _, tsub := range tSubs.tSub {
+			addresses = append(addresses, tsub.Address)
+		}
+	}
+	return addresses
+}
+
+// handleReadError drops the client if the error was caused by a broken connection,
+// so that benthos calls Connect again instead of retrying on a dead session.
+func (g *ABCommInput) handleReadError(address string, err error) error {
+	g.log.Errorf("Error reading %s: %v", address, err)
+	if isTransportError(g.client, err) {
+		g.client.Disconnect()
+		g.client = nil
+		return service.ErrNotConnected
+	}
+	return err
+}
+
 func (g *ABCommInput) ReadBatch(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
 	if ctx == nil || ctx.Done() == nil {
 		return nil, nil, errors.New("emptyCtx is invalid for ReadBatchSubscribe")
 	}
 
+	if g.client == nil {
+		return nil, nil, service.ErrNotConnected
+	}
+
+	if err := waitForPoll(ctx, time.Until(g.nextPoll)); err != nil {
+		return nil, nil, err
+	}
+	g.nextPoll = time.Now().Add(g.pollRate)
+
 	msgs := service.MessageBatch{}
 	for i, subs := range g.subscription {
 
 		value, err := g.client.Read_single(subs.Address, gologix.CIPTypeUnknown, 1)
 		if err != nil {
-			//log.Printf("error reading %s: %v", subs.Address, err)
+			err = g.handleReadError(subs.Address, err)
+			if err == service.ErrNotConnected {
+				return nil, nil, err
+			}
 			return nil, func(ctx context.Context, err error) error {
 				return nil // Acknowledgment handling here if needed
 			}, err
 		}
 
-		/* if subs.DataType == "str" {
-			v, ok := value.([]byte)
-			if !ok {
-				log.Println("Can not convert to byte1 ", value)
-			}
-			subs.Value = string(v)
-
-		} else {
-			subs.Value = value
-		} */
-		subs.Value = value
-		//log.Println("current str value:", g.subscription[i].Value, " New Value:", subs.Value, " Address:", subs.Address, "comparission:", !reflect.DeepEqual(g.subscription[i].Value, subs.Value))
+		subs.Value, err = decodeValue(value, subs.DataType)
+		if err != nil {
+			g.log.Errorf("Error decoding %s: %v", subs.Address, err)
+			continue
+		}
 
 		if !reflect.DeepEqual(g.subscription[i].Value, subs.Value) {
 			//log.Println("There is data change in address:", subs.Address)
-			msgsV := make(map[string]string, 0)
-			for _, tsubs := range g.tSubscription[i].tSub {
+			msgsV := make(map[string]any, 0)
+			descriptions := make(map[string]string, 0)
+			for j, tsubs := range g.tSubscription[i].tSub {
 				tvalue, err := g.client.Read_single(tsubs.Address, gologix.CIPTypeUnknown, 1)
 				if err != nil {
-					//log.Printf("error reading %s: %v", subs.Address, err)
+					err = g.handleReadError(tsubs.Address, err)
+					if err == service.ErrNotConnected {
+						return nil, nil, err
+					}
 					return nil, func(ctx context.Context, err error) error {
 						return nil // Acknowledgment handling here if needed
 					}, err
 				}
-				tsubs.Value = fmt.Sprint(tvalue)
-
-				if tsubs.DataType == "string" {
-					v, ok := tvalue.([]byte)
-					if !ok {
-						g.log.Errorf("Can not convert to byte2")
-					}
-					msgsV[tsubs.Name] = string(bytes.Trim(v, "\t\u0000"))
-				} else {
-					msgsV[tsubs.Name] = fmt.Sprint(tvalue)
+				tsubs.Value, err = decodeValue(tvalue, tsubs.DataType)
+				if err != nil {
+					g.log.Errorf("Error decoding %s: %v", tsubs.Address, err)
+					continue
+				}
+				last := g.tSubscription[i].tSub[j].Value
+				g.tSubscription[i].tSub[j].Value = tsubs.Value
+				if g.subscribeEnabled && last != nil && reflect.DeepEqual(last, tsubs.Value) {
+					continue
+				}
+				msgsV[tsubs.Name] = tsubs.Value
+				if tsubs.Description != "" {
+					descriptions[tsubs.Name] = tsubs.Description
 				}
 				//log.Println("address:", tsubs.Address, " Value:", val, " original:", tvalue)
 			}
-			msg := g.createMessageFromValue(subs, msgsV)
-			msgs = append(msgs, msg)
+			msg := g.createMessageFromValue(subs, msgsV, descriptions)
+			if msg != nil {
+				msgs = append(msgs, msg)
+			}
 			g.subscription[i] = subs
 		}
 
@@ -282,31 +455,40 @@ func (g *ABCommInput) Close(ctx context.Context) error {
 	//log.Println("Girish Close()")
 	if g.client != nil {
 		g.client.Disconnect()
+		g.client = nil
 	}
 	return nil
 }
 
 // createMessageFromValue creates a benthos messages from a given variant and nodeID
 // theoretically nodeID can be extracted from variant, but not in all cases (e.g., when subscribing), so it it left to the calling function
-func (g *ABCommInput) createMessageFromValue(subscriptionDef subscriptionDef, messageJ map[string]string) *service.Message {
+func (g *ABCommInput) createMessageFromValue(subscriptionDef subscriptionDef, messageJ map[string]any, descriptions map[string]string) *service.Message {
 	re := regexp.MustCompile(`[^a-zA-Z0-9_-]`)
 	if subscriptionDef.Value == nil {
 		g.log.Errorf("Value is nil")
 		return nil
 	}
-	message := service.NewMessage(nil)
+	dataType := dataTypeOf(subscriptionDef.Value, subscriptionDef.DataType)
 
-	if subscriptionDef.DataType == "string" {
-		v, ok := subscriptionDef.Value.([]byte)
-		if !ok {
-			log.Println("Can not convert to byte2")
-		}
-		value := string(bytes.Trim(v, "\t\u0000"))
-		message.MetaSet("value", value)
-	} else {
-		message.MetaSet("value", fmt.Sprint(subscriptionDef.Value))
+	newAddress := make(map[string]any)
+	for address, val := range messageJ {
+		addressName := re.ReplaceAllString(address, "_")
+		newAddress[addressName] = val
 	}
 
+	body, err := abValue{
+		Value:    subscriptionDef.Value,
+		DataType: dataType,
+		Values:   newAddress,
+	}.marshal(time.Now())
+	if err != nil {
+		g.log.Errorf("Could not create the message body for %s: %v", subscriptionDef.Address, err)
+		return nil
+	}
+
+	message := service.NewMessage(body)
+	message.MetaSet("value", formatValue(subscriptionDef.Value))
+
 	//message.MetaSet("tag_name", tagName)
 	message.MetaSet("name", subscriptionDef.Address)
 	message.MetaSet("group", subscriptionDef.Group)
@@ -314,11 +496,6 @@ func (g *ABCommInput) createMessageFromValue(subscriptionDef subscriptionDef, me
 	message.MetaSet("historian", subscriptionDef.Historian)
 	message.MetaSet("sqlSp", subscriptionDef.SqlSp)
 	message.MetaSet("trigger", subscriptionDef.Address)
-	newAddress := make(map[string]string)
-	for address, val := range messageJ {
-		addressName := re.ReplaceAllString(address, "_")
-		newAddress[addressName] = val
-	}
 
 	jsonMsg, err := json.Marshal(newAddress)
 	if err != nil {
@@ -326,25 +503,22 @@ func (g *ABCommInput) createMessageFromValue(subscriptionDef subscriptionDef, me
 		return nil
 	}
 	message.MetaSet("Message", string(jsonMsg))
-	message.MetaSet("datatype", subscriptionDef.DataType)
+	message.MetaSet("datatype", dataType)
+	message.MetaSet("description", subscriptionDef.Description)
 
-	/* if subscriptionDef.DataType == "str" {
-		v, ok := subscriptionDef.Value.([]byte)
-		if !ok {
-			log.Println("Can not convert to byte1 ", subscriptionDef.Value)
+	if len(descriptions) > 0 {
+		newDescriptions := make(map[string]string)
+		for address, description := range descriptions {
+			newDescriptions[re.ReplaceAllString(address, "_")] = description
 		}
-		message.MetaSet("value", string(v))
-	} else {
-		message.MetaSet("value", fmt.Sprintf("%s", subscriptionDef.Value))
-	} */
+		jsonDescriptions, err := json.Marshal(newDescriptions)
+		if err != nil {
+			g.log.Errorf("Could not change descriptions to json object")
+			return nil
+		}
+		message.MetaSet("descriptions", string(jsonDescriptions))
+	}
 
 	return message
 
 }
-
-/* func cleanString(str any) string {
-	re := regexp.MustCompile("[\a\x00 ]+") //split according to \s, \t, \r, \t and whitespace. Edit this regex for other 'conditions'
-
-	split := re.ReplaceAllLiteralString(str.(string), "")
-	return split
-} */
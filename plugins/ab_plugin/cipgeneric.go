@@ -0,0 +1,430 @@
+package ab_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/danomagnum/gologix"
+)
+
+//------------------------------------------------------------------------------
+
+// CIPGenericInput polls attributes of CIP objects with explicit messages. Unlike the Logix inputs it does not
+// need a tag database, so it works with any EtherNet/IP device such as drives, robots or IO-Link masters.
+type CIPGenericInput struct {
+	tcpDevice    string        // IP address or host:port of the device.
+	path         string        // Route to the device, e.g. 1,0 for slot 0 of the backplane. Empty for the device itself.
+	timeout      time.Duration // Time duration before a connection attempt or read request times out.
+	pollRate     time.Duration // Time between two reads of the attributes.
+	subscription []cipAttributeDef
+	log          *service.Logger // Logger for logging plugin activity.
+	client       *gologix.Client
+	nextPoll     time.Time
+}
+
+// cipAttributeDef is a single class/instance/attribute to read. Without an attribute
+// the whole instance is read with Get_Attribute_All.
+type cipAttributeDef struct {
+	ID           int
+	Class        gologix.CIPClass
+	Instance     gologix.CIPInstance
+	Attribute    gologix.CIPAttribute
+	HasAttribute bool
+	Name         string
+	Group        string
+	DB           string
+	Historian    string
+	SqlSp        string
+	DataType     string
+	Value        any
+}
+
+// Path returns the class/instance/attribute of the definition, e.g. 1/1/7 or 1/1 for Get_Attribute_All.
+func (c cipAttributeDef) Path() string {
+	if !c.HasAttribute {
+		return fmt.Sprintf("%d/%d", c.Class, c.Instance)
+	}
+	return fmt.Sprintf("%d/%d/%d", c.Class, c.Instance, c.Attribute)
+}
+
+// cipDataTypes are the datatypes an attribute can be decoded as. string is a CIP STRING with a UINT length,
+// short_string a CIP SHORT_STRING with a USINT length. bytes leaves the data undecoded.
+var cipDataTypes = map[string]bool{
+	"bool": true, "int8": true, "uint8": true, "int16": true, "uint16": true, "int32": true, "uint32": true,
+	"int64": true, "uint64": true, "float32": true, "float64": true, "string": true, "short_string": true, "bytes": true,
+}
+
+func ParseCIPAttributeDef(subscription []string) ([]cipAttributeDef, error) {
+	var parsedSubscription []cipAttributeDef
+
+	for _, subscriptionElement := range subscription {
+		var subscr map[string][]map[string]string
+		err := json.Unmarshal([]byte(subscriptionElement), &subscr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing subscription %s: %w", subscriptionElement, err)
+		}
+		for key, values := range subscr {
+			for _, obj := range values {
+				var subsc cipAttributeDef
+				subsc.ID, _ = strconv.Atoi(key)
+
+				class, err := parseCIPNumber(obj["class"])
+				if err != nil {
+					return nil, fmt.Errorf("invalid class in subscription %s: %w", key, err)
+				}
+				instance, err := parseCIPNumber(obj["instance"])
+				if err != nil {
+					return nil, fmt.Errorf("invalid instance in subscription %s: %w", key, err)
+				}
+				subsc.Class = gologix.CIPClass(class)
+				subsc.Instance = gologix.CIPInstance(instance)
+				if obj["attribute"] != "" {
+					attribute, err := parseCIPNumber(obj["attribute"])
+					if err != nil {
+						return nil, fmt.Errorf("invalid attribute in subscription %s: %w", key, err)
+					}
+					subsc.Attribute = gologix.CIPAttribute(attribute)
+					subsc.HasAttribute = true
+				}
+
+				subsc.DataType = normalizeDataType(obj["datatype"])
+				if subsc.DataType == "" {
+					subsc.DataType = "bytes"
+				}
+				for _, dataType := range strings.Split(subsc.DataType, ",") {
+					if !cipDataTypes[strings.TrimSpace(dataType)] {
+						return nil, fmt.Errorf("unsupported datatype %s in subscription %s", dataType, key)
+					}
+				}
+
+				subsc.Name = obj["name"]
+				if subsc.Name == "" {
+					subsc.Name = subsc.Path()
+				}
+				subsc.Group = obj["group"]
+				subsc.DB = obj["db"]
+				subsc.Historian = obj["historian"]
+				subsc.SqlSp = obj["sqlSp"]
+
+				parsedSubscription = append(parsedSubscription, subsc)
+			}
+		}
+	}
+	return parsedSubscription, nil
+}
+
+// parseCIPNumber parses a class, instance or attribute id given in decimal or as 0x prefixed hex.
+func parseCIPNumber(s string) (uint16, error) {
+	if s == "" {
+		return 0, errors.New("missing value")
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 0, 16)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(n), nil
+}
+
+var CIPGenericConfigSpec = service.NewConfigSpec().
+	Summary("Creates an input that reads attributes of CIP objects from EtherNet/IP devices.").
+	Description("This input plugin polls class/instance/attribute triples with Get_Attribute_Single, or whole instances " +
+		"with Get_Attribute_All, from devices that speak CIP but have no tag database, e.g. drives, robots or IO-Link masters. " +
+		"The data is decoded with the configured datatypes and a message is created whenever a value changes.").
+	Field(service.NewStringField("tcpDevice").Description("IP address or host:port of the EtherNet/IP device.")).
+	Field(service.NewStringField("path").Description("Route to the device, e.g. 1,0 for slot 0 of a backplane. Leave empty to talk to the device at tcpDevice itself.").Default("")).
+	Field(service.NewIntField("timeout").Description("The timeout duration in seconds for connection attempts and read requests.").Default(10)).
+	Field(service.NewIntField("pollRate").Description("The time in milliseconds between two reads of the attributes.").Default(1000)).
+	Field(service.NewStringListField("subscriptions").Description(`List of CIP attributes, e.g. {"1": [{"class": "0x01", "instance": "1", "attribute": "7", "datatype": "short_string", "name": "ProductName", "group": "D001", "db": "mssql", "historian": "influx", "sqlSp": "sp_sql_logging"}]}`))
+
+func newCIPGenericInput(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchInput, error) {
+	tcpDevice, err := conf.FieldString("tcpDevice")
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := conf.FieldString("path")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gologix.ParsePath(path); err != nil {
+		return nil, fmt.Errorf("invalid path %s: %w", path, err)
+	}
+
+	timeoutInt, err := conf.FieldInt("timeout")
+	if err != nil {
+		return nil, err
+	}
+
+	pollRate, err := conf.FieldInt("pollRate")
+	if err != nil {
+		return nil, err
+	}
+	if pollRate <= 0 {
+		return nil, fmt.Errorf("pollRate must be positive, got %d", pollRate)
+	}
+
+	subscriptions, err := conf.FieldStringList("subscriptions")
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := ParseCIPAttributeDef(subscriptions)
+	if err != nil {
+		return nil, err
+	}
+	if len(sub) == 0 {
+		return nil, errors.New("no subscriptions provided")
+	}
+
+	m := &CIPGenericInput{
+		tcpDevice:    tcpDevice,
+		path:         path,
+		subscription: sub,
+		log:          mgr.Logger(),
+		timeout:      time.Duration(timeoutInt) * time.Second,
+		pollRate:     time.Duration(pollRate) * time.Millisecond,
+	}
+
+	return service.AutoRetryNacksBatched(m), nil
+}
+
+//------------------------------------------------------------------------------
+
+func init() {
+
+	err := service.RegisterBatchInput(
+		"cip_generic", CIPGenericConfigSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchInput, error) {
+			mgr.Logger().Infof("Created & maintained by the BGRI ")
+			return newCIPGenericInput(conf, mgr)
+		})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (g *CIPGenericInput) Connect(ctx context.Context) error {
+	if g.client != nil {
+		return nil
+	}
+	client := newABClient(g.tcpDevice, g.timeout)
+	path, err := gologix.ParsePath(g.path)
+	if err != nil {
+		return err
+	}
+	client.Path = path
+
+	err = connectABClient(ctx, client)
+	if err != nil {
+		g.log.Errorf("Failed to connect to %s: %v", g.tcpDevice, err)
+		return err
+	}
+	g.log.Infof("Connected to %s", g.tcpDevice)
+	g.client = client
+	return nil
+}
+
+// readAttribute sends Get_Attribute_Single, or Get_Attribute_All if no attribute is configured, and returns the data of the reply.
+func (g *CIPGenericInput) readAttribute(subs cipAttributeDef) ([]byte, error) {
+	cipService := gologix.CIPService_GetAttributeAll
+	parts := []any{subs.Class, subs.Instance}
+	if subs.HasAttribute {
+		cipService = gologix.CIPService_GetAttributeSingle
+		parts = append(parts, subs.Attribute)
+	}
+
+	path, err := gologix.Serialize(parts...)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := g.client.GenericCIPMessage(cipService, path.Bytes(), []byte{})
+	if err != nil {
+		return nil, err
+	}
+	return item.Rest(), nil
+}
+
+func (g *CIPGenericInput) ReadBatch(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
+	if ctx == nil || ctx.Done() == nil {
+		return nil, nil, errors.New("emptyCtx is invalid for ReadBatch")
+	}
+
+	if g.client == nil {
+		return nil, nil, service.ErrNotConnected
+	}
+
+	if err := waitForPoll(ctx, time.Until(g.nextPoll)); err != nil {
+		return nil, nil, err
+	}
+	g.nextPoll = time.Now().Add(g.pollRate)
+
+	msgs := service.MessageBatch{}
+	for i, subs := range g.subscription {
+		data, err := g.readAttribute(subs)
+		if err != nil {
+			g.log.Errorf("Error reading %s: %v", subs.Path(), err)
+			// the device dropped the connection, so throw the session away and let benthos reconnect
+			if isTransportError(g.client, err) {
+				g.client.Disconnect()
+				g.client = nil
+				return nil, nil, service.ErrNotConnected
+			}
+			return nil, func(ctx context.Context, err error) error {
+				return nil // Acknowledgment handling here if needed
+			}, err
+		}
+
+		subs.Value, err = decodeCIPValue(data, subs.DataType)
+		if err != nil {
+			g.log.Errorf("Error decoding %s: %v", subs.Path(), err)
+			continue
+		}
+
+		if !reflect.DeepEqual(g.subscription[i].Value, subs.Value) {
+			msg := g.createMessageFromValue(subs)
+			if msg != nil {
+				msgs = append(msgs, msg)
+			}
+			g.subscription[i] = subs
+		}
+	}
+
+	return msgs, func(ctx context.Context, err error) error {
+		return nil // Acknowledgment handling here if needed
+	}, nil
+}
+
+func (g *CIPGenericInput) Close(ctx context.Context) error {
+	if g.client != nil {
+		g.client.Disconnect()
+		g.client = nil
+	}
+	return nil
+}
+
+func (g *CIPGenericInput) createMessageFromValue(subs cipAttributeDef) *service.Message {
+	body, err := abValue{
+		Name:     subs.Name,
+		Value:    subs.Value,
+		DataType: subs.DataType,
+	}.marshal(time.Now())
+	if err != nil {
+		g.log.Errorf("Could not create the message body for %s: %v", subs.Path(), err)
+		return nil
+	}
+
+	message := service.NewMessage(body)
+	message.MetaSet("value", formatValue(subs.Value))
+	message.MetaSet("tag_name", subs.Path())
+	message.MetaSet("name", subs.Name)
+	message.MetaSet("group", subs.Group)
+	message.MetaSet("db", subs.DB)
+	message.MetaSet("historian", subs.Historian)
+	message.MetaSet("sqlSp", subs.SqlSp)
+	message.MetaSet("datatype", subs.DataType)
+
+	jsonMsg, err := json.Marshal(map[string]any{subs.Name: subs.Value})
+	if err != nil {
+		g.log.Errorf("Could not change benthos message to json object")
+		return nil
+	}
+	message.MetaSet("Message", string(jsonMsg))
+
+	return message
+}
+
+// decodeCIPValue decodes the little endian data of an attribute. A comma separated list of datatypes decodes
+// consecutive members, e.g. the attributes of an instance read with Get_Attribute_All, into a list of values.
+func decodeCIPValue(data []byte, dataType string) (any, error) {
+	dataTypes := strings.Split(dataType, ",")
+	r := bytes.NewReader(data)
+
+	values := make([]any, 0, len(dataTypes))
+	for _, dataType := range dataTypes {
+		value, err := readCIPValue(r, strings.TrimSpace(dataType))
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", dataType, err)
+		}
+		values = append(values, value)
+	}
+	if len(values) == 1 {
+		return values[0], nil
+	}
+	return values, nil
+}
+
+func readCIPValue(r *bytes.Reader, dataType string) (any, error) {
+	switch dataType {
+	case "bytes":
+		rest := make([]byte, r.Len())
+		r.Read(rest)
+		return rawBytes(rest), nil
+	case "string", "short_string":
+		var length int
+		if dataType == "string" {
+			var l uint16
+			if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+				return nil, err
+			}
+			length = int(l)
+		} else {
+			l, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = int(l)
+		}
+		if length > r.Len() {
+			return nil, fmt.Errorf("string length %d exceeds the %d data bytes", length, r.Len())
+		}
+		s := make([]byte, length)
+		r.Read(s)
+		return string(s), nil
+	case "bool":
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		return b != 0, nil
+	}
+
+	var value any
+	switch dataType {
+	case "int8":
+		value = new(int8)
+	case "uint8":
+		value = new(uint8)
+	case "int16":
+		value = new(int16)
+	case "uint16":
+		value = new(uint16)
+	case "int32":
+		value = new(int32)
+	case "uint32":
+		value = new(uint32)
+	case "int64":
+		value = new(int64)
+	case "uint64":
+		value = new(uint64)
+	case "float32":
+		value = new(float32)
+	case "float64":
+		value = new(float64)
+	default:
+		return nil, fmt.Errorf("unsupported datatype %s", dataType)
+	}
+	if err := binary.Read(r, binary.LittleEndian, value); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(value).Elem().Interface(), nil
+}
@@ -0,0 +1,125 @@
+package ab_plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCIPAttributeDef(t *testing.T) {
+	sub, err := ParseCIPAttributeDef([]string{
+		`{"1": [{"class": "0x01", "instance": "1", "attribute": "7", "datatype": "short_string", "name": "ProductName", "group": "D001", "db": "mssql", "historian": "influx", "sqlSp": "sp_sql_logging"}]}`,
+		`{"2": [{"class": "0x01", "instance": "1", "datatype": "uint16,uint16"}]}`,
+	})
+	require.NoError(t, err)
+	require.Len(t, sub, 2)
+
+	assert.Equal(t, "1/1/7", sub[0].Path())
+	assert.Equal(t, "ProductName", sub[0].Name)
+	assert.Equal(t, "D001", sub[0].Group)
+	assert.Equal(t, "sp_sql_logging", sub[0].SqlSp)
+	assert.False(t, sub[1].HasAttribute)
+	assert.Equal(t, "1/1", sub[1].Name)
+
+	for _, invalid := range []string{
+		`{"1": [{"instance": "1", "attribute": "7"}]}`,
+		`{"1": [{"class": "0x10000", "instance": "1"}]}`,
+		`{"1": [{"class": "1", "instance": "1", "datatype": "decimal"}]}`,
+		`not json`,
+	} {
+		_, err := ParseCIPAttributeDef([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestCIPGenericConfig(t *testing.T) {
+	for yaml, valid := range map[string]bool{"pollRate: 1000": true, "pollRate: 0": false, "pollRate: -1000": false} {
+		conf, err := CIPGenericConfigSpec.ParseYAML("tcpDevice: localhost\nsubscriptions: ['{\"1\": [{\"class\": \"1\", \"instance\": \"1\", \"attribute\": \"7\"}]}']\n"+yaml, nil)
+		require.NoError(t, err)
+		_, err = newCIPGenericInput(conf, service.MockResources())
+		assert.Equal(t, valid, err == nil, yaml)
+	}
+}
+
+func TestDecodeCIPValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		dataType string
+		expected any
+	}{
+		{"bool", []byte{0x01}, "bool", true},
+		{"int16", []byte{0xFE, 0xFF}, "int16", int16(-2)},
+		{"uint32", []byte{0x01, 0x02, 0x00, 0x00}, "uint32", uint32(513)},
+		{"float32", []byte{0x00, 0x00, 0xC0, 0x3F}, "float32", float32(1.5)},
+		{"string", []byte{0x03, 0x00, 'a', 'b', 'c'}, "string", "abc"},
+		{"short_string", []byte{0x02, 'h', 'i'}, "short_string", "hi"},
+		{"bytes", []byte{0xDE, 0xAD}, "bytes", rawBytes{0xDE, 0xAD}},
+		{"members", []byte{0x01, 0x00, 0x0C, 0x00, 0x02, 'h', 'i'}, "uint16, uint16, short_string", []any{uint16(1), uint16(12), "hi"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := decodeCIPValue(tc.data, tc.dataType)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, value)
+		})
+	}
+
+	_, err := decodeCIPValue([]byte{0x01}, "uint32")
+	assert.Error(t, err)
+	_, err = decodeCIPValue([]byte{0x05, 'a'}, "short_string")
+	assert.Error(t, err)
+}
+
+func TestCIPGenericInput(t *testing.T) {
+	plc := newTestLogixController(t, nil)
+	plc.SetAttribute("1/1/7", []byte{0x05, 'D', 'r', 'i', 'v', 'e'})
+	plc.SetAttribute("1/1", []byte{0x01, 0x00, 0x02, 0x00})
+	plc.SetAttribute("42/1/3", []byte{0xE8, 0x03})
+
+	sub, err := ParseCIPAttributeDef([]string{
+		`{"1": [{"class": "1", "instance": "1", "attribute": "7", "datatype": "short_string", "name": "product", "group": "D001"}]}`,
+		`{"2": [{"class": "1", "instance": "1", "datatype": "uint16,uint16", "name": "identity"}]}`,
+		`{"3": [{"class": "0x2A", "instance": "1", "attribute": "3", "datatype": "uint16", "name": "speed"}]}`,
+	})
+	require.NoError(t, err)
+
+	input := &CIPGenericInput{
+		tcpDevice:    plc.Address(),
+		timeout:      2 * time.Second,
+		pollRate:     time.Millisecond,
+		subscription: sub,
+		log:          service.MockResources().Logger(),
+	}
+	require.NoError(t, input.Connect(context.Background()))
+	defer input.Close(context.Background())
+
+	bodies := readTestBatch(t, input)
+	require.Len(t, bodies, 3)
+	assert.Equal(t, "Drive", bodies[0]["value"])
+	assert.Equal(t, "short_string", bodies[0]["datatype"])
+	assert.Equal(t, []any{float64(1), float64(2)}, bodies[1]["value"])
+	assert.Equal(t, float64(1000), bodies[2]["value"])
+
+	// only changed attributes are emitted
+	assert.Empty(t, readTestBatch(t, input))
+	plc.SetAttribute("42/1/3", []byte{0xD0, 0x07})
+	bodies = readTestBatch(t, input)
+	require.Len(t, bodies, 1)
+	assert.Equal(t, "speed", bodies[0]["name"])
+	assert.Equal(t, float64(2000), bodies[0]["value"])
+
+	// an unknown object is a CIP error, not a broken connection
+	input.subscription = append(input.subscription, cipAttributeDef{Class: 99, Instance: 1, Attribute: 1, HasAttribute: true, DataType: "bytes"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err = input.ReadBatch(ctx)
+	assert.Error(t, err)
+	assert.NotEqual(t, service.ErrNotConnected, err)
+	assert.NotNil(t, input.client)
+}
@@ -0,0 +1,87 @@
+package ab_plugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/danomagnum/gologix"
+)
+
+// newABClient creates a gologix client for the given device, which is either an IP address
+// or host:port for controllers that are not reachable on the default EtherNet/IP port 44818.
+// The timeout is used by gologix both for dialing the controller and as deadline for every
+// read and write on the socket, so a rebooting controller does not block a read forever.
+func newABClient(tcpDevice string, timeout time.Duration) *gologix.Client {
+	client := gologix.NewClient(tcpDevice)
+	if host, port, err := net.SplitHostPort(tcpDevice); err == nil {
+		client.IPAddress = host
+		client.Port = ":" + port
+	}
+	client.SocketTimeout = timeout
+	// reconnects are handled by the inputs themselves via service.ErrNotConnected,
+	// a silent reconnect inside gologix would hide a dead session from benthos.
+	client.AutoConnect = false
+	return client
+}
+
+// connectABClient connects the client, giving up once the context is done.
+// gologix does not accept a context, so the connect attempt runs in the background
+// and is bounded by the socket timeout of the client.
+func connectABClient(ctx context.Context, client *gologix.Client) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Connect()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		go func() {
+			// wait for the pending attempt so the socket is not leaked
+			if err := <-done; err == nil {
+				client.Disconnect()
+			}
+		}()
+		return ctx.Err()
+	}
+}
+
+// isTransportError reports whether a failed request broke the connection to the controller.
+// gologix closes the socket and clears Connected whenever sending or receiving fails,
+// while CIP errors such as an unknown tag leave the session intact.
+func isTransportError(client *gologix.Client, err error) bool {
+	if err == nil || client == nil {
+		return false
+	}
+	return !client.Connected
+}
+
+// verifyTags reads every address once so that typos in the configuration are
+// reported at connect time instead of failing every ReadBatch.
+func verifyTags(client *gologix.Client, addresses []string) error {
+	for _, address := range addresses {
+		if _, err := client.Read_single(address, gologix.CIPTypeUnknown, 1); err != nil {
+			return fmt.Errorf("verifying tag %s: %w", address, err)
+		}
+	}
+	return nil
+}
+
+// waitForPoll blocks for the given interval or until the context is done.
+func waitForPoll(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,280 @@
+package ab_plugin
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// l5xTag is a single readable tag address found in a Studio 5000 L5X export.
+// Structured tags are expanded into one l5xTag per atomic member.
+type l5xTag struct {
+	Address     string
+	DataType    string
+	Description string
+}
+
+type l5xContent struct {
+	Controller l5xController `xml:"Controller"`
+}
+
+type l5xController struct {
+	Name      string        `xml:"Name,attr"`
+	DataTypes []l5xDataType `xml:"DataTypes>DataType"`
+	Tags      []l5xTagDef   `xml:"Tags>Tag"`
+	Programs  []l5xProgram  `xml:"Programs>Program"`
+}
+
+type l5xProgram struct {
+	Name string      `xml:"Name,attr"`
+	Tags []l5xTagDef `xml:"Tags>Tag"`
+}
+
+type l5xDataType struct {
+	Name        string         `xml:"Name,attr"`
+	Family      string         `xml:"Family,attr"`
+	Description l5xDescription `xml:"Description"`
+	Members     []l5xMember    `xml:"Members>Member"`
+}
+
+type l5xMember struct {
+	Name        string         `xml:"Name,attr"`
+	DataType    string         `xml:"DataType,attr"`
+	Dimension   string         `xml:"Dimension,attr"`
+	Hidden      bool           `xml:"Hidden,attr"`
+	Access      string         `xml:"ExternalAccess,attr"`
+	Description l5xDescription `xml:"Description"`
+}
+
+type l5xTagDef struct {
+	Name        string         `xml:"Name,attr"`
+	TagType     string         `xml:"TagType,attr"`
+	DataType    string         `xml:"DataType,attr"`
+	Dimensions  string         `xml:"Dimensions,attr"`
+	Access      string         `xml:"ExternalAccess,attr"`
+	Description l5xDescription `xml:"Description"`
+}
+
+// l5xDescription holds either a plain description or, in projects with
+// multiple languages, a list of localized descriptions.
+type l5xDescription struct {
+	Text      string `xml:",chardata"`
+	Localized []struct {
+		Lang string `xml:"Lang,attr"`
+		Text string `xml:",chardata"`
+	} `xml:"LocalizedDescription"`
+}
+
+func (d l5xDescription) String() string {
+	if text := strings.TrimSpace(d.Text); text != "" {
+		return text
+	}
+	for _, localized := range d.Localized {
+		if text := strings.TrimSpace(localized.Text); text != "" {
+			return text
+		}
+	}
+	return ""
+}
+
+// l5xAtomicTypes maps the Logix atomic datatypes to the datatype names used in the subscription configuration.
+var l5xAtomicTypes = map[string]string{
+	"BOOL":   "bool",
+	"BIT":    "bool",
+	"SINT":   "int8",
+	"INT":    "int16",
+	"DINT":   "int32",
+	"LINT":   "int64",
+	"USINT":  "uint8",
+	"UINT":   "uint16",
+	"UDINT":  "uint32",
+	"ULINT":  "uint64",
+	"REAL":   "float32",
+	"LREAL":  "float64",
+	"STRING": "string",
+}
+
+// l5xBuiltinTypes lists the members of predefined structures which are not part of the DataTypes section of an export.
+var l5xBuiltinTypes = map[string][]l5xMember{
+	"TIMER": {
+		{Name: "PRE", DataType: "DINT"},
+		{Name: "ACC", DataType: "DINT"},
+		{Name: "EN", DataType: "BOOL"},
+		{Name: "TT", DataType: "BOOL"},
+		{Name: "DN", DataType: "BOOL"},
+	},
+	"COUNTER": {
+		{Name: "PRE", DataType: "DINT"},
+		{Name: "ACC", DataType: "DINT"},
+		{Name: "CU", DataType: "BOOL"},
+		{Name: "CD", DataType: "BOOL"},
+		{Name: "DN", DataType: "BOOL"},
+		{Name: "OV", DataType: "BOOL"},
+		{Name: "UN", DataType: "BOOL"},
+	},
+}
+
+// maxL5XDepth limits the expansion of nested user defined types.
+const maxL5XDepth = 8
+
+// ParseL5X reads the controller and program scoped tags of an L5X export and expands them into readable addresses.
+// Program tags are addressed as Program:<program>.<tag>. Array tags and tags without external read access are skipped.
+func ParseL5X(data []byte) ([]l5xTag, error) {
+	var content l5xContent
+	if err := xml.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("parsing L5X: %w", err)
+	}
+
+	dataTypes := make(map[string]l5xDataType, len(content.Controller.DataTypes))
+	for _, dataType := range content.Controller.DataTypes {
+		dataTypes[strings.ToUpper(dataType.Name)] = dataType
+	}
+
+	var tags []l5xTag
+	for _, tag := range content.Controller.Tags {
+		tags = append(tags, expandL5XTag(tag, "", dataTypes)...)
+	}
+	for _, program := range content.Controller.Programs {
+		for _, tag := range program.Tags {
+			tags = append(tags, expandL5XTag(tag, "Program:"+program.Name+".", dataTypes)...)
+		}
+	}
+	return tags, nil
+}
+
+func expandL5XTag(tag l5xTagDef, prefix string, dataTypes map[string]l5xDataType) []l5xTag {
+	if !l5xReadable(tag.Access) || l5xIsArray(tag.Dimensions) {
+		return nil
+	}
+	address := prefix + tag.Name
+	description := tag.Description.String()
+
+	// the datatype of an alias depends on its target, leave it to the controller
+	if strings.EqualFold(tag.TagType, "Alias") {
+		return []l5xTag{{Address: address, Description: description}}
+	}
+	return expandL5XType(address, tag.DataType, description, dataTypes, 0)
+}
+
+func expandL5XType(address string, dataType string, description string, dataTypes map[string]l5xDataType, depth int) []l5xTag {
+	upper := strings.ToUpper(dataType)
+	if atomic, ok := l5xAtomicTypes[upper]; ok {
+		return []l5xTag{{Address: address, DataType: atomic, Description: description}}
+	}
+	if depth >= maxL5XDepth {
+		return nil
+	}
+
+	members, ok := l5xBuiltinTypes[upper]
+	if udt, found := dataTypes[upper]; found {
+		// string types with another length than STRING are read as a whole, like STRING
+		if strings.EqualFold(udt.Family, "StringFamily") {
+			return []l5xTag{{Address: address, DataType: "string", Description: description}}
+		}
+		members, ok = udt.Members, true
+		if description == "" {
+			description = udt.Description.String()
+		}
+	}
+	// e.g. module defined types
+	if !ok {
+		return nil
+	}
+
+	var tags []l5xTag
+	for _, member := range members {
+		if member.Hidden || !l5xReadable(member.Access) || l5xIsArray(member.Dimension) {
+			continue
+		}
+		memberDescription := member.Description.String()
+		if memberDescription == "" {
+			memberDescription = description
+		}
+		tags = append(tags, expandL5XType(address+"."+member.Name, member.DataType, memberDescription, dataTypes, depth+1)...)
+	}
+	return tags
+}
+
+func l5xReadable(access string) bool {
+	return !strings.EqualFold(access, "None")
+}
+
+func l5xIsArray(dimensions string) bool {
+	dimensions = strings.TrimSpace(dimensions)
+	return dimensions != "" && dimensions != "0"
+}
+
+// FilterL5XTags keeps the tags whose address matches any include pattern (all tags if there is none)
+// and none of the exclude patterns. Patterns use glob syntax, e.g. Program:MainProgram.*
+func FilterL5XTags(tags []l5xTag, include []string, exclude []string) ([]l5xTag, error) {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid L5X pattern %q: %w", pattern, err)
+		}
+	}
+
+	var filtered []l5xTag
+	for _, tag := range tags {
+		if len(include) > 0 && !matchesAny(include, tag.Address) {
+			continue
+		}
+		if matchesAny(exclude, tag.Address) {
+			continue
+		}
+		filtered = append(filtered, tag)
+	}
+	return filtered, nil
+}
+
+func matchesAny(patterns []string, address string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, address); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// loadL5XTags reads and filters the tags of the given L5X file.
+func loadL5XTags(file string, include []string, exclude []string) ([]l5xTag, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := ParseL5X(data)
+	if err != nil {
+		return nil, err
+	}
+	return FilterL5XTags(tags, include, exclude)
+}
+
+// l5xTagsByAddress indexes the tags by their lower case address, as Logix tag names are case insensitive.
+func l5xTagsByAddress(tags []l5xTag) map[string]l5xTag {
+	byAddress := make(map[string]l5xTag, len(tags))
+	for _, tag := range tags {
+		byAddress[strings.ToLower(tag.Address)] = tag
+	}
+	return byAddress
+}
+
+// l5xDefaults are the metadata values assigned to every subscription created from an L5X file.
+type l5xDefaults struct {
+	Group     string `json:"group"`
+	DB        string `json:"db"`
+	Historian string `json:"historian"`
+	SqlSp     string `json:"sqlSp"`
+}
+
+func parseL5XDefaults(defaults string) (l5xDefaults, error) {
+	var d l5xDefaults
+	if defaults == "" {
+		return d, nil
+	}
+	if err := json.Unmarshal([]byte(defaults), &d); err != nil {
+		return d, fmt.Errorf("parsing l5x_defaults: %w", err)
+	}
+	return d, nil
+}
@@ -0,0 +1,170 @@
+package ab_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testL5X = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<RSLogix5000Content SchemaRevision="1.0" TargetType="Controller">
+<Controller Name="Line1">
+<DataTypes>
+<DataType Name="Motor" Family="NoFamily" Class="User">
+<Description><![CDATA[Conveyor motor]]></Description>
+<Members>
+<Member Name="ZZZZZZZZZZMotor0" DataType="SINT" Dimension="0" Radix="Decimal" Hidden="true" ExternalAccess="Read/Write"/>
+<Member Name="Running" DataType="BIT" Dimension="0" Radix="Decimal" Hidden="false" Target="ZZZZZZZZZZMotor0" BitNumber="0" ExternalAccess="Read/Write"/>
+<Member Name="Speed" DataType="REAL" Dimension="0" Radix="Float" Hidden="false" ExternalAccess="Read/Write">
+<Description><![CDATA[Speed in rpm]]></Description>
+</Member>
+<Member Name="History" DataType="DINT" Dimension="10" Radix="Decimal" Hidden="false" ExternalAccess="Read/Write"/>
+</Members>
+</DataType>
+<DataType Name="STRING20" Family="StringFamily" Class="User">
+<Members>
+<Member Name="LEN" DataType="DINT" Dimension="0" Radix="Decimal" Hidden="false" ExternalAccess="Read/Write"/>
+<Member Name="DATA" DataType="SINT" Dimension="20" Radix="ASCII" Hidden="false" ExternalAccess="Read/Write"/>
+</Members>
+</DataType>
+</DataTypes>
+<Tags>
+<Tag Name="Pressure" TagType="Base" DataType="INT" Radix="Decimal" ExternalAccess="Read/Write">
+<Description><![CDATA[Line pressure]]></Description>
+</Tag>
+<Tag Name="Batch" TagType="Base" DataType="STRING" ExternalAccess="Read Only">
+<Description>
+<LocalizedDescription Lang="en-US"><![CDATA[Current batch]]></LocalizedDescription>
+</Description>
+</Tag>
+<Tag Name="Operator" TagType="Base" DataType="STRING20" ExternalAccess="Read/Write"/>
+<Tag Name="Secret" TagType="Base" DataType="DINT" ExternalAccess="None"/>
+<Tag Name="Buffer" TagType="Base" DataType="DINT" Dimensions="100" ExternalAccess="Read/Write"/>
+<Tag Name="M1" TagType="Base" DataType="Motor" ExternalAccess="Read/Write"/>
+</Tags>
+<Programs>
+<Program Name="MainProgram">
+<Tags>
+<Tag Name="Delay" TagType="Base" DataType="TIMER" ExternalAccess="Read/Write"/>
+<Tag Name="PressureAlias" TagType="Alias" AliasFor="Pressure" ExternalAccess="Read/Write"/>
+</Tags>
+</Program>
+</Programs>
+</Controller>
+</RSLogix5000Content>`
+
+func TestParseL5X(t *testing.T) {
+	tags, err := ParseL5X([]byte(testL5X))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []l5xTag{
+		{Address: "Pressure", DataType: "int16", Description: "Line pressure"},
+		{Address: "Batch", DataType: "string", Description: "Current batch"},
+		{Address: "Operator", DataType: "string"},
+		{Address: "M1.Running", DataType: "bool", Description: "Conveyor motor"},
+		{Address: "M1.Speed", DataType: "float32", Description: "Speed in rpm"},
+		{Address: "Program:MainProgram.Delay.PRE", DataType: "int32"},
+		{Address: "Program:MainProgram.Delay.ACC", DataType: "int32"},
+		{Address: "Program:MainProgram.Delay.EN", DataType: "bool"},
+		{Address: "Program:MainProgram.Delay.TT", DataType: "bool"},
+		{Address: "Program:MainProgram.Delay.DN", DataType: "bool"},
+		{Address: "Program:MainProgram.PressureAlias"},
+	}, tags)
+}
+
+func TestFilterL5XTags(t *testing.T) {
+	tags, err := ParseL5X([]byte(testL5X))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		expected []string
+	}{
+		{"include program", []string{"Program:MainProgram.*"}, []string{"*.TT", "*.EN"}, []string{
+			"Program:MainProgram.Delay.PRE",
+			"Program:MainProgram.Delay.ACC",
+			"Program:MainProgram.Delay.DN",
+			"Program:MainProgram.PressureAlias",
+		}},
+		{"exclude only", nil, []string{"Program:*", "M1.*"}, []string{"Pressure", "Batch", "Operator"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			filtered, err := FilterL5XTags(tags, tc.include, tc.exclude)
+			assert.NoError(t, err)
+
+			var addresses []string
+			for _, tag := range filtered {
+				addresses = append(addresses, tag.Address)
+			}
+			assert.Equal(t, tc.expected, addresses)
+		})
+	}
+
+	_, err = FilterL5XTags(tags, []string{"["}, nil)
+	assert.Error(t, err)
+}
+
+func TestABTriggerL5XFile(t *testing.T) {
+	plc := newTestLogixController(t, map[string]any{
+		"Pressure":   int16(42),
+		"Batch":      "B-1",
+		"Operator":   "Jo",
+		"M1.Running": true,
+		"M1.Speed":   float32(1500),
+	})
+	l5xFile := filepath.Join(t.TempDir(), "Line1.L5X")
+	require.NoError(t, os.WriteFile(l5xFile, []byte(testL5X), 0o600))
+
+	newInput := func(include string) service.BatchInput {
+		conf, err := ABCommInputCommConfigSpec.ParseYAML(fmt.Sprintf(`
+tcpDevice: %s
+timeout: 2
+pollRate: 10
+subscriptions: ['{"1": [{"address": "Pressure", "group": "D001"}]}']
+tsubscriptions: ['{"1": [{"address": "Batch", "name": "batch"}]}']
+l5x_file: %s
+l5x_include: %s
+`, plc.Address(), l5xFile, include), nil)
+		require.NoError(t, err)
+		input, err := newABCommInput(conf, service.MockResources())
+		require.NoError(t, err)
+		require.NoError(t, input.Connect(context.Background()))
+		t.Cleanup(func() { input.Close(context.Background()) })
+		return input
+	}
+
+	// without include patterns, the L5X file only completes the configured tags
+	bodies := readTestBatch(t, newInput("[]"))
+	require.Len(t, bodies, 1)
+	assert.Equal(t, "int16", bodies[0]["datatype"])
+	assert.Equal(t, map[string]any{"batch": "B-1"}, bodies[0]["values"])
+
+	input := newInput("['M1.*', 'Operator']")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	batch, _, err := input.ReadBatch(ctx)
+	require.NoError(t, err)
+	require.Len(t, batch, 1)
+
+	body, err := batch[0].AsBytes()
+	require.NoError(t, err)
+	var decoded map[string]any
+	require.NoError(t, json.Unmarshal(body, &decoded))
+	assert.Equal(t, map[string]any{"batch": "B-1", "Operator": "Jo", "M1_Running": true, "M1_Speed": float64(1500)}, decoded["values"])
+	description, _ := batch[0].MetaGet("description")
+	assert.Equal(t, "Line pressure", description)
+	descriptions, _ := batch[0].MetaGet("descriptions")
+	assert.JSONEq(t, `{"batch": "Current batch", "M1_Running": "Conveyor motor", "M1_Speed": "Speed in rpm"}`, descriptions)
+}
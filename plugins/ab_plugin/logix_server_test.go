@@ -0,0 +1,554 @@
+package ab_plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// EtherNet/IP encapsulation commands handled by the test controller
+const (
+	eipRegisterSession   uint16 = 0x65
+	eipUnRegisterSession uint16 = 0x66
+	eipSendRRData        uint16 = 0x6F
+	eipSendUnitData      uint16 = 0x70
+)
+
+// CIP item types and services handled by the test controller
+const (
+	cipItemNull              uint16 = 0x0000
+	cipItemConnectionAddress uint16 = 0x00A1
+	cipItemConnectedData     uint16 = 0x00B1
+	cipItemUnconnectedData   uint16 = 0x00B2
+
+	cipServiceGetAttributeAll    byte = 0x01
+	cipServiceGetAttributeSingle byte = 0x0E
+	cipServiceRead               byte = 0x4C
+	cipServiceWrite              byte = 0x4D
+	cipServiceForwardClose       byte = 0x4E
+	cipServiceForwardOpen        byte = 0x54
+	cipServiceLargeForwardOpen   byte = 0x5B
+
+	cipStatusPathUnknown       byte = 0x05
+	cipStatusServiceNotSupport byte = 0x08
+	cipStatusTypeMismatch      byte = 0xFF
+
+	logixStringHandle   uint16 = 0x0FCE
+	logixStringDataSize        = 82
+)
+
+type eipTestHeader struct {
+	Command       uint16
+	Length        uint16
+	SessionHandle uint32
+	Status        uint32
+	Context       uint64
+	Options       uint32
+}
+
+type cipTestItem struct {
+	ID   uint16
+	Data []byte
+}
+
+// testLogixController emulates a Logix controller over EtherNet/IP for the tests.
+// It handles RegisterSession, (large) Forward Open and Forward Close as well as the
+// connected Read Tag and Write Tag services for symbolic tag paths. The tags live in an
+// in-memory table keyed by the lower case tag path, e.g. "program:mainprogram.speed".
+// Go values are mapped onto the atomic Logix types; strings are served as Logix STRING.
+type testLogixController struct {
+	t *testing.T
+
+	mu    sync.Mutex
+	tags  map[string]any
+	reads map[string]int
+	// attributes of CIP objects keyed by class/instance/attribute, or class/instance for Get_Attribute_All
+	attributes map[string][]byte
+	listener   net.Listener
+	address    string
+	conns      map[net.Conn]struct{}
+	nextID     uint32
+}
+
+func newTestLogixController(t *testing.T, tags map[string]any) *testLogixController {
+	t.Helper()
+
+	c := &testLogixController{
+		t:          t,
+		tags:       make(map[string]any),
+		reads:      make(map[string]int),
+		attributes: make(map[string][]byte),
+		conns:      make(map[net.Conn]struct{}),
+		nextID:     0x1000,
+	}
+	for name, value := range tags {
+		c.tags[strings.ToLower(name)] = value
+	}
+
+	c.listen("127.0.0.1:0")
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *testLogixController) listen(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		c.t.Fatalf("could not start test controller: %v", err)
+	}
+
+	c.mu.Lock()
+	c.listener = listener
+	c.address = listener.Addr().String()
+	c.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c.mu.Lock()
+			c.conns[conn] = struct{}{}
+			c.mu.Unlock()
+			go c.serve(conn)
+		}
+	}()
+}
+
+// Address returns host:port of the controller, to be used as tcpDevice.
+func (c *testLogixController) Address() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.address
+}
+
+func (c *testLogixController) SetTag(name string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tags[strings.ToLower(name)] = value
+}
+
+func (c *testLogixController) Tag(name string) any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tags[strings.ToLower(name)]
+}
+
+// SetAttribute sets the raw data of an attribute. Use the path class/instance for the data returned by Get_Attribute_All.
+func (c *testLogixController) SetAttribute(path string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attributes[path] = data
+}
+
+// Reads returns how often the tag has been read by a client.
+func (c *testLogixController) Reads(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reads[strings.ToLower(name)]
+}
+
+// Reboot drops all sessions and makes the controller unreachable until Restart is called.
+func (c *testLogixController) Reboot() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.listener != nil {
+		c.listener.Close()
+		c.listener = nil
+	}
+	for conn := range c.conns {
+		conn.Close()
+		delete(c.conns, conn)
+	}
+}
+
+// Restart makes the controller reachable again on the same address after a Reboot.
+func (c *testLogixController) Restart() {
+	c.listen(c.Address())
+}
+
+func (c *testLogixController) Close() {
+	c.Reboot()
+}
+
+func (c *testLogixController) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		c.mu.Lock()
+		delete(c.conns, conn)
+		c.mu.Unlock()
+	}()
+
+	for {
+		var hdr eipTestHeader
+		if err := binary.Read(conn, binary.LittleEndian, &hdr); err != nil {
+			return
+		}
+		data := make([]byte, hdr.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+
+		var reply []byte
+		var err error
+		switch hdr.Command {
+		case eipRegisterSession:
+			hdr.SessionHandle = c.newID()
+			reply = data
+		case eipUnRegisterSession:
+			return
+		case eipSendRRData:
+			reply, err = c.handleUnconnected(data)
+		case eipSendUnitData:
+			reply, err = c.handleConnected(data)
+		default:
+			err = fmt.Errorf("unsupported encapsulation command 0x%X", hdr.Command)
+		}
+		if err != nil {
+			c.t.Logf("test controller: %v", err)
+			return
+		}
+
+		hdr.Length = uint16(len(reply))
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.LittleEndian, hdr)
+		buf.Write(reply)
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (c *testLogixController) newID() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	return c.nextID
+}
+
+// handleUnconnected answers the unconnected messages used to open and close the connection.
+func (c *testLogixController) handleUnconnected(data []byte) ([]byte, error) {
+	items, err := parseTestItems(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) != 2 || items[1].ID != cipItemUnconnectedData || len(items[1].Data) < 2 {
+		return nil, errors.New("malformed unconnected message")
+	}
+	request := items[1].Data
+	service := request[0]
+
+	response := new(bytes.Buffer)
+	switch service {
+	case cipServiceForwardOpen, cipServiceLargeForwardOpen:
+		// service, path size in words, path, priority, timeout ticks
+		pos := 2 + int(request[1])*2 + 2
+		if len(request) < pos+16 {
+			return nil, errors.New("forward open request too short")
+		}
+		toConnectionID := binary.LittleEndian.Uint32(request[pos+4:])
+		connectionSerial := binary.LittleEndian.Uint16(request[pos+8:])
+		vendorID := binary.LittleEndian.Uint16(request[pos+10:])
+		originatorSerial := binary.LittleEndian.Uint32(request[pos+12:])
+
+		response.Write([]byte{service | 0x80, 0, 0, 0})
+		binary.Write(response, binary.LittleEndian, c.newID()) // O->T connection id chosen by the target
+		binary.Write(response, binary.LittleEndian, toConnectionID)
+		binary.Write(response, binary.LittleEndian, connectionSerial)
+		binary.Write(response, binary.LittleEndian, vendorID)
+		binary.Write(response, binary.LittleEndian, originatorSerial)
+		binary.Write(response, binary.LittleEndian, uint32(2500000)) // O->T API
+		binary.Write(response, binary.LittleEndian, uint32(2500000)) // T->O API
+		response.Write([]byte{0, 0})
+	case cipServiceForwardClose:
+		response.Write([]byte{service | 0x80, 0, 0, 0})
+	default:
+		response.Write([]byte{service | 0x80, 0, cipStatusServiceNotSupport, 0})
+	}
+
+	return encodeTestItems(cipTestItem{ID: cipItemNull}, cipTestItem{ID: cipItemUnconnectedData, Data: response.Bytes()}), nil
+}
+
+// handleConnected answers the connected Read Tag and Write Tag services.
+func (c *testLogixController) handleConnected(data []byte) ([]byte, error) {
+	items, err := parseTestItems(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) != 2 || items[0].ID != cipItemConnectionAddress || items[1].ID != cipItemConnectedData || len(items[1].Data) < 4 {
+		return nil, errors.New("malformed connected message")
+	}
+	request := items[1].Data
+	sequence := request[:2]
+	service := request[2]
+	pathEnd := 4 + int(request[3])*2
+	if len(request) < pathEnd {
+		return nil, errors.New("connected request path too short")
+	}
+
+	var status byte
+	var payload []byte
+	switch service {
+	case cipServiceGetAttributeSingle, cipServiceGetAttributeAll:
+		path, err := parseTestLogicalPath(request[4:pathEnd])
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		data, ok := c.attributes[path]
+		c.mu.Unlock()
+		if !ok {
+			status = cipStatusPathUnknown
+			break
+		}
+		payload = data
+	case cipServiceRead:
+		tag, err := parseTestTagPath(request[4:pathEnd])
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		value, ok := c.tags[tag]
+		c.reads[tag]++
+		c.mu.Unlock()
+		if !ok {
+			status = cipStatusPathUnknown
+			break
+		}
+		if payload, err = encodeTestValue(value); err != nil {
+			return nil, err
+		}
+	case cipServiceWrite:
+		tag, err := parseTestTagPath(request[4:pathEnd])
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		_, ok := c.tags[tag]
+		c.mu.Unlock()
+		if !ok {
+			status = cipStatusPathUnknown
+			break
+		}
+		value, err := decodeTestValue(request[pathEnd:])
+		if err != nil {
+			status = cipStatusTypeMismatch
+			break
+		}
+		c.SetTag(tag, value)
+	default:
+		status = cipStatusServiceNotSupport
+	}
+
+	response := new(bytes.Buffer)
+	response.Write(sequence)
+	response.Write([]byte{service | 0x80, 0, status, 0})
+	response.Write(payload)
+
+	connectionID := make([]byte, 4)
+	copy(connectionID, items[0].Data)
+	return encodeTestItems(cipTestItem{ID: cipItemConnectionAddress, Data: connectionID}, cipTestItem{ID: cipItemConnectedData, Data: response.Bytes()}), nil
+}
+
+func parseTestItems(data []byte) ([]cipTestItem, error) {
+	// interface handle and timeout
+	if len(data) < 8 {
+		return nil, errors.New("common packet format too short")
+	}
+	r := bytes.NewReader(data[6:])
+	var count uint16
+	binary.Read(r, binary.LittleEndian, &count)
+
+	items := make([]cipTestItem, count)
+	for i := range items {
+		var length uint16
+		if err := binary.Read(r, binary.LittleEndian, &items[i].ID); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return nil, err
+		}
+		items[i].Data = make([]byte, length)
+		if _, err := io.ReadFull(r, items[i].Data); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func encodeTestItems(items ...cipTestItem) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(0)) // interface handle
+	binary.Write(buf, binary.LittleEndian, uint16(0)) // timeout
+	binary.Write(buf, binary.LittleEndian, uint16(len(items)))
+	for _, item := range items {
+		binary.Write(buf, binary.LittleEndian, item.ID)
+		binary.Write(buf, binary.LittleEndian, uint16(len(item.Data)))
+		buf.Write(item.Data)
+	}
+	return buf.Bytes()
+}
+
+// parseTestTagPath turns the symbolic and element segments of a request path back into a tag path.
+func parseTestTagPath(path []byte) (string, error) {
+	var tag strings.Builder
+	for i := 0; i < len(path); {
+		switch path[i] {
+		case 0x91: // ANSI extended symbolic segment
+			if i+1 >= len(path) {
+				return "", errors.New("symbolic segment too short")
+			}
+			length := int(path[i+1])
+			if i+2+length > len(path) {
+				return "", errors.New("symbolic segment too short")
+			}
+			if tag.Len() > 0 {
+				tag.WriteString(".")
+			}
+			tag.WriteString(strings.ToLower(string(path[i+2 : i+2+length])))
+			i += 2 + length + length%2
+		case 0x28: // 8 bit element
+			fmt.Fprintf(&tag, "[%d]", path[i+1])
+			i += 2
+		case 0x29: // 16 bit element
+			fmt.Fprintf(&tag, "[%d]", binary.LittleEndian.Uint16(path[i+2:]))
+			i += 4
+		case 0x2A: // 32 bit element
+			fmt.Fprintf(&tag, "[%d]", binary.LittleEndian.Uint32(path[i+2:]))
+			i += 6
+		default:
+			return "", fmt.Errorf("unsupported path segment 0x%X", path[i])
+		}
+	}
+	return tag.String(), nil
+}
+
+// parseTestLogicalPath turns the class, instance and attribute segments of a request path into class/instance[/attribute].
+func parseTestLogicalPath(path []byte) (string, error) {
+	var parts []string
+	for i := 0; i < len(path); {
+		if i+1 >= len(path) {
+			return "", errors.New("logical segment too short")
+		}
+		switch path[i] {
+		case 0x20, 0x24, 0x30: // 8 bit class, instance, attribute
+			parts = append(parts, fmt.Sprint(path[i+1]))
+			i += 2
+		case 0x21, 0x25, 0x31: // 16 bit class, instance, attribute
+			if i+4 > len(path) {
+				return "", errors.New("logical segment too short")
+			}
+			parts = append(parts, fmt.Sprint(binary.LittleEndian.Uint16(path[i+2:])))
+			i += 4
+		default:
+			return "", fmt.Errorf("unsupported path segment 0x%X", path[i])
+		}
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// encodeTestValue encodes a value the way a Logix controller answers a Read Tag service:
+// the type code followed by the data; STRINGs as structure with handle, LEN and DATA.
+func encodeTestValue(value any) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var typ byte
+	switch v := value.(type) {
+	case string:
+		if len(v) > logixStringDataSize {
+			return nil, fmt.Errorf("string %q longer than %d characters", v, logixStringDataSize)
+		}
+		buf.Write([]byte{0xA0, 0x02})
+		binary.Write(buf, binary.LittleEndian, logixStringHandle)
+		binary.Write(buf, binary.LittleEndian, uint32(len(v)))
+		data := make([]byte, logixStringDataSize)
+		copy(data, v)
+		buf.Write(data)
+		return buf.Bytes(), nil
+	case bool:
+		buf.Write([]byte{0xC1, 0})
+		if v {
+			buf.WriteByte(0xFF)
+		} else {
+			buf.WriteByte(0)
+		}
+		return buf.Bytes(), nil
+	case int8:
+		typ = 0xC2
+	case int16:
+		typ = 0xC3
+	case int32:
+		typ = 0xC4
+	case int64:
+		typ = 0xC5
+	case uint8:
+		typ = 0xC6
+	case uint16:
+		typ = 0xC7
+	case uint32:
+		typ = 0xC8
+	case float32:
+		typ = 0xCA
+	case float64:
+		typ = 0xCB
+	default:
+		return nil, fmt.Errorf("unsupported tag value %T", value)
+	}
+	buf.Write([]byte{typ, 0})
+	binary.Write(buf, binary.LittleEndian, value)
+	return buf.Bytes(), nil
+}
+
+// decodeTestValue decodes the type, element count and data of a Write Tag service.
+func decodeTestValue(data []byte) (any, error) {
+	if len(data) < 4 {
+		return nil, errors.New("write request too short")
+	}
+	typ := data[0]
+	if typ == 0xA0 {
+		// structure handle, element count, LEN, DATA
+		if len(data) < 10 {
+			return nil, errors.New("string write request too short")
+		}
+		length := binary.LittleEndian.Uint32(data[6:])
+		if int(length) > len(data)-10 {
+			return nil, errors.New("string length exceeds the data")
+		}
+		return string(data[10 : 10+length]), nil
+	}
+
+	value := data[4:]
+	need := map[byte]int{0xC1: 1, 0xC2: 1, 0xC3: 2, 0xC4: 4, 0xC5: 8, 0xC6: 1, 0xC7: 2, 0xC8: 4, 0xCA: 4, 0xCB: 8}[typ]
+	if need == 0 || len(value) < need {
+		return nil, fmt.Errorf("unsupported write of type 0x%X", typ)
+	}
+	switch typ {
+	case 0xC1:
+		return value[0] != 0, nil
+	case 0xC2:
+		return int8(value[0]), nil
+	case 0xC3:
+		return int16(binary.LittleEndian.Uint16(value)), nil
+	case 0xC4:
+		return int32(binary.LittleEndian.Uint32(value)), nil
+	case 0xC5:
+		return int64(binary.LittleEndian.Uint64(value)), nil
+	case 0xC6:
+		return value[0], nil
+	case 0xC7:
+		return binary.LittleEndian.Uint16(value), nil
+	case 0xC8:
+		return binary.LittleEndian.Uint32(value), nil
+	case 0xCA:
+		return math.Float32frombits(binary.LittleEndian.Uint32(value)), nil
+	default:
+		return math.Float64frombits(binary.LittleEndian.Uint64(value)), nil
+	}
+}
@@ -0,0 +1,114 @@
+package ab_plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// logixStringLenSize is the size of the DINT LEN member in front of the DATA member of a Logix STRING.
+const logixStringLenSize = 4
+
+// abValue is the JSON body of the messages created by absubscription and abtrigger.
+type abValue struct {
+	Name      string         `json:"name,omitempty"`
+	Value     any            `json:"value"`
+	DataType  string         `json:"datatype"`
+	Timestamp int64          `json:"timestamp_ms"`
+	Values    map[string]any `json:"values,omitempty"`
+}
+
+func (v abValue) marshal(timestamp time.Time) ([]byte, error) {
+	v.Timestamp = timestamp.UnixMilli()
+	return json.Marshal(v)
+}
+
+// rawBytes are the bytes of a value that is not decoded, e.g. a user defined type. They have the datatype bytes,
+// and are emitted as an array of numbers from 0 to 255 in the JSON body instead of the base64 of a []byte.
+type rawBytes []byte
+
+func (b rawBytes) MarshalJSON() ([]byte, error) {
+	numbers := make([]int, len(b))
+	for i, v := range b {
+		numbers[i] = int(v)
+	}
+	return json.Marshal(numbers)
+}
+
+// normalizeDataType maps the datatype names used in the configurations onto one spelling,
+// e.g. the older "str" onto "string".
+func normalizeDataType(dataType string) string {
+	dataType = strings.ToLower(strings.TrimSpace(dataType))
+	switch dataType {
+	case "str":
+		return "string"
+	case "boolean":
+		return "bool"
+	case "real":
+		return "float32"
+	case "lreal":
+		return "float64"
+	}
+	return dataType
+}
+
+// decodeValue turns a value returned by gologix into a typed value. Numbers and bools are kept as they are.
+// Structures are returned by gologix as raw bytes; for the string datatype they are decoded from the Logix STRING
+// layout, which is a DINT LEN followed by the SINT DATA array. Other structures, and structures without a datatype,
+// are kept as rawBytes, as a user defined type may start with a DINT as well.
+func decodeValue(value any, dataType string) (any, error) {
+	raw, ok := value.([]byte)
+	if !ok {
+		return value, nil
+	}
+
+	if normalizeDataType(dataType) == "string" {
+		return decodeLogixString(raw)
+	}
+	return rawBytes(raw), nil
+}
+
+// decodeLogixString decodes a Logix STRING (or any other type of the STRING family) from its raw bytes.
+func decodeLogixString(raw []byte) (string, error) {
+	if len(raw) < logixStringLenSize {
+		return "", fmt.Errorf("logix string needs at least %d bytes, got %d", logixStringLenSize, len(raw))
+	}
+	length := binary.LittleEndian.Uint32(raw[:logixStringLenSize])
+	data := raw[logixStringLenSize:]
+	if uint64(length) > uint64(len(data)) {
+		return "", fmt.Errorf("logix string length %d exceeds the %d data bytes", length, len(data))
+	}
+	return string(bytes.TrimRight(data[:length], "\x00")), nil
+}
+
+// dataTypeOf returns the configured datatype or, if none is configured, the datatype of the decoded value.
+// Values that are not decoded, e.g. user defined types, always have the datatype bytes.
+func dataTypeOf(value any, dataType string) string {
+	if _, ok := value.(rawBytes); ok {
+		return "bytes"
+	}
+	if dataType = normalizeDataType(dataType); dataType != "" {
+		return dataType
+	}
+	switch value.(type) {
+	case string:
+		return "string"
+	case nil:
+		return ""
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// formatValue formats a decoded value for the string based metadata.
+func formatValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case rawBytes:
+		return fmt.Sprintf("%x", []byte(v))
+	}
+	return fmt.Sprint(value)
+}
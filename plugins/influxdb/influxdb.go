@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"log"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,6 +24,8 @@ type InfluxDBOutput struct {
 	password  string
 	client    influxdb2.Client
 	log       *service.Logger
+	// useTimestampMetadata writes the points at the time of the timestamp_ms metadata instead of the current time
+	useTimestampMetadata bool
 }
 
 var InfluxDBConfigSpec = service.NewConfigSpec().
@@ -33,7 +36,8 @@ var InfluxDBConfigSpec = service.NewConfigSpec().
 	Field(service.NewStringField("token").Description("Token")).
 	Field(service.NewStringField("org").Description("Organisation")).
 	Field(service.NewStringField("bucket").Description("Bucket")).
-	Field(service.NewStringField("precision").Description("Precision").Default(""))
+	Field(service.NewStringField("precision").Description("Precision").Default("")).
+	Field(service.NewBoolField("useTimestampMetadata").Description("Set to true to write the points at the time in the timestamp_ms metadata, e.g. the source timestamps of the opcua_history input, instead of the time of the write. Messages without it are written at the current time.").Default(false))
 
 func newInfluxDBOutput(conf *service.ParsedConfig, mgr *service.Resources) (*InfluxDBOutput, int, error) {
 	endpoint, err := conf.FieldString("endpoint")
@@ -71,6 +75,11 @@ func newInfluxDBOutput(conf *service.ParsedConfig, mgr *service.Resources) (*Inf
 		return nil, 1, err
 	}
 
+	useTimestampMetadata, err := conf.FieldBool("useTimestampMetadata")
+	if err != nil {
+		return nil, 1, err
+	}
+
 	return &InfluxDBOutput{
 		endpoint:  endpoint,
 		username:  username,
@@ -80,6 +89,7 @@ func newInfluxDBOutput(conf *service.ParsedConfig, mgr *service.Resources) (*Inf
 		precision: precision,
 		bucket:    bucket,
 		log:       mgr.Logger(),
+		useTimestampMetadata: useTimestampMetadata,
 	}, 1, nil
 
 }
@@ -182,13 +192,33 @@ func (i *InfluxDBOutput) Write(ctx context.Context, msg *service.Message) error
 
 	writeAPI := i.client.WriteAPIBlocking(i.org, i.bucket)
 
-	p := influxdb2.NewPoint(i.bucket, tags, fields, time.Now())
+	// the current time stays the default, as live inputs set timestamp_ms as well
+	timestamp := time.Now()
+	if i.useTimestampMetadata {
+		timestamp = metadataTimestamp(msg, timestamp)
+	}
+
+	p := influxdb2.NewPoint(i.bucket, tags, fields, timestamp)
 
 	// Write point immediately
 	writeAPI.WritePoint(context.Background(), p)
 	return nil
 }
 
+// metadataTimestamp returns the time of the timestamp_ms metadata of a message, e.g. the source timestamp
+// of a historical value, or the fallback if it has none.
+func metadataTimestamp(msg *service.Message, fallback time.Time) time.Time {
+	ms, ok := msg.MetaGet("timestamp_ms")
+	if !ok {
+		return fallback
+	}
+	parsed, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return time.UnixMilli(parsed)
+}
+
 func init() {
 	// Register our new output plugin
 	err := service.RegisterOutput(
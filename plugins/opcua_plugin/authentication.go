@@ -1,74 +1,131 @@
 package opcua_plugin
 
 import (
+	"crypto/rsa"
+	"errors"
+	"os"
 	"sort"
+	"strings"
+
+	"github.com/benthosdev/benthos/v4/public/service"
 
 	"github.com/gopcua/opcua/ua"
 )
 
-// getReasonableEndpoint selects an appropriate OPC UA endpoint based on specified criteria.
-// It filters the endpoints based on the authentication method, security mode, and security policy.
-// If no suitable endpoint is found, it returns nil.
-// This can potentially be replaced by SelectEndpoint function in goopcua package
-func (g *OPCUATriInput) getReasonableEndpoint(
-	endpoints []*ua.EndpointDescription,
-	selectedAuthentication ua.UserTokenType,
-	disableEncryption bool,
-	securityMode string,
-	securityPolicy string,
-) *ua.EndpointDescription {
-
-	// Return nil immediately if no endpoints are provided.
-	if len(endpoints) == 0 {
-		return nil
+// authenticationFields are the config fields for the user identity tokens besides username and password.
+func authenticationFields() []*service.ConfigField {
+	return []*service.ConfigField{
+		service.NewStringField("userCertificate").Description("PEM file, or the PEM itself, of the X.509 certificate to authenticate the user with. Requires userPrivateKey.").Default(""),
+		service.NewStringField("userPrivateKey").Description("PEM file, or the PEM itself, of the private key of the userCertificate.").Default(""),
+		service.NewStringField("issuedToken").Description("Token issued by an authorization service, e.g. a JWT, to authenticate the user with.").Default(""),
+		service.NewStringField("issuedTokenType").Description("URI of the type of the issuedToken, e.g. http://opcfoundation.org/UA/UserToken#JWT. Only endpoints that accept this type are selected. If not set, any type is accepted.").Default(""),
 	}
+}
 
-	// Sort endpoints in descending order of security level.
-	sort.Sort(sort.Reverse(bySecurityLevel(endpoints)))
+// authenticationConfig holds the user identity tokens besides username and password.
+type authenticationConfig struct {
+	userCertificate string
+	userPrivateKey  string
+	issuedToken     string
+	issuedTokenType string
+}
 
-	// Iterate over each endpoint to find a matching one.
-	for _, endpoint := range endpoints {
+func parseAuthenticationConfig(conf *service.ParsedConfig) (authenticationConfig, error) {
+	var a authenticationConfig
+	var err error
 
-		// Check each user identity token in the endpoint.
-		for _, userIdentity := range endpoint.UserIdentityTokens {
+	if a.userCertificate, err = conf.FieldString("userCertificate"); err != nil {
+		return a, err
+	}
+	if a.userPrivateKey, err = conf.FieldString("userPrivateKey"); err != nil {
+		return a, err
+	}
+	if (a.userCertificate == "") != (a.userPrivateKey == "") {
+		return a, errors.New("userCertificate and userPrivateKey must be set together")
+	}
+	if a.issuedToken, err = conf.FieldString("issuedToken"); err != nil {
+		return a, err
+	}
+	if a.issuedTokenType, err = conf.FieldString("issuedTokenType"); err != nil {
+		return a, err
+	}
 
-			// Match the endpoint with the selected authentication type.
-			if selectedAuthentication == userIdentity.TokenType {
+	username, err := conf.FieldString("username")
+	if err != nil {
+		return a, err
+	}
+	methods := 0
+	for _, set := range []bool{username != "", a.userCertificate != "", a.issuedToken != ""} {
+		if set {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return a, errors.New("only one of username, userCertificate and issuedToken can be set")
+	}
+	return a, nil
+}
 
-				// Check for encryption requirements.
-				if disableEncryption && endpoint.SecurityMode == ua.MessageSecurityModeFromString("None") {
-					// Return if encryption is disabled and the endpoint has no security.
-					return endpoint
-				} else if !disableEncryption {
-					// Handle the case where encryption is not disabled.
+// userTokenType returns the user identity token to authenticate with. Without any credentials, the user is anonymous.
+func (a authenticationConfig) userTokenType(username string, password string) ua.UserTokenType {
+	switch {
+	case a.userCertificate != "":
+		return ua.UserTokenTypeCertificate
+	case a.issuedToken != "":
+		return ua.UserTokenTypeIssuedToken
+	case username != "" && password != "":
+		// Use UsernamePassword authentication if both username and password are available.
+		return ua.UserTokenTypeUserName
+	default:
+		return ua.UserTokenTypeAnonymous
+	}
+}
 
-					// Check for a specific security mode if provided.
-					if securityMode != "" && endpoint.SecurityMode == ua.MessageSecurityModeFromString(securityMode) {
+// userCertificateKeyPair loads the user certificate and its private key.
+func (a authenticationConfig) userCertificateKeyPair() (*rsa.PrivateKey, []byte, error) {
+	certPEM, err := readPEM(a.userCertificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := readPEM(a.userPrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseClientCertificate(certPEM, keyPEM)
+}
 
-						// Check for a specific security policy if provided.
-						if securityPolicy != "" && endpoint.SecurityPolicyURI == "http://opcfoundation.org/UA/SecurityPolicy#"+securityPolicy {
-							return endpoint
-						} else if securityPolicy == "" {
-							// If no specific security policy is needed, return the endpoint.
-							return endpoint
-						}
-						// Continue searching if the security policy doesn't match.
-					} else if securityMode == "" {
-						// If no specific security policy is needed, return the endpoint.
-						return endpoint
-					}
-				}
-				// Continue searching if other conditions are not met.
-			}
-		}
+// readPEM returns a PEM that is given either directly or as file.
+func readPEM(value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
 	}
+	return os.ReadFile(value)
+}
 
-	// Return nil if no suitable endpoint is found.
+// userTokenPolicy returns the token policy of an endpoint for the selected authentication. Issued tokens
+// must also match the issuedTokenType, if set.
+func userTokenPolicy(endpoint *ua.EndpointDescription, selectedAuthentication ua.UserTokenType, issuedTokenType string) *ua.UserTokenPolicy {
+	for _, userIdentity := range endpoint.UserIdentityTokens {
+		if userIdentity.TokenType != selectedAuthentication {
+			continue
+		}
+		if selectedAuthentication == ua.UserTokenTypeIssuedToken && issuedTokenType != "" && userIdentity.IssuedTokenType != issuedTokenType {
+			continue
+		}
+		return userIdentity
+	}
 	return nil
 }
-func (g *OPCUAInput) getReasonableEndpoint(
+
+// getReasonableEndpoint selects an appropriate OPC UA endpoint based on specified criteria.
+// It filters the endpoints based on the authentication method, security mode, and security policy.
+// For issued tokens, the issuedTokenType must match as well, unless it is empty.
+// If no suitable endpoint is found, it returns nil.
+// This can potentially be replaced by SelectEndpoint function in goopcua package
+func getReasonableEndpoint(
 	endpoints []*ua.EndpointDescription,
 	selectedAuthentication ua.UserTokenType,
+	issuedTokenType string,
 	disableEncryption bool,
 	securityMode string,
 	securityPolicy string,
@@ -89,7 +146,7 @@ func (g *OPCUAInput) getReasonableEndpoint(
 		for _, userIdentity := range endpoint.UserIdentityTokens {
 
 			// Match the endpoint with the selected authentication type.
-			if selectedAuthentication == userIdentity.TokenType {
+			if userIdentity == userTokenPolicy(endpoint, selectedAuthentication, issuedTokenType) {
 
 				// Check for encryption requirements.
 				if disableEncryption && endpoint.SecurityMode == ua.MessageSecurityModeFromString("None") {
@@ -123,6 +180,28 @@ func (g *OPCUAInput) getReasonableEndpoint(
 	return nil
 }
 
+// getReasonableEndpoint selects the endpoint for the trigger input, see getReasonableEndpoint.
+func (g *OPCUATriInput) getReasonableEndpoint(
+	endpoints []*ua.EndpointDescription,
+	selectedAuthentication ua.UserTokenType,
+	disableEncryption bool,
+	securityMode string,
+	securityPolicy string,
+) *ua.EndpointDescription {
+	return getReasonableEndpoint(endpoints, selectedAuthentication, "", disableEncryption, securityMode, securityPolicy)
+}
+
+// getReasonableEndpoint selects the endpoint for the input, see getReasonableEndpoint.
+func (g *OPCUAInput) getReasonableEndpoint(
+	endpoints []*ua.EndpointDescription,
+	selectedAuthentication ua.UserTokenType,
+	disableEncryption bool,
+	securityMode string,
+	securityPolicy string,
+) *ua.EndpointDescription {
+	return getReasonableEndpoint(endpoints, selectedAuthentication, "", disableEncryption, securityMode, securityPolicy)
+}
+
 // Copy paste from opcua library
 type bySecurityLevel []*ua.EndpointDescription
 
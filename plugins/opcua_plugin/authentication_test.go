@@ -0,0 +1,97 @@
+package opcua_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserTokenType(t *testing.T) {
+	for yaml, tokenType := range map[string]ua.UserTokenType{
+		``:                                     ua.UserTokenTypeAnonymous,
+		"username: operator\npassword: secret": ua.UserTokenTypeUserName,
+		"userCertificate: /certs/user.pem\nuserPrivateKey: /certs/user.key":                             ua.UserTokenTypeCertificate,
+		"issuedToken: eyJhbGciOiJSUzI1NiJ9\nissuedTokenType: http://opcfoundation.org/UA/UserToken#JWT": ua.UserTokenTypeIssuedToken,
+	} {
+		c, err := parseConnectionConfig(testConfig(t, connectionFields(), "endpoint: opc.tcp://localhost:4840\n"+yaml), service.MockResources())
+		require.NoError(t, err, yaml)
+		assert.Equal(t, tokenType, c.authentication.userTokenType(c.username, c.password), yaml)
+	}
+
+	// incomplete and ambiguous identities are rejected
+	for _, yaml := range []string{
+		"userCertificate: /certs/user.pem",
+		"username: operator\nissuedToken: eyJhbGciOiJSUzI1NiJ9",
+		"userCertificate: /certs/user.pem\nuserPrivateKey: /certs/user.key\nissuedToken: eyJhbGciOiJSUzI1NiJ9",
+	} {
+		_, err := parseConnectionConfig(testConfig(t, connectionFields(), "endpoint: opc.tcp://localhost:4840\n"+yaml), service.MockResources())
+		assert.Error(t, err, yaml)
+	}
+}
+
+func TestUserCertificateKeyPair(t *testing.T) {
+	certPEM, keyPEM, err := generateClientCertificate()
+	require.NoError(t, err)
+
+	// the PEM can be given directly
+	a := authenticationConfig{userCertificate: string(certPEM), userPrivateKey: string(keyPEM)}
+	pk, cert, err := a.userCertificateKeyPair()
+	require.NoError(t, err)
+	assert.NotNil(t, pk)
+	assert.NotEmpty(t, cert)
+
+	// or as files
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "user.pem"), certPEM, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "user.key"), keyPEM, 0o600))
+	a = authenticationConfig{userCertificate: filepath.Join(dir, "user.pem"), userPrivateKey: filepath.Join(dir, "user.key")}
+	_, fileCert, err := a.userCertificateKeyPair()
+	require.NoError(t, err)
+	assert.Equal(t, cert, fileCert)
+
+	a = authenticationConfig{userCertificate: filepath.Join(dir, "missing.pem"), userPrivateKey: filepath.Join(dir, "user.key")}
+	_, _, err = a.userCertificateKeyPair()
+	assert.Error(t, err)
+}
+
+func TestGetReasonableEndpoint_UserTokens(t *testing.T) {
+	jwt := &ua.UserTokenPolicy{PolicyID: "jwt", TokenType: ua.UserTokenTypeIssuedToken, IssuedTokenType: "http://opcfoundation.org/UA/UserToken#JWT"}
+	saml := &ua.UserTokenPolicy{PolicyID: "saml", TokenType: ua.UserTokenTypeIssuedToken, IssuedTokenType: "http://opcfoundation.org/UA/UserToken#SAML"}
+	certificate := &ua.UserTokenPolicy{PolicyID: "certificate", TokenType: ua.UserTokenTypeCertificate}
+	endpoints := []*ua.EndpointDescription{{
+		EndpointURL:        "opc.tcp://localhost:4840/saml",
+		SecurityMode:       ua.MessageSecurityModeSignAndEncrypt,
+		SecurityPolicyURI:  ua.SecurityPolicyURIBasic256Sha256,
+		SecurityLevel:      3,
+		UserIdentityTokens: []*ua.UserTokenPolicy{saml, certificate},
+	}, {
+		EndpointURL:        "opc.tcp://localhost:4840/jwt",
+		SecurityMode:       ua.MessageSecurityModeSignAndEncrypt,
+		SecurityPolicyURI:  ua.SecurityPolicyURIBasic256Sha256,
+		SecurityLevel:      2,
+		UserIdentityTokens: []*ua.UserTokenPolicy{saml, jwt},
+	}}
+
+	selected := getReasonableEndpoint(endpoints, ua.UserTokenTypeCertificate, "", false, "", "")
+	require.NotNil(t, selected)
+	assert.Equal(t, "opc.tcp://localhost:4840/saml", selected.EndpointURL)
+	assert.Equal(t, certificate, userTokenPolicy(selected, ua.UserTokenTypeCertificate, ""))
+
+	// any issued token type is accepted by default
+	selected = getReasonableEndpoint(endpoints, ua.UserTokenTypeIssuedToken, "", false, "", "")
+	require.NotNil(t, selected)
+	assert.Equal(t, "opc.tcp://localhost:4840/saml", selected.EndpointURL)
+
+	selected = getReasonableEndpoint(endpoints, ua.UserTokenTypeIssuedToken, jwt.IssuedTokenType, false, "", "")
+	require.NotNil(t, selected)
+	assert.Equal(t, "opc.tcp://localhost:4840/jwt", selected.EndpointURL)
+	assert.Equal(t, jwt, userTokenPolicy(selected, ua.UserTokenTypeIssuedToken, jwt.IssuedTokenType))
+
+	assert.Nil(t, getReasonableEndpoint(endpoints, ua.UserTokenTypeIssuedToken, "urn:kerberos", false, "", ""))
+	assert.Nil(t, getReasonableEndpoint(endpoints, ua.UserTokenTypeUserName, "", false, "", ""))
+}
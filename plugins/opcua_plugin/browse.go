@@ -0,0 +1,496 @@
+package opcua_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/errors"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// browseNodeClasses are the values of the browseNodeClasses setting.
+var browseNodeClasses = map[string]ua.NodeClass{
+	"Object":   ua.NodeClassObject,
+	"Variable": ua.NodeClassVariable,
+	"View":     ua.NodeClassView,
+}
+
+// browseTreeFields are the config fields that select the nodes of the node trees below the configured nodes.
+func browseTreeFields() []*service.ConfigField {
+	return []*service.ConfigField{
+		service.NewIntField("browseMaxDepth").Description("Maximum depth of the node tree below a configured node that is browsed.").Default(10),
+		service.NewStringField("browseInclude").Description("Regular expression a variable found by browsing must match with its BrowseName or path to be read.").Default(""),
+		service.NewStringField("browseExclude").Description("Regular expression excluding nodes found by browsing, including their children, if it matches their BrowseName or path.").Default(""),
+		service.NewStringListField("browseNodeClasses").Description("Node classes that are browsed: Object, Variable and View. Variables are read, Objects and Views are browsed for their children.").Default([]string{"Object", "Variable"}),
+		service.NewIntField("browseWorkers").Description("Number of requests sent in parallel while browsing.").Default(1),
+	}
+}
+
+// browseFields are the config fields that control how the node trees below the configured nodes are browsed.
+func browseFields() []*service.ConfigField {
+	return append(browseTreeFields(), browseCacheFields()...)
+}
+
+// browseCacheFields are the config fields of the cache of browse results.
+func browseCacheFields() []*service.ConfigField {
+	return []*service.ConfigField{
+		service.NewStringField("browseCacheFile").Description("File where browse results are persisted, so that they are reused after a restart. Delete it to browse again.").Default(""),
+		service.NewDurationField("browseCacheTTL").Description("How long browse results are reused on reconnects, per endpoint and configured node. 0s disables the cache.").Default("0s"),
+	}
+}
+
+// browseConfig controls how the node trees below the configured nodes are browsed.
+// A nil browseConfig browses like the defaults of browseFields, without a cache.
+type browseConfig struct {
+	maxDepth    int
+	include     *regexp.Regexp
+	exclude     *regexp.Regexp
+	nodeClasses ua.NodeClass
+	workers     int
+	cache       *browseCache
+}
+
+func defaultBrowseConfig() *browseConfig {
+	return &browseConfig{
+		maxDepth:    10,
+		nodeClasses: ua.NodeClassObject | ua.NodeClassVariable,
+		workers:     1,
+	}
+}
+
+func parseBrowseConfig(conf *service.ParsedConfig) (*browseConfig, error) {
+	b := defaultBrowseConfig()
+	var err error
+
+	if b.maxDepth, err = conf.FieldInt("browseMaxDepth"); err != nil {
+		return nil, err
+	}
+	if b.maxDepth < 0 {
+		return nil, fmt.Errorf("browseMaxDepth must not be negative, got %d", b.maxDepth)
+	}
+	if b.include, err = parseBrowseRegexp(conf, "browseInclude"); err != nil {
+		return nil, err
+	}
+	if b.exclude, err = parseBrowseRegexp(conf, "browseExclude"); err != nil {
+		return nil, err
+	}
+
+	classes, err := conf.FieldStringList("browseNodeClasses")
+	if err != nil {
+		return nil, err
+	}
+	if len(classes) == 0 {
+		return nil, errors.New("browseNodeClasses must not be empty")
+	}
+	b.nodeClasses = 0
+	for _, class := range classes {
+		nodeClass, ok := browseNodeClasses[class]
+		if !ok {
+			return nil, fmt.Errorf("invalid browseNodeClasses entry %q", class)
+		}
+		b.nodeClasses |= nodeClass
+	}
+
+	if b.workers, err = conf.FieldInt("browseWorkers"); err != nil {
+		return nil, err
+	}
+	if b.workers < 1 {
+		return nil, fmt.Errorf("browseWorkers must be at least 1, got %d", b.workers)
+	}
+
+	if b.cache, err = parseBrowseCache(conf); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// parseBrowseCache parses the browseCacheFields. It returns nil if the cache is disabled.
+func parseBrowseCache(conf *service.ParsedConfig) (*browseCache, error) {
+	cacheFile, err := conf.FieldString("browseCacheFile")
+	if err != nil {
+		return nil, err
+	}
+	cacheTTL, err := conf.FieldDuration("browseCacheTTL")
+	if err != nil {
+		return nil, err
+	}
+	if cacheTTL < 0 {
+		return nil, fmt.Errorf("browseCacheTTL must not be negative, got %s", cacheTTL)
+	}
+	if cacheTTL > 0 {
+		return &browseCache{path: cacheFile, ttl: cacheTTL}, nil
+	} else if cacheFile != "" {
+		return nil, errors.New("browseCacheFile requires a browseCacheTTL")
+	}
+	return nil, nil
+}
+
+func parseBrowseRegexp(conf *service.ParsedConfig, field string) (*regexp.Regexp, error) {
+	expr, err := conf.FieldString(field)
+	if err != nil || expr == "" {
+		return nil, err
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", field, err)
+	}
+	return re, nil
+}
+
+// nodes returns the variables in the node tree below root, from the cache if it holds a recent result.
+func (b *browseConfig) nodes(ctx context.Context, c *opcua.Client, endpoint string, root *ua.NodeID, logger *service.Logger) ([]NodeDef, error) {
+	if b == nil {
+		b = defaultBrowseConfig()
+	}
+
+	key := b.cacheKey(endpoint, root)
+	if nodes, browsed, ok := b.cache.get(key); ok {
+		logger.Infof("Using %d nodes below %s browsed at %s", len(nodes), root, browsed.Format(time.RFC3339))
+		return nodes, nil
+	}
+
+	start := time.Now()
+	nodes, err := newBrowser(b, logger).browse(ctx, c.Node(root), "", 0)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Browsed %d nodes below %s in %s", len(nodes), root, time.Since(start).Round(time.Millisecond))
+
+	if err := b.cache.put(key, nodes); err != nil {
+		logger.Errorf("Failed to store browse results in %s: %v", b.cache.path, err)
+	}
+	return nodes, nil
+}
+
+// cacheKey identifies the result of browsing below root. It contains the settings that change the result,
+// so that changing them invalidates the cache.
+func (b *browseConfig) cacheKey(endpoint string, root *ua.NodeID) string {
+	var include, exclude string
+	if b.include != nil {
+		include = b.include.String()
+	}
+	if b.exclude != nil {
+		exclude = b.exclude.String()
+	}
+	return fmt.Sprintf("%s %s depth=%d classes=%d include=%q exclude=%q", endpoint, root, b.maxDepth, b.nodeClasses, include, exclude)
+}
+
+// browser browses a node tree, sending at most workers requests in parallel.
+type browser struct {
+	conf   *browseConfig
+	sem    chan struct{}
+	logger *service.Logger
+}
+
+func newBrowser(conf *browseConfig, logger *service.Logger) *browser {
+	b := &browser{conf: conf, logger: logger}
+	if conf.workers > 1 {
+		b.sem = make(chan struct{}, conf.workers)
+	}
+	return b
+}
+
+// browse browses the node tree with the default settings.
+func browse(ctx context.Context, n *opcua.Node, path string, level int, logger *service.Logger) ([]NodeDef, error) {
+	return newBrowser(defaultBrowseConfig(), logger).browse(ctx, n, path, level)
+}
+
+// acquire blocks until a request may be sent.
+func (b *browser) acquire(ctx context.Context) error {
+	if b.sem == nil {
+		return nil
+	}
+	select {
+	case b.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *browser) release() {
+	if b.sem != nil {
+		<-b.sem
+	}
+}
+
+func (b *browser) browse(ctx context.Context, n *opcua.Node, path string, level int) ([]NodeDef, error) {
+	b.logger.Debugf("node:%s path:%q level:%d\n", n, path, level)
+	if level > b.conf.maxDepth {
+		return nil, nil
+	}
+
+	if err := b.acquire(ctx); err != nil {
+		return nil, err
+	}
+	attrs, err := n.Attributes(ctx, ua.AttributeIDNodeClass, ua.AttributeIDBrowseName, ua.AttributeIDDescription, ua.AttributeIDAccessLevel, ua.AttributeIDDataType)
+	b.release()
+	if err != nil {
+		return nil, err
+	}
+
+	var def = NodeDef{
+		NodeID: n.ID,
+	}
+
+	switch err := attrs[0].Status; err {
+	case ua.StatusOK:
+		def.NodeClass = ua.NodeClass(attrs[0].Value.Int())
+	case ua.StatusBadSecurityModeInsufficient:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	switch err := attrs[1].Status; err {
+	case ua.StatusOK:
+		def.BrowseName = attrs[1].Value.String()
+	case ua.StatusBadSecurityModeInsufficient:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	switch err := attrs[2].Status; err {
+	case ua.StatusOK:
+		def.Description = attrs[2].Value.String()
+	case ua.StatusBadAttributeIDInvalid:
+		// ignore
+	case ua.StatusBadSecurityModeInsufficient:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	switch err := attrs[3].Status; err {
+	case ua.StatusOK:
+		def.AccessLevel = ua.AccessLevelType(attrs[3].Value.Int())
+		def.Writable = def.AccessLevel&ua.AccessLevelTypeCurrentWrite == ua.AccessLevelTypeCurrentWrite
+	case ua.StatusBadAttributeIDInvalid:
+		// ignore
+	case ua.StatusBadSecurityModeInsufficient:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	switch err := attrs[4].Status; err {
+	case ua.StatusOK:
+		def.DataType = dataTypeName(attrs[4].Value.NodeID())
+	case ua.StatusBadAttributeIDInvalid:
+		// ignore
+	case ua.StatusBadSecurityModeInsufficient:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	def.Path = join(path, def.BrowseName)
+	b.logger.Debugf("%d: def.Path:%s def.NodeClass:%s\n", level, def.Path, def.NodeClass)
+
+	// The configured node itself is always browsed, the filters only apply to the nodes found below it
+	if level > 0 && matchesBrowseName(b.conf.exclude, def) {
+		b.logger.Debugf("excluded %s", def.Path)
+		return nil, nil
+	}
+
+	// If a node has a Variable class, it probably means that it is a tag
+	// Therefore, no need to browse further
+	if def.NodeClass == ua.NodeClassVariable {
+		if level > 0 && b.conf.include != nil && !matchesBrowseName(b.conf.include, def) {
+			return nil, nil
+		}
+		return []NodeDef{def}, nil
+	}
+
+	// If a node has an Object class, it probably means that it is a folder
+	// Therefore, browse its children
+	if def.NodeClass != ua.NodeClassObject && def.NodeClass != ua.NodeClassView {
+		return nil, nil
+	}
+
+	// To determine if an Object is a folder, we need to check different references
+	// Add here all references that should be checked
+	// For hasProperty it makes sense to show it very close to the tag itself, e.g., use the tagName as tagGroup and then the properties as subparts of it
+	var nodes []NodeDef
+	for _, refType := range []uint32{id.HasComponent, id.Organizes, id.FolderType} {
+		if err := b.acquire(ctx); err != nil {
+			return nil, err
+		}
+		refs, err := n.ReferencedNodes(ctx, refType, ua.BrowseDirectionForward, b.conf.nodeClasses, true)
+		b.release()
+		if err != nil {
+			return nil, errors.Errorf("References: %d: %s", refType, err)
+		}
+		b.logger.Debugf("found %d child refs\n", len(refs))
+
+		children, err := b.browseChildren(ctx, refs, def.Path, level+1)
+		if err != nil {
+			return nil, errors.Errorf("browse children: %s", err)
+		}
+		nodes = append(nodes, children...)
+	}
+	return nodes, nil
+}
+
+// browseChildren browses the children of a node, in parallel if there are multiple workers.
+// The nodes are returned in the order of the children either way.
+func (b *browser) browseChildren(ctx context.Context, children []*opcua.Node, path string, level int) ([]NodeDef, error) {
+	results := make([][]NodeDef, len(children))
+
+	if b.sem == nil {
+		for i, child := range children {
+			nodes, err := b.browse(ctx, child, path, level)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = nodes
+		}
+	} else {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		errs := make([]error, len(children))
+		var wg sync.WaitGroup
+		for i, child := range children {
+			wg.Add(1)
+			go func(i int, child *opcua.Node) {
+				defer wg.Done()
+				results[i], errs[i] = b.browse(ctx, child, path, level)
+				if errs[i] != nil {
+					// stop browsing the siblings, the result is discarded anyway
+					cancel()
+				}
+			}(i, child)
+		}
+		wg.Wait()
+
+		// report the error that caused the others
+		var firstErr error
+		for _, err := range errs {
+			if err != nil && (firstErr == nil || errors.Is(firstErr, context.Canceled)) {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return nil, firstErr
+		}
+	}
+
+	var nodes []NodeDef
+	for _, result := range results {
+		nodes = append(nodes, result...)
+	}
+	return nodes, nil
+}
+
+// matchesBrowseName reports whether the BrowseName or the path of the node matches.
+func matchesBrowseName(re *regexp.Regexp, def NodeDef) bool {
+	return re != nil && (re.MatchString(def.BrowseName) || re.MatchString(def.Path))
+}
+
+// browseCacheMu guards the browse cache files, which inputs may share.
+var browseCacheMu sync.Mutex
+
+type browseCacheEntry struct {
+	Browsed time.Time `json:"browsed"`
+	Nodes   []NodeDef `json:"nodes"`
+}
+
+// browseCache keeps browse results for the TTL, optionally persisted in a JSON file.
+// A nil browseCache caches nothing.
+type browseCache struct {
+	path    string
+	ttl     time.Duration
+	entries map[string]browseCacheEntry
+}
+
+// get returns the cached nodes and when they were browsed, unless they expired.
+func (c *browseCache) get(key string) ([]NodeDef, time.Time, bool) {
+	if c == nil {
+		return nil, time.Time{}, false
+	}
+	browseCacheMu.Lock()
+	defer browseCacheMu.Unlock()
+
+	if c.entries == nil {
+		entries, err := c.load()
+		if err != nil {
+			// the cache is only an optimization, so browse again
+			return nil, time.Time{}, false
+		}
+		c.entries = entries
+	}
+
+	entry, ok := c.entries[key]
+	if !ok || time.Since(entry.Browsed) > c.ttl {
+		return nil, time.Time{}, false
+	}
+	return entry.Nodes, entry.Browsed, true
+}
+
+// put caches the nodes and persists the cache, keeping the entries other inputs stored in the meantime.
+func (c *browseCache) put(key string, nodes []NodeDef) error {
+	if c == nil {
+		return nil
+	}
+	browseCacheMu.Lock()
+	defer browseCacheMu.Unlock()
+
+	entries, err := c.load()
+	if err != nil {
+		entries = map[string]browseCacheEntry{}
+	}
+	entries[key] = browseCacheEntry{Browsed: time.Now(), Nodes: nodes}
+	for k, entry := range entries {
+		if time.Since(entry.Browsed) > c.ttl {
+			delete(entries, k)
+		}
+	}
+	c.entries = entries
+	if c.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so that a crash does not leave a broken cache behind
+	tmp := c.path + ".tmp"
+	if err := writeFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *browseCache) load() (map[string]browseCacheEntry, error) {
+	entries := map[string]browseCacheEntry{}
+	if c.path == "" {
+		if c.entries != nil {
+			return c.entries, nil
+		}
+		return entries, nil
+	}
+
+	b, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("invalid browse cache %s: %w", c.path, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,245 @@
+package opcua_plugin
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// browseCommandFlags are the settings of the opcua input that the browse command accepts as flags, by their type.
+var browseCommandFlags = map[string][]string{
+	"string": {"endpoint", "username", "password", "userCertificate", "userPrivateKey", "issuedToken", "issuedTokenType", "securityMode", "securityPolicy", "clientCertificateFile", "clientPrivateKeyFile", "trustedCertsDir", "rejectedCertsDir", "browseInclude", "browseExclude", "browseCacheFile", "browseCacheTTL", "reverseConnect"},
+	"bool":   {"insecure"},
+	"int":    {"browseMaxDepth", "browseWorkers", "reverseConnectTimeout"},
+	"list":   {"serverCertificateThumbprints", "browseNodeClasses", "reverseConnectServerURIs"},
+}
+
+// nodeEntryTemplate holds the placeholders of the node entries generated by the browse command.
+type nodeEntryTemplate struct {
+	key       string
+	group     string
+	db        string
+	historian string
+	sqlSp     string
+}
+
+// RunBrowseCommand runs `benthos-umh opcua browse` with the arguments that follow it. It connects like the opcua input,
+// browses the node trees below the given roots and writes the variables found as CSV or YAML, or as a nodeIDs or
+// tNodeIDs entry to paste into a config.
+func RunBrowseCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("benthos-umh opcua browse", flag.ContinueOnError)
+
+	// the settings are parsed by the config spec of the input, so that they are validated like in a config
+	settings := map[string]interface{}{}
+	for _, name := range browseCommandFlags["string"] {
+		name := name
+		fs.Func(name, fmt.Sprintf("The %s of the opcua input.", name), func(v string) error {
+			settings[name] = v
+			return nil
+		})
+	}
+	for _, name := range browseCommandFlags["bool"] {
+		name := name
+		fs.BoolFunc(name, fmt.Sprintf("The %s of the opcua input.", name), func(v string) error {
+			b, err := strconv.ParseBool(v)
+			settings[name] = b
+			return err
+		})
+	}
+	for _, name := range browseCommandFlags["int"] {
+		name := name
+		fs.Func(name, fmt.Sprintf("The %s of the opcua input.", name), func(v string) error {
+			i, err := strconv.Atoi(v)
+			settings[name] = i
+			return err
+		})
+	}
+	for _, name := range browseCommandFlags["list"] {
+		name := name
+		fs.Func(name, fmt.Sprintf("The %s of the opcua input, separated by commas.", name), func(v string) error {
+			settings[name] = strings.Split(v, ",")
+			return nil
+		})
+	}
+
+	var roots []string
+	fs.Func("root", "Node to browse, as node ID, nsu= node ID or browse path. Can be given several times. (default: the Objects folder)", func(v string) error {
+		roots = append(roots, v)
+		return nil
+	})
+	format := fs.String("format", "csv", "Output format: csv, yaml, nodeIDs or tNodeIDs.")
+	output := fs.String("output", "", "File to write to instead of stdout.")
+	template := nodeEntryTemplate{}
+	fs.StringVar(&template.key, "key", "1", "Key of the generated nodeIDs or tNodeIDs entry.")
+	fs.StringVar(&template.group, "group", "<group>", "Group of the generated node entries.")
+	fs.StringVar(&template.db, "db", "<db>", "Database of the generated node entries.")
+	fs.StringVar(&template.historian, "historian", "<historian>", "Historian of the generated node entries.")
+	fs.StringVar(&template.sqlSp, "sqlSp", "<sqlSp>", "SQL stored procedure of the generated node entries.")
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if _, ok := settings["endpoint"]; !ok {
+		return errors.New("-endpoint is required")
+	}
+	switch *format {
+	case "csv", "yaml", "nodeIDs", "tNodeIDs":
+	default:
+		return fmt.Errorf("unknown format %s, expected csv, yaml, nodeIDs or tNodeIDs", *format)
+	}
+	if len(roots) == 0 {
+		roots = []string{ua.NewNumericNodeID(0, id.ObjectsFolder).String()}
+	}
+
+	// JSON is valid YAML
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	conf, err := service.NewConfigSpec().Fields(endpointFields()...).Fields(browseFields()...).ParseYAML(string(b), nil)
+	if err != nil {
+		return err
+	}
+	connection, err := parseEndpointConfig(conf)
+	if err != nil {
+		return err
+	}
+	browseConf, err := parseBrowseConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	// the logs of the plugin are not shown, errors are returned instead
+	log := service.MockResources().Logger()
+
+	defer connection.reverse.close()
+	c, err := connection.connect(ctx, log)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", connection.endpoint, err)
+	}
+	defer c.Close(ctx)
+
+	var toResolve []string
+	for _, root := range roots {
+		if needsResolving(root) {
+			toResolve = append(toResolve, root)
+		}
+	}
+	resolved, err := resolveNodes(ctx, c, toResolve, log)
+	if err != nil {
+		return err
+	}
+
+	var nodes []NodeDef
+	for _, root := range roots {
+		if nodeID, ok := resolved[root]; ok {
+			root = nodeID
+		}
+		nodeID, err := ua.ParseNodeID(root)
+		if err != nil {
+			return fmt.Errorf("invalid root %s: %w", root, err)
+		}
+
+		fmt.Fprintf(os.Stderr, "Browsing %s...\n", nodeID)
+		found, err := browseConf.nodes(ctx, c, connection.endpoint, nodeID, log)
+		if err != nil {
+			return fmt.Errorf("failed to browse %s: %w", nodeID, err)
+		}
+		fmt.Fprintf(os.Stderr, "Found %d nodes below %s\n", len(found), nodeID)
+		nodes = append(nodes, found...)
+	}
+
+	if *output == "" {
+		return writeBrowseResult(stdout, *format, nodes, template)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := writeBrowseResult(f, *format, nodes, template); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeBrowseResult writes the browsed nodes in the given format.
+func writeBrowseResult(w io.Writer, format string, nodes []NodeDef, template nodeEntryTemplate) error {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"BrowseName", "DataType", "NodeID", "Unit", "Scale", "Min", "Max", "Writable", "Description"}); err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			if err := cw.Write(node.Records()); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+
+	case "yaml":
+		var sb strings.Builder
+		for _, node := range nodes {
+			fmt.Fprintf(&sb, "- nodeID: %s\n", yamlString(node.NodeID.String()))
+			fmt.Fprintf(&sb, "  browseName: %s\n", yamlString(node.BrowseName))
+			fmt.Fprintf(&sb, "  path: %s\n", yamlString(node.Path))
+			fmt.Fprintf(&sb, "  dataType: %s\n", yamlString(node.DataType))
+			fmt.Fprintf(&sb, "  unit: %s\n", yamlString(node.Unit))
+			fmt.Fprintf(&sb, "  scale: %s\n", yamlString(node.Scale))
+			fmt.Fprintf(&sb, "  min: %s\n", yamlString(node.Min))
+			fmt.Fprintf(&sb, "  max: %s\n", yamlString(node.Max))
+			fmt.Fprintf(&sb, "  writable: %t\n", node.Writable)
+			fmt.Fprintf(&sb, "  description: %s\n", yamlString(node.Description))
+		}
+		_, err := io.WriteString(w, sb.String())
+		return err
+
+	default: // nodeIDs and tNodeIDs
+		entries := make([]map[string]string, 0, len(nodes))
+		for _, node := range nodes {
+			entries = append(entries, map[string]string{
+				"node":      node.NodeID.String(),
+				"group":     template.group,
+				"db":        template.db,
+				"historian": template.historian,
+				"sqlSp":     template.sqlSp,
+				"name":      node.BrowseName,
+			})
+		}
+		// the placeholders must stay readable
+		var b strings.Builder
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(map[string][]map[string]string{template.key: entries}); err != nil {
+			return err
+		}
+		entry := strings.TrimSuffix(b.String(), "\n")
+		_, err := fmt.Fprintf(w, "%s:\n  - '%s'\n", format, strings.ReplaceAll(entry, "'", "''"))
+		return err
+	}
+}
+
+// yamlString quotes a string for YAML, whose double-quoted escapes include the ones of Go.
+func yamlString(s string) string {
+	return strconv.Quote(s)
+}
@@ -0,0 +1,83 @@
+package opcua_plugin
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBrowseResult(t *testing.T) {
+	nodes := []NodeDef{{
+		NodeID:      ua.NewStringNodeID(2, "Line1.Temperature"),
+		NodeClass:   ua.NodeClassVariable,
+		BrowseName:  "Temperature",
+		Path:        "Line1.Temperature",
+		DataType:    "float64",
+		Unit:        "°C",
+		Description: `Temperature of "Line 1"`,
+	}, {
+		NodeID:     ua.MustParseNodeID("ns=2;i=1002"),
+		NodeClass:  ua.NodeClassVariable,
+		BrowseName: "Operator's note",
+		Path:       "Line1.Operator_s_note",
+		DataType:   "string",
+		Writable:   true,
+	}}
+	template := nodeEntryTemplate{key: "1", group: "<group>", db: "<db>", historian: "<historian>", sqlSp: "<sqlSp>"}
+
+	var b bytes.Buffer
+	require.NoError(t, writeBrowseResult(&b, "csv", nodes, template))
+	assert.Equal(t, `BrowseName,DataType,NodeID,Unit,Scale,Min,Max,Writable,Description
+Temperature,float64,ns=2;s=Line1.Temperature,°C,,,,false,"Temperature of ""Line 1"""
+Operator's note,string,ns=2;i=1002,,,,,true,
+`, b.String())
+
+	b.Reset()
+	require.NoError(t, writeBrowseResult(&b, "yaml", nodes[:1], template))
+	assert.Equal(t, `- nodeID: "ns=2;s=Line1.Temperature"
+  browseName: "Temperature"
+  path: "Line1.Temperature"
+  dataType: "float64"
+  unit: "°C"
+  scale: ""
+  min: ""
+  max: ""
+  writable: false
+  description: "Temperature of \"Line 1\""
+`, b.String())
+
+	b.Reset()
+	require.NoError(t, writeBrowseResult(&b, "nodeIDs", nodes, template))
+	assert.Equal(t, `nodeIDs:
+  - '{"1":[{"db":"<db>","group":"<group>","historian":"<historian>","name":"Temperature","node":"ns=2;s=Line1.Temperature","sqlSp":"<sqlSp>"},{"db":"<db>","group":"<group>","historian":"<historian>","name":"Operator''s note","node":"ns=2;i=1002","sqlSp":"<sqlSp>"}]}'
+`, b.String())
+
+	// the generated entries are valid node entries
+	entry := `{"1":[{"db":"<db>","group":"<group>","historian":"<historian>","name":"Temperature","node":"ns=2;s=Line1.Temperature","sqlSp":"<sqlSp>"}]}`
+	nodeGroupMapping, _, err := parseNodeGroupMapping([]string{entry})
+	require.NoError(t, err)
+	assert.Equal(t, "<group>,<db>,<historian>,<sqlSp>,Temperature", nodeGroupMapping["ns=2;s=Line1.Temperature"])
+
+	b.Reset()
+	require.NoError(t, writeBrowseResult(&b, "tNodeIDs", nil, template))
+	assert.Equal(t, "tNodeIDs:\n  - '{\"1\":[]}'\n", b.String())
+}
+
+func TestRunBrowseCommandInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-endpoint", "opc.tcp://localhost:4840", "-format", "xml"},
+		{"-endpoint", "opc.tcp://localhost:4840", "-browseWorkers", "0"},
+		{"-endpoint", "opc.tcp://localhost:4840", "-browseNodeClasses", "Object,Method"},
+		{"-endpoint", "opc.tcp://localhost:4840", "-browseMaxDepth", "deep"},
+		{"-endpoint", "opc.tcp://localhost:4840", "extra"},
+	} {
+		var b bytes.Buffer
+		assert.Error(t, RunBrowseCommand(context.Background(), args, &b), "%v", args)
+		assert.Empty(t, b.String())
+	}
+}
@@ -0,0 +1,151 @@
+package opcua_plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrowseFilters(t *testing.T) {
+	b, err := parseBrowseConfig(testConfig(t, browseFields(), `
+browseMaxDepth: 3
+browseInclude: ^Temperature
+browseExclude: Diagnostics
+browseNodeClasses: [Object, View, Variable]
+`))
+	require.NoError(t, err)
+	assert.Equal(t, ua.NodeClassObject|ua.NodeClassVariable|ua.NodeClassView, b.nodeClasses)
+
+	// the filters match the browse name or the path
+	assert.True(t, matchesBrowseName(b.include, NodeDef{BrowseName: "Temperature1", Path: "Line1.Temperature1"}))
+	assert.False(t, matchesBrowseName(b.include, NodeDef{BrowseName: "Pressure", Path: "Line1.Pressure"}))
+	assert.True(t, matchesBrowseName(b.exclude, NodeDef{BrowseName: "Uptime", Path: "Server.Diagnostics.Uptime"}))
+
+	for _, yaml := range []string{
+		`browseMaxDepth: -1`,
+		`browseInclude: "("`,
+		`browseNodeClasses: []`,
+		`browseNodeClasses: [Method]`,
+		`browseWorkers: 0`,
+		`browseCacheFile: /data/browse.json`,
+	} {
+		_, err := parseBrowseConfig(testConfig(t, browseFields(), yaml))
+		assert.Error(t, err, yaml)
+	}
+}
+
+func TestBrowseCacheKey(t *testing.T) {
+	root := ua.NewStringNodeID(2, "Line1")
+	b := defaultBrowseConfig()
+	key := b.cacheKey("opc.tcp://localhost:4840", root)
+
+	assert.NotEqual(t, key, b.cacheKey("opc.tcp://localhost:4841", root))
+	assert.NotEqual(t, key, b.cacheKey("opc.tcp://localhost:4840", ua.NewStringNodeID(2, "Line2")))
+
+	// changing the filters browses again
+	filtered, err := parseBrowseConfig(testConfig(t, browseFields(), `browseExclude: Diagnostics`))
+	require.NoError(t, err)
+	assert.NotEqual(t, key, filtered.cacheKey("opc.tcp://localhost:4840", root))
+
+	// but the number of workers does not change the result
+	parallel, err := parseBrowseConfig(testConfig(t, browseFields(), `browseWorkers: 4`))
+	require.NoError(t, err)
+	assert.Equal(t, key, parallel.cacheKey("opc.tcp://localhost:4840", root))
+}
+
+func TestBrowseCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache", "browse.json")
+	nodes := []NodeDef{{
+		NodeID:     ua.NewStringNodeID(2, "Line1.Temperature"),
+		NodeClass:  ua.NodeClassVariable,
+		BrowseName: "Temperature",
+		Path:       "Line1.Temperature",
+		DataType:   "float64",
+	}}
+
+	var disabled *browseCache
+	require.NoError(t, disabled.put("key", nodes))
+	_, _, ok := disabled.get("key")
+	assert.False(t, ok)
+
+	c := &browseCache{path: path, ttl: time.Hour}
+	_, _, ok = c.get("key")
+	assert.False(t, ok)
+	require.NoError(t, c.put("key", nodes))
+
+	// the cache survives a restart
+	restarted := &browseCache{path: path, ttl: time.Hour}
+	cached, browsed, ok := restarted.get("key")
+	require.True(t, ok)
+	assert.Equal(t, nodes, cached)
+	assert.WithinDuration(t, time.Now(), browsed, time.Minute)
+
+	// another input sharing the file keeps the entries of the others
+	other := &browseCache{path: path, ttl: time.Hour}
+	require.NoError(t, other.put("other", nil))
+	_, _, ok = (&browseCache{path: path, ttl: time.Hour}).get("key")
+	assert.True(t, ok)
+
+	// expired entries are browsed again
+	expired := &browseCache{path: path, ttl: time.Nanosecond}
+	time.Sleep(time.Millisecond)
+	_, _, ok = expired.get("key")
+	assert.False(t, ok)
+
+	// deleting the file invalidates the cache
+	require.NoError(t, os.Remove(path))
+	_, _, ok = (&browseCache{path: path, ttl: time.Hour}).get("key")
+	assert.False(t, ok)
+}
+
+func TestBrowseCacheAgainstServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	log := service.MockResources().Logger()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+	writeTestValues(t, ctx, out, "line1", map[string]string{"temperature": "23.5"})
+
+	endpoint := "opc.tcp://" + out.server.listener.Addr().String()
+	conn, err := parseConnectionConfig(testConfig(t, connectionFields(), "endpoint: "+endpoint+"\nsecurityMode: None\nsecurityPolicy: None"), service.MockResources())
+	require.NoError(t, err)
+	c, err := conn.connect(ctx, log)
+	require.NoError(t, err)
+	defer c.Close(ctx)
+
+	path := filepath.Join(t.TempDir(), "browse.json")
+	root := ua.NewStringNodeID(1, "line1")
+	browseNames := func(ttl string) []string {
+		b, err := parseBrowseConfig(testConfig(t, browseFields(), "browseCacheFile: "+path+"\nbrowseCacheTTL: "+ttl))
+		require.NoError(t, err)
+		nodes, err := b.nodes(ctx, c, endpoint, root, log)
+		require.NoError(t, err)
+		var names []string
+		for _, node := range nodes {
+			if node.NodeClass == ua.NodeClassVariable {
+				names = append(names, node.BrowseName)
+			}
+		}
+		return names
+	}
+
+	assert.ElementsMatch(t, []string{"temperature"}, browseNames("1h"))
+
+	// a new variable is not browsed while the cache of a restarted input is valid
+	writeTestValues(t, ctx, out, "line1", map[string]string{"pressure": "1.2"})
+	assert.ElementsMatch(t, []string{"temperature"}, browseNames("1h"))
+
+	// but once it expired
+	time.Sleep(10 * time.Millisecond)
+	assert.ElementsMatch(t, []string{"temperature", "pressure"}, browseNames("5ms"))
+	assert.ElementsMatch(t, []string{"temperature", "pressure"}, browseNames("1h"))
+}
@@ -0,0 +1,228 @@
+package opcua_plugin
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua/errors"
+	"github.com/gopcua/opcua/uatest"
+)
+
+// certificateFields are the config fields for the client certificate and the trust store of server certificates.
+func certificateFields() []*service.ConfigField {
+	return []*service.ConfigField{
+		service.NewStringField("clientCertificateFile").Description("PEM file of the client certificate. If it does not exist, a certificate is generated once and stored there, so that servers only need to trust the client once. If not set, a new certificate is generated on every connect.").Default(""),
+		service.NewStringField("clientPrivateKeyFile").Description("PEM file of the private key of the client certificate. Required if clientCertificateFile is set.").Default(""),
+		service.NewStringField("trustedCertsDir").Description("Directory with the trusted server certificates (DER or PEM). Servers with other certificates are rejected on endpoints with security, unless insecure is set.").Default(""),
+		service.NewStringField("rejectedCertsDir").Description("Directory where rejected server certificates are stored, so that they can be reviewed and moved to the trustedCertsDir.").Default(""),
+		service.NewStringListField("serverCertificateThumbprints").Description("SHA1 thumbprints (hex) of the trusted server certificates, which are trusted in addition to the trustedCertsDir.").Default([]string{}),
+	}
+}
+
+// certificateConfig holds the client certificate and the trust store of server certificates.
+type certificateConfig struct {
+	certificateFile  string
+	privateKeyFile   string
+	trustedCertsDir  string
+	rejectedCertsDir string
+	thumbprints      []string
+}
+
+func parseCertificateConfig(conf *service.ParsedConfig) (certificateConfig, error) {
+	var c certificateConfig
+	var err error
+
+	if c.certificateFile, err = conf.FieldString("clientCertificateFile"); err != nil {
+		return c, err
+	}
+	if c.privateKeyFile, err = conf.FieldString("clientPrivateKeyFile"); err != nil {
+		return c, err
+	}
+	if (c.certificateFile == "") != (c.privateKeyFile == "") {
+		return c, errors.New("clientCertificateFile and clientPrivateKeyFile must be set together")
+	}
+	if c.trustedCertsDir, err = conf.FieldString("trustedCertsDir"); err != nil {
+		return c, err
+	}
+	if c.rejectedCertsDir, err = conf.FieldString("rejectedCertsDir"); err != nil {
+		return c, err
+	}
+	if c.thumbprints, err = conf.FieldStringList("serverCertificateThumbprints"); err != nil {
+		return c, err
+	}
+	for i, thumbprint := range c.thumbprints {
+		c.thumbprints[i] = normalizeThumbprint(thumbprint)
+	}
+	return c, nil
+}
+
+// clientCertificate returns the client certificate and its private key. They are loaded from the configured files
+// or generated and stored there if the files do not exist yet. Without files, a new certificate is generated in memory.
+func (c certificateConfig) clientCertificate(log *service.Logger) (*rsa.PrivateKey, []byte, error) {
+	return c.loadOrGenerate(generateClientCertificate, log)
+}
+
+// loadOrGenerate loads the certificate and private key from the configured files, or generates them with generate
+// and stores them there if the files do not exist yet. Without files, a new certificate is generated in memory.
+func (c certificateConfig) loadOrGenerate(generate func() ([]byte, []byte, error), log *service.Logger) (*rsa.PrivateKey, []byte, error) {
+	if c.certificateFile == "" {
+		certPEM, keyPEM, err := generate()
+		if err != nil {
+			return nil, nil, err
+		}
+		return parseClientCertificate(certPEM, keyPEM)
+	}
+
+	certPEM, certErr := os.ReadFile(c.certificateFile)
+	keyPEM, keyErr := os.ReadFile(c.privateKeyFile)
+	switch {
+	case certErr == nil && keyErr == nil:
+		log.Infof("Using certificate %s", c.certificateFile)
+		return parseClientCertificate(certPEM, keyPEM)
+	case errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist):
+		// generated below
+	case certErr != nil && !errors.Is(certErr, os.ErrNotExist):
+		return nil, nil, certErr
+	case keyErr != nil && !errors.Is(keyErr, os.ErrNotExist):
+		return nil, nil, keyErr
+	default:
+		return nil, nil, fmt.Errorf("only one of %s and %s exists", c.certificateFile, c.privateKeyFile)
+	}
+
+	certPEM, keyPEM, err := generate()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeFile(c.certificateFile, certPEM, 0o644); err != nil {
+		return nil, nil, err
+	}
+	if err := writeFile(c.privateKeyFile, keyPEM, 0o600); err != nil {
+		return nil, nil, err
+	}
+	log.Infof("Generated certificate %s", c.certificateFile)
+	return parseClientCertificate(certPEM, keyPEM)
+}
+
+func generateClientCertificate() (certPEM []byte, keyPEM []byte, err error) {
+	randomStr := randomString(8) // Generates an 8-character random string
+	clientName := "urn:benthos-umh:client-" + randomStr
+	certPEM, keyPEM, err = uatest.GenerateCert(clientName, 2048, 24*time.Hour*365*10)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate certificate: %w", err)
+	}
+	return certPEM, keyPEM, nil
+}
+
+func parseClientCertificate(certPEM []byte, keyPEM []byte) (*rsa.PrivateKey, []byte, error) {
+	// Convert PEM to X509 Certificate and RSA PrivateKey for in-memory use.
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	pk, ok := cert.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("invalid private key type")
+	}
+	return pk, cert.Certificate[0], nil
+}
+
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, perm)
+}
+
+// verifiesPeers reports whether a trust store is configured, so that the certificates of the peers are validated.
+func (c certificateConfig) verifiesPeers() bool {
+	return c.trustedCertsDir != "" || len(c.thumbprints) > 0
+}
+
+// verifyCertificate checks that the DER encoded certificate of a peer, the server or a client, is pinned by its
+// thumbprint or contained in the trusted certificates directory. Rejected certificates are stored in the rejected
+// certificates directory.
+func (c certificateConfig) verifyCertificate(peer string, der []byte, log *service.Logger) error {
+	if len(der) == 0 {
+		return fmt.Errorf("%s did not present a certificate", peer)
+	}
+
+	thumbprint := certificateThumbprint(der)
+	for _, pinned := range c.thumbprints {
+		if pinned == thumbprint {
+			return nil
+		}
+	}
+
+	if c.trustedCertsDir != "" {
+		trusted, err := certificateInDir(c.trustedCertsDir, der)
+		if err != nil {
+			return err
+		}
+		if trusted {
+			return nil
+		}
+	}
+
+	if c.rejectedCertsDir != "" {
+		path := filepath.Join(c.rejectedCertsDir, thumbprint+".der")
+		if err := writeFile(path, der, 0o644); err != nil {
+			log.Errorf("Failed to store rejected certificate: %v", err)
+		} else {
+			log.Infof("Stored rejected %s certificate in %s, move it to the trusted certificates to trust the %s", peer, path, peer)
+		}
+	}
+	return fmt.Errorf("%s certificate with thumbprint %s is not trusted", peer, thumbprint)
+}
+
+// certificateInDir reports whether the directory contains the DER encoded certificate, either DER or PEM encoded.
+func certificateInDir(dir string, der []byte) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(b, der) {
+			return true, nil
+		}
+		for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == "CERTIFICATE" && bytes.Equal(block.Bytes, der) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// certificateThumbprint returns the SHA1 thumbprint of a DER encoded certificate, as shown by OPC UA servers.
+func certificateThumbprint(der []byte) string {
+	sum := sha1.Sum(der)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// normalizeThumbprint allows thumbprints to be configured in lower case and separated by colons or spaces.
+func normalizeThumbprint(thumbprint string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "", " ", "").Replace(thumbprint))
+}
@@ -0,0 +1,104 @@
+package opcua_plugin
+
+import (
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCertificatePersisted(t *testing.T) {
+	dir := t.TempDir()
+	certs := certificateConfig{
+		certificateFile: filepath.Join(dir, "pki", "client.pem"),
+		privateKeyFile:  filepath.Join(dir, "pki", "client.key"),
+	}
+	log := service.MockResources().Logger()
+
+	key, cert, err := certs.clientCertificate(log)
+	require.NoError(t, err)
+	require.NotNil(t, key)
+
+	info, err := os.Stat(certs.privateKeyFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// the same certificate is used after a restart
+	reloadedKey, reloadedCert, err := certs.clientCertificate(log)
+	require.NoError(t, err)
+	assert.Equal(t, cert, reloadedCert)
+	assert.True(t, key.Equal(reloadedKey))
+
+	// without files, every connect uses a new certificate
+	_, inMemory, err := certificateConfig{}.clientCertificate(log)
+	require.NoError(t, err)
+	assert.NotEqual(t, cert, inMemory)
+
+	require.NoError(t, os.Remove(certs.privateKeyFile))
+	_, _, err = certs.clientCertificate(log)
+	assert.Error(t, err)
+}
+
+func TestVerifyCertificate(t *testing.T) {
+	log := service.MockResources().Logger()
+	_, server, err := certificateConfig{}.clientCertificate(log)
+	require.NoError(t, err)
+	_, other, err := certificateConfig{}.clientCertificate(log)
+	require.NoError(t, err)
+
+	thumbprint := certificateThumbprint(server)
+	assert.Len(t, thumbprint, 40)
+	assert.Equal(t, "AB12CD", normalizeThumbprint("ab:12:cd"))
+
+	pinned := certificateConfig{thumbprints: []string{thumbprint}}
+	assert.True(t, pinned.verifiesPeers())
+	assert.NoError(t, pinned.verifyCertificate("server", server, log))
+	assert.Error(t, pinned.verifyCertificate("server", other, log))
+	assert.Error(t, pinned.verifyCertificate("server", nil, log))
+
+	dir := t.TempDir()
+	trust := certificateConfig{
+		trustedCertsDir:  filepath.Join(dir, "trusted"),
+		rejectedCertsDir: filepath.Join(dir, "rejected"),
+	}
+	require.NoError(t, os.MkdirAll(trust.trustedCertsDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(trust.trustedCertsDir, "server.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server}), 0o644))
+
+	assert.NoError(t, trust.verifyCertificate("server", server, log))
+
+	// rejected certificates are stored, so that they can be moved to the trusted certificates
+	assert.Error(t, trust.verifyCertificate("server", other, log))
+	rejected := filepath.Join(trust.rejectedCertsDir, certificateThumbprint(other)+".der")
+	stored, err := os.ReadFile(rejected)
+	require.NoError(t, err)
+	assert.Equal(t, other, stored)
+
+	require.NoError(t, os.Rename(rejected, filepath.Join(trust.trustedCertsDir, "other.der")))
+	assert.NoError(t, trust.verifyCertificate("server", other, log))
+
+	assert.False(t, certificateConfig{}.verifiesPeers())
+}
+
+func TestParseCertificateConfig(t *testing.T) {
+	spec := service.NewConfigSpec().Fields(certificateFields()...)
+
+	conf, err := spec.ParseYAML(`
+clientCertificateFile: /data/client.pem
+clientPrivateKeyFile: /data/client.key
+serverCertificateThumbprints: ["ab:cd:ef"]
+`, nil)
+	require.NoError(t, err)
+	certs, err := parseCertificateConfig(conf)
+	require.NoError(t, err)
+	assert.Equal(t, "/data/client.pem", certs.certificateFile)
+	assert.Equal(t, []string{"ABCDEF"}, certs.thumbprints)
+
+	conf, err = spec.ParseYAML(`clientCertificateFile: /data/client.pem`, nil)
+	require.NoError(t, err)
+	_, err = parseCertificateConfig(conf)
+	assert.Error(t, err)
+}
@@ -0,0 +1,330 @@
+package opcua_plugin
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/errors"
+	"github.com/gopcua/opcua/ua"
+)
+
+// connectionFields are the config fields every OPC UA plugin needs to open a session, or to use the session of an
+// opcua_connection resource.
+func connectionFields() []*service.ConfigField {
+	return append([]*service.ConfigField{connectionField()}, endpointFields()...)
+}
+
+// endpointFields are the config fields to open a session with an OPC UA server.
+func endpointFields() []*service.ConfigField {
+	return append([]*service.ConfigField{
+		service.NewStringField("endpoint").Description("Address of the OPC-UA server to connect with. Required unless connection is set.").Default(""),
+		service.NewStringField("username").Description("Username for server access. If not set, no username is used.").Default(""),
+		service.NewStringField("password").Description("Password for server access. If not set, no password is used.").Default(""),
+		service.NewStringField("securityMode").Description("Security mode to use. If not set, a reasonable security mode will be set depending on the discovered endpoints.").Default(""),
+		service.NewStringField("securityPolicy").Description("The security policy to use.  If not set, a reasonable security policy will be set depending on the discovered endpoints.").Default(""),
+		service.NewBoolField("insecure").Description("Set to true to bypass secure connections, useful in case of SSL or certificate issues. Default is secure (false).").Default(false),
+	}, append(append(append(authenticationFields(), certificateFields()...), sessionFields()...), reverseConnectFields()...)...)
+}
+
+// connectionConfig holds the settings needed to open a session with an OPC UA server.
+type connectionConfig struct {
+	endpoint       string
+	username       string
+	password       string
+	securityMode   string
+	securityPolicy string
+	insecure       bool
+	authentication authenticationConfig
+	certificates   certificateConfig
+	session        *sessionConfig
+	reverse        *reverseConnectConfig
+	// shared is the opcua_connection resource whose session is used, if set
+	shared *connectionRef
+}
+
+// parseConnectionConfig parses the connectionFields. With an opcua_connection resource, the settings of the resource are returned.
+func parseConnectionConfig(conf *service.ParsedConfig, mgr *service.Resources) (connectionConfig, error) {
+	shared, err := parseSharedConnection(conf, mgr)
+	if err != nil {
+		return connectionConfig{}, err
+	}
+	if shared != nil {
+		return shared.config(), nil
+	}
+	return parseEndpointConfig(conf)
+}
+
+func parseEndpointConfig(conf *service.ParsedConfig) (connectionConfig, error) {
+	var c connectionConfig
+	var err error
+
+	if c.endpoint, err = conf.FieldString("endpoint"); err != nil {
+		return c, err
+	}
+	if c.username, err = conf.FieldString("username"); err != nil {
+		return c, err
+	}
+	if c.password, err = conf.FieldString("password"); err != nil {
+		return c, err
+	}
+	if c.securityMode, err = conf.FieldString("securityMode"); err != nil {
+		return c, err
+	}
+	if c.securityPolicy, err = conf.FieldString("securityPolicy"); err != nil {
+		return c, err
+	}
+	if c.insecure, err = conf.FieldBool("insecure"); err != nil {
+		return c, err
+	}
+	if c.authentication, err = parseAuthenticationConfig(conf); err != nil {
+		return c, err
+	}
+	if c.certificates, err = parseCertificateConfig(conf); err != nil {
+		return c, err
+	}
+	if c.session, err = parseSessionConfig(conf); err != nil {
+		return c, err
+	}
+	if c.reverse, err = parseReverseConnectConfig(conf); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// connect discovers the endpoints of the server, selects a reasonable one for the configured
+// authentication and security settings and opens a session.
+func (c connectionConfig) connect(ctx context.Context, log *service.Logger) (*opcua.Client, error) {
+	if c.shared != nil {
+		return c.shared.conn.acquire(ctx, c.shared)
+	}
+
+	// Step 0: With reverse connect, the server opens the connections, which the client reaches over a local endpoint.
+	endpoint := c.endpoint
+	if c.reverse != nil {
+		var err error
+		if endpoint, err = c.reverse.endpoint(log); err != nil {
+			log.Errorf("Failed to listen for reverse connections: %v", err)
+			return nil, err
+		}
+	}
+
+	// Step 1: Retrieve all available endpoints from the OPC UA server.
+	log.Infof("Endpoint URI: %s", c.endpoint)
+	endpoints, err := opcua.GetEndpoints(ctx, endpoint)
+	if err != nil {
+		log.Infof("GetEndpoints failed: %s", err)
+	}
+
+	// Step 2: Log details of each discovered endpoint for debugging.
+	logEndpoints(log, endpoints)
+
+	// Step 3: Determine the authentication method to use.
+	// Default to Anonymous if no credentials are provided.
+	selectedAuthentication := c.authentication.userTokenType(c.username, c.password)
+
+	// Step 3.1: Filter the endpoints based on the selected authentication method.
+	// This will eliminate endpoints that do not support the chosen method.
+	selectedEndpoint := getReasonableEndpoint(endpoints, selectedAuthentication, c.authentication.issuedTokenType, c.insecure, c.securityMode, c.securityPolicy)
+	if selectedEndpoint == nil {
+		log.Errorf("Could not select a suitable endpoint")
+		if err == nil {
+			err = errors.New("no suitable endpoint found")
+		}
+		return nil, err
+	}
+
+	if strings.HasPrefix(selectedEndpoint.EndpointURL, "opc.tcp://:") { // I omitted the port here, as it might change ?
+		selectedEndpoint.EndpointURL = endpoint
+	}
+	log.Infof("Selected endpoint: %v", selectedEndpoint)
+
+	// Step 3.2: Only connect to trusted servers, unless the connection is insecure anyway. Endpoints without security
+	// do not use the server certificate, so there is nothing to trust.
+	if !c.insecure && selectedEndpoint.SecurityMode != ua.MessageSecurityModeNone {
+		if err := c.certificates.verifyCertificate("server", selectedEndpoint.ServerCertificate, log); err != nil {
+			log.Errorf("Rejecting server: %v. Add its certificate to trustedCertsDir or serverCertificateThumbprints to trust it", err)
+			return nil, err
+		}
+	}
+
+	// Step 4: Initialize OPC UA client options
+	opts := make([]opcua.Option, 0)
+	// the identity token is created for the selected token policy, as servers may offer several issued token types
+	tokenEndpoint := *selectedEndpoint
+	tokenEndpoint.UserIdentityTokens = []*ua.UserTokenPolicy{userTokenPolicy(selectedEndpoint, selectedAuthentication, c.authentication.issuedTokenType)}
+	opts = append(opts, opcua.SecurityFromEndpoint(&tokenEndpoint, selectedAuthentication))
+	opts = append(opts, c.session.options()...)
+
+	// Set additional options based on the authentication method
+	switch selectedAuthentication {
+	case ua.UserTokenTypeAnonymous:
+		log.Infof("Using anonymous login")
+	case ua.UserTokenTypeUserName:
+		log.Infof("Using username/password login")
+		opts = append(opts, opcua.AuthUsername(c.username, c.password))
+	case ua.UserTokenTypeCertificate:
+		log.Infof("Using X.509 user certificate login")
+		pk, cert, err := c.authentication.userCertificateKeyPair()
+		if err != nil {
+			log.Errorf("Failed to load user certificate: %v", err)
+			return nil, err
+		}
+		opts = append(opts, opcua.AuthCertificate(cert), opcua.AuthPrivateKey(pk))
+	case ua.UserTokenTypeIssuedToken:
+		log.Infof("Using issued token login")
+		if selectedEndpoint.SecurityMode == ua.MessageSecurityModeNone {
+			log.Warnf("The issued token is sent unencrypted, as the selected endpoint has no security")
+		}
+		opts = append(opts, opcua.AuthIssuedToken([]byte(c.authentication.issuedToken)))
+	}
+
+	// Step 5: Load or generate the client certificate, because this is really a step that can not happen in the background...
+	if !c.insecure {
+		pk, cert, err := c.certificates.clientCertificate(log)
+		if err != nil {
+			log.Errorf("Failed to load client certificate: %v", err)
+			return nil, err
+		}
+
+		// Append the certificate and private key to the client options
+		opts = append(opts, opcua.PrivateKey(pk), opcua.Certificate(cert))
+	}
+
+	// Step 6: Create and connect the OPC UA client
+	// Note that we are not taking `selectedEndpoint.EndpointURL` here as the server can be misconfigured. We are taking instead the user input.
+	client, err := opcua.NewClient(endpoint, opts...)
+	if err != nil {
+		log.Errorf("Failed to create a new client")
+		return nil, err
+	}
+
+	// Connect to the selected endpoint
+	if err := client.Connect(ctx); err != nil {
+		log.Errorf("Failed to connect")
+		return nil, err
+	}
+
+	log.Infof("Connected to %s", c.endpoint)
+	return client, nil
+}
+
+// close closes a client that connect returned. The session of an opcua_connection resource stays open for its
+// other users.
+func (c connectionConfig) close(ctx context.Context, client *opcua.Client) {
+	if c.shared != nil {
+		c.shared.conn.release(ctx, c.shared)
+		return
+	}
+	if client != nil {
+		client.Close(ctx)
+	}
+}
+
+// lost closes a client whose session is lost. The session of an opcua_connection resource is closed for all its
+// users, so that the next connect opens a new one.
+func (c connectionConfig) lost(ctx context.Context, client *opcua.Client) {
+	if c.shared != nil {
+		c.shared.conn.lost(ctx, client)
+	}
+	c.close(ctx, client)
+}
+
+// subscribe creates a subscription, which is shared with the other users of an opcua_connection resource that
+// subscribe with the same parameters.
+func (c connectionConfig) subscribe(ctx context.Context, client *opcua.Client, params *opcua.SubscriptionParameters, notifyCh chan<- *opcua.PublishNotificationData) (monitor, error) {
+	if c.shared != nil {
+		return c.shared.conn.subscribe(ctx, c.shared, params, notifyCh)
+	}
+	sub, err := client.Subscribe(ctx, params, notifyCh)
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// isConnectionError reports whether a failed service call means that the session is gone
+// and the plugin has to reconnect.
+func isConnectionError(err error) bool {
+	switch err {
+	case ua.StatusBadSessionIDInvalid,
+		ua.StatusBadCommunicationError,
+		ua.StatusBadConnectionClosed,
+		ua.StatusBadTimeout,
+		ua.StatusBadConnectionRejected,
+		ua.StatusBadServerNotConnected:
+		return true
+	}
+	return false
+}
+
+func logEndpoints(log *service.Logger, endpoints []*ua.EndpointDescription) {
+	for i, endpoint := range endpoints {
+		log.Infof("Endpoint %d:", i+1)
+		log.Infof("  EndpointURL: %s", endpoint.EndpointURL)
+		log.Infof("  SecurityMode: %v", endpoint.SecurityMode)
+		log.Infof("  SecurityPolicyURI: %s", endpoint.SecurityPolicyURI)
+		log.Infof("  TransportProfileURI: %s", endpoint.TransportProfileURI)
+		log.Infof("  SecurityLevel: %d", endpoint.SecurityLevel)
+
+		// If Server is not nil, log its details
+		if endpoint.Server != nil {
+			log.Infof("  Server ApplicationURI: %s", endpoint.Server.ApplicationURI)
+			log.Infof("  Server ProductURI: %s", endpoint.Server.ProductURI)
+			log.Infof("  Server ApplicationName: %s", endpoint.Server.ApplicationName.Text)
+			log.Infof("  Server ApplicationType: %v", endpoint.Server.ApplicationType)
+			log.Infof("  Server GatewayServerURI: %s", endpoint.Server.GatewayServerURI)
+			log.Infof("  Server DiscoveryProfileURI: %s", endpoint.Server.DiscoveryProfileURI)
+			log.Infof("  Server DiscoveryURLs: %v", endpoint.Server.DiscoveryURLs)
+		}
+
+		// Output the certificate
+		if len(endpoint.ServerCertificate) > 0 {
+			// Convert to PEM format first, then log the certificate information
+			pemCert := pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: endpoint.ServerCertificate,
+			})
+			logServerCertificate(log, pemCert)
+		}
+
+		// Loop through UserIdentityTokens
+		for j, token := range endpoint.UserIdentityTokens {
+			log.Infof("  UserIdentityToken %d:", j+1)
+			log.Infof("    PolicyID: %s", token.PolicyID)
+			log.Infof("    TokenType: %v", token.TokenType)
+			log.Infof("    IssuedTokenType: %s", token.IssuedTokenType)
+			log.Infof("    IssuerEndpointURL: %s", token.IssuerEndpointURL)
+		}
+	}
+}
+
+func logServerCertificate(log *service.Logger, certBytes []byte) {
+	log.Infof("  Server certificate:")
+
+	// Decode the certificate from base64 to DER format
+	block, _ := pem.Decode(certBytes)
+	if block == nil {
+		log.Errorf("Failed to decode certificate")
+		return
+	}
+
+	// Parse the DER-format certificate
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.Errorf("Failed to parse certificate: %v", err)
+		return
+	}
+
+	// Log the details
+	log.Infof("    Not Before: %v", cert.NotBefore)
+	log.Infof("    Not After: %v", cert.NotAfter)
+	log.Infof("    DNS Names: %v", cert.DNSNames)
+	log.Infof("    IP Addresses: %v", cert.IPAddresses)
+	log.Infof("    URIs: %v", cert.URIs)
+	log.Infof("    Thumbprint: %s", certificateThumbprint(block.Bytes))
+}
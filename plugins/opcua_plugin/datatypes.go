@@ -0,0 +1,521 @@
+package opcua_plugin
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// rawStructure keeps the binary body of an ExtensionObject with a custom structure, which gopcua would otherwise
+// discard, so that it can be decoded with the DataTypeDefinition of its DataType.
+type rawStructure struct {
+	body []byte
+}
+
+func (r *rawStructure) Decode(b []byte) (int, error) {
+	r.body = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (r *rawStructure) Encode() ([]byte, error) {
+	return r.body, nil
+}
+
+// fieldType is how the values of a DataType are encoded: as a builtin type or as a structure.
+// Enumerations are encoded as Int32.
+type fieldType struct {
+	builtin   ua.TypeID
+	structure *ua.StructureDefinition
+}
+
+// dataTypeDecoder converts values into plain JSON values and decodes custom structures with the DataTypeDefinitions
+// of their DataTypes, which are loaded from the server on connect. A nil dataTypeDecoder knows no custom structures.
+type dataTypeDecoder struct {
+	// types are the loaded DataTypes, keyed by their node ID
+	types map[string]fieldType
+	// encodings maps the binary encodings of structures to their DataType
+	encodings map[string]string
+	log       *service.Logger
+}
+
+func newDataTypeDecoder(log *service.Logger) *dataTypeDecoder {
+	return &dataTypeDecoder{
+		types:     map[string]fieldType{},
+		encodings: map[string]string{},
+		log:       log,
+	}
+}
+
+// loadDataTypes loads the definitions of the custom DataTypes of the nodes. DataTypes that cannot be loaded, e.g. because
+// the server does not support DataTypeDefinitions, are logged and their values are passed on undecoded.
+func loadDataTypes(ctx context.Context, c *opcua.Client, dataTypes []string, log *service.Logger) *dataTypeDecoder {
+	d := newDataTypeDecoder(log)
+	for _, dataType := range dataTypes {
+		// dataTypeName returns node IDs only for DataTypes that have no Go type
+		if !strings.Contains(dataType, "=") {
+			continue
+		}
+		nodeID, err := ua.ParseNodeID(dataType)
+		if err != nil {
+			continue
+		}
+		if err := d.load(ctx, c, nodeID); err != nil {
+			log.Warnf("Values of DataType %s are not decoded: %v", dataType, err)
+		}
+	}
+	return d
+}
+
+// load loads how values of the DataType are encoded, including the DataTypes of the fields of structures.
+func (d *dataTypeDecoder) load(ctx context.Context, c *opcua.Client, dataType *ua.NodeID) error {
+	key := dataType.String()
+	if _, ok := d.types[key]; ok {
+		return nil
+	}
+	if builtin, ok := builtinType(dataType); ok {
+		d.types[key] = fieldType{builtin: builtin}
+		return nil
+	}
+
+	attrs, err := c.Node(dataType).Attributes(ctx, ua.AttributeIDDataTypeDefinition)
+	if err != nil {
+		return err
+	}
+
+	var definition interface{}
+	if attrs[0].Status == ua.StatusOK && attrs[0].Value != nil {
+		if eo, ok := attrs[0].Value.Value().(*ua.ExtensionObject); ok {
+			definition = eo.Value
+		}
+	}
+
+	switch def := definition.(type) {
+	case *ua.StructureDefinition:
+		switch def.StructureType {
+		case ua.StructureTypeStructure, ua.StructureTypeStructureWithOptionalFields, ua.StructureTypeUnion:
+		default:
+			return fmt.Errorf("structure type %s is not supported", def.StructureType)
+		}
+		// stored before the fields are loaded, as structures may contain themselves
+		d.types[key] = fieldType{structure: def}
+		encoding, err := binaryEncoding(ctx, c, dataType, def)
+		if err != nil {
+			delete(d.types, key)
+			return err
+		}
+		d.encodings[encoding.String()] = key
+		// gopcua discards the bodies of unknown ExtensionObjects, the builtin ones are decoded by gopcua itself
+		if encoding.Namespace() != 0 {
+			ua.RegisterExtensionObject(encoding, new(rawStructure))
+		}
+		for _, field := range def.Fields {
+			if err := d.load(ctx, c, field.DataType); err != nil {
+				delete(d.types, key)
+				return fmt.Errorf("field %s: %w", field.Name, err)
+			}
+		}
+		return nil
+
+	case *ua.EnumDefinition:
+		d.types[key] = fieldType{builtin: ua.TypeIDInt32}
+		return nil
+	}
+
+	// other DataTypes are encoded like the builtin type they are derived from, e.g. Duration like Double
+	supertypes, err := c.Node(dataType).ReferencedNodes(ctx, id.HasSubtype, ua.BrowseDirectionInverse, ua.NodeClassDataType, false)
+	if err != nil {
+		return err
+	}
+	if len(supertypes) == 0 {
+		return fmt.Errorf("DataType %s has neither a DataTypeDefinition nor a supertype", dataType)
+	}
+	if supertypes[0].ID.Namespace() == 0 && supertypes[0].ID.IntID() == id.Enumeration {
+		d.types[key] = fieldType{builtin: ua.TypeIDInt32}
+		return nil
+	}
+	if err := d.load(ctx, c, supertypes[0].ID); err != nil {
+		return err
+	}
+	d.types[key] = d.types[supertypes[0].ID.String()]
+	return nil
+}
+
+// builtinType returns the builtin type of the DataTypes that are builtin types, which have the same ids.
+func builtinType(dataType *ua.NodeID) (ua.TypeID, bool) {
+	if dataType.Namespace() != 0 || dataType.Type() != ua.NodeIDTypeTwoByte && dataType.Type() != ua.NodeIDTypeFourByte && dataType.Type() != ua.NodeIDTypeNumeric {
+		return 0, false
+	}
+	if dataType.IntID() < uint32(ua.TypeIDBoolean) || dataType.IntID() > uint32(ua.TypeIDDiagnosticInfo) {
+		return 0, false
+	}
+	return ua.TypeID(dataType.IntID()), true
+}
+
+// binaryEncoding returns the node ID of the binary encoding of a structure, which ExtensionObjects use as their TypeID.
+func binaryEncoding(ctx context.Context, c *opcua.Client, dataType *ua.NodeID, def *ua.StructureDefinition) (*ua.NodeID, error) {
+	if def.DefaultEncodingID != nil && !(def.DefaultEncodingID.Namespace() == 0 && def.DefaultEncodingID.IntID() == 0) {
+		return def.DefaultEncodingID, nil
+	}
+
+	refs, err := c.Node(dataType).References(ctx, id.HasEncoding, ua.BrowseDirectionForward, ua.NodeClassObject, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if ref.BrowseName != nil && ref.BrowseName.Name == "Default Binary" {
+			return ref.NodeID.NodeID, nil
+		}
+	}
+	return nil, fmt.Errorf("DataType %s has no binary encoding", dataType)
+}
+
+// jsonValue converts a value read from the server into a value that encodes to clean JSON: LocalizedTexts and QualifiedNames
+// become objects, GUIDs and node IDs strings, ByteStrings base64 strings, arrays of any dimension (nested) arrays and structures
+// objects with their field names.
+func (d *dataTypeDecoder) jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case bool, string, int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		return v
+	case float32:
+		return jsonFloat(float64(v))
+	case float64:
+		return jsonFloat(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		if v == nil {
+			return nil
+		}
+		return base64.StdEncoding.EncodeToString(v)
+	case ua.ByteArray:
+		values := make([]interface{}, len(v))
+		for i, b := range v {
+			values[i] = b
+		}
+		return values
+	case *ua.LocalizedText:
+		if v == nil {
+			return nil
+		}
+		return map[string]interface{}{"locale": v.Locale, "text": v.Text}
+	case *ua.QualifiedName:
+		if v == nil {
+			return nil
+		}
+		return map[string]interface{}{"namespaceIndex": v.NamespaceIndex, "name": v.Name}
+	case *ua.GUID:
+		if v == nil {
+			return nil
+		}
+		return v.String()
+	case *ua.NodeID:
+		if v == nil {
+			return nil
+		}
+		return v.String()
+	case *ua.ExpandedNodeID:
+		if v == nil || v.NodeID == nil {
+			return nil
+		}
+		if v.NamespaceURI != "" {
+			return fmt.Sprintf("nsu=%s;%s", v.NamespaceURI, strings.TrimPrefix(v.NodeID.String(), fmt.Sprintf("ns=%d;", v.NodeID.Namespace())))
+		}
+		return v.NodeID.String()
+	case ua.StatusCode:
+		return uint32(v)
+	case *ua.XMLElement:
+		if v == nil {
+			return nil
+		}
+		return string(*v)
+	case *ua.Variant:
+		if v == nil {
+			return nil
+		}
+		return d.jsonValue(v.Value())
+	case *ua.DataValue:
+		if v == nil || v.Value == nil {
+			return nil
+		}
+		return d.jsonValue(v.Value.Value())
+	case *ua.ExtensionObject:
+		return d.extensionObjectValue(v)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil
+		}
+		values := make([]interface{}, rv.Len())
+		for i := range values {
+			values[i] = d.jsonValue(rv.Index(i).Interface())
+		}
+		return values
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil
+		}
+		return d.jsonValue(rv.Elem().Interface())
+	case reflect.Struct:
+		// structures known to gopcua, e.g. Range or EUInformation
+		fields := map[string]interface{}{}
+		for i := 0; i < rv.NumField(); i++ {
+			if rv.Type().Field(i).IsExported() {
+				fields[rv.Type().Field(i).Name] = d.jsonValue(rv.Field(i).Interface())
+			}
+		}
+		return fields
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// enumerations
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint()
+	}
+	return fmt.Sprint(v)
+}
+
+// jsonFloat returns nil for NaN and infinity, which JSON cannot represent.
+func jsonFloat(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return f
+}
+
+func (d *dataTypeDecoder) extensionObjectValue(eo *ua.ExtensionObject) interface{} {
+	if eo == nil || eo.Value == nil {
+		return nil
+	}
+	raw, ok := eo.Value.(*rawStructure)
+	if !ok {
+		return d.jsonValue(eo.Value)
+	}
+
+	typeID := eo.TypeID.NodeID.String()
+	if d != nil {
+		if dataType, ok := d.encodings[typeID]; ok {
+			buf := ua.NewBuffer(raw.body)
+			value, err := d.decodeStructure(buf, d.types[dataType].structure)
+			if err == nil {
+				err = buf.Error()
+			}
+			if err == nil {
+				return value
+			}
+			d.log.Debugf("Failed to decode structure %s: %v", dataType, err)
+		}
+	}
+	// without the definition, the structure is passed on as it was received
+	return map[string]interface{}{"typeId": typeID, "body": base64.StdEncoding.EncodeToString(raw.body)}
+}
+
+// decodeStructure decodes the binary encoding of a structure into an object with its field names.
+func (d *dataTypeDecoder) decodeStructure(buf *ua.Buffer, def *ua.StructureDefinition) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+
+	switch def.StructureType {
+	case ua.StructureTypeUnion:
+		// the switch field selects the only field that is encoded, 0 means none
+		selected := buf.ReadUint32()
+		if selected == 0 {
+			return fields, buf.Error()
+		}
+		if int(selected) > len(def.Fields) {
+			return nil, fmt.Errorf("invalid union field %d", selected)
+		}
+		field := def.Fields[selected-1]
+		value, err := d.decodeField(buf, field)
+		if err != nil {
+			return nil, err
+		}
+		fields[field.Name] = value
+		return fields, buf.Error()
+
+	case ua.StructureTypeStructureWithOptionalFields:
+		// every optional field has a bit in the encoding mask, in the order of the fields
+		mask := buf.ReadUint32()
+		optional := 0
+		for _, field := range def.Fields {
+			if field.IsOptional {
+				present := mask&(1<<optional) != 0
+				optional++
+				if !present {
+					continue
+				}
+			}
+			value, err := d.decodeField(buf, field)
+			if err != nil {
+				return nil, err
+			}
+			fields[field.Name] = value
+		}
+		return fields, buf.Error()
+	}
+
+	for _, field := range def.Fields {
+		value, err := d.decodeField(buf, field)
+		if err != nil {
+			return nil, err
+		}
+		fields[field.Name] = value
+	}
+	return fields, buf.Error()
+}
+
+// decodeField decodes a field of a structure, which is either a scalar or an array of any dimension.
+func (d *dataTypeDecoder) decodeField(buf *ua.Buffer, field *ua.StructureField) (interface{}, error) {
+	typ, ok := d.types[field.DataType.String()]
+	if !ok {
+		return nil, fmt.Errorf("field %s has the unknown DataType %s", field.Name, field.DataType)
+	}
+	if field.ValueRank < 1 {
+		return d.decodeValue(buf, typ)
+	}
+
+	// multi-dimensional arrays are encoded with their dimensions first, followed by all values
+	dims := []int32{-1}
+	if field.ValueRank > 1 {
+		n := buf.ReadInt32()
+		if n < 0 || int(n) > buf.Len() {
+			return nil, fmt.Errorf("field %s has invalid array dimensions", field.Name)
+		}
+		dims = make([]int32, n)
+		for i := range dims {
+			dims[i] = buf.ReadInt32()
+		}
+	}
+
+	n := buf.ReadInt32()
+	if n < 0 {
+		return nil, buf.Error()
+	}
+	if int(n) > buf.Len() {
+		return nil, fmt.Errorf("field %s has an invalid array length %d", field.Name, n)
+	}
+	values := make([]interface{}, n)
+	for i := range values {
+		value, err := d.decodeValue(buf, typ)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	if len(dims) < 2 {
+		return values, buf.Error()
+	}
+	return reshape(values, dims)
+}
+
+// reshape nests the flattened values of a multi-dimensional array, the last dimension varying fastest.
+func reshape(values []interface{}, dims []int32) (interface{}, error) {
+	count := 1
+	for _, dim := range dims {
+		if dim < 0 {
+			return nil, fmt.Errorf("invalid array dimension %d", dim)
+		}
+		count *= int(dim)
+	}
+	if count != len(values) {
+		return nil, fmt.Errorf("%d values do not match the array dimensions %v", len(values), dims)
+	}
+	if len(dims) == 1 {
+		return values, nil
+	}
+
+	nested := make([]interface{}, dims[0])
+	step := 0
+	if dims[0] > 0 {
+		step = len(values) / int(dims[0])
+	}
+	for i := range nested {
+		inner, err := reshape(values[i*step:(i+1)*step], dims[1:])
+		if err != nil {
+			return nil, err
+		}
+		nested[i] = inner
+	}
+	return nested, nil
+}
+
+// decodeValue decodes a single value of a field.
+func (d *dataTypeDecoder) decodeValue(buf *ua.Buffer, typ fieldType) (interface{}, error) {
+	if typ.structure != nil {
+		return d.decodeStructure(buf, typ.structure)
+	}
+
+	var v interface{}
+	switch typ.builtin {
+	case ua.TypeIDBoolean:
+		v = buf.ReadBool()
+	case ua.TypeIDSByte:
+		v = buf.ReadInt8()
+	case ua.TypeIDByte:
+		v = buf.ReadByte()
+	case ua.TypeIDInt16:
+		v = buf.ReadInt16()
+	case ua.TypeIDUint16:
+		v = buf.ReadUint16()
+	case ua.TypeIDInt32:
+		v = buf.ReadInt32()
+	case ua.TypeIDUint32:
+		v = buf.ReadUint32()
+	case ua.TypeIDInt64:
+		v = buf.ReadInt64()
+	case ua.TypeIDUint64:
+		v = buf.ReadUint64()
+	case ua.TypeIDFloat:
+		v = buf.ReadFloat32()
+	case ua.TypeIDDouble:
+		v = buf.ReadFloat64()
+	case ua.TypeIDString:
+		v = buf.ReadString()
+	case ua.TypeIDDateTime:
+		v = buf.ReadTime()
+	case ua.TypeIDGUID:
+		v = readStruct(buf, new(ua.GUID))
+	case ua.TypeIDByteString:
+		v = buf.ReadBytes()
+	case ua.TypeIDXMLElement:
+		v = buf.ReadString()
+	case ua.TypeIDNodeID:
+		v = readStruct(buf, new(ua.NodeID))
+	case ua.TypeIDExpandedNodeID:
+		v = readStruct(buf, new(ua.ExpandedNodeID))
+	case ua.TypeIDStatusCode:
+		v = ua.StatusCode(buf.ReadUint32())
+	case ua.TypeIDQualifiedName:
+		v = readStruct(buf, new(ua.QualifiedName))
+	case ua.TypeIDLocalizedText:
+		v = readStruct(buf, new(ua.LocalizedText))
+	case ua.TypeIDExtensionObject:
+		v = readStruct(buf, new(ua.ExtensionObject))
+	case ua.TypeIDDataValue:
+		v = readStruct(buf, new(ua.DataValue))
+	case ua.TypeIDVariant:
+		v = readStruct(buf, new(ua.Variant))
+	case ua.TypeIDDiagnosticInfo:
+		v = readStruct(buf, new(ua.DiagnosticInfo))
+	default:
+		return nil, fmt.Errorf("unsupported builtin type %d", typ.builtin)
+	}
+	return d.jsonValue(v), buf.Error()
+}
+
+func readStruct(buf *ua.Buffer, v interface{}) interface{} {
+	buf.ReadStruct(v)
+	return v
+}
@@ -0,0 +1,145 @@
+package opcua_plugin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func jsonString(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestJSONValue(t *testing.T) {
+	var d *dataTypeDecoder
+	guid := ua.NewGUID("72962B91-FA75-4AE6-8D28-B404DC7DAF63")
+
+	for _, tc := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{int64(math.MaxInt64), `9223372036854775807`},
+		{uint64(math.MaxUint64), `18446744073709551615`},
+		{[]byte{0xde, 0xad, 0xbe, 0xef}, `"3q2+7w=="`},
+		{ua.ByteArray{1, 2}, `[1,2]`},
+		{&ua.LocalizedText{Locale: "en", Text: "Running"}, `{"locale":"en","text":"Running"}`},
+		{&ua.QualifiedName{NamespaceIndex: 2, Name: "Press"}, `{"name":"Press","namespaceIndex":2}`},
+		{guid, `"72962B91-FA75-4AE6-8D28-B404DC7DAF63"`},
+		{ua.NewStringNodeID(2, "Line1"), `"ns=2;s=Line1"`},
+		{time.Date(2024, 4, 6, 12, 0, 0, 500000000, time.UTC), `"2024-04-06T12:00:00.5Z"`},
+		{math.NaN(), `null`},
+		{[][]int32{{1, 2, 3}, {4, 5, 6}}, `[[1,2,3],[4,5,6]]`},
+		{[]*ua.LocalizedText{{Text: "a"}, nil}, `[{"locale":"","text":"a"},null]`},
+		{ua.NewExtensionObject(&ua.Range{Low: 0, High: 100}), `{"High":100,"Low":0}`},
+		{ua.StatusBadNodeIDUnknown, `2150891520`},
+	} {
+		assert.Equal(t, tc.expected, jsonString(t, d.jsonValue(tc.value)), "%T", tc.value)
+	}
+}
+
+func TestDecodeStructure(t *testing.T) {
+	encoding := ua.NewNumericNodeID(2, 5001)
+	ua.RegisterExtensionObject(encoding, new(rawStructure))
+
+	d := newDataTypeDecoder(service.MockResources().Logger())
+	d.types["i=12"] = fieldType{builtin: ua.TypeIDString}
+	d.types["i=11"] = fieldType{builtin: ua.TypeIDDouble}
+	d.types["i=6"] = fieldType{builtin: ua.TypeIDInt32}
+	d.types["i=21"] = fieldType{builtin: ua.TypeIDLocalizedText}
+	d.types["ns=2;i=3001"] = fieldType{structure: &ua.StructureDefinition{
+		StructureType: ua.StructureTypeStructureWithOptionalFields,
+		Fields: []*ua.StructureField{
+			{Name: "Name", DataType: ua.NewNumericNodeID(0, 12), ValueRank: -1},
+			{Name: "Temperature", DataType: ua.NewNumericNodeID(0, 11), ValueRank: -1},
+			{Name: "Counts", DataType: ua.NewNumericNodeID(0, 6), ValueRank: 2},
+			{Name: "Comment", DataType: ua.NewNumericNodeID(0, 21), ValueRank: -1, IsOptional: true},
+			{Name: "Setpoint", DataType: ua.NewNumericNodeID(0, 11), ValueRank: -1, IsOptional: true},
+		},
+	}}
+	d.encodings[encoding.String()] = "ns=2;i=3001"
+
+	body := ua.NewBuffer(nil)
+	body.WriteUint32(0b10) // only Setpoint is set
+	body.WriteString("Press 1")
+	body.WriteFloat64(21.5)
+	body.WriteInt32(2) // dimensions
+	body.WriteInt32(2)
+	body.WriteInt32(3)
+	body.WriteInt32(6) // values
+	for i := int32(1); i <= 6; i++ {
+		body.WriteInt32(i)
+	}
+	body.WriteFloat64(22)
+	require.NoError(t, body.Error())
+
+	// the body survives the encoding of the ExtensionObject
+	b, err := ua.NewExtensionObject(&rawStructure{body: body.Bytes()}).Encode()
+	require.NoError(t, err)
+	eo := new(ua.ExtensionObject)
+	_, err = eo.Decode(b)
+	require.NoError(t, err)
+
+	assert.Equal(t, `{"Counts":[[1,2,3],[4,5,6]],"Name":"Press 1","Setpoint":22,"Temperature":21.5}`, jsonString(t, d.jsonValue(eo)))
+
+	// without the definition, the structure is passed on as received
+	var unknown *dataTypeDecoder
+	assert.Equal(t, map[string]interface{}{"typeId": "ns=2;i=5001", "body": base64.StdEncoding.EncodeToString(body.Bytes())}, unknown.jsonValue(eo))
+
+	// a truncated body is not decoded either
+	eo.Value = &rawStructure{body: body.Bytes()[:10]}
+	assert.Contains(t, d.jsonValue(eo), "body")
+}
+
+func TestDecodeUnion(t *testing.T) {
+	d := newDataTypeDecoder(service.MockResources().Logger())
+	d.types["i=6"] = fieldType{builtin: ua.TypeIDInt32}
+	d.types["i=12"] = fieldType{builtin: ua.TypeIDString}
+	def := &ua.StructureDefinition{
+		StructureType: ua.StructureTypeUnion,
+		Fields: []*ua.StructureField{
+			{Name: "Code", DataType: ua.NewNumericNodeID(0, 6), ValueRank: -1},
+			{Name: "Text", DataType: ua.NewNumericNodeID(0, 12), ValueRank: -1},
+		},
+	}
+
+	body := ua.NewBuffer(nil)
+	body.WriteUint32(2)
+	body.WriteString("stopped")
+	value, err := d.decodeStructure(ua.NewBuffer(body.Bytes()), def)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"Text": "stopped"}, value)
+
+	body = ua.NewBuffer(nil)
+	body.WriteUint32(3)
+	_, err = d.decodeStructure(ua.NewBuffer(body.Bytes()), def)
+	assert.Error(t, err)
+}
+
+func TestCreateMessageFromTypedValue(t *testing.T) {
+	g := &OPCUAInput{
+		log:              service.MockResources().Logger(),
+		nodeGroupMapping: map[string]string{"ns=2;s=State": "D001,,,,State"},
+	}
+
+	msg := g.createMessageFromValue(&ua.DataValue{Value: ua.MustVariant(&ua.LocalizedText{Locale: "en", Text: "Running"})}, NodeDef{}, "ns=2;s=State", nil)
+	require.NotNil(t, msg)
+	b, err := msg.AsBytes()
+	require.NoError(t, err)
+	assert.Equal(t, `{"locale":"en","text":"Running"}`, string(b))
+
+	// scalars stay plain values
+	msg = g.createMessageFromValue(&ua.DataValue{Value: ua.MustVariant(int64(-42))}, NodeDef{}, "ns=2;s=State", nil)
+	b, err = msg.AsBytes()
+	require.NoError(t, err)
+	assert.Equal(t, `-42`, string(b))
+}
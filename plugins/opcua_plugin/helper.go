@@ -30,6 +30,10 @@ func ParseNodeIDs(incomingNodes []string) []*ua.NodeID {
 	parsedNodeIDs := make([]*ua.NodeID, len(incomingNodes))
 
 	for _, id := range incomingNodes {
+		// resolved on connect
+		if needsResolving(id) {
+			continue
+		}
 		parsedNodeID, err := ua.ParseNodeID(id)
 		if err != nil {
 			return nil
@@ -60,6 +64,10 @@ func ParseTriggerNodeIDs(incomingTNodes []string) []*ua.NodeID {
 				//fmt.Println(obj)
 
 				nodeID := obj["node"]
+				// resolved on connect
+				if needsResolving(nodeID) {
+					continue
+				}
 				parsedTNodeID, err := ua.ParseNodeID(nodeID)
 				if err != nil {
 					return nil
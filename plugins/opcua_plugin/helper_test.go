@@ -0,0 +1,44 @@
+package opcua_plugin
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/stretchr/testify/require"
+)
+
+// testConfig parses the yaml with the fields.
+func testConfig(t *testing.T, fields []*service.ConfigField, yaml string) *service.ParsedConfig {
+	t.Helper()
+	conf, err := service.NewConfigSpec().Fields(fields...).ParseYAML(yaml, nil)
+	require.NoError(t, err)
+	return conf
+}
+
+// newTestInput connects an opcua input to the server of a test server output.
+func newTestInput(t *testing.T, ctx context.Context, out *OPCUAServerOutput, yaml string) service.BatchInput {
+	t.Helper()
+	conf, err := OPCUAConfigSpec.ParseYAML(fmt.Sprintf(`
+endpoint: opc.tcp://%s
+securityMode: None
+securityPolicy: None
+%s`, out.server.listener.Addr(), yaml), nil)
+	require.NoError(t, err)
+	in, err := newOPCUAInput(conf, service.MockResources())
+	require.NoError(t, err)
+	require.NoError(t, in.Connect(ctx))
+	return in
+}
+
+// writeTestValues writes values to the variables of a group of a test server output.
+func writeTestValues(t *testing.T, ctx context.Context, out *OPCUAServerOutput, group string, values map[string]string) {
+	t.Helper()
+	for name, value := range values {
+		msg := service.NewMessage([]byte(value))
+		msg.MetaSet("group", group)
+		msg.MetaSet("name", name)
+		require.NoError(t, out.Write(ctx, msg))
+	}
+}
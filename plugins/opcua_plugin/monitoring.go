@@ -0,0 +1,293 @@
+package opcua_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// dataChangeTriggers are the values of the dataChangeTrigger setting.
+var dataChangeTriggers = map[string]ua.DataChangeTrigger{
+	"Status":               ua.DataChangeTriggerStatus,
+	"StatusValue":          ua.DataChangeTriggerStatusValue,
+	"StatusValueTimestamp": ua.DataChangeTriggerStatusValueTimestamp,
+}
+
+// deadbandTypes are the values of the deadbandType setting.
+var deadbandTypes = map[string]ua.DeadbandType{
+	"None":     ua.DeadbandTypeNone,
+	"Absolute": ua.DeadbandTypeAbsolute,
+	"Percent":  ua.DeadbandTypePercent,
+}
+
+// subscriptionFields are the config fields that tune subscriptions. All but the publishingInterval
+// can be overridden per node entry, e.g. {"node": "ns=2;s=Pressure", "samplingInterval": "500", "deadbandType": "Absolute", "deadbandValue": "0.5"}.
+func subscriptionFields() []*service.ConfigField {
+	return []*service.ConfigField{
+		service.NewIntField("publishingInterval").Description("Interval in milliseconds in which the server sends the changes of subscribed nodes.").Default(100),
+		service.NewFloatField("samplingInterval").Description("Interval in milliseconds in which the server samples subscribed nodes. 0 samples as fast as the server can, -1 uses the publishingInterval.").Default(0),
+		service.NewIntField("queueSize").Description("Number of changes of a node the server queues between two publishes.").Default(10),
+		service.NewBoolField("discardOldest").Description("Set to false to discard the newest instead of the oldest changes when the queue of a node is full.").Default(true),
+		service.NewStringEnumField("dataChangeTrigger", "Status", "StatusValue", "StatusValueTimestamp").Description("Which changes of a node are reported.").Default("StatusValue"),
+		service.NewStringEnumField("deadbandType", "None", "Absolute", "Percent").Description("Only report value changes exceeding the deadbandValue, either absolute or in percent of the EURange of the node.").Default("None"),
+		service.NewFloatField("deadbandValue").Description("The deadband of value changes.").Default(0),
+	}
+}
+
+// monitoringConfig are the monitoring parameters of a subscribed node.
+type monitoringConfig struct {
+	samplingInterval float64
+	queueSize        uint32
+	discardOldest    bool
+	trigger          ua.DataChangeTrigger
+	deadbandType     ua.DeadbandType
+	deadbandValue    float64
+}
+
+// defaultMonitoringConfig matches opcua.NewMonitoredItemCreateRequestWithDefaults.
+func defaultMonitoringConfig() monitoringConfig {
+	return monitoringConfig{
+		queueSize:     10,
+		discardOldest: true,
+		trigger:       ua.DataChangeTriggerStatusValue,
+		deadbandType:  ua.DeadbandTypeNone,
+	}
+}
+
+// subscriptionConfig holds the parameters of the subscription and of its monitored items.
+// A nil subscriptionConfig uses the defaults of gopcua.
+type subscriptionConfig struct {
+	publishingInterval time.Duration
+	defaults           monitoringConfig
+	// nodes are the monitoring parameters of node entries that override the defaults, keyed by node ID
+	nodes map[string]monitoringConfig
+}
+
+// parseSubscriptionConfig parses the subscription fields and the overrides of the node entries.
+func parseSubscriptionConfig(conf *service.ParsedConfig, nodeEntries []string) (*subscriptionConfig, error) {
+	publishingInterval, err := conf.FieldInt("publishingInterval")
+	if err != nil {
+		return nil, err
+	}
+	if publishingInterval <= 0 {
+		return nil, fmt.Errorf("publishingInterval must be positive, got %d", publishingInterval)
+	}
+
+	defaults := defaultMonitoringConfig()
+	if defaults.samplingInterval, err = conf.FieldFloat("samplingInterval"); err != nil {
+		return nil, err
+	}
+	queueSize, err := conf.FieldInt("queueSize")
+	if err != nil {
+		return nil, err
+	}
+	if queueSize < 0 {
+		return nil, fmt.Errorf("queueSize must not be negative, got %d", queueSize)
+	}
+	defaults.queueSize = uint32(queueSize)
+	if defaults.discardOldest, err = conf.FieldBool("discardOldest"); err != nil {
+		return nil, err
+	}
+	trigger, err := conf.FieldString("dataChangeTrigger")
+	if err != nil {
+		return nil, err
+	}
+	deadbandType, err := conf.FieldString("deadbandType")
+	if err != nil {
+		return nil, err
+	}
+	if defaults.deadbandValue, err = conf.FieldFloat("deadbandValue"); err != nil {
+		return nil, err
+	}
+	if defaults, err = defaults.override(map[string]string{"dataChangeTrigger": trigger, "deadbandType": deadbandType}); err != nil {
+		return nil, err
+	}
+
+	s := &subscriptionConfig{
+		publishingInterval: time.Duration(publishingInterval) * time.Millisecond,
+		defaults:           defaults,
+	}
+	if err := s.setNodes(nodeEntries); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// setNodes replaces the overrides by those of the node entries. Nodes that need resolving are
+// validated, but only stored once setNodes is called again with the resolved node entries.
+func (s *subscriptionConfig) setNodes(nodeEntries []string) error {
+	if s == nil {
+		return nil
+	}
+
+	nodes := map[string]monitoringConfig{}
+	for _, nodeElements := range nodeEntries {
+		var nodeObj map[string][]map[string]string
+		if err := json.Unmarshal([]byte(nodeElements), &nodeObj); err != nil {
+			return err
+		}
+
+		for _, values := range nodeObj {
+			for _, obj := range values {
+				monitoring, err := s.defaults.override(obj)
+				if err != nil {
+					return fmt.Errorf("node %s: %w", obj["node"], err)
+				}
+				if needsResolving(obj["node"]) {
+					continue
+				}
+				nodeID, err := ua.ParseNodeID(obj["node"])
+				if err != nil {
+					return fmt.Errorf("invalid node %q: %w", obj["node"], err)
+				}
+				if monitoring != s.defaults {
+					nodes[nodeID.String()] = monitoring
+				}
+			}
+		}
+	}
+	s.nodes = nodes
+	return nil
+}
+
+// override returns the monitoring parameters with the settings of a node entry applied.
+func (m monitoringConfig) override(obj map[string]string) (monitoringConfig, error) {
+	if s, ok := obj["samplingInterval"]; ok {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return m, fmt.Errorf("invalid samplingInterval %q", s)
+		}
+		m.samplingInterval = v
+	}
+	if s, ok := obj["queueSize"]; ok {
+		v, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return m, fmt.Errorf("invalid queueSize %q", s)
+		}
+		m.queueSize = uint32(v)
+	}
+	if s, ok := obj["discardOldest"]; ok {
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return m, fmt.Errorf("invalid discardOldest %q", s)
+		}
+		m.discardOldest = v
+	}
+	if s, ok := obj["dataChangeTrigger"]; ok {
+		v, ok := dataChangeTriggers[s]
+		if !ok {
+			return m, fmt.Errorf("invalid dataChangeTrigger %q", s)
+		}
+		m.trigger = v
+	}
+	if s, ok := obj["deadbandType"]; ok {
+		v, ok := deadbandTypes[s]
+		if !ok {
+			return m, fmt.Errorf("invalid deadbandType %q", s)
+		}
+		m.deadbandType = v
+	}
+	if s, ok := obj["deadbandValue"]; ok {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return m, fmt.Errorf("invalid deadbandValue %q", s)
+		}
+		m.deadbandValue = v
+	}
+	if m.deadbandType == ua.DeadbandTypePercent && (m.deadbandValue < 0 || m.deadbandValue > 100) {
+		return m, fmt.Errorf("percent deadbandValue must be between 0 and 100, got %v", m.deadbandValue)
+	}
+	return m, nil
+}
+
+// parameters returns the parameters of the subscription.
+func (s *subscriptionConfig) parameters() *opcua.SubscriptionParameters {
+	if s == nil {
+		return &opcua.SubscriptionParameters{Interval: opcua.DefaultSubscriptionInterval}
+	}
+	return &opcua.SubscriptionParameters{Interval: s.publishingInterval}
+}
+
+// inherit applies the monitoring parameters of a configured node to a node found by browsing it, e.g. the variables of a folder.
+func (s *subscriptionConfig) inherit(root *ua.NodeID, node *ua.NodeID) {
+	if s == nil || root == nil || node == nil {
+		return
+	}
+	monitoring, ok := s.nodes[root.String()]
+	if !ok {
+		return
+	}
+	if _, ok := s.nodes[node.String()]; !ok {
+		s.nodes[node.String()] = monitoring
+	}
+}
+
+// monitoredItem creates the request to monitor the value of a node.
+func (s *subscriptionConfig) monitoredItem(nodeID *ua.NodeID, clientHandle uint32) *ua.MonitoredItemCreateRequest {
+	req := opcua.NewMonitoredItemCreateRequestWithDefaults(nodeID, ua.AttributeIDValue, clientHandle)
+	if s == nil {
+		return req
+	}
+
+	monitoring, ok := s.nodes[nodeID.String()]
+	if !ok {
+		monitoring = s.defaults
+	}
+
+	params := req.RequestedParameters
+	params.SamplingInterval = monitoring.samplingInterval
+	params.QueueSize = monitoring.queueSize
+	params.DiscardOldest = monitoring.discardOldest
+	// only send a filter if it differs from the default, as some servers reject filters e.g. on strings
+	if monitoring.trigger != ua.DataChangeTriggerStatusValue || monitoring.deadbandType != ua.DeadbandTypeNone {
+		params.Filter = ua.NewExtensionObject(&ua.DataChangeFilter{
+			Trigger:       monitoring.trigger,
+			DeadbandType:  uint32(monitoring.deadbandType),
+			DeadbandValue: monitoring.deadbandValue,
+		})
+	}
+	return req
+}
+
+// changed reports whether a polled value of a node changed since the last poll the way its dataChangeTrigger
+// would report it in a subscription. Deadbands are applied by the server and therefore only work when subscribing.
+func (s *subscriptionConfig) changed(nodeID *ua.NodeID, last *ua.DataValue, current *ua.DataValue) bool {
+	if last == nil {
+		return true
+	}
+
+	trigger := ua.DataChangeTriggerStatusValue
+	if s != nil {
+		monitoring, ok := s.nodes[nodeID.String()]
+		if !ok {
+			monitoring = s.defaults
+		}
+		trigger = monitoring.trigger
+	}
+
+	if last.Status != current.Status {
+		return true
+	}
+	if trigger == ua.DataChangeTriggerStatus {
+		return false
+	}
+	if !reflect.DeepEqual(variantValue(last.Value), variantValue(current.Value)) {
+		return true
+	}
+	return trigger == ua.DataChangeTriggerStatusValueTimestamp && !last.SourceTimestamp.Equal(current.SourceTimestamp)
+}
+
+// variantValue returns the value of a variant, which may be nil.
+func variantValue(v *ua.Variant) interface{} {
+	if v == nil {
+		return nil
+	}
+	return v.Value()
+}
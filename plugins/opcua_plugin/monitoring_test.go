@@ -0,0 +1,162 @@
+package opcua_plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscriptionDefaults(t *testing.T) {
+	pressure := ua.NewStringNodeID(2, "Pressure")
+	s, err := parseSubscriptionConfig(testConfig(t, subscriptionFields(), ``), []string{`{"1": [{"node": "ns=2;s=Pressure", "group": "D001"}]}`})
+	require.NoError(t, err)
+	assert.Equal(t, opcua.DefaultSubscriptionInterval, s.parameters().Interval)
+
+	// the defaults match the requests used before the settings existed
+	assert.Equal(t, opcua.NewMonitoredItemCreateRequestWithDefaults(pressure, ua.AttributeIDValue, 3), s.monitoredItem(pressure, 3))
+
+	var unset *subscriptionConfig
+	assert.Equal(t, opcua.DefaultSubscriptionInterval, unset.parameters().Interval)
+	assert.Equal(t, opcua.NewMonitoredItemCreateRequestWithDefaults(pressure, ua.AttributeIDValue, 3), unset.monitoredItem(pressure, 3))
+}
+
+func TestMonitoredItemsPerNode(t *testing.T) {
+	conf := testConfig(t, subscriptionFields(), `
+publishingInterval: 500
+samplingInterval: 250
+queueSize: 5
+deadbandType: Absolute
+deadbandValue: 0.5
+`)
+	s, err := parseSubscriptionConfig(conf, []string{
+		`{"1": [{"node": "ns=2;s=Pressure", "group": "D001"}]}`,
+		`{"2": [{"node": "ns=2;s=Counters", "samplingInterval": "1000", "queueSize": "100", "discardOldest": "false", "dataChangeTrigger": "StatusValueTimestamp", "deadbandType": "None"}]}`,
+		`{"3": [{"node": "ns=2;s=Temperature", "deadbandType": "Percent", "deadbandValue": "2"}]}`,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, s.parameters().Interval)
+
+	params := s.monitoredItem(ua.NewStringNodeID(2, "Pressure"), 0).RequestedParameters
+	assert.Equal(t, 250.0, params.SamplingInterval)
+	assert.Equal(t, uint32(5), params.QueueSize)
+	assert.True(t, params.DiscardOldest)
+	require.NotNil(t, params.Filter)
+	assert.Equal(t, &ua.DataChangeFilter{Trigger: ua.DataChangeTriggerStatusValue, DeadbandType: uint32(ua.DeadbandTypeAbsolute), DeadbandValue: 0.5}, params.Filter.Value)
+
+	params = s.monitoredItem(ua.NewStringNodeID(2, "Counters"), 1).RequestedParameters
+	assert.Equal(t, 1000.0, params.SamplingInterval)
+	assert.Equal(t, uint32(100), params.QueueSize)
+	assert.False(t, params.DiscardOldest)
+	assert.Equal(t, &ua.DataChangeFilter{Trigger: ua.DataChangeTriggerStatusValueTimestamp, DeadbandType: uint32(ua.DeadbandTypeNone), DeadbandValue: 0.5}, params.Filter.Value)
+
+	// variables of a browsed folder are monitored like the folder
+	s.inherit(ua.NewStringNodeID(2, "Counters"), ua.NewStringNodeID(2, "Counters.Good"))
+	s.inherit(ua.NewStringNodeID(2, "Counters"), ua.NewStringNodeID(2, "Temperature"))
+	assert.Equal(t, uint32(100), s.monitoredItem(ua.NewStringNodeID(2, "Counters.Good"), 2).RequestedParameters.QueueSize)
+	// but not if they are configured themselves
+	params = s.monitoredItem(ua.NewStringNodeID(2, "Temperature"), 3).RequestedParameters
+	assert.Equal(t, &ua.DataChangeFilter{Trigger: ua.DataChangeTriggerStatusValue, DeadbandType: uint32(ua.DeadbandTypePercent), DeadbandValue: 2}, params.Filter.Value)
+
+	// the filter has to be encodable to be sent to the server
+	_, err = ua.Encode(params.Filter)
+	assert.NoError(t, err)
+}
+
+func TestParseSubscriptionConfigInvalid(t *testing.T) {
+	for _, yaml := range []string{
+		`publishingInterval: 0`,
+		`queueSize: -1`,
+		`{deadbandType: Percent, deadbandValue: 150}`,
+	} {
+		_, err := parseSubscriptionConfig(testConfig(t, subscriptionFields(), yaml), nil)
+		assert.Error(t, err, yaml)
+	}
+
+	for _, entry := range []string{
+		`{"1": [{"node": "ns=2;s=Pressure", "queueSize": "many"}]}`,
+		`{"1": [{"node": "ns=2;s=Pressure", "deadbandType": "Relative"}]}`,
+		`{"1": [{"node": "ns=2;s=Pressure", "dataChangeTrigger": "Value"}]}`,
+	} {
+		_, err := parseSubscriptionConfig(testConfig(t, subscriptionFields(), ``), []string{entry})
+		assert.Error(t, err, entry)
+	}
+}
+
+func TestPolledDataChange(t *testing.T) {
+	s, err := parseSubscriptionConfig(testConfig(t, subscriptionFields(), ``), []string{`{"1": [{"node": "ns=2;s=Trigger", "group": "D001"}, {"node": "ns=2;s=Counter", "group": "D001", "dataChangeTrigger": "StatusValueTimestamp"}]}`})
+	require.NoError(t, err)
+	trigger := ua.NewStringNodeID(2, "Trigger")
+	counter := ua.NewStringNodeID(2, "Counter")
+
+	now := time.Now()
+	last := &ua.DataValue{Value: ua.MustVariant(int32(1)), Status: ua.StatusOK, SourceTimestamp: now}
+	sameValue := &ua.DataValue{Value: ua.MustVariant(int32(1)), Status: ua.StatusOK, SourceTimestamp: now.Add(time.Second)}
+	newValue := &ua.DataValue{Value: ua.MustVariant(int32(2)), Status: ua.StatusOK, SourceTimestamp: now.Add(time.Second)}
+	bad := &ua.DataValue{Status: ua.StatusBadNodeIDUnknown}
+
+	// the first poll is always reported
+	assert.True(t, s.changed(trigger, nil, last))
+	assert.True(t, s.changed(trigger, last, newValue))
+	assert.False(t, s.changed(trigger, last, sameValue))
+	assert.True(t, s.changed(trigger, last, bad))
+	assert.False(t, s.changed(trigger, bad, bad))
+
+	// per node triggers apply
+	assert.True(t, s.changed(counter, last, sameValue))
+
+	var unset *subscriptionConfig
+	assert.True(t, unset.changed(trigger, last, newValue))
+	assert.False(t, unset.changed(trigger, last, sameValue))
+}
+
+func TestMonitoredItemFilters(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+	writeTestValues(t, ctx, out, "line1", map[string]string{"temperature": "20.5", "state": "1"})
+
+	in := newTestInput(t, ctx, out, `
+subscribeEnabled: true
+publishingInterval: 50
+deadbandType: Absolute
+deadbandValue: 1
+nodeIDs:
+  - '{"1": [{"node": "ns=1;s=line1/temperature", "group": "line1", "name": "temperature"}, {"node": "ns=1;s=line1/state", "group": "line1", "name": "state", "dataChangeTrigger": "Status", "deadbandType": "None"}]}'
+`)
+	defer in.Close(ctx)
+
+	// readValues reads until n values were received, and returns them by the name of their node
+	readValues := func(n int) map[string][]string {
+		values := map[string][]string{}
+		for received := 0; received < n; {
+			batch, ack, err := in.ReadBatch(ctx)
+			require.NoError(t, err)
+			require.NoError(t, ack(ctx, nil))
+			for _, msg := range batch {
+				name, _ := msg.MetaGet("name")
+				b, err := msg.AsBytes()
+				require.NoError(t, err)
+				values[name] = append(values[name], string(b))
+				received++
+			}
+		}
+		return values
+	}
+
+	// the initial values are always reported
+	assert.Equal(t, map[string][]string{"temperature": {"20.5"}, "state": {"1"}}, readValues(2))
+
+	// changes within the deadband and value changes of a node that only reports status changes are filtered
+	writeTestValues(t, ctx, out, "line1", map[string]string{"temperature": "21", "state": "2"})
+	time.Sleep(200 * time.Millisecond)
+	writeTestValues(t, ctx, out, "line1", map[string]string{"temperature": "22.5"})
+	assert.Equal(t, map[string][]string{"temperature": {"22.5"}}, readValues(1))
+}
@@ -16,11 +16,7 @@ package opcua_plugin
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -33,7 +29,6 @@ import (
 	"github.com/gopcua/opcua/errors"
 	"github.com/gopcua/opcua/id"
 	"github.com/gopcua/opcua/ua"
-	"github.com/gopcua/opcua/uatest"
 )
 
 type NodeDef struct {
@@ -56,223 +51,158 @@ func (n NodeDef) Records() []string {
 	return []string{n.BrowseName, n.DataType, n.NodeID.String(), n.Unit, n.Scale, n.Min, n.Max, strconv.FormatBool(n.Writable), n.Description}
 }
 
-func browse(ctx context.Context, n *opcua.Node, path string, level int, logger *service.Logger) ([]NodeDef, error) {
-	logger.Debugf("node:%s path:%q level:%d\n", n, path, level)
-	if level > 10 {
-		return nil, nil
-	}
-
-	attrs, err := n.Attributes(ctx, ua.AttributeIDNodeClass, ua.AttributeIDBrowseName, ua.AttributeIDDescription, ua.AttributeIDAccessLevel, ua.AttributeIDDataType)
-	if err != nil {
-		return nil, err
-	}
-
-	var def = NodeDef{
-		NodeID: n.ID,
-	}
-
-	switch err := attrs[0].Status; err {
-	case ua.StatusOK:
-		def.NodeClass = ua.NodeClass(attrs[0].Value.Int())
-	case ua.StatusBadSecurityModeInsufficient:
-		return nil, nil
-	default:
-		return nil, err
-	}
-
-	switch err := attrs[1].Status; err {
-	case ua.StatusOK:
-		def.BrowseName = attrs[1].Value.String()
-	case ua.StatusBadSecurityModeInsufficient:
-		return nil, nil
-	default:
-		return nil, err
-	}
-
-	switch err := attrs[2].Status; err {
-	case ua.StatusOK:
-		def.Description = attrs[2].Value.String()
-	case ua.StatusBadAttributeIDInvalid:
-		// ignore
-	case ua.StatusBadSecurityModeInsufficient:
-		return nil, nil
-	default:
-		return nil, err
-	}
-
-	switch err := attrs[3].Status; err {
-	case ua.StatusOK:
-		def.AccessLevel = ua.AccessLevelType(attrs[3].Value.Int())
-		def.Writable = def.AccessLevel&ua.AccessLevelTypeCurrentWrite == ua.AccessLevelTypeCurrentWrite
-	case ua.StatusBadAttributeIDInvalid:
-		// ignore
-	case ua.StatusBadSecurityModeInsufficient:
-		return nil, nil
-	default:
-		return nil, err
-	}
-
-	switch err := attrs[4].Status; err {
-	case ua.StatusOK:
-		switch v := attrs[4].Value.NodeID().IntID(); v {
-		case id.DateTime:
-			def.DataType = "time.Time"
-		case id.Boolean:
-			def.DataType = "bool"
-		case id.SByte:
-			def.DataType = "int8"
-		case id.Int16:
-			def.DataType = "int16"
-		case id.Int32:
-			def.DataType = "int32"
-		case id.Byte:
-			def.DataType = "byte"
-		case id.UInt16:
-			def.DataType = "uint16"
-		case id.UInt32:
-			def.DataType = "uint32"
-		case id.UtcTime:
-			def.DataType = "time.Time"
-		case id.String:
-			def.DataType = "string"
-		case id.Float:
-			def.DataType = "float32"
-		case id.Double:
-			def.DataType = "float64"
-		default:
-			def.DataType = attrs[4].Value.NodeID().String()
-		}
-	case ua.StatusBadAttributeIDInvalid:
-		// ignore
-	case ua.StatusBadSecurityModeInsufficient:
-		return nil, nil
-	default:
-		return nil, err
-	}
-
-	def.Path = join(path, def.BrowseName)
-	logger.Debugf("%d: def.Path:%s def.NodeClass:%s\n", level, def.Path, def.NodeClass)
-
-	var nodes []NodeDef
-	// If a node has a Variable class, it probably means that it is a tag
-	// Therefore, no need to browse further
-	if def.NodeClass == ua.NodeClassVariable {
-		nodes = append(nodes, def)
-		return nodes, nil
-	}
-
-	browseChildren := func(refType uint32) error {
-		refs, err := n.ReferencedNodes(ctx, refType, ua.BrowseDirectionForward, ua.NodeClassAll, true)
-		if err != nil {
-			return errors.Errorf("References: %d: %s", refType, err)
-		}
-		logger.Debugf("found %d child refs\n", len(refs))
-		for _, rn := range refs {
-			children, err := browse(ctx, rn, def.Path, level+1, logger)
-			if err != nil {
-				return errors.Errorf("browse children: %s", err)
-			}
-			nodes = append(nodes, children...)
-		}
-		return nil
-	}
-
-	// If a node has an Object class, it probably means that it is a folder
-	// Therefore, browse its children
-	if def.NodeClass == ua.NodeClassObject {
-		// To determine if an Object is a folder, we need to check different references
-		// Add here all references that should be checked
-
-		if err := browseChildren(id.HasComponent); err != nil {
-			return nil, err
-		}
-		if err := browseChildren(id.Organizes); err != nil {
-			return nil, err
-		}
-		if err := browseChildren(id.FolderType); err != nil {
-			return nil, err
-		}
-		// For hasProperty it makes sense to show it very close to the tag itself, e.g., use the tagName as tagGroup and then the properties as subparts of it
-		/*
-			if err := browseChildren(id.HasProperty); err != nil {
-				return nil, err
-			}
-		*/
-	}
-	return nodes, nil
+// dataTypeName maps the DataType of a variable to the name of the Go type its values are decoded into.
+// Other DataTypes, e.g. structures, are returned as their NodeID.
+func dataTypeName(dataType *ua.NodeID) string {
+	switch dataType.IntID() {
+	case id.DateTime, id.UtcTime:
+		return "time.Time"
+	case id.Boolean:
+		return "bool"
+	case id.SByte:
+		return "int8"
+	case id.Int16:
+		return "int16"
+	case id.Int32:
+		return "int32"
+	case id.Int64:
+		return "int64"
+	case id.Byte:
+		return "byte"
+	case id.UInt16:
+		return "uint16"
+	case id.UInt32:
+		return "uint32"
+	case id.UInt64:
+		return "uint64"
+	case id.String:
+		return "string"
+	case id.Float:
+		return "float32"
+	case id.Double:
+		return "float64"
+	case id.ByteString:
+		return "[]byte"
+	case id.GUID:
+		return "*ua.GUID"
+	case id.NodeID:
+		return "*ua.NodeID"
+	case id.QualifiedName:
+		return "*ua.QualifiedName"
+	case id.LocalizedText:
+		return "*ua.LocalizedText"
+	}
+	return dataType.String()
 }
 
 //------------------------------------------------------------------------------
 
 var OPCUAConfigSpec = service.NewConfigSpec().
 	Summary("Creates an input that reads data from OPC-UA servers. Created & maintained by the United Manufacturing Hub. About us: www.umh.app").
-	Field(service.NewStringField("endpoint").Description("Address of the OPC-UA server to connect with.")).
-	Field(service.NewStringField("username").Description("Username for server access. If not set, no username is used.").Default("")).
-	Field(service.NewStringField("password").Description("Password for server access. If not set, no password is used.").Default("")).
+	Fields(connectionFields()...).
 	Field(service.NewStringListField("nodeIDs").Description("List of OPC-UA node IDs to begin browsing.")).
-	Field(service.NewStringField("securityMode").Description("Security mode to use. If not set, a reasonable security mode will be set depending on the discovered endpoints.").Default("")).
-	Field(service.NewStringField("securityPolicy").Description("The security policy to use.  If not set, a reasonable security policy will be set depending on the discovered endpoints.").Default("")).
-	Field(service.NewBoolField("insecure").Description("Set to true to bypass secure connections, useful in case of SSL or certificate issues. Default is secure (false).").Default(false)).
-	Field(service.NewBoolField("subscribeEnabled").Description("Set to true to subscribe to OPC-UA nodes instead of fetching them every seconds. Default is pulling messages every second (false).").Default(false))
+	Field(service.NewBoolField("subscribeEnabled").Description("Set to true to subscribe to OPC-UA nodes instead of reading them every pollRate. Default is pulling messages (false).").Default(false)).
+	Field(service.NewStringEnumField("payloadFormat", "value", "json").Description("Set to json to emit the values with their status, source and server timestamps and native types as JSON payload, instead of only the value.").Default("value")).
+	Field(service.NewStringEnumField("timestampSource", timestampSourceSource, timestampSourceServer, timestampSourceNone).Description("Timestamp that is set as timestamp_ms metadata: source uses the SourceTimestamp of a value, or its ServerTimestamp if the server did not send one, server the ServerTimestamp, and none leaves timestamp_ms unset.").Default(timestampSourceSource)).
+	Fields(subscriptionFields()...).
+	Fields(pollFields()...).
+	Fields(browseFields()...)
 
 func newOPCUAInput(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchInput, error) {
-	endpoint, err := conf.FieldString("endpoint")
+	connection, err := parseConnectionConfig(conf, mgr)
 	if err != nil {
 		return nil, err
 	}
 
-	securityMode, err := conf.FieldString("securityMode")
+	subscribeEnabled, err := conf.FieldBool("subscribeEnabled")
 	if err != nil {
 		return nil, err
 	}
 
-	securityPolicy, err := conf.FieldString("securityPolicy")
+	nodeIDs, err := conf.FieldStringList("nodeIDs")
 	if err != nil {
 		return nil, err
 	}
+	// fail if no nodeIDs are provided
+	if len(nodeIDs) == 0 {
+		return nil, errors.New("no nodeIDs provided")
+	}
 
-	username, err := conf.FieldString("username")
+	payloadFormat, err := conf.FieldString("payloadFormat")
 	if err != nil {
 		return nil, err
 	}
 
-	password, err := conf.FieldString("password")
+	timestampSource, err := conf.FieldString("timestampSource")
 	if err != nil {
 		return nil, err
 	}
 
-	insecure, err := conf.FieldBool("insecure")
+	subscription, err := parseSubscriptionConfig(conf, nodeIDs)
 	if err != nil {
 		return nil, err
 	}
 
-	subscribeEnabled, err := conf.FieldBool("subscribeEnabled")
+	poll, err := parsePollConfig(conf, nodeIDs)
 	if err != nil {
 		return nil, err
 	}
 
-	nodeIDs, err := conf.FieldStringList("nodeIDs")
+	browseConf, err := parseBrowseConfig(conf)
 	if err != nil {
 		return nil, err
 	}
-	// fail if no nodeIDs are provided
-	if len(nodeIDs) == 0 {
-		return nil, errors.New("no nodeIDs provided")
-	}
+
+	browseConf = connection.shared.browseConfig(browseConf)
 
 	//parsedNodeIDs := ParseNodeIDs(nodeIDs)
 	parsedNodeIDs := ParseTriggerNodeIDs(nodeIDs)
 
 	// tnodes group, sql procedures mapping
-	nodeGroupMapping := make(map[string]string)
-	nodesMapping := make(map[string]string)
+	nodeGroupMapping, nodesMapping, err := parseNodeGroupMapping(nodeIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &OPCUAInput{
+		endpoint:         connection.endpoint,
+		username:         connection.username,
+		password:         connection.password,
+		nodeIDs:          parsedNodeIDs,
+		nodeEntries:      nodeIDs,
+		nodesMapping:     nodesMapping,
+		nodeGroupMapping: nodeGroupMapping,
+		log:              mgr.Logger(),
+		securityMode:     connection.securityMode,
+		securityPolicy:   connection.securityPolicy,
+		insecure:         connection.insecure,
+		authentication:   connection.authentication,
+		certificates:     connection.certificates,
+		session:          connection.session,
+		reverse:          connection.reverse,
+		shared:           connection.shared,
+		subscribeEnabled: subscribeEnabled,
+		payloadFormat:    payloadFormat,
+		timestampSource:  timestampSource,
+		subscription:     subscription,
+		poll:             poll,
+		browse:           browseConf,
+	}
+
+	return service.AutoRetryNacksBatched(m), nil
+}
+
+// parseNodeGroupMapping maps every configured node to its "group,db,historian,sqlSp,name" and to the key of its group of nodes.
+func parseNodeGroupMapping(nodeIDs []string) (nodeGroupMapping map[string]string, nodesMapping map[string]string, err error) {
+	nodeGroupMapping = make(map[string]string)
+	nodesMapping = make(map[string]string)
 
 	for _, nodeElements := range nodeIDs {
 
 		var nodeObj map[string][]map[string]string
 		err := json.Unmarshal([]byte(nodeElements), &nodeObj)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		for key, values := range nodeObj {
@@ -290,22 +220,7 @@ func newOPCUAInput(conf *service.ParsedConfig, mgr *service.Resources) (service.
 			}
 		}
 	}
-
-	m := &OPCUAInput{
-		endpoint:         endpoint,
-		username:         username,
-		password:         password,
-		nodeIDs:          parsedNodeIDs,
-		nodesMapping:     nodesMapping,
-		nodeGroupMapping: nodeGroupMapping,
-		log:              mgr.Logger(),
-		securityMode:     securityMode,
-		securityPolicy:   securityPolicy,
-		insecure:         insecure,
-		subscribeEnabled: subscribeEnabled,
-	}
-
-	return service.AutoRetryNacksBatched(m), nil
+	return nodeGroupMapping, nodesMapping, nil
 }
 
 func init() {
@@ -327,155 +242,61 @@ type OPCUAInput struct {
 	username         string
 	password         string
 	nodeIDs          []*ua.NodeID
+	nodeEntries      []string // the configured nodeIDs, kept to resolve them on every connect
 	nodesMapping     map[string]string
 	nodeList         []NodeDef
 	nodeGroupMapping map[string]string
 	securityMode     string
 	securityPolicy   string
 	insecure         bool
+	authentication   authenticationConfig
+	certificates     certificateConfig
+	session          *sessionConfig
+	reverse          *reverseConnectConfig
+	shared           *connectionRef
 	client           *opcua.Client
+	watch            *sessionWatch
 	log              *service.Logger
 	// this is required for subscription
 	subscribeEnabled bool
+	payloadFormat    string
+	timestampSource  string
+	subscription     *subscriptionConfig
 	subNotifyChan    chan *opcua.PublishNotificationData
+	poll             *pollConfig
+	schedule         *pollSchedule
+	browse           *browseConfig
+	dataTypes        *dataTypeDecoder
+	limits           operationLimits
+	readFailures     readFailures
 }
 
-func (g *OPCUAInput) Connect(ctx context.Context) error {
+func (g *OPCUAInput) Connect(ctx context.Context) (err error) {
 	if g.client != nil {
 		return nil
 	}
 
-	var c *opcua.Client
-	var endpoints []*ua.EndpointDescription
-	var err error
-
-	// Step 1: Retrieve all available endpoints from the OPC UA server.
-	g.log.Infof("Endpoint URI: %s", g.endpoint)
-	endpoints, err = opcua.GetEndpoints(ctx, g.endpoint)
+	c, err := g.connection().connect(ctx, g.log)
 	if err != nil {
-		g.log.Infof("GetEndpoints failed: %s", err)
-	}
-	// Step 2: Log details of each discovered endpoint for debugging.
-	for i, endpoint := range endpoints {
-		g.log.Infof("Endpoint %d:", i+1)
-		g.log.Infof("  EndpointURL: %s", endpoint.EndpointURL)
-		g.log.Infof("  SecurityMode: %v", endpoint.SecurityMode)
-		g.log.Infof("  SecurityPolicyURI: %s", endpoint.SecurityPolicyURI)
-		g.log.Infof("  TransportProfileURI: %s", endpoint.TransportProfileURI)
-		g.log.Infof("  SecurityLevel: %d", endpoint.SecurityLevel)
-
-		// If Server is not nil, log its details
-		if endpoint.Server != nil {
-			g.log.Infof("  Server ApplicationURI: %s", endpoint.Server.ApplicationURI)
-			g.log.Infof("  Server ProductURI: %s", endpoint.Server.ProductURI)
-			g.log.Infof("  Server ApplicationName: %s", endpoint.Server.ApplicationName.Text)
-			g.log.Infof("  Server ApplicationType: %v", endpoint.Server.ApplicationType)
-			g.log.Infof("  Server GatewayServerURI: %s", endpoint.Server.GatewayServerURI)
-			g.log.Infof("  Server DiscoveryProfileURI: %s", endpoint.Server.DiscoveryProfileURI)
-			g.log.Infof("  Server DiscoveryURLs: %v", endpoint.Server.DiscoveryURLs)
-		}
-
-		// Output the certificate
-		if len(endpoint.ServerCertificate) > 0 {
-			// Convert to PEM format first, then log the certificate information
-			pemCert := pem.EncodeToMemory(&pem.Block{
-				Type:  "CERTIFICATE",
-				Bytes: endpoint.ServerCertificate,
-			})
-			g.logCertificateInfo(pemCert)
-		}
-
-		// Loop through UserIdentityTokens
-		for j, token := range endpoint.UserIdentityTokens {
-			g.log.Infof("  UserIdentityToken %d:", j+1)
-			g.log.Infof("    PolicyID: %s", token.PolicyID)
-			g.log.Infof("    TokenType: %v", token.TokenType)
-			g.log.Infof("    IssuedTokenType: %s", token.IssuedTokenType)
-			g.log.Infof("    IssuerEndpointURL: %s", token.IssuerEndpointURL)
-		}
-	}
-
-	// Step 3: Determine the authentication method to use.
-	// Default to Anonymous if neither username nor password is provided.
-	selectedAuthentication := ua.UserTokenTypeAnonymous
-	if g.username != "" && g.password != "" {
-		// Use UsernamePassword authentication if both username and password are available.
-		selectedAuthentication = ua.UserTokenTypeUserName
-	}
-
-	// Step 3.1: Filter the endpoints based on the selected authentication method.
-	// This will eliminate endpoints that do not support the chosen method.
-
-	selectedEndpoint := g.getReasonableEndpoint(endpoints, selectedAuthentication, g.insecure, g.securityMode, g.securityPolicy)
-	if selectedEndpoint == nil {
-		g.log.Errorf("Could not select a suitable endpoint")
 		return err
 	}
+	g.log.Infof("Please note that browsing large node trees can take a long time (around 5 nodes per second), see browseWorkers and browseCacheTTL")
 
-	if strings.HasPrefix(selectedEndpoint.EndpointURL, "opc.tcp://:") { // I omitted the port here, as it might change ?
-		selectedEndpoint.EndpointURL = g.endpoint
-	}
-	g.log.Infof("Selected endpoint: %v", selectedEndpoint)
-
-	// Step 4: Initialize OPC UA client options
-	opts := make([]opcua.Option, 0)
-	opts = append(opts, opcua.SecurityFromEndpoint(selectedEndpoint, selectedAuthentication))
-
-	// Set additional options based on the authentication method
-	switch selectedAuthentication {
-	case ua.UserTokenTypeAnonymous:
-		g.log.Infof("Using anonymous login")
-	case ua.UserTokenTypeUserName:
-		g.log.Infof("Using username/password login")
-		opts = append(opts, opcua.AuthUsername(g.username, g.password))
-	}
-
-	// Step 5: Generate Certificates, because this is really a step that can not happen in the background...
-	if !g.insecure {
-		// Generate a new certificate in memory, no file read/write operations.
-		randomStr := randomString(8) // Generates an 8-character random string
-		clientName := "urn:benthos-umh:client-" + randomStr
-		certPEM, keyPEM, err := uatest.GenerateCert(clientName, 2048, 24*time.Hour*365*10)
-		if err != nil {
-			g.log.Errorf("Failed to generate certificate: %v", err)
-			return err
-		}
-
-		// Convert PEM to X509 Certificate and RSA PrivateKey for in-memory use.
-		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	g.client = c
+	defer func() {
 		if err != nil {
-			g.log.Errorf("Failed to parse certificate: %v", err)
-			return err
-		}
-
-		pk, ok := cert.PrivateKey.(*rsa.PrivateKey)
-		if !ok {
-			g.log.Errorf("Invalid private key type")
-			return err
+			// ensure that if something fails here, the connection is always safely closed and opened again by the next Connect
+			g.connection().close(ctx, c)
+			g.client = nil
 		}
+	}()
 
-		// Append the certificate and private key to the client options
-		opts = append(opts, opcua.PrivateKey(pk), opcua.Certificate(cert.Certificate[0]))
-	}
-
-	// Step 6: Create and connect the OPC UA client
-	// Note that we are not taking `selectedEndpoint.EndpointURL` here as the server can be misconfigured. We are taking instead the user input.
-	c, err = opcua.NewClient(g.endpoint, opts...)
-	if err != nil {
-		g.log.Errorf("Failed to create a new client")
-		return err
-	}
-
-	// Connect to the selected endpoint
-	if err := c.Connect(ctx); err != nil {
-		g.log.Errorf("Failed to connect")
+	if err := g.resolveNodes(ctx); err != nil {
+		g.log.Errorf("Resolving nodes failed: %s", err)
 		return err
 	}
 
-	g.log.Infof("Connected to %s", g.endpoint)
-	g.log.Infof("Please note that browsing large node trees can take a long time (around 5 nodes per second)")
-
-	g.client = c
+	g.limits = readOperationLimits(ctx, c, g.log)
 
 	// Create a slice to store the detected nodes
 	nodeList := make([]NodeDef, 0)
@@ -490,10 +311,9 @@ func (g *OPCUAInput) Connect(ctx context.Context) error {
 		g.log.Debugf("Browsing nodeID: %s", id.String())
 
 		// Browse the OPC-UA server's node tree and print the results.
-		nodes, err := browse(ctx, g.client.Node(id), "", 0, g.log)
+		nodes, err := g.browse.nodes(ctx, g.client, g.endpoint, id, g.log)
 		if err != nil {
-			g.log.Errorf("Browsing failed: %s")
-			c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
+			g.log.Errorf("Browsing failed: %s", err)
 			return err
 		}
 
@@ -503,8 +323,7 @@ func (g *OPCUAInput) Connect(ctx context.Context) error {
 
 	b, err := json.Marshal(nodeList)
 	if err != nil {
-		g.log.Errorf("Unmarshalling failed: %s")
-		c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
+		g.log.Errorf("Unmarshalling failed: %s", err)
 		return err
 	}
 
@@ -513,29 +332,35 @@ func (g *OPCUAInput) Connect(ctx context.Context) error {
 	g.nodeList = nodeList
 
 	if err := g.detectTriggerNodeIDs(ctx); err != nil {
-		g.log.Errorf("Error detecting trigger nodes: %s")
-		c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
+		g.log.Errorf("Error detecting trigger nodes: %s", err)
 		return err
 	}
+	// the nodes are read in the groups of the new node list
+	g.schedule = nil
+
+	// custom structures are decoded with the DataTypeDefinitions of their DataTypes
+	dataTypes := make([]string, 0, len(g.nodeList))
+	for _, node := range g.nodeList {
+		dataTypes = append(dataTypes, node.DataType)
+	}
+	g.dataTypes = loadDataTypes(ctx, c, dataTypes, g.log)
+
 	// If subscription is enabled, start subscribing to the nodes
 	if g.subscribeEnabled {
 		g.log.Infof("Subscription is enabled, therefore start subscribing to the selected notes...")
 
 		g.subNotifyChan = make(chan *opcua.PublishNotificationData, 100)
 
-		sub, err := c.Subscribe(ctx, &opcua.SubscriptionParameters{
-			Interval: opcua.DefaultSubscriptionInterval,
-		}, g.subNotifyChan)
+		sub, err := g.connection().subscribe(ctx, c, g.subscription.parameters(), g.subNotifyChan)
 		if err != nil {
-			g.log.Errorf("Subscribing failed: %s")
-			c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
+			g.log.Errorf("Subscribing failed: %s", err)
 			return err
 		}
 
 		monitoredRequests := make([]*ua.MonitoredItemCreateRequest, 0, len(nodeList))
 
 		for pos, id := range nodeList {
-			miCreateRequest := opcua.NewMonitoredItemCreateRequestWithDefaults(id.NodeID, ua.AttributeIDValue, uint32(pos))
+			miCreateRequest := g.subscription.monitoredItem(id.NodeID, uint32(pos))
 			monitoredRequests = append(monitoredRequests, miCreateRequest)
 		}
 
@@ -544,41 +369,47 @@ func (g *OPCUAInput) Connect(ctx context.Context) error {
 			return fmt.Errorf("no valid nodes selected")
 		}
 
-		res, err := sub.Monitor(ctx, ua.TimestampsToReturnBoth, monitoredRequests...)
+		res, err := g.limits.monitor(ctx, sub, ua.TimestampsToReturnBoth, monitoredRequests...)
 		if err != nil {
-			g.log.Errorf("Monitoring failed: %s")
-			c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
+			g.log.Errorf("Monitoring failed: %s", err)
 			return err
 		}
 		if res == nil {
 			g.log.Errorf("Expected res to not be nil, if there is no error")
-			c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
 			return fmt.Errorf("expected res to be not nil")
 		}
 
-		// Assuming you want to check the status code of each result
-		for _, result := range res.Results {
+		// nodes that can not be monitored are reported, the others are still subscribed
+		monitored := 0
+		for i, result := range res.Results {
 			if !errors.Is(result.StatusCode, ua.StatusOK) {
-				g.log.Errorf("Monitoring failed with status code: %v", result.StatusCode)
-				c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
-				return fmt.Errorf("monitoring failed for node, status code: %v", result.StatusCode)
+				g.log.Warnf("Monitoring %s failed with status code: %v", nodeList[i].NodeID, result.StatusCode)
+				continue
 			}
+			monitored++
+		}
+		if monitored == 0 {
+			return fmt.Errorf("monitoring failed for all %d nodes", len(res.Results))
 		}
 
-		g.log.Infof("Subscribed to %d nodes!", len(res.Results))
+		g.log.Infof("Subscribed to %d of %d nodes!", monitored, len(res.Results))
 
 	}
 
+	// the client restores the session after connection losses, the watch notices when it can not
+	g.watch = g.session.watch(c, g.log)
+
 	return nil
 }
 
-// createMessageFromValue creates a benthos messages from a given variant and nodeID
+// createMessageFromValue creates a benthos messages from a given value and nodeID, with its status and timestamps as metadata
 // theoretically nodeID can be extracted from variant, but not in all cases (e.g., when subscribing), so it it left to the calling function
-func (g *OPCUAInput) createMessageFromValue(variant *ua.Variant, node NodeDef, nodeID string, msgs map[string]string) *service.Message {
-	if variant == nil {
+func (g *OPCUAInput) createMessageFromValue(value *ua.DataValue, node NodeDef, nodeID string, msgs map[string]string) *service.Message {
+	if value == nil || value.Value == nil {
 		g.log.Errorf("Variant is nil")
 		return nil
 	}
+	variant := value.Value
 
 	b := make([]byte, 0)
 
@@ -612,8 +443,8 @@ func (g *OPCUAInput) createMessageFromValue(variant *ua.Variant, node NodeDef, n
 	case uint64:
 		b = append(b, []byte(strconv.FormatUint(v, 10))...)
 	default:
-		// Convert unknown types to JSON
-		jsonBytes, err := json.Marshal(v)
+		// Convert other types, e.g. arrays and structures, to JSON
+		jsonBytes, err := json.Marshal(g.dataTypes.jsonValue(v))
 		if err != nil {
 			g.log.Errorf("Error marshaling to JSON: %v", err)
 			return nil
@@ -627,7 +458,24 @@ func (g *OPCUAInput) createMessageFromValue(variant *ua.Variant, node NodeDef, n
 	}
 	trigMap := make(map[string]string)
 
-	message := service.NewMessage(b)
+	timestamp := dataValueTimestamp(value, g.timestampSource)
+
+	payload := b
+	if g.payloadFormat == "json" {
+		item := g.dataTypes.dataValueJSON(value)
+		item["nodeID"] = nodeID
+		if !timestamp.IsZero() {
+			item["timestamp_ms"] = timestamp.UnixMilli()
+		}
+		jsonBytes, err := json.Marshal(item)
+		if err != nil {
+			g.log.Errorf("Error marshaling to JSON: %v", err)
+			return nil
+		}
+		payload = jsonBytes
+	}
+
+	message := service.NewMessage(payload)
 
 	re := regexp.MustCompile(`[^a-zA-Z0-9_-]`)
 	opcuaPath := re.ReplaceAllString(nodeID, "_")
@@ -635,6 +483,18 @@ func (g *OPCUAInput) createMessageFromValue(variant *ua.Variant, node NodeDef, n
 	message.MetaSet("opcua_path", opcuaPath)
 	message.MetaSet("description", node.Description)
 	message.MetaSet("nodeID", nodeID)
+	message.MetaSet("status", statusName(value.Status))
+	message.MetaSet("statusCode", strconv.FormatUint(uint64(value.Status), 10))
+	message.MetaSet("quality", quality(value.Status))
+	if !value.SourceTimestamp.IsZero() {
+		message.MetaSet("sourceTimestamp", value.SourceTimestamp.UTC().Format(time.RFC3339Nano))
+	}
+	if !value.ServerTimestamp.IsZero() {
+		message.MetaSet("serverTimestamp", value.ServerTimestamp.UTC().Format(time.RFC3339Nano))
+	}
+	if !timestamp.IsZero() {
+		message.MetaSet("timestamp_ms", strconv.FormatInt(timestamp.UnixMilli(), 10))
+	}
 
 	nodeElements := strings.Split(g.nodeGroupMapping[nodeID], ",")
 	message.MetaSet("group", nodeElements[0])
@@ -657,74 +517,89 @@ func (g *OPCUAInput) ReadBatchPull(ctx context.Context) (service.MessageBatch, s
 	if g.client == nil {
 		return nil, nil, errors.New("client is nil")
 	}
-	// Read all values in NodeList and return each of them as a message with the node's path as the metadata
+	if g.schedule == nil {
+		nodeIDs := make([]*ua.NodeID, 0, len(g.nodeList))
+		for _, node := range g.nodeList {
+			nodeIDs = append(nodeIDs, node.NodeID)
+		}
+		g.schedule = g.poll.schedule(nodeIDs)
+	}
+	due, err := g.schedule.wait(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if g.client == nil {
+		return nil, nil, errors.New("client is nil")
+	}
+	if g.watch.isLost() {
+		return nil, nil, g.connectionLost(ctx)
+	}
 
-	// Create first a list of all the values to read
-	var nodesToRead []*ua.ReadValueID
+	// Read the values of the due groups and return each of them as a message with the node's path as the metadata
+	msgs := service.MessageBatch{}
+	for _, group := range due {
+		batch, err := g.readPollGroup(ctx, group)
+		if err != nil {
+			return nil, nil, err
+		}
+		msgs = append(msgs, batch...)
+	}
 
-	for _, node := range g.nodeList {
+	return msgs, func(ctx context.Context, err error) error {
+		// Nacks are retried automatically when we use service.AutoRetryNacks
+		return nil
+	}, nil
+}
+
+// readPollGroup reads the nodes of a group of the poll schedule.
+func (g *OPCUAInput) readPollGroup(ctx context.Context, group *pollGroup) (service.MessageBatch, error) {
+	// Create first a list of all the values to read
+	nodesToRead := make([]*ua.ReadValueID, 0, len(group.nodes))
+	for _, i := range group.nodes {
 		nodesToRead = append(nodesToRead, &ua.ReadValueID{
-			NodeID: node.NodeID,
+			NodeID: g.nodeList[i].NodeID,
 		})
 	}
 
-	if len(g.nodeList) > 100 {
-		g.log.Warnf("Reading more than 100 nodes with pull method. The request might fail as it can take too much time. Recommendation: use subscribeEnabled: true instead for better performance")
-	}
-
 	req := &ua.ReadRequest{
-		MaxAge:             2000,
+		MaxAge:             float64(group.timing.maxAge.Milliseconds()),
 		NodesToRead:        nodesToRead,
 		TimestampsToReturn: ua.TimestampsToReturnBoth,
 	}
 
-	resp, err := g.client.Read(ctx, req)
+	resp, err := g.limits.read(ctx, g.client, req)
 	if err != nil {
 		g.log.Errorf("Read failed: %s", err)
-		// if the error is StatusBadSessionIDInvalid, the session has been closed
-		// and we need to reconnect.
-		switch err {
-		case ua.StatusBadSessionIDInvalid:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadCommunicationError:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadConnectionClosed:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadTimeout:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadConnectionRejected:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadServerNotConnected:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
+		// if the session has been closed, e.g. StatusBadSessionIDInvalid,
+		// we need to reconnect.
+		if isConnectionError(err) {
+			return nil, g.connectionLost(ctx)
 		}
 
 		// return error and stop executing this function.
-		return nil, nil, err
+		return nil, err
+	}
+
+	if len(resp.Results) != len(nodesToRead) {
+		return nil, fmt.Errorf("expected %d read results, got %d", len(nodesToRead), len(resp.Results))
 	}
 
-	if resp.Results[0].Status != ua.StatusOK {
-		g.log.Errorf("Status not OK: %v", resp.Results[0].Status)
+	if g.readFailures == nil {
+		g.readFailures = readFailures{}
 	}
 
 	// Create a message with the node's path as the metadata
 	msgs := service.MessageBatch{}
 
-	for i, node := range g.nodeList {
-		value := resp.Results[i].Value
+	for i, pos := range group.nodes {
+		node := g.nodeList[pos]
+		value := resp.Results[i]
 		if value == nil {
-			g.log.Errorf("Received nil from node: %s", node.NodeID.String())
+			continue
+		}
+		// nodes that can not be read are reported, the others are still sent
+		g.readFailures.report(node.NodeID.String(), value.Status, g.log)
+		if value.Value == nil {
 			continue
 		}
 		message := g.createMessageFromValue(value, node, node.NodeID.String(), nil)
@@ -732,14 +607,7 @@ func (g *OPCUAInput) ReadBatchPull(ctx context.Context) (service.MessageBatch, s
 			msgs = append(msgs, message)
 		}
 	}
-
-	// Wait for a second before returning a message.
-	time.Sleep(time.Second)
-
-	return msgs, func(ctx context.Context, err error) error {
-		// Nacks are retried automatically when we use service.AutoRetryNacks
-		return nil
-	}, nil
+	return msgs, nil
 }
 
 func (g *OPCUAInput) ReadBatchSubscribe(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
@@ -753,6 +621,9 @@ func (g *OPCUAInput) ReadBatchSubscribe(ctx context.Context) (service.MessageBat
 		// Received a result, check for error
 		if res.Error != nil {
 			g.log.Errorf("ReadBatchSubscribe error: %s", res.Error)
+			if isConnectionError(res.Error) {
+				return nil, nil, g.connectionLost(ctx)
+			}
 			return nil, nil, res.Error
 		}
 
@@ -774,7 +645,7 @@ func (g *OPCUAInput) ReadBatchSubscribe(ctx context.Context) (service.MessageBat
 				// see also NewMonitoredItemCreateRequestWithDefaults call in other functions
 				handleID := item.ClientHandle
 				if uint32(len(g.nodeList)) >= handleID {
-					message := g.createMessageFromValue(item.Value.Value, g.nodeList[handleID], g.nodeList[handleID].NodeID.String(), nil)
+					message := g.createMessageFromValue(item.Value, g.nodeList[handleID], g.nodeList[handleID].NodeID.String(), nil)
 					if message != nil {
 						msgs = append(msgs, message)
 					}
@@ -789,6 +660,9 @@ func (g *OPCUAInput) ReadBatchSubscribe(ctx context.Context) (service.MessageBat
 			return nil
 		}, nil
 
+	case <-g.watch.lostChan():
+		return nil, nil, g.connectionLost(ctx)
+
 	case _, ok := <-ctx.Done():
 		if !ok {
 			g.log.Errorf("timeout channel was closed")
@@ -808,38 +682,72 @@ func (g *OPCUAInput) ReadBatch(ctx context.Context) (service.MessageBatch, servi
 }
 
 func (g *OPCUAInput) Close(ctx context.Context) error {
+	g.watch.stop()
+	g.watch = nil
 	if g.client != nil {
-		g.client.Close(ctx)
+		g.connection().close(ctx, g.client)
 		g.client = nil
 	}
+	g.reverse.close()
 
 	return nil
 }
 
-func (g *OPCUAInput) logCertificateInfo(certBytes []byte) {
-	g.log.Infof("  Server certificate:")
+// connection returns the settings used to open the session.
+func (g *OPCUAInput) connection() connectionConfig {
+	return connectionConfig{
+		endpoint:       g.endpoint,
+		username:       g.username,
+		password:       g.password,
+		securityMode:   g.securityMode,
+		securityPolicy: g.securityPolicy,
+		insecure:       g.insecure,
+		authentication: g.authentication,
+		certificates:   g.certificates,
+		session:        g.session,
+		reverse:        g.reverse,
+		shared:         g.shared,
+	}
+}
 
-	// Decode the certificate from base64 to DER format
-	block, _ := pem.Decode(certBytes)
-	if block == nil {
-		g.log.Errorf("Failed to decode certificate")
-		return
+// connectionLost handles a service call that failed because of the connection. While the client restores the
+// session and transfers its subscriptions, the input keeps the client and its browsed nodes. Otherwise the client
+// is closed, so that Connect opens a new session.
+func (g *OPCUAInput) connectionLost(ctx context.Context) error {
+	if !g.watch.restored(ctx) {
+		g.connection().lost(ctx, g.client)
+		g.client = nil
+		_ = g.Close(ctx)
 	}
+	return service.ErrNotConnected
+}
 
-	// Parse the DER-format certificate
-	cert, err := x509.ParseCertificate(block.Bytes)
+// resolveNodes resolves the nsu= node IDs and browse paths of the configured nodes, as the namespace
+// indexes of the server may have changed since the last connect.
+func (g *OPCUAInput) resolveNodes(ctx context.Context) error {
+	nodes, err := configuredNodes(g.nodeEntries)
 	if err != nil {
-		g.log.Errorf("Failed to parse certificate:", err)
-		return
+		return err
+	}
+	resolved, err := resolveNodes(ctx, g.client, nodes, g.log)
+	if err != nil || resolved == nil {
+		return err
 	}
 
-	// Log the details
-	g.log.Infof("    Not Before:", cert.NotBefore)
-	g.log.Infof("    Not After:", cert.NotAfter)
-	g.log.Infof("    DNS Names:", cert.DNSNames)
-	g.log.Infof("    IP Addresses:", cert.IPAddresses)
-	g.log.Infof("    URIs:", cert.URIs)
+	nodeEntries, err := rewriteNodeEntries(g.nodeEntries, resolved)
+	if err != nil {
+		return err
+	}
+	g.nodeIDs = ParseTriggerNodeIDs(nodeEntries)
+	if g.nodeGroupMapping, g.nodesMapping, err = parseNodeGroupMapping(nodeEntries); err != nil {
+		return err
+	}
+	if err := g.subscription.setNodes(nodeEntries); err != nil {
+		return err
+	}
+	return g.poll.setNodes(nodeEntries)
 }
+
 func (g *OPCUAInput) detectTriggerNodeIDs(ctx context.Context) error {
 	// Create a slice to store the detected trigger nodes
 	nodeList := make([]NodeDef, 0)
@@ -854,12 +762,18 @@ func (g *OPCUAInput) detectTriggerNodeIDs(ctx context.Context) error {
 		g.log.Infof("Browsing trigger nodeID: %s", id.String())
 
 		// Browse the OPC-UA server's node tree and print the results.
-		nodes, err := browse(ctx, g.client.Node(id), "", 0, g.log)
+		nodes, err := g.browse.nodes(ctx, g.client, g.endpoint, id, g.log)
 		if err != nil {
 			g.log.Errorf("Browsing failed: %s")
 			return err
 		}
 
+		// Browsed nodes are monitored and read like the configured node they were found under
+		for _, node := range nodes {
+			g.subscription.inherit(id, node.NodeID)
+			g.poll.inherit(id, node.NodeID)
+		}
+
 		// Add the trigger nodes to the tNodeList
 		nodeList = append(nodeList, nodes...)
 	}
@@ -0,0 +1,188 @@
+// Copyright 2023 UMH Systems GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opcua_plugin
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/errors"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// conditionMethods are the methods of the AcknowledgeableConditionType, keyed by the action.
+var conditionMethods = map[string]uint32{
+	"acknowledge": id.AcknowledgeableConditionType_Acknowledge,
+	"confirm":     id.AcknowledgeableConditionType_Confirm,
+}
+
+var OPCUAAcknowledgeConfigSpec = service.NewConfigSpec().
+	Summary("Creates a processor that acknowledges or confirms OPC-UA conditions. Created & maintained by the United Manufacturing Hub. About us: www.umh.app").
+	Description("The condition is taken from the eventId and conditionId metadata, as set by the opcua_events input.").
+	Fields(connectionFields()...).
+	Field(service.NewStringEnumField("action", "acknowledge", "confirm").Description("Whether the condition is acknowledged or confirmed.").Default("acknowledge")).
+	Field(service.NewInterpolatedStringField("comment").Description("The comment added to the condition.").Default(""))
+
+func newOPCUAAcknowledgeProcessor(conf *service.ParsedConfig, mgr *service.Resources) (*OPCUAAcknowledgeProcessor, error) {
+	connection, err := parseConnectionConfig(conf, mgr)
+	if err != nil {
+		return nil, err
+	}
+
+	action, err := conf.FieldString("action")
+	if err != nil {
+		return nil, err
+	}
+	method, ok := conditionMethods[action]
+	if !ok {
+		return nil, fmt.Errorf("unknown action %q", action)
+	}
+
+	comment, err := conf.FieldInterpolatedString("comment")
+	if err != nil {
+		return nil, err
+	}
+
+	return &OPCUAAcknowledgeProcessor{
+		connection: connection,
+		methodID:   ua.NewNumericNodeID(0, method),
+		comment:    comment,
+		log:        mgr.Logger(),
+	}, nil
+}
+
+func init() {
+	err := service.RegisterProcessor(
+		"opcua_acknowledge", OPCUAAcknowledgeConfigSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.Processor, error) {
+			mgr.Logger().Infof("Created & maintained by the United Manufacturing Hub. About us: www.umh.app")
+			return newOPCUAAcknowledgeProcessor(conf, mgr)
+		})
+	if err != nil {
+		panic(err)
+	}
+}
+
+//------------------------------------------------------------------------------
+
+type OPCUAAcknowledgeProcessor struct {
+	connection connectionConfig
+	methodID   *ua.NodeID
+	comment    *service.InterpolatedString
+
+	// mu guards the client, as processors are called concurrently
+	mu     sync.Mutex
+	client *opcua.Client
+	log    *service.Logger
+}
+
+func (p *OPCUAAcknowledgeProcessor) connect(ctx context.Context) (*opcua.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != nil {
+		return p.client, nil
+	}
+
+	c, err := p.connection.connect(ctx, p.log)
+	if err != nil {
+		return nil, err
+	}
+	p.client = c
+	return c, nil
+}
+
+// conditionRequest builds the call of the Acknowledge or Confirm method for the condition of a message.
+func conditionRequest(msg *service.Message, methodID *ua.NodeID, comment string) (*ua.CallMethodRequest, error) {
+	conditionIDString, ok := msg.MetaGet("conditionId")
+	if !ok || conditionIDString == "" {
+		return nil, errors.New("message has no conditionId metadata")
+	}
+	conditionID, err := ua.ParseNodeID(conditionIDString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid conditionId %q: %w", conditionIDString, err)
+	}
+
+	eventIDString, ok := msg.MetaGet("eventId")
+	if !ok || eventIDString == "" {
+		return nil, errors.New("message has no eventId metadata")
+	}
+	eventID, err := hex.DecodeString(eventIDString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid eventId %q: %w", eventIDString, err)
+	}
+
+	return &ua.CallMethodRequest{
+		ObjectID: conditionID,
+		MethodID: methodID,
+		InputArguments: []*ua.Variant{
+			ua.MustVariant(eventID),
+			ua.MustVariant(&ua.LocalizedText{EncodingMask: ua.LocalizedTextText, Text: comment}),
+		},
+	}, nil
+}
+
+func (p *OPCUAAcknowledgeProcessor) Process(ctx context.Context, msg *service.Message) (service.MessageBatch, error) {
+	comment, err := p.comment.TryString(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := conditionRequest(msg, p.methodID, comment)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := p.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.Call(ctx, req)
+	if err != nil {
+		p.log.Errorf("Calling %s on %s failed: %s", p.methodID, req.ObjectID, err)
+		if isConnectionError(err) {
+			p.mu.Lock()
+			if p.client == c {
+				p.connection.lost(ctx, c)
+				p.client = nil
+			}
+			p.mu.Unlock()
+		}
+		return nil, err
+	}
+	if result.StatusCode != ua.StatusOK {
+		return nil, fmt.Errorf("calling %s on %s: %w", p.methodID, req.ObjectID, result.StatusCode)
+	}
+	return service.MessageBatch{msg}, nil
+}
+
+func (p *OPCUAAcknowledgeProcessor) Close(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != nil {
+		p.connection.close(ctx, p.client)
+		p.client = nil
+	}
+	p.connection.reverse.close()
+	return nil
+}
@@ -0,0 +1,308 @@
+// Copyright 2023 UMH Systems GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opcua_plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/errors"
+	"github.com/gopcua/opcua/ua"
+)
+
+var OPCUACallConfigSpec = service.NewConfigSpec().
+	Summary("Creates a processor that calls an OPC-UA method for each message. Created & maintained by the United Manufacturing Hub. About us: www.umh.app").
+	Description("The input arguments are taken from the message and converted to the DataTypes of the InputArguments property of the method. " +
+		"The output arguments are added to the message, keyed by their names.").
+	Fields(connectionFields()...).
+	Field(service.NewStringField("objectID").Description("The object node the method is called on, e.g. ns=2;s=Machine1.")).
+	Field(service.NewStringField("methodID").Description("The method node to call, e.g. ns=2;s=Machine1.StartJob.")).
+	Field(service.NewStringListField("inputFields").Description("Message fields passed as input arguments, in the order of the InputArguments of the method. Nested fields are separated by a dot. If not set, the fields named like the input arguments are used.").Default([]string{})).
+	Field(service.NewStringField("resultField").Description("Field of the message the output arguments are written to. If empty, they are added to the root of the message.").Default("result"))
+
+func newOPCUACallProcessor(conf *service.ParsedConfig, mgr *service.Resources) (*OPCUACallProcessor, error) {
+	connection, err := parseConnectionConfig(conf, mgr)
+	if err != nil {
+		return nil, err
+	}
+
+	objectIDString, err := conf.FieldString("objectID")
+	if err != nil {
+		return nil, err
+	}
+	objectID, err := ua.ParseNodeID(objectIDString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid objectID %q: %w", objectIDString, err)
+	}
+
+	methodIDString, err := conf.FieldString("methodID")
+	if err != nil {
+		return nil, err
+	}
+	methodID, err := ua.ParseNodeID(methodIDString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid methodID %q: %w", methodIDString, err)
+	}
+
+	inputFields, err := conf.FieldStringList("inputFields")
+	if err != nil {
+		return nil, err
+	}
+
+	resultField, err := conf.FieldString("resultField")
+	if err != nil {
+		return nil, err
+	}
+
+	return &OPCUACallProcessor{
+		connection:  connection,
+		objectID:    objectID,
+		methodID:    methodID,
+		inputFields: inputFields,
+		resultField: resultField,
+		log:         mgr.Logger(),
+	}, nil
+}
+
+func init() {
+	err := service.RegisterProcessor(
+		"opcua_call", OPCUACallConfigSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.Processor, error) {
+			mgr.Logger().Infof("Created & maintained by the United Manufacturing Hub. About us: www.umh.app")
+			return newOPCUACallProcessor(conf, mgr)
+		})
+	if err != nil {
+		panic(err)
+	}
+}
+
+//------------------------------------------------------------------------------
+
+type OPCUACallProcessor struct {
+	connection  connectionConfig
+	objectID    *ua.NodeID
+	methodID    *ua.NodeID
+	inputFields []string
+	resultField string
+
+	// mu guards the client and the arguments of the method, as processors are called concurrently
+	mu         sync.Mutex
+	client     *opcua.Client
+	inputArgs  []*ua.Argument
+	outputArgs []*ua.Argument
+	log        *service.Logger
+}
+
+// connect opens the session and reads the arguments of the method, unless this was already done.
+// It returns the client with the input and output arguments of the method.
+func (p *OPCUACallProcessor) connect(ctx context.Context) (*opcua.Client, []*ua.Argument, []*ua.Argument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != nil {
+		return p.client, p.inputArgs, p.outputArgs, nil
+	}
+
+	c, err := p.connection.connect(ctx, p.log)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	inputArgs, err := methodArguments(ctx, c, p.methodID, "InputArguments")
+	if err != nil {
+		p.connection.close(ctx, c)
+		return nil, nil, nil, err
+	}
+	outputArgs, err := methodArguments(ctx, c, p.methodID, "OutputArguments")
+	if err != nil {
+		p.connection.close(ctx, c)
+		return nil, nil, nil, err
+	}
+	if len(p.inputFields) > 0 && len(p.inputFields) != len(inputArgs) {
+		p.connection.close(ctx, c)
+		return nil, nil, nil, fmt.Errorf("method %s has %d input arguments, but %d inputFields are configured", p.methodID, len(inputArgs), len(p.inputFields))
+	}
+
+	for _, arg := range inputArgs {
+		p.log.Infof("Input argument %q of %s: %s", arg.Name, p.methodID, dataTypeName(arg.DataType))
+	}
+
+	p.client = c
+	p.inputArgs = inputArgs
+	p.outputArgs = outputArgs
+	return c, inputArgs, outputArgs, nil
+}
+
+// methodArguments reads the InputArguments or OutputArguments property of a method.
+// Methods without the property have no arguments.
+func methodArguments(ctx context.Context, c *opcua.Client, methodID *ua.NodeID, property string) ([]*ua.Argument, error) {
+	propertyID, err := c.Node(methodID).TranslateBrowsePathInNamespaceToNodeID(ctx, 0, property)
+	if err == ua.StatusBadNoMatch {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("finding %s of %s: %w", property, methodID, err)
+	}
+
+	value, err := c.Node(propertyID).Value(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s of %s: %w", property, methodID, err)
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	objects, ok := value.Value().([]*ua.ExtensionObject)
+	if !ok {
+		return nil, fmt.Errorf("%s of %s is a %T", property, methodID, value.Value())
+	}
+
+	args := make([]*ua.Argument, 0, len(objects))
+	for _, obj := range objects {
+		arg, ok := obj.Value.(*ua.Argument)
+		if !ok {
+			return nil, fmt.Errorf("%s of %s contains a %T", property, methodID, obj.Value)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func (p *OPCUACallProcessor) Process(ctx context.Context, msg *service.Message) (service.MessageBatch, error) {
+	c, inputArgs, outputArgs, err := p.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	structured, err := msg.AsStructuredMut()
+	if err != nil {
+		return nil, err
+	}
+
+	inputs, err := callArguments(structured, inputArgs, p.inputFields)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.Call(ctx, &ua.CallMethodRequest{
+		ObjectID:       p.objectID,
+		MethodID:       p.methodID,
+		InputArguments: inputs,
+	})
+	if err != nil {
+		p.log.Errorf("Calling %s failed: %s", p.methodID, err)
+		if isConnectionError(err) {
+			p.mu.Lock()
+			if p.client == c {
+				p.connection.lost(ctx, c)
+				p.client = nil
+			}
+			p.mu.Unlock()
+		}
+		return nil, err
+	}
+
+	if result.StatusCode != ua.StatusOK {
+		for i, status := range result.InputArgumentResults {
+			if status != ua.StatusOK && i < len(inputArgs) {
+				return nil, fmt.Errorf("calling %s: input argument %q: %w", p.methodID, inputArgs[i].Name, status)
+			}
+		}
+		return nil, fmt.Errorf("calling %s: %w", p.methodID, result.StatusCode)
+	}
+
+	structured, err = setCallResult(structured, p.resultField, callResult(outputArgs, result.OutputArguments))
+	if err != nil {
+		return nil, err
+	}
+	msg.SetStructuredMut(structured)
+	return service.MessageBatch{msg}, nil
+}
+
+func (p *OPCUACallProcessor) Close(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != nil {
+		p.connection.close(ctx, p.client)
+		p.client = nil
+	}
+	p.connection.reverse.close()
+	return nil
+}
+
+//------------------------------------------------------------------------------
+
+// callArguments builds the input arguments of a method call from a structured message.
+// Without inputFields, the fields are looked up by the names of the arguments.
+func callArguments(structured any, args []*ua.Argument, inputFields []string) ([]*ua.Variant, error) {
+	inputs := make([]*ua.Variant, 0, len(args))
+	for i, arg := range args {
+		field := arg.Name
+		if len(inputFields) > 0 {
+			field = inputFields[i]
+		}
+
+		value, ok := lookupField(structured, field)
+		if !ok {
+			return nil, fmt.Errorf("message has no field %q for input argument %q", field, arg.Name)
+		}
+
+		v, err := toVariant(value, dataTypeName(arg.DataType))
+		if err != nil {
+			return nil, fmt.Errorf("input argument %q: %w", arg.Name, err)
+		}
+		inputs = append(inputs, v)
+	}
+	return inputs, nil
+}
+
+// callResult maps the output arguments of a method call to their names.
+func callResult(args []*ua.Argument, values []*ua.Variant) map[string]any {
+	result := make(map[string]any, len(values))
+	for i, value := range values {
+		name := fmt.Sprintf("output%d", i)
+		if i < len(args) && args[i].Name != "" {
+			name = args[i].Name
+		}
+		if value == nil {
+			result[name] = nil
+			continue
+		}
+		result[name] = value.Value()
+	}
+	return result
+}
+
+// setCallResult adds the output arguments to the message, either at the resultField or at its root.
+func setCallResult(structured any, resultField string, result map[string]any) (any, error) {
+	obj, ok := structured.(map[string]any)
+	if !ok {
+		return nil, errors.New("output arguments can only be added to a JSON object")
+	}
+
+	if resultField == "" {
+		for k, v := range result {
+			obj[k] = v
+		}
+		return obj, nil
+	}
+	obj[resultField] = result
+	return obj, nil
+}
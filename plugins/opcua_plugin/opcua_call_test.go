@@ -0,0 +1,105 @@
+// Copyright 2023 UMH Systems GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opcua_plugin
+
+import (
+	"testing"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOPCUACallConfig(t *testing.T) {
+	conf, err := OPCUACallConfigSpec.ParseYAML(`
+endpoint: opc.tcp://localhost:46010
+objectID: ns=2;s=Machine1
+methodID: ns=2;s=Machine1.StartJob
+inputFields: [job.id, job.quantity]
+`, nil)
+	require.NoError(t, err)
+
+	proc, err := newOPCUACallProcessor(conf, service.MockResources())
+	require.NoError(t, err)
+	assert.Equal(t, "ns=2;s=Machine1", proc.objectID.String())
+	assert.Equal(t, "ns=2;s=Machine1.StartJob", proc.methodID.String())
+	assert.Equal(t, []string{"job.id", "job.quantity"}, proc.inputFields)
+	assert.Equal(t, "result", proc.resultField)
+	assert.Equal(t, "opc.tcp://localhost:46010", proc.connection.endpoint)
+
+	conf, err = OPCUACallConfigSpec.ParseYAML(`
+endpoint: opc.tcp://localhost:46010
+objectID: ns=abc;s=Machine1
+methodID: ns=2;s=Machine1.StartJob
+`, nil)
+	require.NoError(t, err)
+	_, err = newOPCUACallProcessor(conf, service.MockResources())
+	assert.Error(t, err)
+}
+
+func TestCallArguments(t *testing.T) {
+	args := []*ua.Argument{
+		{Name: "JobID", DataType: ua.NewNumericNodeID(0, id.String), ValueRank: -1},
+		{Name: "Quantity", DataType: ua.NewNumericNodeID(0, id.UInt32), ValueRank: -1},
+		{Name: "Speeds", DataType: ua.NewNumericNodeID(0, id.Float), ValueRank: 1},
+	}
+	structured := map[string]any{
+		"JobID":    "J-42",
+		"Quantity": float64(100),
+		"Speeds":   []any{1.5, float64(2)},
+		"job":      map[string]any{"id": "J-43", "quantity": float64(5), "speeds": []any{}},
+	}
+
+	inputs, err := callArguments(structured, args, nil)
+	require.NoError(t, err)
+	require.Len(t, inputs, 3)
+	assert.Equal(t, "J-42", inputs[0].Value())
+	assert.Equal(t, uint32(100), inputs[1].Value())
+	assert.Equal(t, []float32{1.5, 2}, inputs[2].Value())
+
+	inputs, err = callArguments(structured, args, []string{"job.id", "job.quantity", "job.speeds"})
+	require.NoError(t, err)
+	assert.Equal(t, "J-43", inputs[0].Value())
+	assert.Equal(t, uint32(5), inputs[1].Value())
+
+	_, err = callArguments(map[string]any{"JobID": "J-42"}, args, nil)
+	assert.Error(t, err)
+	_, err = callArguments(map[string]any{"JobID": "J-42", "Quantity": float64(-1), "Speeds": []any{}}, args, nil)
+	assert.Error(t, err)
+
+	// methods without arguments do not need any fields
+	inputs, err = callArguments(structured, nil, nil)
+	require.NoError(t, err)
+	assert.Empty(t, inputs)
+}
+
+func TestCallResult(t *testing.T) {
+	args := []*ua.Argument{{Name: "Accepted"}, {Name: ""}}
+	result := callResult(args, []*ua.Variant{ua.MustVariant(true), ua.MustVariant(int32(7)), nil})
+	assert.Equal(t, map[string]any{"Accepted": true, "output1": int32(7), "output2": nil}, result)
+
+	structured, err := setCallResult(map[string]any{"JobID": "J-42"}, "result", result)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"JobID": "J-42", "result": result}, structured)
+
+	structured, err = setCallResult(map[string]any{"JobID": "J-42"}, "", map[string]any{"Accepted": true})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"JobID": "J-42", "Accepted": true}, structured)
+
+	_, err = setCallResult(float64(42), "result", result)
+	assert.Error(t, err)
+}
@@ -0,0 +1,528 @@
+// Copyright 2023 UMH Systems GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opcua_plugin
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/errors"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// EventNodeDef is a node whose events are subscribed to, usually the Server object or an area of the address space.
+type EventNodeDef struct {
+	NodeID    *ua.NodeID
+	Name      string
+	Group     string
+	DB        string
+	Historian string
+	SqlSp     string
+}
+
+// ParseEventNodeIDs parses the nodeIDs of the opcua_events input,
+// e.g. {"1": [{"node": "i=2253", "name": "Alarms", "group": "D001", "db": "mssql", "historian": "influx", "sqlSp": "sp_sql_logging"}]}
+func ParseEventNodeIDs(incomingNodes []string) ([]EventNodeDef, error) {
+	var nodes []EventNodeDef
+
+	for _, nodeElements := range incomingNodes {
+		var nodeObj map[string][]map[string]string
+		if err := json.Unmarshal([]byte(nodeElements), &nodeObj); err != nil {
+			return nil, err
+		}
+
+		for _, values := range nodeObj {
+			for _, obj := range values {
+				nodeID, err := ua.ParseNodeID(obj["node"])
+				if err != nil {
+					return nil, fmt.Errorf("invalid node %q: %w", obj["node"], err)
+				}
+				name := obj["name"]
+				if name == "" {
+					name = nodeID.String()
+				}
+				nodes = append(nodes, EventNodeDef{
+					NodeID:    nodeID,
+					Name:      name,
+					Group:     obj["group"],
+					DB:        obj["db"],
+					Historian: obj["historian"],
+					SqlSp:     obj["sqlSp"],
+				})
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// parseBrowsePath parses a select clause like ActiveState/Id into qualified names.
+// Names of other namespaces than 0 are prefixed with their namespace index, e.g. 2:Temperature.
+func parseBrowsePath(path string) ([]*ua.QualifiedName, error) {
+	var names []*ua.QualifiedName
+	for _, segment := range strings.Split(path, "/") {
+		name := &ua.QualifiedName{Name: segment}
+		if ns, rest, ok := strings.Cut(segment, ":"); ok {
+			index, err := strconv.ParseUint(ns, 10, 16)
+			if err == nil {
+				name = &ua.QualifiedName{NamespaceIndex: uint16(index), Name: rest}
+			}
+		}
+		if name.Name == "" {
+			return nil, fmt.Errorf("invalid select clause %q", path)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// eventFilter builds the select and where clauses of the event monitored items.
+// EventId and the ConditionId are always selected, as they are needed to acknowledge conditions.
+// It returns the positions of both in the event fields.
+func eventFilter(selectClauses []string, eventTypes []*ua.NodeID, minSeverity uint16) (filter *ua.EventFilter, eventIDIndex int, conditionIDIndex int, err error) {
+	filter = &ua.EventFilter{}
+	eventIDIndex = -1
+
+	for i, clause := range selectClauses {
+		path, err := parseBrowsePath(clause)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if clause == "EventId" {
+			eventIDIndex = i
+		}
+		filter.SelectClauses = append(filter.SelectClauses, &ua.SimpleAttributeOperand{
+			TypeDefinitionID: ua.NewNumericNodeID(0, id.BaseEventType),
+			BrowsePath:       path,
+			AttributeID:      ua.AttributeIDValue,
+		})
+	}
+	if eventIDIndex < 0 {
+		eventIDIndex = len(filter.SelectClauses)
+		filter.SelectClauses = append(filter.SelectClauses, &ua.SimpleAttributeOperand{
+			TypeDefinitionID: ua.NewNumericNodeID(0, id.BaseEventType),
+			BrowsePath:       []*ua.QualifiedName{{Name: "EventId"}},
+			AttributeID:      ua.AttributeIDValue,
+		})
+	}
+	// the ConditionId is the NodeId of the condition itself, selected with an empty browse path
+	conditionIDIndex = len(filter.SelectClauses)
+	filter.SelectClauses = append(filter.SelectClauses, &ua.SimpleAttributeOperand{
+		TypeDefinitionID: ua.NewNumericNodeID(0, id.ConditionType),
+		AttributeID:      ua.AttributeIDNodeID,
+	})
+
+	filter.WhereClause = whereClause(eventTypes, minSeverity)
+	return filter, eventIDIndex, conditionIDIndex, nil
+}
+
+// contentFilterNode is an element of a where clause. Leaves have operands, all other nodes have children.
+type contentFilterNode struct {
+	operator ua.FilterOperator
+	operands []*ua.ExtensionObject
+	children []*contentFilterNode
+}
+
+// whereClause only lets events of one of the eventTypes with at least minSeverity pass.
+func whereClause(eventTypes []*ua.NodeID, minSeverity uint16) *ua.ContentFilter {
+	var conditions []*contentFilterNode
+
+	var typeConditions []*contentFilterNode
+	for _, eventType := range eventTypes {
+		typeConditions = append(typeConditions, &contentFilterNode{
+			operator: ua.FilterOperatorOfType,
+			operands: []*ua.ExtensionObject{
+				ua.NewExtensionObject(&ua.LiteralOperand{Value: ua.MustVariant(eventType)}),
+			},
+		})
+	}
+	if len(typeConditions) > 0 {
+		conditions = append(conditions, combineFilterNodes(ua.FilterOperatorOr, typeConditions))
+	}
+
+	if minSeverity > 0 {
+		conditions = append(conditions, &contentFilterNode{
+			operator: ua.FilterOperatorGreaterThanOrEqual,
+			operands: []*ua.ExtensionObject{
+				ua.NewExtensionObject(&ua.SimpleAttributeOperand{
+					TypeDefinitionID: ua.NewNumericNodeID(0, id.BaseEventType),
+					BrowsePath:       []*ua.QualifiedName{{Name: "Severity"}},
+					AttributeID:      ua.AttributeIDValue,
+				}),
+				ua.NewExtensionObject(&ua.LiteralOperand{Value: ua.MustVariant(minSeverity)}),
+			},
+		})
+	}
+
+	if len(conditions) == 0 {
+		return &ua.ContentFilter{}
+	}
+
+	// the elements are flattened in pre-order, as the first element of a content filter is its root
+	filter := &ua.ContentFilter{}
+	var flatten func(node *contentFilterNode) uint32
+	flatten = func(node *contentFilterNode) uint32 {
+		index := uint32(len(filter.Elements))
+		element := &ua.ContentFilterElement{FilterOperator: node.operator, FilterOperands: node.operands}
+		filter.Elements = append(filter.Elements, element)
+		for _, child := range node.children {
+			childIndex := flatten(child)
+			element.FilterOperands = append(element.FilterOperands, ua.NewExtensionObject(&ua.ElementOperand{Index: childIndex}))
+		}
+		return index
+	}
+	flatten(combineFilterNodes(ua.FilterOperatorAnd, conditions))
+	return filter
+}
+
+// combineFilterNodes combines nodes with a binary operator such as And or Or.
+func combineFilterNodes(operator ua.FilterOperator, nodes []*contentFilterNode) *contentFilterNode {
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	return &contentFilterNode{
+		operator: operator,
+		children: []*contentFilterNode{nodes[0], combineFilterNodes(operator, nodes[1:])},
+	}
+}
+
+// eventFieldValue converts an event field into a value that can be marshalled to JSON.
+func eventFieldValue(v *ua.Variant) any {
+	if v == nil {
+		return nil
+	}
+	switch value := v.Value().(type) {
+	case *ua.LocalizedText:
+		if value == nil {
+			return nil
+		}
+		return value.Text
+	case *ua.QualifiedName:
+		if value == nil {
+			return nil
+		}
+		return value.Name
+	case *ua.NodeID:
+		if value == nil {
+			return nil
+		}
+		return value.String()
+	case *ua.ExpandedNodeID:
+		if value == nil || value.NodeID == nil {
+			return nil
+		}
+		return value.NodeID.String()
+	case []byte:
+		return hex.EncodeToString(value)
+	default:
+		return value
+	}
+}
+
+//------------------------------------------------------------------------------
+
+var OPCUAEventsConfigSpec = service.NewConfigSpec().
+	Summary("Creates an input that subscribes to OPC-UA events, e.g. alarms and conditions. Created & maintained by the United Manufacturing Hub. About us: www.umh.app").
+	Description("Every event becomes a message containing the selected fields. The EventId and the ConditionId are added as eventId and conditionId metadata, " +
+		"so that conditions can be acknowledged or confirmed with the opcua_acknowledge processor.").
+	Fields(connectionFields()...).
+	Field(service.NewStringListField("nodeIDs").Description(`List of OPC-UA nodes whose events are subscribed to, e.g. {"1": [{"node": "i=2253", "name": "Alarms", "group": "D001"}]} for all events of the server.`)).
+	Field(service.NewStringListField("selectClauses").Description("The event fields that are selected, as browse paths from the BaseEventType, e.g. ActiveState/Id. Names of other namespaces are prefixed with their namespace index, e.g. 2:Temperature.").
+		Default([]string{"EventId", "EventType", "Message", "Severity", "SourceName", "Time", "ActiveState", "AckedState"})).
+	Field(service.NewObjectField("where",
+		service.NewStringListField("eventTypes").Description("Only pass events of one of these types or their subtypes, e.g. i=2915 for alarms. If empty, events of all types pass.").Default([]string{}),
+		service.NewIntField("minSeverity").Description("Only pass events with at least this severity (1-1000).").Default(0),
+	).Description("The where clause of the event filter."))
+
+func newOPCUAEventsInput(conf *service.ParsedConfig, mgr *service.Resources) (*OPCUAEventsInput, error) {
+	connection, err := parseConnectionConfig(conf, mgr)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeIDs, err := conf.FieldStringList("nodeIDs")
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := ParseEventNodeIDs(nodeIDs)
+	if err != nil {
+		return nil, err
+	}
+	// fail if no nodeIDs are provided
+	if len(nodes) == 0 {
+		return nil, errors.New("no nodeIDs provided")
+	}
+
+	selectClauses, err := conf.FieldStringList("selectClauses")
+	if err != nil {
+		return nil, err
+	}
+
+	eventTypeStrings, err := conf.FieldStringList("where", "eventTypes")
+	if err != nil {
+		return nil, err
+	}
+	var eventTypes []*ua.NodeID
+	for _, s := range eventTypeStrings {
+		eventType, err := ua.ParseNodeID(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event type %q: %w", s, err)
+		}
+		eventTypes = append(eventTypes, eventType)
+	}
+
+	minSeverity, err := conf.FieldInt("where", "minSeverity")
+	if err != nil {
+		return nil, err
+	}
+	if minSeverity < 0 || minSeverity > 1000 {
+		return nil, fmt.Errorf("minSeverity must be between 0 and 1000, got %d", minSeverity)
+	}
+
+	filter, eventIDIndex, conditionIDIndex, err := eventFilter(selectClauses, eventTypes, uint16(minSeverity))
+	if err != nil {
+		return nil, err
+	}
+
+	return &OPCUAEventsInput{
+		connection:       connection,
+		nodes:            nodes,
+		selectClauses:    selectClauses,
+		filter:           filter,
+		eventIDIndex:     eventIDIndex,
+		conditionIDIndex: conditionIDIndex,
+		log:              mgr.Logger(),
+	}, nil
+}
+
+func init() {
+	err := service.RegisterBatchInput(
+		"opcua_events", OPCUAEventsConfigSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchInput, error) {
+			mgr.Logger().Infof("Created & maintained by the United Manufacturing Hub. About us: www.umh.app")
+			input, err := newOPCUAEventsInput(conf, mgr)
+			if err != nil {
+				return nil, err
+			}
+			return service.AutoRetryNacksBatched(input), nil
+		})
+	if err != nil {
+		panic(err)
+	}
+}
+
+//------------------------------------------------------------------------------
+
+type OPCUAEventsInput struct {
+	connection       connectionConfig
+	nodes            []EventNodeDef
+	selectClauses    []string
+	filter           *ua.EventFilter
+	eventIDIndex     int
+	conditionIDIndex int
+	client           *opcua.Client
+	subNotifyChan    chan *opcua.PublishNotificationData
+	log              *service.Logger
+}
+
+func (g *OPCUAEventsInput) Connect(ctx context.Context) error {
+	if g.client != nil {
+		return nil
+	}
+
+	c, err := g.connection.connect(ctx, g.log)
+	if err != nil {
+		return err
+	}
+
+	g.subNotifyChan = make(chan *opcua.PublishNotificationData, 100)
+
+	sub, err := g.connection.subscribe(ctx, c, &opcua.SubscriptionParameters{
+		Interval: opcua.DefaultSubscriptionInterval,
+	}, g.subNotifyChan)
+	if err != nil {
+		g.log.Errorf("Subscribing failed: %s", err)
+		g.connection.close(ctx, c) // ensure that if something fails here, the connection is always safely closed
+		return err
+	}
+
+	monitoredRequests := make([]*ua.MonitoredItemCreateRequest, 0, len(g.nodes))
+	for pos, node := range g.nodes {
+		monitoredRequests = append(monitoredRequests, &ua.MonitoredItemCreateRequest{
+			ItemToMonitor: &ua.ReadValueID{
+				NodeID:       node.NodeID,
+				AttributeID:  ua.AttributeIDEventNotifier,
+				DataEncoding: &ua.QualifiedName{},
+			},
+			MonitoringMode: ua.MonitoringModeReporting,
+			RequestedParameters: &ua.MonitoringParameters{
+				// the handle is the position in g.nodes
+				ClientHandle:  uint32(pos),
+				DiscardOldest: true,
+				Filter:        ua.NewExtensionObject(g.filter),
+				QueueSize:     100,
+			},
+		})
+	}
+
+	res, err := readOperationLimits(ctx, c, g.log).monitor(ctx, sub, ua.TimestampsToReturnBoth, monitoredRequests...)
+	if err != nil {
+		g.log.Errorf("Monitoring failed: %s", err)
+		g.connection.close(ctx, c) // ensure that if something fails here, the connection is always safely closed
+		return err
+	}
+
+	for i, result := range res.Results {
+		if !errors.Is(result.StatusCode, ua.StatusOK) {
+			g.log.Errorf("Monitoring events of %s failed with status code: %v", g.nodes[i].NodeID, result.StatusCode)
+			g.connection.close(ctx, c) // ensure that if something fails here, the connection is always safely closed
+			return fmt.Errorf("monitoring events failed for node %s, status code: %v", g.nodes[i].NodeID, result.StatusCode)
+		}
+		g.logFilterResult(g.nodes[i], result.FilterResult)
+	}
+
+	g.log.Infof("Subscribed to events of %d nodes!", len(res.Results))
+	g.client = c
+	return nil
+}
+
+// logFilterResult logs the select clauses the server could not resolve, e.g. because of a typo.
+func (g *OPCUAEventsInput) logFilterResult(node EventNodeDef, result *ua.ExtensionObject) {
+	if result == nil {
+		return
+	}
+	filterResult, ok := result.Value.(*ua.EventFilterResult)
+	if !ok {
+		return
+	}
+	for i, status := range filterResult.SelectClauseResults {
+		if status != ua.StatusOK && i < len(g.selectClauses) {
+			g.log.Warnf("Select clause %q is invalid for events of %s: %v", g.selectClauses[i], node.NodeID, status)
+		}
+	}
+	if filterResult.WhereClauseResult != nil {
+		for _, element := range filterResult.WhereClauseResult.ElementResults {
+			if element.StatusCode != ua.StatusOK {
+				g.log.Warnf("Where clause is invalid for events of %s: %v", node.NodeID, element.StatusCode)
+			}
+		}
+	}
+}
+
+// createMessageFromEvent creates a benthos message containing the selected fields of an event.
+func (g *OPCUAEventsInput) createMessageFromEvent(node EventNodeDef, fields []*ua.Variant) *service.Message {
+	event := make(map[string]any, len(g.selectClauses))
+	for i, clause := range g.selectClauses {
+		if i < len(fields) {
+			event[clause] = eventFieldValue(fields[i])
+		}
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		g.log.Errorf("Error marshaling event to JSON: %v", err)
+		return nil
+	}
+	message := service.NewMessage(b)
+
+	if g.eventIDIndex < len(fields) {
+		if eventID, ok := eventFieldValue(fields[g.eventIDIndex]).(string); ok {
+			message.MetaSet("eventId", eventID)
+		}
+	}
+	if g.conditionIDIndex < len(fields) {
+		if conditionID, ok := eventFieldValue(fields[g.conditionIDIndex]).(string); ok {
+			message.MetaSet("conditionId", conditionID)
+		}
+	}
+	message.MetaSet("nodeID", node.NodeID.String())
+	message.MetaSet("group", node.Group)
+	message.MetaSet("db", node.DB)
+	message.MetaSet("historian", node.Historian)
+	message.MetaSet("sqlSp", node.SqlSp)
+	message.MetaSet("name", node.Name)
+
+	jsonMsg, err := json.Marshal(map[string]json.RawMessage{node.Name: b})
+	if err != nil {
+		g.log.Errorf("Could not change benthos message to json object")
+		return nil
+	}
+	message.MetaSet("Message", string(jsonMsg))
+
+	return message
+}
+
+func (g *OPCUAEventsInput) ReadBatch(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
+	if g.client == nil {
+		return nil, nil, service.ErrNotConnected
+	}
+	if ctx == nil || ctx.Done() == nil {
+		return nil, nil, errors.New("emptyCtx is invalid for ReadBatch")
+	}
+
+	select {
+	case res := <-g.subNotifyChan:
+		if res.Error != nil {
+			g.log.Errorf("ReadBatch error: %s", res.Error)
+			if isConnectionError(res.Error) {
+				g.connection.lost(ctx, g.client)
+				g.client = nil
+				return nil, nil, service.ErrNotConnected
+			}
+			return nil, nil, res.Error
+		}
+
+		msgs := service.MessageBatch{}
+		switch x := res.Value.(type) {
+		case *ua.EventNotificationList:
+			for _, item := range x.Events {
+				if item == nil || int(item.ClientHandle) >= len(g.nodes) {
+					g.log.Errorf("Received event for unknown client handle")
+					continue
+				}
+				message := g.createMessageFromEvent(g.nodes[item.ClientHandle], item.EventFields)
+				if message != nil {
+					msgs = append(msgs, message)
+				}
+			}
+		default:
+			g.log.Errorf("Unknown publish result %T", res.Value)
+		}
+
+		return msgs, func(ctx context.Context, err error) error {
+			// Nacks are retried automatically when we use service.AutoRetryNacks
+			return nil
+		}, nil
+
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+func (g *OPCUAEventsInput) Close(ctx context.Context) error {
+	if g.client != nil {
+		g.connection.close(ctx, g.client)
+		g.client = nil
+	}
+	g.connection.reverse.close()
+	return nil
+}
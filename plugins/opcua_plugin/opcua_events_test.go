@@ -0,0 +1,149 @@
+// Copyright 2023 UMH Systems GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opcua_plugin
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEventNodeIDs(t *testing.T) {
+	nodes, err := ParseEventNodeIDs([]string{
+		`{"1": [{"node": "i=2253", "name": "Alarms", "group": "D001", "db": "mssql", "historian": "influx", "sqlSp": "sp_sql_logging"}]}`,
+		`{"2": [{"node": "ns=2;s=Line1"}]}`,
+	})
+	require.NoError(t, err)
+	require.Len(t, nodes, 2)
+	assert.Equal(t, "i=2253", nodes[0].NodeID.String())
+	assert.Equal(t, "Alarms", nodes[0].Name)
+	assert.Equal(t, "sp_sql_logging", nodes[0].SqlSp)
+	assert.Equal(t, "ns=2;s=Line1", nodes[1].Name)
+
+	_, err = ParseEventNodeIDs([]string{`{"1": [{"node": "ns=abc;i=1"}]}`})
+	assert.Error(t, err)
+}
+
+func TestParseBrowsePath(t *testing.T) {
+	path, err := parseBrowsePath("ActiveState/Id")
+	require.NoError(t, err)
+	assert.Equal(t, []*ua.QualifiedName{{Name: "ActiveState"}, {Name: "Id"}}, path)
+
+	path, err = parseBrowsePath("2:Temperature")
+	require.NoError(t, err)
+	assert.Equal(t, []*ua.QualifiedName{{NamespaceIndex: 2, Name: "Temperature"}}, path)
+
+	_, err = parseBrowsePath("ActiveState//Id")
+	assert.Error(t, err)
+}
+
+func TestEventFilter(t *testing.T) {
+	filter, eventIDIndex, conditionIDIndex, err := eventFilter([]string{"Message", "Severity"}, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, filter.SelectClauses, 4)
+	assert.Equal(t, 2, eventIDIndex)
+	assert.Equal(t, 3, conditionIDIndex)
+	assert.Equal(t, ua.AttributeIDNodeID, filter.SelectClauses[3].AttributeID)
+	assert.Empty(t, filter.WhereClause.Elements)
+
+	filter, eventIDIndex, _, err = eventFilter([]string{"EventId", "Message"}, nil, 0)
+	require.NoError(t, err)
+	assert.Len(t, filter.SelectClauses, 3)
+	assert.Equal(t, 0, eventIDIndex)
+
+	// And(Or(OfType(alarm), OfType(audit)), Severity >= 500)
+	filter, _, _, err = eventFilter([]string{"Message"}, []*ua.NodeID{
+		ua.NewNumericNodeID(0, id.AlarmConditionType),
+		ua.NewNumericNodeID(0, id.AuditEventType),
+	}, 500)
+	require.NoError(t, err)
+
+	elements := filter.WhereClause.Elements
+	require.Len(t, elements, 5)
+	assert.Equal(t, ua.FilterOperatorAnd, elements[0].FilterOperator)
+	assert.Equal(t, ua.FilterOperatorOr, elements[1].FilterOperator)
+	assert.Equal(t, ua.FilterOperatorOfType, elements[2].FilterOperator)
+	assert.Equal(t, ua.FilterOperatorOfType, elements[3].FilterOperator)
+	assert.Equal(t, ua.FilterOperatorGreaterThanOrEqual, elements[4].FilterOperator)
+
+	operandIndex := func(element *ua.ContentFilterElement, i int) uint32 {
+		operand, ok := element.FilterOperands[i].Value.(*ua.ElementOperand)
+		require.True(t, ok)
+		return operand.Index
+	}
+	assert.Equal(t, uint32(1), operandIndex(elements[0], 0))
+	assert.Equal(t, uint32(4), operandIndex(elements[0], 1))
+	assert.Equal(t, uint32(2), operandIndex(elements[1], 0))
+	assert.Equal(t, uint32(3), operandIndex(elements[1], 1))
+
+	// the filter has to be encodable to be sent to the server
+	_, err = ua.Encode(ua.NewExtensionObject(filter))
+	assert.NoError(t, err)
+}
+
+func TestCreateMessageFromEvent(t *testing.T) {
+	input := &OPCUAEventsInput{
+		selectClauses:    []string{"EventType", "Message", "Severity", "Time", "ActiveState/Id"},
+		eventIDIndex:     5,
+		conditionIDIndex: 6,
+		log:              service.MockResources().Logger(),
+	}
+	node := EventNodeDef{NodeID: ua.NewNumericNodeID(0, id.Server), Name: "Alarms", Group: "D001"}
+	eventTime := time.Date(2024, 4, 6, 15, 58, 12, 0, time.UTC)
+
+	msg := input.createMessageFromEvent(node, []*ua.Variant{
+		ua.MustVariant(ua.NewNumericNodeID(0, id.OffNormalAlarmType)),
+		ua.MustVariant(&ua.LocalizedText{EncodingMask: ua.LocalizedTextText, Text: "Pressure too high"}),
+		ua.MustVariant(uint16(700)),
+		ua.MustVariant(eventTime),
+		ua.MustVariant(true),
+		ua.MustVariant([]byte{0xCA, 0xFE}),
+		ua.MustVariant(ua.NewStringNodeID(2, "Line1.PressureAlarm")),
+	})
+	require.NotNil(t, msg)
+
+	b, err := msg.AsBytes()
+	require.NoError(t, err)
+	var event map[string]any
+	require.NoError(t, json.Unmarshal(b, &event))
+	assert.Equal(t, "i=10637", event["EventType"])
+	assert.Equal(t, "Pressure too high", event["Message"])
+	assert.Equal(t, float64(700), event["Severity"])
+	assert.Equal(t, "2024-04-06T15:58:12Z", event["Time"])
+	assert.Equal(t, true, event["ActiveState/Id"])
+
+	eventID, _ := msg.MetaGet("eventId")
+	assert.Equal(t, "cafe", eventID)
+	conditionID, _ := msg.MetaGet("conditionId")
+	assert.Equal(t, "ns=2;s=Line1.PressureAlarm", conditionID)
+	group, _ := msg.MetaGet("group")
+	assert.Equal(t, "D001", group)
+
+	// the acknowledge processor calls the condition with the metadata of the event
+	req, err := conditionRequest(msg, ua.NewNumericNodeID(0, id.AcknowledgeableConditionType_Acknowledge), "checked valve")
+	require.NoError(t, err)
+	assert.Equal(t, "ns=2;s=Line1.PressureAlarm", req.ObjectID.String())
+	assert.Equal(t, []byte{0xCA, 0xFE}, req.InputArguments[0].Value())
+	assert.Equal(t, "checked valve", req.InputArguments[1].Value().(*ua.LocalizedText).Text)
+
+	_, err = conditionRequest(service.NewMessage(nil), req.MethodID, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,451 @@
+// Copyright 2023 UMH Systems GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opcua_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua/errors"
+	"github.com/gopcua/opcua/ua"
+)
+
+// historyTick is the resolution of OPC UA DateTimes. A checkpoint is resumed one tick after the last value,
+// so that the last value is not read twice.
+const historyTick = 100 * time.Nanosecond
+
+// historyCheckpoint stores the source timestamp of the last acknowledged value of every node,
+// so that a restarted backfill continues where it stopped.
+type historyCheckpoint struct {
+	path string
+
+	mu    sync.Mutex
+	nodes map[string]time.Time
+}
+
+func loadHistoryCheckpoint(path string) (*historyCheckpoint, error) {
+	c := &historyCheckpoint{path: path, nodes: map[string]time.Time{}}
+	if path == "" {
+		return c, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.nodes); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// get returns the last acknowledged timestamp of the node.
+func (c *historyCheckpoint) get(nodeID string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.nodes[nodeID]
+	return t, ok
+}
+
+// update stores the timestamp for the node, unless a later one is already stored, and persists the checkpoint.
+func (c *historyCheckpoint) update(nodeID string, t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if last, ok := c.nodes[nodeID]; ok && !t.After(last) {
+		return nil
+	}
+	c.nodes[nodeID] = t
+	if c.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(c.nodes, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so that a crash does not leave a broken checkpoint behind
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// historyNode is the progress of reading the history of a node.
+type historyNode struct {
+	node NodeDef
+	// start is the StartTime of the current request. It must not change while paging through continuation points.
+	start time.Time
+	// resume is the time after the last emitted value, where a new request starts e.g. after a reconnect.
+	resume            time.Time
+	continuationPoint []byte
+}
+
+//------------------------------------------------------------------------------
+
+var OPCUAHistoryConfigSpec = service.NewConfigSpec().
+	Summary("Creates an input that reads the history of OPC-UA nodes, e.g. to backfill gaps after network outages. Created & maintained by the United Manufacturing Hub. About us: www.umh.app").
+	Description("The browsed nodes are read with HistoryReadRaw, paging through continuation points. Nodes are read one after another, or as many at once " +
+		"as the MaxNodesPerHistoryReadData of the server allows. Every value becomes a message " +
+		"with its source timestamp in the timestamp_ms metadata. The input ends once all nodes have been read up to the endTime.").
+	Fields(connectionFields()...).
+	Field(service.NewStringListField("nodeIDs").Description("List of OPC-UA node IDs to begin browsing.")).
+	Field(service.NewStringField("startTime").Description("Start of the time range to read, in RFC3339 format, e.g. 2024-04-06T00:00:00Z. Nodes that have a checkpoint continue from there instead.").Default("")).
+	Field(service.NewStringField("endTime").Description("End of the time range to read, in RFC3339 format. If not set, the history is read up to the time the input connects.").Default("")).
+	Field(service.NewStringField("checkpointFile").Description("File where the timestamp of the last acknowledged value of every node is persisted. If set, a restarted input continues from there.").Default("")).
+	Field(service.NewIntField("numValuesPerNode").Description("Maximum number of values the server returns per request, before a continuation point is used.").Default(1000)).
+	Fields(browseFields()...)
+
+func newOPCUAHistoryInput(conf *service.ParsedConfig, mgr *service.Resources) (*OPCUAHistoryInput, error) {
+	connection, err := parseConnectionConfig(conf, mgr)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeIDs, err := conf.FieldStringList("nodeIDs")
+	if err != nil {
+		return nil, err
+	}
+	// fail if no nodeIDs are provided
+	if len(nodeIDs) == 0 {
+		return nil, errors.New("no nodeIDs provided")
+	}
+	nodeGroupMapping, nodesMapping, err := parseNodeGroupMapping(nodeIDs)
+	if err != nil {
+		return nil, err
+	}
+	browseConf, err := parseBrowseConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	browseConf = connection.shared.browseConfig(browseConf)
+
+	parseTime := func(field string) (time.Time, error) {
+		s, err := conf.FieldString(field)
+		if err != nil || s == "" {
+			return time.Time{}, err
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s: %w", field, err)
+		}
+		return t, nil
+	}
+
+	startTime, err := parseTime("startTime")
+	if err != nil {
+		return nil, err
+	}
+	endTime, err := parseTime("endTime")
+	if err != nil {
+		return nil, err
+	}
+	if !endTime.IsZero() && !startTime.Before(endTime) {
+		return nil, errors.New("startTime must be before endTime")
+	}
+
+	checkpointFile, err := conf.FieldString("checkpointFile")
+	if err != nil {
+		return nil, err
+	}
+	if startTime.IsZero() && checkpointFile == "" {
+		return nil, errors.New("either startTime or checkpointFile must be set")
+	}
+	checkpoint, err := loadHistoryCheckpoint(checkpointFile)
+	if err != nil {
+		return nil, err
+	}
+
+	numValuesPerNode, err := conf.FieldInt("numValuesPerNode")
+	if err != nil {
+		return nil, err
+	}
+	if numValuesPerNode < 0 {
+		return nil, errors.New("numValuesPerNode must not be negative")
+	}
+
+	return &OPCUAHistoryInput{
+		input: &OPCUAInput{
+			endpoint:         connection.endpoint,
+			username:         connection.username,
+			password:         connection.password,
+			securityMode:     connection.securityMode,
+			securityPolicy:   connection.securityPolicy,
+			insecure:         connection.insecure,
+			authentication:   connection.authentication,
+			certificates:     connection.certificates,
+			session:          connection.session,
+			reverse:          connection.reverse,
+			shared:           connection.shared,
+			nodeIDs:          ParseTriggerNodeIDs(nodeIDs),
+			nodeEntries:      nodeIDs,
+			nodesMapping:     nodesMapping,
+			nodeGroupMapping: nodeGroupMapping,
+			log:              mgr.Logger(),
+			browse:           browseConf,
+		},
+		startTime:        startTime,
+		endTime:          endTime,
+		checkpoint:       checkpoint,
+		numValuesPerNode: uint32(numValuesPerNode),
+		log:              mgr.Logger(),
+	}, nil
+}
+
+func init() {
+	err := service.RegisterBatchInput(
+		"opcua_history", OPCUAHistoryConfigSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchInput, error) {
+			mgr.Logger().Infof("Created & maintained by the United Manufacturing Hub. About us: www.umh.app")
+			input, err := newOPCUAHistoryInput(conf, mgr)
+			if err != nil {
+				return nil, err
+			}
+			return service.AutoRetryNacksBatched(input), nil
+		})
+	if err != nil {
+		panic(err)
+	}
+}
+
+//------------------------------------------------------------------------------
+
+type OPCUAHistoryInput struct {
+	// input connects, browses the nodes and creates the messages the same way as the opcua input
+	input            *OPCUAInput
+	startTime        time.Time
+	endTime          time.Time
+	checkpoint       *historyCheckpoint
+	numValuesPerNode uint32
+	// pending are the nodes whose history has not been read completely, the first one is read next
+	pending []*historyNode
+	started bool
+	log     *service.Logger
+}
+
+func (h *OPCUAHistoryInput) Connect(ctx context.Context) error {
+	if h.input.client != nil {
+		return nil
+	}
+
+	if err := h.input.Connect(ctx); err != nil {
+		return err
+	}
+
+	if !h.started {
+		if h.endTime.IsZero() {
+			h.endTime = time.Now().UTC()
+		}
+		h.pending = h.historyNodes(h.input.nodeList)
+		h.started = true
+		h.log.Infof("Reading the history of %d nodes until %s", len(h.pending), h.endTime.Format(time.RFC3339))
+		return nil
+	}
+
+	// continuation points are only valid within the session they were returned in
+	for _, node := range h.pending {
+		node.start = node.resume
+		node.continuationPoint = nil
+	}
+	return nil
+}
+
+// historyNodes determines where the history of every node starts, either at its checkpoint or at the startTime.
+func (h *OPCUAHistoryInput) historyNodes(nodeList []NodeDef) []*historyNode {
+	var nodes []*historyNode
+	for _, node := range nodeList {
+		if node.NodeClass != ua.NodeClassVariable {
+			continue
+		}
+
+		start := h.startTime
+		if last, ok := h.checkpoint.get(node.NodeID.String()); ok {
+			start = last.Add(historyTick)
+		}
+		if start.IsZero() {
+			h.log.Warnf("Skipping %s, as it has no checkpoint and no startTime is set", node.NodeID)
+			continue
+		}
+		if !start.Before(h.endTime) {
+			continue
+		}
+		nodes = append(nodes, &historyNode{node: node, start: start, resume: start})
+	}
+	return nodes
+}
+
+func (h *OPCUAHistoryInput) ReadBatch(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
+	if h.input.client == nil {
+		return nil, nil, service.ErrNotConnected
+	}
+
+	for len(h.pending) > 0 {
+		current := h.nextHistoryNodes()
+
+		nodesToRead := make([]*ua.HistoryReadValueID, 0, len(current))
+		for _, node := range current {
+			nodesToRead = append(nodesToRead, &ua.HistoryReadValueID{
+				NodeID:            node.node.NodeID,
+				DataEncoding:      &ua.QualifiedName{},
+				ContinuationPoint: node.continuationPoint,
+			})
+		}
+		resp, err := h.input.client.HistoryReadRawModified(ctx, nodesToRead, &ua.ReadRawModifiedDetails{
+			StartTime:        current[0].start,
+			EndTime:          h.endTime,
+			NumValuesPerNode: h.numValuesPerNode,
+		})
+		if err != nil {
+			h.log.Errorf("HistoryRead failed: %s", err)
+			if isConnectionError(err) {
+				// continuation points are only valid within their session, so the history is resumed on a new one
+				h.input.connection().lost(ctx, h.input.client)
+				h.input.client = nil
+				_ = h.input.Close(ctx)
+				return nil, nil, service.ErrNotConnected
+			}
+			return nil, nil, err
+		}
+		if len(resp.Results) != len(current) {
+			return nil, nil, fmt.Errorf("expected %d history results, got %d", len(current), len(resp.Results))
+		}
+
+		var msgs service.MessageBatch
+		checkpoints := make(map[string]time.Time)
+		done := make(map[*historyNode]bool, len(current))
+		for i, result := range resp.Results {
+			node := current[i]
+			if result.StatusCode != ua.StatusOK && result.StatusCode != ua.StatusGoodNoData && result.StatusCode != ua.StatusGoodMoreData {
+				// e.g. nodes that are not historized, which must not stop the backfill of all other nodes
+				h.log.Warnf("Skipping the history of %s: %v", node.node.NodeID, result.StatusCode)
+				done[node] = true
+				continue
+			}
+
+			node.continuationPoint = result.ContinuationPoint
+			done[node] = len(node.continuationPoint) == 0
+
+			var values []*ua.DataValue
+			if result.HistoryData != nil {
+				if data, ok := result.HistoryData.Value.(*ua.HistoryData); ok {
+					values = data.DataValues
+				}
+			}
+
+			nodeMsgs, last := h.createMessages(node.node, values)
+			if last.After(node.resume) {
+				node.resume = last.Add(historyTick)
+			}
+			if len(nodeMsgs) > 0 {
+				msgs = append(msgs, nodeMsgs...)
+				checkpoints[node.node.NodeID.String()] = last
+			}
+		}
+		remaining := make([]*historyNode, 0, len(h.pending))
+		for _, node := range h.pending {
+			if !done[node] {
+				remaining = append(remaining, node)
+			}
+		}
+		h.pending = remaining
+		if len(msgs) == 0 {
+			continue
+		}
+
+		return msgs, func(ctx context.Context, err error) error {
+			// Nacks are retried automatically when we use service.AutoRetryNacks
+			if err != nil {
+				return nil
+			}
+			for nodeID, last := range checkpoints {
+				if err := h.checkpoint.update(nodeID, last); err != nil {
+					h.log.Errorf("Updating the checkpoint of %s failed: %s", nodeID, err)
+				}
+			}
+			return nil
+		}, nil
+	}
+
+	h.log.Infof("Finished reading the history until %s", h.endTime.Format(time.RFC3339))
+	return nil, nil, service.ErrEndOfInput
+}
+
+// nextHistoryNodes returns the pending nodes that are read with the next HistoryRead. As a request has a single
+// StartTime, which must not change while paging through continuation points, it only contains nodes with the same start.
+func (h *OPCUAHistoryInput) nextHistoryNodes() []*historyNode {
+	limit := h.input.limits.historyNodesPerRead()
+	var nodes []*historyNode
+	for _, node := range h.pending {
+		if len(nodes) == limit {
+			break
+		}
+		if node.start.Equal(h.pending[0].start) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// createMessages creates a message for every historical value and returns the latest timestamp of them.
+func (h *OPCUAHistoryInput) createMessages(node NodeDef, values []*ua.DataValue) (service.MessageBatch, time.Time) {
+	var msgs service.MessageBatch
+	var last time.Time
+
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		timestamp := historyTimestamp(value)
+		if timestamp.After(last) {
+			last = timestamp
+		}
+		if value.Value == nil {
+			// e.g. bounds or values with a bad status, which have no value
+			continue
+		}
+
+		message := h.input.createMessageFromValue(value, node, node.NodeID.String(), nil)
+		if message == nil {
+			continue
+		}
+		message.MetaSet("timestamp_ms", strconv.FormatInt(timestamp.UnixMilli(), 10))
+		msgs = append(msgs, message)
+	}
+	return msgs, last
+}
+
+// historyTimestamp returns the source timestamp of a historical value, or its server timestamp if the source did not set one.
+func historyTimestamp(value *ua.DataValue) time.Time {
+	if !value.SourceTimestamp.IsZero() {
+		return value.SourceTimestamp
+	}
+	return value.ServerTimestamp
+}
+
+func (h *OPCUAHistoryInput) Close(ctx context.Context) error {
+	return h.input.Close(ctx)
+}
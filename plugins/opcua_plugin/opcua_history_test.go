@@ -0,0 +1,165 @@
+// Copyright 2023 UMH Systems GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opcua_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOPCUAHistoryConfig(t *testing.T) {
+	parse := func(yaml string) (*OPCUAHistoryInput, error) {
+		conf, err := OPCUAHistoryConfigSpec.ParseYAML(yaml, nil)
+		require.NoError(t, err)
+		return newOPCUAHistoryInput(conf, service.MockResources())
+	}
+
+	input, err := parse(`
+endpoint: opc.tcp://localhost:46010
+nodeIDs: ['{"1": [{"node": "ns=2;s=Pressure", "name": "Pressure", "group": "D001"}]}']
+startTime: 2024-04-06T00:00:00Z
+endTime: 2024-04-07T00:00:00Z
+`)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 4, 6, 0, 0, 0, 0, time.UTC), input.startTime)
+	assert.Equal(t, time.Date(2024, 4, 7, 0, 0, 0, 0, time.UTC), input.endTime)
+	assert.Equal(t, uint32(1000), input.numValuesPerNode)
+	assert.Equal(t, "D001,,,,Pressure", input.input.nodeGroupMapping["ns=2;s=Pressure"])
+
+	for _, invalid := range []string{
+		// neither startTime nor checkpointFile
+		`{endpoint: opc.tcp://localhost:46010, nodeIDs: ['{"1": [{"node": "ns=2;s=Pressure"}]}']}`,
+		`{endpoint: opc.tcp://localhost:46010, nodeIDs: ['{"1": [{"node": "ns=2;s=Pressure"}]}'], startTime: yesterday}`,
+		`{endpoint: opc.tcp://localhost:46010, nodeIDs: ['{"1": [{"node": "ns=2;s=Pressure"}]}'], startTime: 2024-04-07T00:00:00Z, endTime: 2024-04-06T00:00:00Z}`,
+		`{endpoint: opc.tcp://localhost:46010, nodeIDs: [], startTime: 2024-04-06T00:00:00Z}`,
+	} {
+		_, err := parse(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestHistoryCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	checkpoint, err := loadHistoryCheckpoint(path)
+	require.NoError(t, err)
+	_, ok := checkpoint.get("ns=2;s=Pressure")
+	assert.False(t, ok)
+
+	first := time.Date(2024, 4, 6, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, checkpoint.update("ns=2;s=Pressure", first))
+	require.NoError(t, checkpoint.update("ns=2;s=Pressure", first.Add(time.Minute)))
+	// acks of older batches must not move the checkpoint back
+	require.NoError(t, checkpoint.update("ns=2;s=Pressure", first))
+
+	reloaded, err := loadHistoryCheckpoint(path)
+	require.NoError(t, err)
+	last, ok := reloaded.get("ns=2;s=Pressure")
+	assert.True(t, ok)
+	assert.Equal(t, first.Add(time.Minute), last)
+
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0o644))
+	_, err = loadHistoryCheckpoint(path)
+	assert.Error(t, err)
+}
+
+func TestHistoryNodes(t *testing.T) {
+	checkpoint, err := loadHistoryCheckpoint("")
+	require.NoError(t, err)
+
+	start := time.Date(2024, 4, 6, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	require.NoError(t, checkpoint.update("ns=2;s=Temperature", start.Add(time.Hour)))
+	require.NoError(t, checkpoint.update("ns=2;s=Humidity", end))
+
+	input := &OPCUAHistoryInput{
+		startTime:  start,
+		endTime:    end,
+		checkpoint: checkpoint,
+		log:        service.MockResources().Logger(),
+	}
+	nodes := input.historyNodes([]NodeDef{
+		{NodeID: ua.NewStringNodeID(2, "Pressure"), NodeClass: ua.NodeClassVariable},
+		{NodeID: ua.NewStringNodeID(2, "Temperature"), NodeClass: ua.NodeClassVariable},
+		// already read up to the endTime
+		{NodeID: ua.NewStringNodeID(2, "Humidity"), NodeClass: ua.NodeClassVariable},
+		{NodeID: ua.NewStringNodeID(2, "Folder"), NodeClass: ua.NodeClassObject},
+	})
+
+	require.Len(t, nodes, 2)
+	assert.Equal(t, start, nodes[0].start)
+	assert.Equal(t, start.Add(time.Hour+historyTick), nodes[1].start)
+	assert.Equal(t, nodes[1].start, nodes[1].resume)
+}
+
+func TestNextHistoryNodes(t *testing.T) {
+	start := time.Date(2024, 4, 6, 0, 0, 0, 0, time.UTC)
+	nodes := []*historyNode{
+		{node: NodeDef{NodeID: ua.NewStringNodeID(2, "Pressure")}, start: start},
+		{node: NodeDef{NodeID: ua.NewStringNodeID(2, "Temperature")}, start: start.Add(time.Hour)},
+		{node: NodeDef{NodeID: ua.NewStringNodeID(2, "Humidity")}, start: start},
+		{node: NodeDef{NodeID: ua.NewStringNodeID(2, "Flow")}, start: start},
+	}
+
+	// without a MaxNodesPerHistoryReadData, the nodes are read one after another
+	input := &OPCUAHistoryInput{input: &OPCUAInput{}, pending: nodes}
+	assert.Equal(t, nodes[:1], input.nextHistoryNodes())
+
+	// a request only contains nodes with the same StartTime
+	input.input.limits.maxNodesPerHistoryReadData = 2
+	assert.Equal(t, []*historyNode{nodes[0], nodes[2]}, input.nextHistoryNodes())
+	input.input.limits.maxNodesPerHistoryReadData = 10
+	assert.Equal(t, []*historyNode{nodes[0], nodes[2], nodes[3]}, input.nextHistoryNodes())
+}
+
+func TestHistoryCreateMessages(t *testing.T) {
+	input := &OPCUAHistoryInput{
+		input: &OPCUAInput{
+			nodeGroupMapping: map[string]string{"ns=2;s=Pressure": "D001,mssql,influx,sp_sql_logging,Pressure"},
+			log:              service.MockResources().Logger(),
+		},
+		log: service.MockResources().Logger(),
+	}
+	node := NodeDef{NodeID: ua.NewStringNodeID(2, "Pressure"), NodeClass: ua.NodeClassVariable}
+	source := time.Date(2024, 4, 6, 12, 0, 0, 0, time.UTC)
+
+	msgs, last := input.createMessages(node, []*ua.DataValue{
+		{Value: ua.MustVariant(1.5), SourceTimestamp: source, ServerTimestamp: source.Add(time.Second)},
+		{Value: ua.MustVariant(2.5), ServerTimestamp: source.Add(time.Minute)},
+		// values without a value still move the timestamp forward
+		{Status: ua.StatusBadNoData, SourceTimestamp: source.Add(time.Hour)},
+	})
+
+	require.Len(t, msgs, 2)
+	assert.Equal(t, source.Add(time.Hour), last)
+
+	b, err := msgs[0].AsBytes()
+	require.NoError(t, err)
+	assert.Equal(t, "1.5", string(b))
+	timestamp, _ := msgs[0].MetaGet("timestamp_ms")
+	assert.Equal(t, "1712404800000", timestamp)
+	group, _ := msgs[0].MetaGet("group")
+	assert.Equal(t, "D001", group)
+
+	timestamp, _ = msgs[1].MetaGet("timestamp_ms")
+	assert.Equal(t, "1712404860000", timestamp)
+}
@@ -0,0 +1,308 @@
+// Copyright 2023 UMH Systems GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opcua_plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+)
+
+var OPCUAServerConfigSpec = service.NewConfigSpec().
+	Summary("Creates an output that hosts an OPC-UA server and publishes the messages as its variables. Created & maintained by the United Manufacturing Hub. About us: www.umh.app").
+	Description("Every message updates a variable below the Objects folder, which is created with its folders on the first message. " +
+		"The path of the variable is taken from the path field, e.g. a topic, or from the group and name metadata that the " +
+		"opcua, modbus and Allen-Bradley inputs set. JSON objects update one variable per key below the path, and a timestamp_ms key " +
+		"sets the SourceTimestamp of the values. Numbers become Double, booleans Boolean and everything else String " +
+		"variables. Clients can browse, read and subscribe to the variables, but not write them.").
+	Field(service.NewStringField("endpoint").Description("Endpoint the server listens on. A host of 0.0.0.0 listens on all interfaces and advertises the host name of the machine.").Default("opc.tcp://0.0.0.0:4840")).
+	Field(service.NewStringField("namespaceURI").Description("URI of namespace 1, which contains the variables.").Default("urn:benthos-umh")).
+	Field(service.NewInterpolatedStringField("path").Description(`Path of the variable, e.g. ${! meta("topic") }. If empty, the path is the group and name metadata of the message.`).Default("")).
+	Field(service.NewStringField("pathSeparator").Description(`Separator of the folders in the path, e.g. "." for topics like enterprise.site.area.`).Default("/")).
+	Field(service.NewStringListField("securityPolicies").Description("Security policies the server offers: None, Basic128Rsa15, Basic256, Basic256Sha256, Aes128_Sha256_RsaOaep or Aes256_Sha256_RsaPss. All except None are offered with the Sign and SignAndEncrypt security modes. None neither signs nor encrypts the connection, so it is not offered by default.").Default([]string{"Basic256Sha256"})).
+	Field(service.NewStringField("serverCertificateFile").Description("PEM file of the server certificate. If it does not exist, a certificate is generated once and stored there, so that clients only need to trust the server once. If not set, a new certificate is generated on every start.").Default("")).
+	Field(service.NewStringField("serverPrivateKeyFile").Description("PEM file of the private key of the server certificate. Required if serverCertificateFile is set.").Default("")).
+	Field(service.NewStringField("trustedCertsDir").Description("Directory with the trusted client certificates (DER or PEM). Clients with other certificates are rejected on the endpoints with security.").Default("")).
+	Field(service.NewStringField("rejectedCertsDir").Description("Directory where rejected client certificates are stored, so that they can be reviewed and moved to the trustedCertsDir.").Default("")).
+	Field(service.NewStringListField("clientCertificateThumbprints").Description("SHA1 thumbprints (hex) of the trusted client certificates, which are trusted in addition to the trustedCertsDir.").Default([]string{})).
+	Field(service.NewStringMapField("users").Description("User names and passwords of the users that may connect. Passwords are encrypted with the strongest security policy even on endpoints without security.").Default(map[string]any{})).
+	Field(service.NewBoolField("allowAnonymous").Description("Set to true to also accept clients without a user name, e.g. if the clients are authenticated by their certificates.").Default(false)).
+	Field(service.NewOutputMaxInFlightField())
+
+func newOPCUAServerOutput(conf *service.ParsedConfig, mgr *service.Resources) (*OPCUAServerOutput, error) {
+	var sc serverConfig
+	var err error
+
+	if sc.endpoint, err = conf.FieldString("endpoint"); err != nil {
+		return nil, err
+	}
+	if sc.namespaceURI, err = conf.FieldString("namespaceURI"); err != nil {
+		return nil, err
+	}
+
+	policies, err := conf.FieldStringList("securityPolicies")
+	if err != nil {
+		return nil, err
+	}
+	if len(policies) == 0 {
+		return nil, errors.New("no securityPolicies provided")
+	}
+	for _, policy := range policies {
+		uri := "http://opcfoundation.org/UA/SecurityPolicy#" + policy
+		if _, ok := securityPolicyRanks[uri]; !ok {
+			return nil, fmt.Errorf("unknown security policy %s", policy)
+		}
+		sc.securityPolicies = append(sc.securityPolicies, uri)
+	}
+
+	if sc.certificate.certificateFile, err = conf.FieldString("serverCertificateFile"); err != nil {
+		return nil, err
+	}
+	if sc.certificate.privateKeyFile, err = conf.FieldString("serverPrivateKeyFile"); err != nil {
+		return nil, err
+	}
+	if (sc.certificate.certificateFile == "") != (sc.certificate.privateKeyFile == "") {
+		return nil, errors.New("serverCertificateFile and serverPrivateKeyFile must be set together")
+	}
+	if sc.certificate.trustedCertsDir, err = conf.FieldString("trustedCertsDir"); err != nil {
+		return nil, err
+	}
+	if sc.certificate.rejectedCertsDir, err = conf.FieldString("rejectedCertsDir"); err != nil {
+		return nil, err
+	}
+	if sc.certificate.thumbprints, err = conf.FieldStringList("clientCertificateThumbprints"); err != nil {
+		return nil, err
+	}
+	for i, thumbprint := range sc.certificate.thumbprints {
+		sc.certificate.thumbprints[i] = normalizeThumbprint(thumbprint)
+	}
+
+	if sc.users, err = conf.FieldStringMap("users"); err != nil {
+		return nil, err
+	}
+	if sc.allowAnonymous, err = conf.FieldBool("allowAnonymous"); err != nil {
+		return nil, err
+	}
+	if !sc.allowAnonymous && len(sc.users) == 0 {
+		return nil, errors.New("users are required unless allowAnonymous is set")
+	}
+
+	path, err := conf.FieldInterpolatedString("path")
+	if err != nil {
+		return nil, err
+	}
+	separator, err := conf.FieldString("pathSeparator")
+	if err != nil {
+		return nil, err
+	}
+	if separator == "" {
+		return nil, errors.New("pathSeparator must not be empty")
+	}
+
+	return &OPCUAServerOutput{
+		conf:      sc,
+		path:      path,
+		separator: separator,
+		log:       mgr.Logger(),
+	}, nil
+}
+
+func init() {
+	err := service.RegisterOutput(
+		"opcua_server", OPCUAServerConfigSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (out service.Output, maxInFlight int, err error) {
+			mgr.Logger().Infof("Created & maintained by the United Manufacturing Hub. About us: www.umh.app")
+			if maxInFlight, err = conf.FieldMaxInFlight(); err != nil {
+				return
+			}
+			out, err = newOPCUAServerOutput(conf, mgr)
+			return
+		})
+	if err != nil {
+		panic(err)
+	}
+}
+
+//------------------------------------------------------------------------------
+
+type OPCUAServerOutput struct {
+	conf      serverConfig
+	path      *service.InterpolatedString
+	separator string
+	server    *uaServer
+	log       *service.Logger
+}
+
+func (o *OPCUAServerOutput) Connect(ctx context.Context) error {
+	if o.server != nil {
+		return nil
+	}
+
+	srv, err := newServer(o.conf, o.log)
+	if err != nil {
+		return err
+	}
+	if err := srv.start(); err != nil {
+		return err
+	}
+	o.server = srv
+	return nil
+}
+
+func (o *OPCUAServerOutput) Write(ctx context.Context, msg *service.Message) error {
+	if o.server == nil {
+		return service.ErrNotConnected
+	}
+
+	path, err := o.messagePath(msg)
+	if err != nil {
+		return err
+	}
+	values, sourceTimestamp, err := messageValues(msg)
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return errors.New("message has no values")
+	}
+
+	for _, v := range values {
+		if err := o.server.setVariable(append(path[:len(path):len(path)], v.path...), v.value, sourceTimestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// messagePath returns the folders and the name of the variable of a message.
+func (o *OPCUAServerOutput) messagePath(msg *service.Message) ([]string, error) {
+	var segments []string
+	path, err := o.path.TryString(msg)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		segments = strings.Split(path, o.separator)
+	} else {
+		group, _ := msg.MetaGet("group")
+		name, _ := msg.MetaGet("name")
+		if name == "" {
+			return nil, errors.New("message has no name metadata and no path is configured")
+		}
+		segments = []string{group, name}
+	}
+
+	var cleaned []string
+	for _, segment := range segments {
+		if segment != "" {
+			cleaned = append(cleaned, segment)
+		}
+	}
+	if len(cleaned) == 0 {
+		return nil, fmt.Errorf("invalid path %q", path)
+	}
+	return cleaned, nil
+}
+
+// messageValue is a value of a message with its path below the path of the message.
+type messageValue struct {
+	path  []string
+	value any
+}
+
+// messageValues flattens a message into its values. Objects are flattened into one value per key, sorted by
+// their paths, and a timestamp_ms key at the top sets the source timestamp. Other messages are a single value,
+// or a string if they are not JSON.
+func messageValues(msg *service.Message) ([]messageValue, time.Time, error) {
+	sourceTimestamp := time.Now()
+
+	structured, err := msg.AsStructured()
+	if err != nil {
+		raw, rawErr := msg.AsBytes()
+		if rawErr != nil {
+			return nil, sourceTimestamp, rawErr
+		}
+		structured = string(raw)
+	}
+
+	obj, ok := structured.(map[string]any)
+	if !ok {
+		if structured == nil {
+			return nil, sourceTimestamp, nil
+		}
+		return []messageValue{{value: structured}}, sourceTimestamp, nil
+	}
+
+	if ts, ok := obj["timestamp_ms"]; ok {
+		s, err := scalarString(ts)
+		if err != nil {
+			return nil, sourceTimestamp, fmt.Errorf("invalid timestamp_ms: %w", err)
+		}
+		ms, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, sourceTimestamp, fmt.Errorf("invalid timestamp_ms: %w", err)
+		}
+		sourceTimestamp = time.UnixMilli(int64(ms))
+		obj = shallowCopyWithout(obj, "timestamp_ms")
+	}
+
+	var values []messageValue
+	var flatten func(prefix []string, obj map[string]any)
+	flatten = func(prefix []string, obj map[string]any) {
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			path := append(prefix[:len(prefix):len(prefix)], key)
+			switch v := obj[key].(type) {
+			case nil:
+				// null values leave the variable unchanged
+			case map[string]any:
+				flatten(path, v)
+			default:
+				values = append(values, messageValue{path: path, value: v})
+			}
+		}
+	}
+	flatten(nil, obj)
+	return values, sourceTimestamp, nil
+}
+
+func shallowCopyWithout(obj map[string]any, without string) map[string]any {
+	c := make(map[string]any, len(obj))
+	for key, value := range obj {
+		if key != without {
+			c[key] = value
+		}
+	}
+	return c
+}
+
+func (o *OPCUAServerOutput) Close(ctx context.Context) error {
+	if o.server != nil {
+		o.server.close()
+		o.server = nil
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package opcua_plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uapolicy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testServerConfig is a server on a random port that clients can connect to without security.
+const testServerConfig = `
+endpoint: opc.tcp://127.0.0.1:0
+securityPolicies: [None]
+allowAnonymous: true
+`
+
+func newTestServerOutput(t *testing.T, yaml string) *OPCUAServerOutput {
+	t.Helper()
+	conf, err := OPCUAServerConfigSpec.ParseYAML(yaml, nil)
+	require.NoError(t, err)
+	out, err := newOPCUAServerOutput(conf, service.MockResources())
+	require.NoError(t, err)
+	return out
+}
+
+func TestMessageValues(t *testing.T) {
+	msg := service.NewMessage([]byte(`{"timestamp_ms": 1700000000000, "temperature": 23.5, "state": {"running": true, "mode": "auto"}, "ignored": null}`))
+	values, sourceTimestamp, err := messageValues(msg)
+	require.NoError(t, err)
+	assert.Equal(t, time.UnixMilli(1700000000000), sourceTimestamp)
+	require.Len(t, values, 3)
+	assert.Equal(t, []string{"state", "mode"}, values[0].path)
+	assert.Equal(t, "auto", values[0].value)
+	assert.Equal(t, []string{"state", "running"}, values[1].path)
+	assert.Equal(t, true, values[1].value)
+	assert.Equal(t, []string{"temperature"}, values[2].path)
+
+	values, _, err = messageValues(service.NewMessage([]byte(`not json`)))
+	require.NoError(t, err)
+	require.Len(t, values, 1)
+	assert.Nil(t, values[0].path)
+	assert.Equal(t, "not json", values[0].value)
+
+	_, _, err = messageValues(service.NewMessage([]byte(`{"timestamp_ms": "yesterday"}`)))
+	assert.Error(t, err)
+}
+
+func TestMessagePath(t *testing.T) {
+	out := newTestServerOutput(t, `allowAnonymous: true`)
+	msg := service.NewMessage([]byte(`1`))
+	msg.MetaSet("group", "line1")
+	msg.MetaSet("name", "temperature")
+	path, err := out.messagePath(msg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"line1", "temperature"}, path)
+
+	_, err = out.messagePath(service.NewMessage([]byte(`1`)))
+	assert.Error(t, err)
+
+	out = newTestServerOutput(t, `
+allowAnonymous: true
+path: ${! meta("topic") }
+pathSeparator: "."
+`)
+	msg.MetaSet("topic", "enterprise.site..area.temperature")
+	path, err = out.messagePath(msg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"enterprise", "site", "area", "temperature"}, path)
+}
+
+func TestParseServerConfig(t *testing.T) {
+	for _, yaml := range []string{
+		"{}",
+		"securityPolicies: []",
+		"securityPolicies: [Basic512]",
+		"serverCertificateFile: server.pem",
+		`pathSeparator: ""`,
+	} {
+		conf, err := OPCUAServerConfigSpec.ParseYAML(yaml, nil)
+		require.NoError(t, err)
+		_, err = newOPCUAServerOutput(conf, service.MockResources())
+		assert.Error(t, err, yaml)
+	}
+}
+
+func TestOPCUAServerOutput(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	client := certificateConfig{certificateFile: filepath.Join(dir, "client.pem"), privateKeyFile: filepath.Join(dir, "client.key")}
+	_, der, err := client.clientCertificate(service.MockResources().Logger())
+	require.NoError(t, err)
+
+	out := newTestServerOutput(t, fmt.Sprintf(`
+endpoint: opc.tcp://127.0.0.1:0
+securityPolicies: [None, Basic256Sha256]
+clientCertificateThumbprints: [%s]
+users:
+  operator: secret
+allowAnonymous: true
+`, certificateThumbprint(der)))
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+
+	write := func(value string) {
+		msg := service.NewMessage([]byte(value))
+		msg.MetaSet("group", "line1")
+		msg.MetaSet("name", "temperature")
+		require.NoError(t, out.Write(ctx, msg))
+	}
+	write(`23.5`)
+
+	endpoint := fmt.Sprintf("opc.tcp://127.0.0.1:%d", out.server.listener.Addr().(*net.TCPAddr).Port)
+	nodeID := ua.NewStringNodeID(1, "line1/temperature")
+
+	t.Run("anonymous", func(t *testing.T) {
+		c, err := opcua.NewClient(endpoint, opcua.SecurityMode(ua.MessageSecurityModeNone))
+		require.NoError(t, err)
+		require.NoError(t, c.Connect(ctx))
+		defer c.Close(ctx)
+
+		resp, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: []*ua.ReadValueID{{NodeID: nodeID, AttributeID: ua.AttributeIDValue}}})
+		require.NoError(t, err)
+		require.Len(t, resp.Results, 1)
+		assert.Equal(t, ua.StatusOK, resp.Results[0].Status)
+		assert.Equal(t, 23.5, resp.Results[0].Value.Value())
+
+		refs, err := c.Node(ua.NewNumericNodeID(0, 85)).ReferencedNodes(ctx, 35, ua.BrowseDirectionForward, ua.NodeClassAll, true)
+		require.NoError(t, err)
+		var folders []string
+		for _, ref := range refs {
+			folders = append(folders, ref.ID.String())
+		}
+		assert.Contains(t, folders, "ns=1;s=line1")
+
+		notifyCh := make(chan *opcua.PublishNotificationData, 10)
+		sub, err := c.Subscribe(ctx, &opcua.SubscriptionParameters{Interval: 100 * time.Millisecond}, notifyCh)
+		require.NoError(t, err)
+		defer sub.Cancel(ctx)
+		_, err = sub.Monitor(ctx, ua.TimestampsToReturnBoth, opcua.NewMonitoredItemCreateRequestWithDefaults(nodeID, ua.AttributeIDValue, 1))
+		require.NoError(t, err)
+
+		write(`24.5`)
+		for {
+			select {
+			case data := <-notifyCh:
+				require.NoError(t, data.Error)
+				notification, ok := data.Value.(*ua.DataChangeNotification)
+				if !ok {
+					continue
+				}
+				for _, item := range notification.MonitoredItems {
+					if item.Value.Value.Value() == 24.5 {
+						return
+					}
+				}
+			case <-ctx.Done():
+				t.Fatal("no data change notification received")
+			}
+		}
+	})
+
+	t.Run("untrusted server", func(t *testing.T) {
+		rejectedDir := t.TempDir()
+		conf, err := parseConnectionConfig(testConfig(t, connectionFields(), fmt.Sprintf(`
+endpoint: %s
+username: operator
+password: secret
+securityMode: SignAndEncrypt
+securityPolicy: Basic256Sha256
+rejectedCertsDir: %s
+`, endpoint, rejectedDir)), service.MockResources())
+		require.NoError(t, err)
+		_, err = conf.connect(ctx, service.MockResources().Logger())
+		assert.Error(t, err)
+
+		// the certificate is stored for review, so that it can be trusted
+		_, err = os.Stat(filepath.Join(rejectedDir, certificateThumbprint(out.server.cert)+".der"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("username", func(t *testing.T) {
+		conf, err := parseConnectionConfig(testConfig(t, connectionFields(), fmt.Sprintf(`
+endpoint: %s
+username: operator
+password: secret
+securityMode: SignAndEncrypt
+securityPolicy: Basic256Sha256
+serverCertificateThumbprints: [%s]
+clientCertificateFile: %s
+clientPrivateKeyFile: %s
+`, endpoint, certificateThumbprint(out.server.cert), client.certificateFile, client.privateKeyFile)), service.MockResources())
+		require.NoError(t, err)
+		c, err := conf.connect(ctx, service.MockResources().Logger())
+		require.NoError(t, err)
+		defer c.Close(ctx)
+
+		v, err := c.Node(nodeID).Value(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 24.5, v.Value())
+
+		conf.password = "wrong"
+		_, err = conf.connect(ctx, service.MockResources().Logger())
+		assert.Error(t, err)
+	})
+}
+
+func TestOPCUAServerClientTrust(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	log := service.MockResources().Logger()
+	trusted := certificateConfig{certificateFile: filepath.Join(dir, "trusted.pem"), privateKeyFile: filepath.Join(dir, "trusted.key")}
+	_, der, err := trusted.clientCertificate(log)
+	require.NoError(t, err)
+
+	rejectedDir := filepath.Join(dir, "rejected")
+	out := newTestServerOutput(t, fmt.Sprintf(`
+endpoint: opc.tcp://127.0.0.1:0
+rejectedCertsDir: %s
+clientCertificateThumbprints: [%s]
+allowAnonymous: true
+`, rejectedDir, certificateThumbprint(der)))
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+
+	connect := func(certs string) error {
+		conf, err := parseConnectionConfig(testConfig(t, connectionFields(), fmt.Sprintf(`
+endpoint: opc.tcp://127.0.0.1:%d
+securityMode: SignAndEncrypt
+securityPolicy: Basic256Sha256
+serverCertificateThumbprints: [%s]
+%s`, out.server.listener.Addr().(*net.TCPAddr).Port, certificateThumbprint(out.server.cert), certs)), service.MockResources())
+		require.NoError(t, err)
+		c, err := conf.connect(ctx, log)
+		if err != nil {
+			return err
+		}
+		return c.Close(ctx)
+	}
+
+	assert.NoError(t, connect(fmt.Sprintf("clientCertificateFile: %s\nclientPrivateKeyFile: %s\n", trusted.certificateFile, trusted.privateKeyFile)))
+
+	// a client with a generated certificate is rejected, and its certificate is stored for review
+	assert.Error(t, connect(""))
+	rejected, err := os.ReadDir(rejectedDir)
+	require.NoError(t, err)
+	assert.Len(t, rejected, 1)
+
+	// clients without security are not offered an endpoint
+	c, err := opcua.NewClient(fmt.Sprintf("opc.tcp://127.0.0.1:%d", out.server.listener.Addr().(*net.TCPAddr).Port), opcua.SecurityMode(ua.MessageSecurityModeNone))
+	require.NoError(t, err)
+	assert.Error(t, c.Connect(ctx))
+}
+
+// noneChannel is an open channel without security of a server with the security policies.
+func noneChannel(t *testing.T, policies ...string) *serverChannel {
+	t.Helper()
+	algo, err := uapolicy.Symmetric(ua.SecurityPolicyURINone, nil, nil)
+	require.NoError(t, err)
+	return &serverChannel{
+		srv:       &uaServer{conf: serverConfig{securityPolicies: policies}, log: service.MockResources().Logger()},
+		id:        1,
+		policyURI: ua.SecurityPolicyURINone,
+		mode:      ua.MessageSecurityModeNone,
+		chunks:    map[uint32][][]byte{},
+		tokens:    map[uint32]*uapolicy.EncryptionAlgorithm{1: algo},
+	}
+}
+
+// intermediateChunk encodes an intermediate chunk of a request on a channel without security.
+func intermediateChunk(requestID uint32, size int) []byte {
+	b := make([]byte, 24+size)
+	copy(b, "MSGC")
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[8:], 1)  // secure channel ID
+	binary.LittleEndian.PutUint32(b[12:], 1) // token ID
+	binary.LittleEndian.PutUint32(b[16:], requestID)
+	binary.LittleEndian.PutUint32(b[20:], requestID)
+	return b
+}
+
+func TestServerChannelChunkLimits(t *testing.T) {
+	// clients can only buffer the chunks of a few requests
+	ch := noneChannel(t, ua.SecurityPolicyURINone)
+	for id := uint32(1); id <= maxChunkedRequests; id++ {
+		require.NoError(t, ch.receive(intermediateChunk(id, 100)))
+	}
+	assert.ErrorIs(t, ch.receive(intermediateChunk(maxChunkedRequests+1, 100)), ua.StatusBadTCPNotEnoughResources)
+	assert.Equal(t, maxChunkedRequests*100, ch.chunkBytes)
+
+	// and at most a message of the maximum size
+	ch = noneChannel(t, ua.SecurityPolicyURINone)
+	var err error
+	for id := uint32(1); err == nil; id = id%maxChunkedRequests + 1 {
+		err = ch.receive(intermediateChunk(id, 60000))
+	}
+	assert.ErrorIs(t, err, ua.StatusBadTCPMessageTooLarge)
+
+	// channels that are only accepted for the discovery can not send chunked requests
+	ch = noneChannel(t, ua.SecurityPolicyURIBasic256Sha256)
+	assert.ErrorIs(t, ch.receive(intermediateChunk(1, 100)), ua.StatusBadSecurityPolicyRejected)
+	assert.Empty(t, ch.chunks)
+}
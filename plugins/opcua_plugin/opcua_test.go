@@ -1460,6 +1460,11 @@ func TestAgainstRemoteInstance(t *testing.T) {
 	})
 
 	t.Run("ReadBatch_SecurityMode_SecurityPolicy", func(t *testing.T) {
+		// servers are only trusted by their certificate on endpoints with security
+		thumbprint := os.Getenv("TEST_WAGO_SERVER_THUMBPRINT")
+		if thumbprint == "" {
+			t.Skip("Skipping test: TEST_WAGO_SERVER_THUMBPRINT not set")
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
@@ -1477,6 +1482,7 @@ func TestAgainstRemoteInstance(t *testing.T) {
 			insecure:       false,
 			securityMode:   "SignAndEncrypt",
 			securityPolicy: "Basic128Rsa15",
+			certificates:   certificateConfig{thumbprints: []string{normalizeThumbprint(thumbprint)}},
 		}
 		// Attempt to connect
 		err = input.Connect(ctx)
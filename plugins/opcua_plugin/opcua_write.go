@@ -0,0 +1,519 @@
+// Copyright 2023 UMH Systems GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opcua_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/errors"
+	"github.com/gopcua/opcua/ua"
+)
+
+// WriteNodeDef maps a field of the incoming messages to the node it is written to.
+type WriteNodeDef struct {
+	NodeID *ua.NodeID
+	// Field is the path of the value in the JSON message, e.g. setpoint or recipe.speed.
+	// If empty, the whole message is written.
+	Field string
+	// DataType overrides the DataType discovered by browsing the node.
+	DataType string
+}
+
+// ParseWriteNodeIDs parses the nodeIDs of the opcua_write output,
+// e.g. {"1": [{"node": "ns=2;s=Setpoint", "field": "setpoint", "datatype": "float32"}]}
+func ParseWriteNodeIDs(incomingNodes []string) ([]WriteNodeDef, error) {
+	var nodes []WriteNodeDef
+
+	for _, nodeElements := range incomingNodes {
+		var nodeObj map[string][]map[string]string
+		if err := json.Unmarshal([]byte(nodeElements), &nodeObj); err != nil {
+			return nil, err
+		}
+
+		for _, values := range nodeObj {
+			for _, obj := range values {
+				nodeID, err := ua.ParseNodeID(obj["node"])
+				if err != nil {
+					return nil, fmt.Errorf("invalid node %q: %w", obj["node"], err)
+				}
+				nodes = append(nodes, WriteNodeDef{
+					NodeID:   nodeID,
+					Field:    obj["field"],
+					DataType: obj["datatype"],
+				})
+			}
+		}
+	}
+	return nodes, nil
+}
+
+//------------------------------------------------------------------------------
+
+var OPCUAWriteConfigSpec = service.NewConfigSpec().
+	Summary("Creates an output that writes message fields to OPC-UA nodes. Created & maintained by the United Manufacturing Hub. About us: www.umh.app").
+	Description("The values are converted to the DataType of each node as discovered by browsing it, so e.g. a JSON number is written " +
+		"as Float, Int16 or UInt32 depending on the node. All writes of a batch are sent in one WriteRequest, and a node that several messages of the batch write only gets the value of the latest one. Messages whose " +
+		"writes are answered with a bad StatusCode are nacked.").
+	Fields(connectionFields()...).
+	Field(service.NewStringListField("nodeIDs").Description(`List of OPC-UA nodes to write and the message field written to them, e.g. {"1": [{"node": "ns=2;s=Setpoint", "field": "setpoint"}]}. The optional datatype overrides the DataType of the node.`)).
+	Field(service.NewBoolField("readBack").Description("Set to true to read the nodes back after writing them and nack the message if the server reports a different value, e.g. for setpoint changes. Default is false.").Default(false)).
+	Field(service.NewBatchPolicyField("batching")).
+	Field(service.NewOutputMaxInFlightField())
+
+func newOPCUAWriteOutput(conf *service.ParsedConfig, mgr *service.Resources) (*OPCUAWriteOutput, error) {
+	connection, err := parseConnectionConfig(conf, mgr)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeIDs, err := conf.FieldStringList("nodeIDs")
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := ParseWriteNodeIDs(nodeIDs)
+	if err != nil {
+		return nil, err
+	}
+	// fail if no nodeIDs are provided
+	if len(nodes) == 0 {
+		return nil, errors.New("no nodeIDs provided")
+	}
+
+	readBack, err := conf.FieldBool("readBack")
+	if err != nil {
+		return nil, err
+	}
+
+	return &OPCUAWriteOutput{
+		connection: connection,
+		nodes:      nodes,
+		readBack:   readBack,
+		log:        mgr.Logger(),
+	}, nil
+}
+
+func init() {
+	err := service.RegisterBatchOutput(
+		"opcua_write", OPCUAWriteConfigSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (out service.BatchOutput, batchPolicy service.BatchPolicy, maxInFlight int, err error) {
+			mgr.Logger().Infof("Created & maintained by the United Manufacturing Hub. About us: www.umh.app")
+			if batchPolicy, err = conf.FieldBatchPolicy("batching"); err != nil {
+				return
+			}
+			if maxInFlight, err = conf.FieldMaxInFlight(); err != nil {
+				return
+			}
+			out, err = newOPCUAWriteOutput(conf, mgr)
+			return
+		})
+	if err != nil {
+		panic(err)
+	}
+}
+
+//------------------------------------------------------------------------------
+
+type OPCUAWriteOutput struct {
+	connection connectionConfig
+	nodes      []WriteNodeDef
+	// dataTypes are the DataTypes of the nodes, in the same order as nodes
+	dataTypes []string
+	readBack  bool
+	limits    operationLimits
+	client    *opcua.Client
+	log       *service.Logger
+}
+
+func (o *OPCUAWriteOutput) Connect(ctx context.Context) error {
+	if o.client != nil {
+		return nil
+	}
+
+	c, err := o.connection.connect(ctx, o.log)
+	if err != nil {
+		return err
+	}
+
+	dataTypes := make([]string, len(o.nodes))
+	for i, node := range o.nodes {
+		if node.DataType != "" {
+			dataTypes[i] = node.DataType
+			continue
+		}
+
+		defs, err := browse(ctx, c.Node(node.NodeID), "", 0, o.log)
+		if err != nil {
+			o.log.Errorf("Browsing %s failed: %s", node.NodeID, err)
+			o.connection.close(ctx, c) // ensure that if something fails here, the connection is always safely closed
+			return err
+		}
+		if len(defs) != 1 || defs[0].NodeClass != ua.NodeClassVariable {
+			o.connection.close(ctx, c)
+			return fmt.Errorf("node %s is not a variable", node.NodeID)
+		}
+		if !defs[0].Writable {
+			o.log.Warnf("Node %s is not writable for the current user", node.NodeID)
+		}
+		dataTypes[i] = defs[0].DataType
+		if _, err := convertValue(nil, dataTypes[i]); err != nil {
+			o.connection.close(ctx, c)
+			return fmt.Errorf("node %s: %w", node.NodeID, err)
+		}
+		o.log.Infof("Writing field %q to %s as %s", node.Field, node.NodeID, dataTypes[i])
+	}
+
+	o.dataTypes = dataTypes
+	o.limits = readOperationLimits(ctx, c, o.log)
+	o.client = c
+	return nil
+}
+
+// pendingWrite is a single value of a message that is written to a node.
+type pendingWrite struct {
+	message int
+	node    *ua.NodeID
+	value   *ua.Variant
+}
+
+func (o *OPCUAWriteOutput) WriteBatch(ctx context.Context, batch service.MessageBatch) error {
+	if o.client == nil {
+		return service.ErrNotConnected
+	}
+
+	var batchErr *service.BatchError
+	fail := func(i int, err error) {
+		o.log.Errorf("Writing message %d failed: %v", i, err)
+		if batchErr == nil {
+			batchErr = service.NewBatchError(batch, errors.New("writing to OPC-UA failed"))
+		}
+		batchErr.Failed(i, err)
+	}
+
+	var writes []pendingWrite
+	for i, msg := range batch {
+		msgWrites, err := o.messageWrites(i, msg)
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+		writes = append(writes, msgWrites...)
+	}
+
+	if len(writes) == 0 {
+		if batchErr != nil {
+			return batchErr
+		}
+		return nil
+	}
+	writes = latestWrites(writes)
+
+	nodesToWrite := make([]*ua.WriteValue, 0, len(writes))
+	for _, write := range writes {
+		nodesToWrite = append(nodesToWrite, &ua.WriteValue{
+			NodeID:      write.node,
+			AttributeID: ua.AttributeIDValue,
+			Value: &ua.DataValue{
+				EncodingMask: ua.DataValueValue,
+				Value:        write.value,
+			},
+		})
+	}
+
+	resp, err := o.limits.write(ctx, o.client, &ua.WriteRequest{NodesToWrite: nodesToWrite})
+	if err != nil {
+		o.log.Errorf("Write failed: %s", err)
+		if isConnectionError(err) {
+			o.connection.lost(ctx, o.client)
+			o.client = nil
+			return service.ErrNotConnected
+		}
+		return err
+	}
+	if len(resp.Results) != len(writes) {
+		return fmt.Errorf("expected %d write results, got %d", len(writes), len(resp.Results))
+	}
+
+	written := make([]pendingWrite, 0, len(writes))
+	for j, status := range resp.Results {
+		if status != ua.StatusOK {
+			fail(writes[j].message, fmt.Errorf("writing %s: %w", writes[j].node, status))
+			continue
+		}
+		written = append(written, writes[j])
+	}
+
+	if o.readBack && len(written) > 0 {
+		if err := o.verify(ctx, written, fail); err != nil {
+			return err
+		}
+	}
+
+	if batchErr != nil {
+		return batchErr
+	}
+	return nil
+}
+
+// latestWrites keeps only the last write of every node. Servers may apply the writes of a request in any order, so
+// a node that is written by several messages of a batch only gets the value of the latest message. The older
+// values are superseded and their messages succeed without writing them.
+func latestWrites(writes []pendingWrite) []pendingWrite {
+	last := make(map[string]int, len(writes))
+	for j, write := range writes {
+		last[write.node.String()] = j
+	}
+	latest := make([]pendingWrite, 0, len(last))
+	for j, write := range writes {
+		if last[write.node.String()] == j {
+			latest = append(latest, write)
+		}
+	}
+	return latest
+}
+
+// messageWrites converts the configured fields of a message into typed variants.
+func (o *OPCUAWriteOutput) messageWrites(i int, msg *service.Message) ([]pendingWrite, error) {
+	structured, err := msg.AsStructured()
+	if err != nil {
+		// not JSON, so the message can only be written as a whole
+		raw, rawErr := msg.AsBytes()
+		if rawErr != nil {
+			return nil, rawErr
+		}
+		structured = string(raw)
+	}
+
+	var writes []pendingWrite
+	for n, node := range o.nodes {
+		value, ok := lookupField(structured, node.Field)
+		if !ok {
+			continue
+		}
+		variant, err := toVariant(value, o.dataTypes[n])
+		if err != nil {
+			return nil, fmt.Errorf("converting %q for %s: %w", node.Field, node.NodeID, err)
+		}
+		writes = append(writes, pendingWrite{message: i, node: node.NodeID, value: variant})
+	}
+	if len(writes) == 0 {
+		return nil, errors.New("message contains none of the configured fields")
+	}
+	return writes, nil
+}
+
+// verify reads the written nodes back and fails the messages whose nodes report another value.
+func (o *OPCUAWriteOutput) verify(ctx context.Context, written []pendingWrite, fail func(int, error)) error {
+	nodesToRead := make([]*ua.ReadValueID, 0, len(written))
+	for _, write := range written {
+		nodesToRead = append(nodesToRead, &ua.ReadValueID{
+			NodeID:      write.node,
+			AttributeID: ua.AttributeIDValue,
+		})
+	}
+
+	resp, err := o.limits.read(ctx, o.client, &ua.ReadRequest{
+		MaxAge:             0,
+		NodesToRead:        nodesToRead,
+		TimestampsToReturn: ua.TimestampsToReturnNeither,
+	})
+	if err != nil {
+		o.log.Errorf("Read back failed: %s", err)
+		if isConnectionError(err) {
+			o.connection.lost(ctx, o.client)
+			o.client = nil
+			return service.ErrNotConnected
+		}
+		return err
+	}
+	if len(resp.Results) != len(written) {
+		return fmt.Errorf("expected %d read results, got %d", len(written), len(resp.Results))
+	}
+
+	for j, result := range resp.Results {
+		if result.Status != ua.StatusOK {
+			fail(written[j].message, fmt.Errorf("reading back %s: %w", written[j].node, result.Status))
+			continue
+		}
+		if result.Value == nil || !reflect.DeepEqual(result.Value.Value(), written[j].value.Value()) {
+			var got any
+			if result.Value != nil {
+				got = result.Value.Value()
+			}
+			fail(written[j].message, fmt.Errorf("read back %v from %s after writing %v", got, written[j].node, written[j].value.Value()))
+		}
+	}
+	return nil
+}
+
+func (o *OPCUAWriteOutput) Close(ctx context.Context) error {
+	if o.client != nil {
+		o.connection.close(ctx, o.client)
+		o.client = nil
+	}
+	o.connection.reverse.close()
+	return nil
+}
+
+//------------------------------------------------------------------------------
+
+// lookupField returns the value at the dot separated path in a structured message.
+// An empty path returns the whole message.
+func lookupField(structured any, field string) (any, bool) {
+	if field == "" {
+		return structured, structured != nil
+	}
+
+	value := structured
+	for _, key := range strings.Split(field, ".") {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+// toVariant converts a value of a JSON message into a variant of the given DataType,
+// as returned by browse. Arrays are converted element by element.
+func toVariant(value any, dataType string) (*ua.Variant, error) {
+	if elements, ok := value.([]any); ok {
+		scalar, err := convertValue(nil, dataType)
+		if err != nil {
+			return nil, err
+		}
+		slice := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(scalar)), 0, len(elements))
+		for _, element := range elements {
+			converted, err := convertValue(element, dataType)
+			if err != nil {
+				return nil, err
+			}
+			slice = reflect.Append(slice, reflect.ValueOf(converted))
+		}
+		return ua.NewVariant(slice.Interface())
+	}
+
+	converted, err := convertValue(value, dataType)
+	if err != nil {
+		return nil, err
+	}
+	return ua.NewVariant(converted)
+}
+
+// convertValue converts a single value into the Go type of the DataType.
+// A nil value returns the zero value of the type.
+func convertValue(value any, dataType string) (any, error) {
+	var s string
+	if value != nil {
+		var err error
+		if s, err = scalarString(value); err != nil {
+			return nil, err
+		}
+	}
+
+	parseInt := func(bits int) (int64, error) {
+		if value == nil {
+			return 0, nil
+		}
+		return strconv.ParseInt(s, 10, bits)
+	}
+	parseUint := func(bits int) (uint64, error) {
+		if value == nil {
+			return 0, nil
+		}
+		return strconv.ParseUint(s, 10, bits)
+	}
+	parseFloat := func(bits int) (float64, error) {
+		if value == nil {
+			return 0, nil
+		}
+		return strconv.ParseFloat(s, bits)
+	}
+
+	switch dataType {
+	case "bool":
+		if value == nil {
+			return false, nil
+		}
+		return strconv.ParseBool(s)
+	case "int8":
+		v, err := parseInt(8)
+		return int8(v), err
+	case "byte", "uint8":
+		v, err := parseUint(8)
+		return uint8(v), err
+	case "int16":
+		v, err := parseInt(16)
+		return int16(v), err
+	case "uint16":
+		v, err := parseUint(16)
+		return uint16(v), err
+	case "int32":
+		v, err := parseInt(32)
+		return int32(v), err
+	case "uint32":
+		v, err := parseUint(32)
+		return uint32(v), err
+	case "int64":
+		return parseInt(64)
+	case "uint64":
+		return parseUint(64)
+	case "float32":
+		v, err := parseFloat(32)
+		return float32(v), err
+	case "float64":
+		return parseFloat(64)
+	case "string":
+		return s, nil
+	case "time.Time":
+		if value == nil {
+			return time.Time{}, nil
+		}
+		if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.UnixMilli(ms).UTC(), nil
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	return nil, fmt.Errorf("writing DataType %s is not supported", dataType)
+}
+
+// scalarString formats a scalar JSON value so that it can be parsed into the DataType of a node.
+func scalarString(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("cannot write a %T", value)
+}
@@ -0,0 +1,159 @@
+// Copyright 2023 UMH Systems GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opcua_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWriteNodeIDs(t *testing.T) {
+	nodes, err := ParseWriteNodeIDs([]string{
+		`{"1": [{"node": "ns=2;s=Setpoint", "field": "setpoint"}, {"node": "ns=2;i=1001", "field": "recipe.speed", "datatype": "uint16"}]}`,
+	})
+	require.NoError(t, err)
+	require.Len(t, nodes, 2)
+	assert.Equal(t, "ns=2;s=Setpoint", nodes[0].NodeID.String())
+	assert.Equal(t, "setpoint", nodes[0].Field)
+	assert.Equal(t, "recipe.speed", nodes[1].Field)
+	assert.Equal(t, "uint16", nodes[1].DataType)
+
+	_, err = ParseWriteNodeIDs([]string{`{"1": [{"node": "ns=abc;i=1"}]}`})
+	assert.Error(t, err)
+	_, err = ParseWriteNodeIDs([]string{`not json`})
+	assert.Error(t, err)
+}
+
+func TestLookupField(t *testing.T) {
+	structured := map[string]any{
+		"setpoint": 12.5,
+		"recipe":   map[string]any{"speed": json.Number("1200")},
+		"empty":    nil,
+	}
+
+	value, ok := lookupField(structured, "setpoint")
+	assert.True(t, ok)
+	assert.Equal(t, 12.5, value)
+
+	value, ok = lookupField(structured, "recipe.speed")
+	assert.True(t, ok)
+	assert.Equal(t, json.Number("1200"), value)
+
+	value, ok = lookupField(structured, "")
+	assert.True(t, ok)
+	assert.Equal(t, structured, value)
+
+	for _, missing := range []string{"missing", "setpoint.value", "recipe.temperature", "empty"} {
+		_, ok = lookupField(structured, missing)
+		assert.False(t, ok, missing)
+	}
+}
+
+func TestToVariant(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    any
+		dataType string
+		expected any
+	}{
+		{"bool", true, "bool", true},
+		{"bool from string", "false", "bool", false},
+		{"int8", float64(-5), "int8", int8(-5)},
+		{"byte", json.Number("255"), "byte", uint8(255)},
+		{"int16", json.Number("-300"), "int16", int16(-300)},
+		{"uint16", float64(1200), "uint16", uint16(1200)},
+		{"int32", "70000", "int32", int32(70000)},
+		{"uint32", float64(4000000000), "uint32", uint32(4000000000)},
+		{"float32", 12.5, "float32", float32(12.5)},
+		{"float64", json.Number("0.1"), "float64", 0.1},
+		{"string", "recipe-42", "string", "recipe-42"},
+		{"number as string", float64(42), "string", "42"},
+		{"time from unix ms", float64(1700000000000), "time.Time", time.UnixMilli(1700000000000).UTC()},
+		{"time from RFC3339", "2023-11-14T22:13:20Z", "time.Time", time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)},
+		{"array", []any{float64(1), float64(2), float64(3)}, "int16", []int16{1, 2, 3}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := toVariant(tc.value, tc.dataType)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, v.Value())
+		})
+	}
+
+	for _, invalid := range []struct {
+		value    any
+		dataType string
+	}{
+		{float64(128), "int8"},
+		{float64(-1), "uint16"},
+		{1.5, "int32"},
+		{"yes please", "bool"},
+		{map[string]any{"a": 1}, "string"},
+		{float64(1), "ns=0;i=884"},
+	} {
+		_, err := toVariant(invalid.value, invalid.dataType)
+		assert.Error(t, err, "%v as %s", invalid.value, invalid.dataType)
+	}
+}
+
+func TestLatestWrites(t *testing.T) {
+	setpoint := ua.NewStringNodeID(2, "Setpoint")
+	speed := ua.NewStringNodeID(2, "Speed")
+	writes := latestWrites([]pendingWrite{
+		{message: 0, node: setpoint, value: ua.MustVariant(10.0)},
+		{message: 0, node: speed, value: ua.MustVariant(int16(1200))},
+		{message: 1, node: ua.NewStringNodeID(2, "Setpoint"), value: ua.MustVariant(12.5)},
+	})
+
+	// only the newest setpoint is written, so a server can not apply the older one last
+	require.Len(t, writes, 2)
+	assert.Equal(t, 0, writes[0].message)
+	assert.Equal(t, speed, writes[0].node)
+	assert.Equal(t, 1, writes[1].message)
+	assert.Equal(t, 12.5, writes[1].value.Value())
+}
+
+func TestOPCUAWriteNotConnected(t *testing.T) {
+	nodes, err := ParseWriteNodeIDs([]string{`{"1": [{"node": "ns=2;s=Setpoint", "field": "setpoint"}]}`})
+	require.NoError(t, err)
+
+	output := &OPCUAWriteOutput{
+		nodes:     nodes,
+		dataTypes: []string{"float32"},
+		log:       service.MockResources().Logger(),
+	}
+
+	err = output.WriteBatch(context.Background(), service.MessageBatch{service.NewMessage([]byte(`{"setpoint": 1}`))})
+	assert.Equal(t, service.ErrNotConnected, err)
+
+	// messages without any configured field are nacked before anything is sent
+	writes, err := output.messageWrites(0, service.NewMessage([]byte(`{"other": 1}`)))
+	assert.Error(t, err)
+	assert.Empty(t, writes)
+
+	writes, err = output.messageWrites(3, service.NewMessage([]byte(`{"setpoint": 21.5}`)))
+	require.NoError(t, err)
+	require.Len(t, writes, 1)
+	assert.Equal(t, 3, writes[0].message)
+	assert.Equal(t, float32(21.5), writes[0].value.Value())
+}
@@ -16,11 +16,7 @@ package opcua_plugin
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 
 	"regexp"
@@ -32,9 +28,7 @@ import (
 
 	"github.com/gopcua/opcua"
 	"github.com/gopcua/opcua/errors"
-	"github.com/gopcua/opcua/id"
 	"github.com/gopcua/opcua/ua"
-	"github.com/gopcua/opcua/uatest"
 )
 
 type TNodeDef struct {
@@ -56,222 +50,137 @@ func (n TNodeDef) Records() []string {
 	return []string{n.BrowseName, n.DataType, n.TNodeID.String(), n.Unit, n.Scale, n.Min, n.Max, strconv.FormatBool(n.Writable), n.Description}
 }
 
-func tBrowse(ctx context.Context, n *opcua.Node, path string, level int, logger *service.Logger) ([]TNodeDef, error) {
-	logger.Debugf("node:%s path:%q level:%d\n", n, path, level)
-	if level > 10 {
-		return nil, nil
-	}
-
-	attrs, err := n.Attributes(ctx, ua.AttributeIDNodeClass, ua.AttributeIDBrowseName, ua.AttributeIDDescription, ua.AttributeIDAccessLevel, ua.AttributeIDDataType)
+// tBrowse browses the node tree below id like browse, and returns the variables as trigger nodes.
+func (g *OPCUATriInput) tBrowse(ctx context.Context, id *ua.NodeID) ([]TNodeDef, error) {
+	nodes, err := g.browse.nodes(ctx, g.client, g.endpoint, id, g.log)
 	if err != nil {
 		return nil, err
 	}
 
-	var def = TNodeDef{
-		TNodeID: n.ID,
-	}
-
-	switch err := attrs[0].Status; err {
-	case ua.StatusOK:
-		def.NodeClass = ua.NodeClass(attrs[0].Value.Int())
-	case ua.StatusBadSecurityModeInsufficient:
-		return nil, nil
-	default:
-		return nil, err
-	}
-
-	switch err := attrs[1].Status; err {
-	case ua.StatusOK:
-		def.BrowseName = attrs[1].Value.String()
-	case ua.StatusBadSecurityModeInsufficient:
-		return nil, nil
-	default:
-		return nil, err
-	}
-
-	switch err := attrs[2].Status; err {
-	case ua.StatusOK:
-		def.Description = attrs[2].Value.String()
-	case ua.StatusBadAttributeIDInvalid:
-		// ignore
-	case ua.StatusBadSecurityModeInsufficient:
-		return nil, nil
-	default:
-		return nil, err
-	}
-
-	switch err := attrs[3].Status; err {
-	case ua.StatusOK:
-		def.AccessLevel = ua.AccessLevelType(attrs[3].Value.Int())
-		def.Writable = def.AccessLevel&ua.AccessLevelTypeCurrentWrite == ua.AccessLevelTypeCurrentWrite
-	case ua.StatusBadAttributeIDInvalid:
-		// ignore
-	case ua.StatusBadSecurityModeInsufficient:
-		return nil, nil
-	default:
-		return nil, err
-	}
-
-	switch err := attrs[4].Status; err {
-	case ua.StatusOK:
-		switch v := attrs[4].Value.NodeID().IntID(); v {
-		case id.DateTime:
-			def.DataType = "time.Time"
-		case id.Boolean:
-			def.DataType = "bool"
-		case id.SByte:
-			def.DataType = "int8"
-		case id.Int16:
-			def.DataType = "int16"
-		case id.Int32:
-			def.DataType = "int32"
-		case id.Byte:
-			def.DataType = "byte"
-		case id.UInt16:
-			def.DataType = "uint16"
-		case id.UInt32:
-			def.DataType = "uint32"
-		case id.UtcTime:
-			def.DataType = "time.Time"
-		case id.String:
-			def.DataType = "string"
-		case id.Float:
-			def.DataType = "float32"
-		case id.Double:
-			def.DataType = "float64"
-		default:
-			def.DataType = attrs[4].Value.NodeID().String()
-		}
-	case ua.StatusBadAttributeIDInvalid:
-		// ignore
-	case ua.StatusBadSecurityModeInsufficient:
-		return nil, nil
-	default:
-		return nil, err
-	}
-
-	def.Path = join(path, def.BrowseName)
-	logger.Debugf("%d: def.Path:%s def.NodeClass:%s\n", level, def.Path, def.NodeClass)
-
-	var nodes []TNodeDef
-	// If a node has a Variable class, it probably means that it is a tag
-	// Therefore, no need to browse further
-	if def.NodeClass == ua.NodeClassVariable {
-		nodes = append(nodes, def)
-		return nodes, nil
-	}
-
-	browseChildren := func(refType uint32) error {
-		refs, err := n.ReferencedNodes(ctx, refType, ua.BrowseDirectionForward, ua.NodeClassAll, true)
-		if err != nil {
-			return errors.Errorf("References: %d: %s", refType, err)
-		}
-		logger.Debugf("found %d child refs\n", len(refs))
-		for _, rn := range refs {
-			children, err := tBrowse(ctx, rn, def.Path, level+1, logger)
-			if err != nil {
-				return errors.Errorf("browse children: %s", err)
-			}
-			nodes = append(nodes, children...)
-		}
-		return nil
-	}
-
-	// If a node has an Object class, it probably means that it is a folder
-	// Therefore, browse its children
-	if def.NodeClass == ua.NodeClassObject {
-		// To determine if an Object is a folder, we need to check different references
-		// Add here all references that should be checked
-		if err := browseChildren(id.HasComponent); err != nil {
-			return nil, err
-		}
-		if err := browseChildren(id.Organizes); err != nil {
-			return nil, err
-		}
-		if err := browseChildren(id.FolderType); err != nil {
-			return nil, err
-		}
-		// For hasProperty it makes sense to show it very close to the tag itself, e.g., use the tagName as tagGroup and then the properties as subparts of it
-		/*
-			if err := browseChildren(id.HasProperty); err != nil {
-				return nil, err
-			}
-		*/
+	tNodes := make([]TNodeDef, 0, len(nodes))
+	for _, n := range nodes {
+		tNodes = append(tNodes, TNodeDef{
+			TNodeID:     n.NodeID,
+			NodeClass:   n.NodeClass,
+			BrowseName:  n.BrowseName,
+			Description: n.Description,
+			AccessLevel: n.AccessLevel,
+			Path:        n.Path,
+			DataType:    n.DataType,
+			Writable:    n.Writable,
+			Unit:        n.Unit,
+			Scale:       n.Scale,
+			Min:         n.Min,
+			Max:         n.Max,
+		})
 	}
-	return nodes, nil
+	return tNodes, nil
 }
 
 //------------------------------------------------------------------------------
 
 var OPCUATriConfigSpec = service.NewConfigSpec().
 	Summary("Creates an input that reads data from OPC-UA servers").
-	Field(service.NewStringField("endpoint").Description("Address of the OPC-UA server to connect with.")).
-	Field(service.NewStringField("username").Description("Username for server access. If not set, no username is used.").Default("")).
-	Field(service.NewStringField("password").Description("Password for server access. If not set, no password is used.").Default("")).
+	Fields(connectionFields()...).
 	//Field(service.NewStringListField("nodeIDs").Description("List of OPC-UA node IDs to begin browsing.")).
 	Field(service.NewStringListField("tNodeIDs").Description("List of OPC-UA trigger node IDs.")).
 	Field(service.NewStringListField("tBatchNodeIDs").Description("List of OPC-UA trigger batch node IDs.")).
-	Field(service.NewStringField("securityMode").Description("Security mode to use. If not set, a reasonable security mode will be set depending on the discovered endpoints.").Default("")).
-	Field(service.NewStringField("securityPolicy").Description("The security policy to use.  If not set, a reasonable security policy will be set depending on the discovered endpoints.").Default("")).
-	Field(service.NewBoolField("insecure").Description("Set to true to bypass secure connections, useful in case of SSL or certificate issues. Default is secure (false).").Default(false)).
-	Field(service.NewBoolField("subscribeEnabled").Description("Set to true to subscribe to OPC-UA nodes instead of fetching them every seconds. Default is pulling messages every second (false).").Default(false))
-
-func newOPCUATriInput(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchInput, error) {
-	endpoint, err := conf.FieldString("endpoint")
+	Field(service.NewBoolField("subscribeEnabled").Description("Set to true to subscribe to OPC-UA nodes instead of fetching them every seconds. Default is pulling messages every second (false).").Default(false)).
+	Fields(pollFields()...).
+	Field(service.NewStringEnumField("payloadFormat", "value", "json").Description("Set to json to emit the trigger and batch values with their status, source and server timestamps and native types as JSON payload, instead of only the trigger value.").Default("value")).
+	Fields(qualityFields()...).
+	Fields(subscriptionFields()...).
+	Fields(browseFields()...)
+
+func newOPCUATriInput(conf *service.ParsedConfig, mgr *service.Resources) (*OPCUATriInput, error) {
+	connection, err := parseConnectionConfig(conf, mgr)
 	if err != nil {
 		return nil, err
 	}
 
-	securityMode, err := conf.FieldString("securityMode")
+	subscribeEnabled, err := conf.FieldBool("subscribeEnabled")
 	if err != nil {
 		return nil, err
 	}
 
-	securityPolicy, err := conf.FieldString("securityPolicy")
+	payloadFormat, err := conf.FieldString("payloadFormat")
 	if err != nil {
 		return nil, err
 	}
 
-	username, err := conf.FieldString("username")
+	qualityConf, err := parseQualityConfig(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	password, err := conf.FieldString("password")
+	/* nodeIDs, err := conf.FieldStringList("nodeIDs")
 	if err != nil {
 		return nil, err
-	}
+	} */
 
-	insecure, err := conf.FieldBool("insecure")
+	tNodeIDs, err := conf.FieldStringList("tNodeIDs")
 	if err != nil {
 		return nil, err
 	}
 
-	subscribeEnabled, err := conf.FieldBool("subscribeEnabled")
+	tBatchNodeIDs, err := conf.FieldStringList("tBatchNodeIDs")
 	if err != nil {
 		return nil, err
 	}
 
-	/* nodeIDs, err := conf.FieldStringList("nodeIDs")
+	// fail if no nodeIDs are provided
+	if len(tNodeIDs) == 0 {
+		return nil, errors.New("no tNodeIDs provided")
+	}
+
+	subscription, err := parseSubscriptionConfig(conf, tNodeIDs)
 	if err != nil {
 		return nil, err
-	} */
+	}
 
-	tNodeIDs, err := conf.FieldStringList("tNodeIDs")
+	poll, err := parsePollConfig(conf, tNodeIDs)
 	if err != nil {
 		return nil, err
 	}
 
-	tBatchNodeIDs, err := conf.FieldStringList("tBatchNodeIDs")
+	browseConf, err := parseBrowseConfig(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	// fail if no nodeIDs are provided
-	if len(tNodeIDs) == 0 {
-		return nil, errors.New("no tNodeIDs provided")
+	browseConf = connection.shared.browseConfig(browseConf)
+
+	m := &OPCUATriInput{
+		endpoint:          connection.endpoint,
+		username:          connection.username,
+		password:          connection.password,
+		tNodeEntries:      tNodeIDs,
+		tBatchNodeEntries: tBatchNodeIDs,
+		log:               mgr.Logger(),
+		securityMode:      connection.securityMode,
+		securityPolicy:    connection.securityPolicy,
+		insecure:          connection.insecure,
+		authentication:    connection.authentication,
+		certificates:      connection.certificates,
+		session:           connection.session,
+		reverse:           connection.reverse,
+		shared:            connection.shared,
+		subscribeEnabled:  subscribeEnabled,
+		poll:              poll,
+		payloadFormat:     payloadFormat,
+		quality:           qualityConf,
+		subscription:      subscription,
+		browse:            browseConf,
+	}
+	if err := m.setNodeEntries(tNodeIDs, tBatchNodeIDs); err != nil {
+		return nil, err
 	}
 
+	return m, nil
+}
+
+// setNodeEntries parses the trigger and batch node entries into the node IDs and mappings of the input.
+func (g *OPCUATriInput) setNodeEntries(tNodeIDs []string, tBatchNodeIDs []string) error {
 	parsedNodeIDs := ParseNodeIDs(tNodeIDs)
 	parsedTNodeIDs := ParseTriggerNodeIDs(tNodeIDs)
 
@@ -283,7 +192,7 @@ func newOPCUATriInput(conf *service.ParsedConfig, mgr *service.Resources) (servi
 	// 	var temp map[string][]string
 	// 	err := json.Unmarshal([]byte(node), &temp)
 	// 	if err != nil {
-	// 		return nil, err
+	// 		return err
 	// 	}
 
 	// 	for _, value := range temp {
@@ -298,7 +207,7 @@ func newOPCUATriInput(conf *service.ParsedConfig, mgr *service.Resources) (servi
 		var tNodeObj map[string][]map[string]string
 		err := json.Unmarshal([]byte(tNodeElements), &tNodeObj)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		for key, values := range tNodeObj {
@@ -320,7 +229,7 @@ func newOPCUATriInput(conf *service.ParsedConfig, mgr *service.Resources) (servi
 	// 	var temp map[string][]string
 	// 	err := json.Unmarshal([]byte(node), &temp)
 	// 	if err != nil {
-	// 		return nil, err
+	// 		return err
 	// 	}
 	// 	for key, val := range temp {
 	// 		tNodesMapping[val[0]] = key
@@ -339,7 +248,7 @@ func newOPCUATriInput(conf *service.ParsedConfig, mgr *service.Resources) (servi
 		// Unmarshal the JSON string into the temporary map
 		err := json.Unmarshal([]byte(jsonString), &temp)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// Merge the temporary map into the result map
@@ -358,25 +267,44 @@ func newOPCUATriInput(conf *service.ParsedConfig, mgr *service.Resources) (servi
 	}
 	parsedBatchTNodeIDs := ParseNodeIDs(tBatch)
 
-	m := &OPCUATriInput{
-		endpoint:              endpoint,
-		username:              username,
-		password:              password,
-		nodeIDs:               parsedNodeIDs,
-		tNodeIDs:              parsedTNodeIDs,
-		batchTNodeIDs:         parsedBatchTNodeIDs,
-		tBatchNodesMapping:    tBatchNodesMapping,
-		tNodesMapping:         tNodesMapping,
-		tBatchNodeNameMapping: tBatchNodeNameMapping,
-		tNodeGroupMapping:     tNodeGroupMapping,
-		log:                   mgr.Logger(),
-		securityMode:          securityMode,
-		securityPolicy:        securityPolicy,
-		insecure:              insecure,
-		subscribeEnabled:      subscribeEnabled,
-	}
-
-	return service.AutoRetryNacksBatched(m), nil
+	g.nodeIDs = parsedNodeIDs
+	g.tNodeIDs = parsedTNodeIDs
+	g.batchTNodeIDs = parsedBatchTNodeIDs
+	g.tBatchNodesMapping = tBatchNodesMapping
+	g.tNodesMapping = tNodesMapping
+	g.tBatchNodeNameMapping = tBatchNodeNameMapping
+	g.tNodeGroupMapping = tNodeGroupMapping
+	if err := g.subscription.setNodes(tNodeIDs); err != nil {
+		return err
+	}
+	return g.poll.setNodes(tNodeIDs)
+}
+
+// resolveNodes resolves the nsu= node IDs and browse paths of the configured nodes, as the namespace
+// indexes of the server may have changed since the last connect.
+func (g *OPCUATriInput) resolveNodes(ctx context.Context) error {
+	tNodes, err := configuredNodes(g.tNodeEntries)
+	if err != nil {
+		return err
+	}
+	tBatchNodes, err := configuredNodes(g.tBatchNodeEntries)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveNodes(ctx, g.client, append(tNodes, tBatchNodes...), g.log)
+	if err != nil || resolved == nil {
+		return err
+	}
+
+	tNodeIDs, err := rewriteNodeEntries(g.tNodeEntries, resolved)
+	if err != nil {
+		return err
+	}
+	tBatchNodeIDs, err := rewriteNodeEntries(g.tBatchNodeEntries, resolved)
+	if err != nil {
+		return err
+	}
+	return g.setNodeEntries(tNodeIDs, tBatchNodeIDs)
 }
 
 func init() {
@@ -385,7 +313,11 @@ func init() {
 		"opcuatrigger", OPCUATriConfigSpec,
 		func(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchInput, error) {
 			mgr.Logger().Infof("Created & maintained by the BGRI ")
-			return newOPCUATriInput(conf, mgr)
+			input, err := newOPCUATriInput(conf, mgr)
+			if err != nil {
+				return nil, err
+			}
+			return service.AutoRetryNacksBatched(input), nil
 		})
 	if err != nil {
 		panic(err)
@@ -401,6 +333,8 @@ type OPCUATriInput struct {
 	nodeIDs               []*ua.NodeID
 	tNodeIDs              []*ua.NodeID
 	batchTNodeIDs         []*ua.NodeID
+	tNodeEntries          []string // the configured tNodeIDs and tBatchNodeIDs, kept to resolve them on every connect
+	tBatchNodeEntries     []string
 	tNodesMapping         map[string]string
 	tBatchNodesMapping    map[string][]*ua.NodeID
 	nodeList              []TNodeDef
@@ -411,149 +345,56 @@ type OPCUATriInput struct {
 	securityMode          string
 	securityPolicy        string
 	insecure              bool
+	authentication        authenticationConfig
+	certificates          certificateConfig
+	session               *sessionConfig
+	reverse               *reverseConnectConfig
+	shared                *connectionRef
 	client                *opcua.Client
+	watch                 *sessionWatch
 	log                   *service.Logger
 	// this is required for subscription
 	subscribeEnabled bool
+	subscription     *subscriptionConfig
 	subNotifyChan    chan *opcua.PublishNotificationData
+	poll             *pollConfig
+	schedule         *pollSchedule
+	// lastTriggerValues are the values of the trigger nodes at the last poll, keyed by node ID
+	lastTriggerValues map[string]*ua.DataValue
+	payloadFormat     string
+	quality           qualityConfig
+	browse            *browseConfig
+	dataTypes         *dataTypeDecoder
+	limits            operationLimits
 }
 
-func (g *OPCUATriInput) Connect(ctx context.Context) error {
+func (g *OPCUATriInput) Connect(ctx context.Context) (err error) {
 
 	if g.client != nil {
 		return nil
 	}
 
-	var c *opcua.Client
-	var endpoints []*ua.EndpointDescription
-	var err error
-
-	// Step 1: Retrieve all available endpoints from the OPC UA server.
-	g.log.Infof("Endpoint URI: %s", g.endpoint)
-	endpoints, err = opcua.GetEndpoints(ctx, g.endpoint)
+	c, err := g.connection().connect(ctx, g.log)
 	if err != nil {
-		g.log.Infof("GetEndpoints failed: %s", err)
-	}
-
-	// Step 2: Log details of each discovered endpoint for debugging.
-	for i, endpoint := range endpoints {
-		g.log.Infof("Endpoint %d:", i+1)
-		g.log.Infof("  EndpointURL: %s", endpoint.EndpointURL)
-		g.log.Infof("  SecurityMode: %v", endpoint.SecurityMode)
-		g.log.Infof("  SecurityPolicyURI: %s", endpoint.SecurityPolicyURI)
-		g.log.Infof("  TransportProfileURI: %s", endpoint.TransportProfileURI)
-		g.log.Infof("  SecurityLevel: %d", endpoint.SecurityLevel)
-
-		// If Server is not nil, log its details
-		if endpoint.Server != nil {
-			g.log.Infof("  Server ApplicationURI: %s", endpoint.Server.ApplicationURI)
-			g.log.Infof("  Server ProductURI: %s", endpoint.Server.ProductURI)
-			g.log.Infof("  Server ApplicationName: %s", endpoint.Server.ApplicationName.Text)
-			g.log.Infof("  Server ApplicationType: %v", endpoint.Server.ApplicationType)
-			g.log.Infof("  Server GatewayServerURI: %s", endpoint.Server.GatewayServerURI)
-			g.log.Infof("  Server DiscoveryProfileURI: %s", endpoint.Server.DiscoveryProfileURI)
-			g.log.Infof("  Server DiscoveryURLs: %v", endpoint.Server.DiscoveryURLs)
-		}
-
-		// Output the certificate
-		if len(endpoint.ServerCertificate) > 0 {
-			// Convert to PEM format first, then log the certificate information
-			pemCert := pem.EncodeToMemory(&pem.Block{
-				Type:  "CERTIFICATE",
-				Bytes: endpoint.ServerCertificate,
-			})
-			g.logCertificateInfo(pemCert)
-		}
-
-		// Loop through UserIdentityTokens
-		for j, token := range endpoint.UserIdentityTokens {
-			g.log.Infof("  UserIdentityToken %d:", j+1)
-			g.log.Infof("    PolicyID: %s", token.PolicyID)
-			g.log.Infof("    TokenType: %v", token.TokenType)
-			g.log.Infof("    IssuedTokenType: %s", token.IssuedTokenType)
-			g.log.Infof("    IssuerEndpointURL: %s", token.IssuerEndpointURL)
-		}
-	}
-
-	// Step 3: Determine the authentication method to use.
-	// Default to Anonymous if neither username nor password is provided.
-	selectedAuthentication := ua.UserTokenTypeAnonymous
-	if g.username != "" && g.password != "" {
-		// Use UsernamePassword authentication if both username and password are available.
-		selectedAuthentication = ua.UserTokenTypeUserName
-	}
-
-	// Step 3.1: Filter the endpoints based on the selected authentication method.
-	// This will eliminate endpoints that do not support the chosen method.
-	selectedEndpoint := g.getReasonableEndpoint(endpoints, selectedAuthentication, g.insecure, g.securityMode, g.securityPolicy)
-	if selectedEndpoint == nil {
-		g.log.Errorf("Could not select a suitable endpoint")
 		return err
 	}
-	if strings.HasPrefix(selectedEndpoint.EndpointURL, "opc.tcp://:") { // I omitted the port here, as it might change ?
-		selectedEndpoint.EndpointURL = g.endpoint
-	}
-	g.log.Infof("Selected endpoint: %v", selectedEndpoint)
+	g.log.Infof("Please note that browsing large node trees can take a long time (around 5 nodes per second), see browseWorkers and browseCacheTTL")
 
-	// Step 4: Initialize OPC UA client options
-	opts := make([]opcua.Option, 0)
-	opts = append(opts, opcua.SecurityFromEndpoint(selectedEndpoint, selectedAuthentication))
-
-	// Set additional options based on the authentication method
-	switch selectedAuthentication {
-	case ua.UserTokenTypeAnonymous:
-		g.log.Infof("Using anonymous login")
-	case ua.UserTokenTypeUserName:
-		g.log.Infof("Using username/password login")
-		opts = append(opts, opcua.AuthUsername(g.username, g.password))
-	}
-
-	// Step 5: Generate Certificates, because this is really a step that can not happen in the background...
-	if !g.insecure {
-		// Generate a new certificate in memory, no file read/write operations.
-		randomStr := randomString(8) // Generates an 8-character random string
-		clientName := "urn:benthos-umh:client-" + randomStr
-		certPEM, keyPEM, err := uatest.GenerateCert(clientName, 2048, 24*time.Hour*365*10)
-		if err != nil {
-			g.log.Errorf("Failed to generate certificate: %v", err)
-			return err
-		}
-
-		// Convert PEM to X509 Certificate and RSA PrivateKey for in-memory use.
-		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	g.client = c
+	defer func() {
 		if err != nil {
-			g.log.Errorf("Failed to parse certificate: %v", err)
-			return err
-		}
-
-		pk, ok := cert.PrivateKey.(*rsa.PrivateKey)
-		if !ok {
-			g.log.Errorf("Invalid private key type")
-			return err
+			// ensure that if something fails here, the connection is always safely closed and opened again by the next Connect
+			g.connection().close(ctx, c)
+			g.client = nil
 		}
+	}()
 
-		// Append the certificate and private key to the client options
-		opts = append(opts, opcua.PrivateKey(pk), opcua.Certificate(cert.Certificate[0]))
-	}
-
-	// Step 6: Create and connect the OPC UA client
-	// Note that we are not taking `selectedEndpoint.EndpointURL` here as the server can be misconfigured. We are taking instead the user input.
-	c, err = opcua.NewClient(g.endpoint, opts...)
-	if err != nil {
-		g.log.Errorf("Failed to create a new client")
+	if err := g.resolveNodes(ctx); err != nil {
+		g.log.Errorf("Resolving nodes failed: %s", err)
 		return err
 	}
 
-	// Connect to the selected endpoint
-	if err := c.Connect(ctx); err != nil {
-		g.log.Errorf("Failed to connect")
-		return err
-	}
-
-	g.log.Infof("Connected to %s", g.endpoint)
-	g.log.Infof("Please note that browsing large node trees can take a long time (around 5 nodes per second)")
-
-	g.client = c
+	g.limits = readOperationLimits(ctx, c, g.log)
 
 	// Create a slice to store the detected nodes
 	nodeList := make([]TNodeDef, 0)
@@ -568,10 +409,9 @@ func (g *OPCUATriInput) Connect(ctx context.Context) error {
 		g.log.Infof("Browsing nodeID: %s", id.String())
 
 		// Browse the OPC-UA server's node tree and print the results.
-		nodes, err := tBrowse(ctx, g.client.Node(id), "", 0, g.log)
+		nodes, err := g.tBrowse(ctx, id)
 		if err != nil {
-			g.log.Errorf("Browsing failed: %s")
-			c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
+			g.log.Errorf("Browsing failed: %s", err)
 			return err
 		}
 
@@ -581,8 +421,7 @@ func (g *OPCUATriInput) Connect(ctx context.Context) error {
 
 	b, err := json.Marshal(nodeList)
 	if err != nil {
-		g.log.Errorf("Unmarshalling failed: %s")
-		c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
+		g.log.Errorf("Unmarshalling failed: %s", err)
 		return err
 	}
 
@@ -592,16 +431,34 @@ func (g *OPCUATriInput) Connect(ctx context.Context) error {
 
 	// to detect all trigger nodes
 	if err := g.detectTriggerNodeIDs(ctx); err != nil {
-		g.log.Errorf("Error detecting trigger nodes: %s")
-		c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
+		g.log.Errorf("Error detecting trigger nodes: %s", err)
 		return err
 	}
 	// to detect all trigger nodes
 	if err := g.detectBatchTriggerNodeIDs(ctx); err != nil {
-		g.log.Errorf("Error detecting batch trigger nodes: %s")
-		c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
+		g.log.Errorf("Error detecting batch trigger nodes: %s", err)
 		return err
 	}
+	// the trigger nodes are read in the groups of the new trigger node list
+	g.schedule = nil
+
+	// custom structures are decoded with the DataTypeDefinitions of their DataTypes
+	dataTypes := make([]string, 0, len(g.nodeList)+len(g.tNodeList))
+	for _, node := range g.nodeList {
+		dataTypes = append(dataTypes, node.DataType)
+	}
+	for _, node := range g.tNodeList {
+		dataTypes = append(dataTypes, node.DataType)
+	}
+	for _, nodes := range g.batchTNodeList {
+		for _, node := range nodes {
+			dataTypes = append(dataTypes, node.DataType)
+		}
+	}
+	g.dataTypes = loadDataTypes(ctx, c, dataTypes, g.log)
+
+	// the first poll after connecting reports the current values of all trigger nodes, like a new subscription does
+	g.lastTriggerValues = make(map[string]*ua.DataValue)
 
 	// If subscription is enabled, start subscribing to the nodes
 	if g.subscribeEnabled {
@@ -609,19 +466,16 @@ func (g *OPCUATriInput) Connect(ctx context.Context) error {
 
 		g.subNotifyChan = make(chan *opcua.PublishNotificationData, 100)
 
-		sub, err := c.Subscribe(ctx, &opcua.SubscriptionParameters{
-			Interval: opcua.DefaultSubscriptionInterval,
-		}, g.subNotifyChan)
+		sub, err := g.connection().subscribe(ctx, c, g.subscription.parameters(), g.subNotifyChan)
 		if err != nil {
-			g.log.Errorf("Subscribing failed: %s")
-			c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
+			g.log.Errorf("Subscribing failed: %s", err)
 			return err
 		}
 
 		monitoredRequests := make([]*ua.MonitoredItemCreateRequest, 0, len(g.tNodeList))
 
 		for pos, id := range g.tNodeList {
-			miCreateRequest := opcua.NewMonitoredItemCreateRequestWithDefaults(id.TNodeID, ua.AttributeIDValue, uint32(pos))
+			miCreateRequest := g.subscription.monitoredItem(id.TNodeID, uint32(pos))
 			monitoredRequests = append(monitoredRequests, miCreateRequest)
 		}
 
@@ -630,81 +484,111 @@ func (g *OPCUATriInput) Connect(ctx context.Context) error {
 			return fmt.Errorf("no valid nodes selected")
 		}
 
-		res, err := sub.Monitor(ctx, ua.TimestampsToReturnBoth, monitoredRequests...)
+		res, err := g.limits.monitor(ctx, sub, ua.TimestampsToReturnBoth, monitoredRequests...)
 		if err != nil {
-			g.log.Errorf("Monitoring failed: %s")
-			c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
+			g.log.Errorf("Monitoring failed: %s", err)
 			return err
 		}
 		if res == nil {
 			g.log.Errorf("Expected res to not be nil, if there is no error")
-			c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
 			return fmt.Errorf("expected res to be not nil")
 		}
 
-		// Assuming you want to check the status code of each result
-		for _, result := range res.Results {
+		// trigger nodes that can not be monitored are reported, the others are still subscribed
+		monitored := 0
+		for i, result := range res.Results {
 			if !errors.Is(result.StatusCode, ua.StatusOK) {
-				g.log.Errorf("Monitoring failed with status code: %v", result.StatusCode)
-				c.Close(ctx) // ensure that if something fails here, the connection is always safely closed
-				return fmt.Errorf("monitoring failed for node, status code: %v", result.StatusCode)
+				g.log.Warnf("Monitoring trigger node %s failed with status code: %v", g.tNodeList[i].TNodeID, result.StatusCode)
+				continue
 			}
+			monitored++
+		}
+		if monitored == 0 {
+			return fmt.Errorf("monitoring failed for all %d trigger nodes", len(res.Results))
 		}
 
-		g.log.Infof("Subscribed to %d nodes!", len(res.Results))
+		g.log.Infof("Subscribed to %d of %d nodes!", monitored, len(res.Results))
 
 	}
 
+	// the client restores the session after connection losses, the watch notices when it can not
+	g.watch = g.session.watch(c, g.log)
+
 	return nil
 }
 
-// createMessageFromValue creates a benthos messages from a given variant and nodeID
+// batchValue is the value of a batch node, read when its trigger node changed.
+type batchValue struct {
+	node  TNodeDef
+	name  string
+	value *ua.DataValue
+}
+
+// createMessageFromValue creates a benthos messages from a given trigger value and nodeID, with the values of its batch
 // theoretically nodeID can be extracted from variant, but not in all cases (e.g., when subscribing), so it it left to the calling function
-func (g *OPCUATriInput) createMessageFromValue(variant *ua.Variant, node TNodeDef, nodeID string, msgs map[string]string) *service.Message {
-	if variant == nil {
+func (g *OPCUATriInput) createMessageFromValue(value *ua.DataValue, node TNodeDef, nodeID string, batch []batchValue) *service.Message {
+	if value == nil || value.Value == nil {
 		g.log.Errorf("Variant is nil")
 		return nil
 	}
 
+	batchQuality := qualityGood
+	for _, v := range batch {
+		batchQuality = worseQuality(batchQuality, quality(v.value.Status))
+	}
+	if batchQuality != qualityGood && g.quality.policy == qualityPolicyDrop {
+		g.log.Warnf("Dropping the batch of trigger node %s as its quality is %s", nodeID, batchQuality)
+		return nil
+	}
+
 	b := make([]byte, 0)
 
-	switch v := variant.Value().(type) {
-	case float32:
-		b = append(b, []byte(strconv.FormatFloat(float64(v), 'f', -1, 32))...)
-	case float64:
-		b = append(b, []byte(strconv.FormatFloat(v, 'f', -1, 64))...)
-	case string:
-		b = append(b, []byte(string(v))...)
-	case bool:
-		b = append(b, []byte(strconv.FormatBool(v))...)
-	case int:
-		b = append(b, []byte(strconv.Itoa(v))...)
-	case int8:
-		b = append(b, []byte(strconv.FormatInt(int64(v), 10))...)
-	case int16:
-		b = append(b, []byte(strconv.FormatInt(int64(v), 10))...)
-	case int32:
-		b = append(b, []byte(strconv.FormatInt(int64(v), 10))...)
-	case int64:
-		b = append(b, []byte(strconv.FormatInt(v, 10))...)
-	case uint:
-		b = append(b, []byte(strconv.FormatUint(uint64(v), 10))...)
-	case uint8:
-		b = append(b, []byte(strconv.FormatUint(uint64(v), 10))...)
-	case uint16:
-		b = append(b, []byte(strconv.FormatUint(uint64(v), 10))...)
-	case uint32:
-		b = append(b, []byte(strconv.FormatUint(uint64(v), 10))...)
-	case uint64:
-		b = append(b, []byte(strconv.FormatUint(v, 10))...)
-	default:
-		// Convert unknown types to JSON
-		jsonBytes, err := json.Marshal(v)
+	if g.payloadFormat == "json" {
+		jsonBytes, err := json.Marshal(g.batchPayload(value, nodeID, batch, batchQuality))
 		if err != nil {
 			g.log.Errorf("Error marshaling to JSON: %v", err)
 			return nil
 		}
 		b = append(b, jsonBytes...)
+	} else {
+		switch v := value.Value.Value().(type) {
+		case float32:
+			b = append(b, []byte(strconv.FormatFloat(float64(v), 'f', -1, 32))...)
+		case float64:
+			b = append(b, []byte(strconv.FormatFloat(v, 'f', -1, 64))...)
+		case string:
+			b = append(b, []byte(string(v))...)
+		case bool:
+			b = append(b, []byte(strconv.FormatBool(v))...)
+		case int:
+			b = append(b, []byte(strconv.Itoa(v))...)
+		case int8:
+			b = append(b, []byte(strconv.FormatInt(int64(v), 10))...)
+		case int16:
+			b = append(b, []byte(strconv.FormatInt(int64(v), 10))...)
+		case int32:
+			b = append(b, []byte(strconv.FormatInt(int64(v), 10))...)
+		case int64:
+			b = append(b, []byte(strconv.FormatInt(v, 10))...)
+		case uint:
+			b = append(b, []byte(strconv.FormatUint(uint64(v), 10))...)
+		case uint8:
+			b = append(b, []byte(strconv.FormatUint(uint64(v), 10))...)
+		case uint16:
+			b = append(b, []byte(strconv.FormatUint(uint64(v), 10))...)
+		case uint32:
+			b = append(b, []byte(strconv.FormatUint(uint64(v), 10))...)
+		case uint64:
+			b = append(b, []byte(strconv.FormatUint(v, 10))...)
+		default:
+			// Convert other types, e.g. arrays and structures, to JSON
+			jsonBytes, err := json.Marshal(g.dataTypes.jsonValue(v))
+			if err != nil {
+				g.log.Errorf("Error marshaling to JSON: %v", err)
+				return nil
+			}
+			b = append(b, jsonBytes...)
+		}
 	}
 
 	if b == nil {
@@ -726,12 +610,20 @@ func (g *OPCUATriInput) createMessageFromValue(variant *ua.Variant, node TNodeDe
 	message.MetaSet("db", tNodeElements[1])
 	message.MetaSet("historian", tNodeElements[2])
 	message.MetaSet("sqlSp", tNodeElements[3])
+	message.MetaSet("quality", batchQuality)
 
 	newBatchNodes := make(map[string]string)
 
-	for nodeID, val := range msgs {
-		newdNode := re.ReplaceAllString(nodeID, "_")
-		newBatchNodes[newdNode] = val
+	for _, v := range batch {
+		if v.value.Value == nil {
+			g.log.Errorf("Received nil from batch trigger node %s with status %v", v.node.TNodeID.String(), v.value.Status)
+			continue
+		}
+		name, change := g.fetchMessages(v.value.Value, v.node, v.node.TNodeID.String())
+		if name != "" {
+			newdNode := re.ReplaceAllString(name, "_")
+			newBatchNodes[newdNode] = change
+		}
 	}
 
 	jsonMsg, err := json.Marshal(newBatchNodes)
@@ -781,8 +673,8 @@ func (g *OPCUATriInput) fetchMessages(variant *ua.Variant, node TNodeDef, nodeID
 	case uint64:
 		b = append(b, []byte(strconv.FormatUint(v, 10))...)
 	default:
-		// Convert unknown types to JSON
-		jsonBytes, err := json.Marshal(v)
+		// Convert other types, e.g. arrays and structures, to JSON
+		jsonBytes, err := json.Marshal(g.dataTypes.jsonValue(v))
 		if err != nil {
 			g.log.Errorf("Error marshaling to JSON: %v", err)
 			return "", ""
@@ -799,95 +691,6 @@ func (g *OPCUATriInput) fetchMessages(variant *ua.Variant, node TNodeDef, nodeID
 	return g.tBatchNodeNameMapping[nodeID], string(b)
 }
 
-func (g *OPCUATriInput) ReadBatchPull(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
-	if g.client == nil {
-		return nil, nil, errors.New("client is nil")
-	}
-	// Read all values in NodeList and return each of them as a message with the node's path as the metadata
-
-	// Create first a list of all the values to read
-	var nodesToRead []*ua.ReadValueID
-
-	for _, node := range g.nodeList {
-		nodesToRead = append(nodesToRead, &ua.ReadValueID{
-			NodeID: node.TNodeID,
-		})
-	}
-
-	if len(g.nodeList) > 100 {
-		g.log.Warnf("Reading more than 100 nodes with pull method. The request might fail as it can take too much time. Recommendation: use subscribeEnabled: true instead for better performance")
-	}
-
-	req := &ua.ReadRequest{
-		MaxAge:             2000,
-		NodesToRead:        nodesToRead,
-		TimestampsToReturn: ua.TimestampsToReturnBoth,
-	}
-
-	resp, err := g.client.Read(ctx, req)
-	if err != nil {
-		g.log.Errorf("Read failed: %s", err)
-		// if the error is StatusBadSessionIDInvalid, the session has been closed
-		// and we need to reconnect.
-		switch err {
-		case ua.StatusBadSessionIDInvalid:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadCommunicationError:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadConnectionClosed:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadTimeout:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadConnectionRejected:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadServerNotConnected:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		}
-
-		// return error and stop executing this function.
-		return nil, nil, err
-	}
-
-	if resp.Results[0].Status != ua.StatusOK {
-		g.log.Errorf("Status not OK: %v", resp.Results[0].Status)
-	}
-
-	// Create a message with the node's path as the metadata
-	msgs := service.MessageBatch{}
-
-	for i, node := range g.nodeList {
-		value := resp.Results[i].Value
-		if value == nil {
-			g.log.Errorf("Received nil from node: %s", node.TNodeID.String())
-			continue
-		}
-		message := g.createMessageFromValue(value, node, node.TNodeID.String(), nil)
-		if message != nil {
-			msgs = append(msgs, message)
-		}
-	}
-
-	// Wait for a second before returning a message.
-	time.Sleep(time.Second)
-
-	return msgs, func(ctx context.Context, err error) error {
-		// Nacks are retried automatically when we use service.AutoRetryNacks
-		return nil
-	}, nil
-}
-
 func (g *OPCUATriInput) ReadBatchSubscribe(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
 	var res *opcua.PublishNotificationData
 
@@ -923,7 +726,7 @@ func (g *OPCUATriInput) ReadBatchSubscribe(ctx context.Context) (service.Message
 				handleID := item.ClientHandle
 
 				if uint32(len(g.nodeList)) >= handleID {
-					message := g.createMessageFromValue(item.Value.Value, g.nodeList[handleID], g.nodeList[handleID].TNodeID.String(), nil)
+					message := g.createMessageFromValue(item.Value, g.nodeList[handleID], g.nodeList[handleID].TNodeID.String(), nil)
 					if message != nil {
 						msgs = append(msgs, message)
 					}
@@ -954,43 +757,48 @@ func (g *OPCUATriInput) ReadBatch(ctx context.Context) (service.MessageBatch, se
 		return g.ReadTriggerBatchSubscribe(ctx)
 		// return g.ReadBatchSubscribe(ctx)
 	}
-	// return g.ReadBatchPull(ctx)
-	// return g.ReadTriggerBatchPull(ctx)
-	return nil, nil, nil
+	return g.ReadTriggerBatchPoll(ctx)
 }
 
 func (g *OPCUATriInput) Close(ctx context.Context) error {
+	g.watch.stop()
+	g.watch = nil
 	if g.client != nil {
-		g.client.Close(ctx)
+		g.connection().close(ctx, g.client)
 		g.client = nil
 	}
+	g.reverse.close()
 
 	return nil
 }
 
-func (g *OPCUATriInput) logCertificateInfo(certBytes []byte) {
-	g.log.Infof("  Server certificate:")
-
-	// Decode the certificate from base64 to DER format
-	block, _ := pem.Decode(certBytes)
-	if block == nil {
-		g.log.Errorf("Failed to decode certificate")
-		return
+// connection returns the settings used to open the session.
+func (g *OPCUATriInput) connection() connectionConfig {
+	return connectionConfig{
+		endpoint:       g.endpoint,
+		username:       g.username,
+		password:       g.password,
+		securityMode:   g.securityMode,
+		securityPolicy: g.securityPolicy,
+		insecure:       g.insecure,
+		authentication: g.authentication,
+		certificates:   g.certificates,
+		session:        g.session,
+		reverse:        g.reverse,
+		shared:         g.shared,
 	}
+}
 
-	// Parse the DER-format certificate
-	cert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		g.log.Errorf("Failed to parse certificate:", err)
-		return
+// connectionLost handles a service call that failed because of the connection. While the client restores the
+// session and transfers its subscriptions, the input keeps the client and its browsed nodes. Otherwise the client
+// is closed, so that Connect opens a new session.
+func (g *OPCUATriInput) connectionLost(ctx context.Context) error {
+	if !g.watch.restored(ctx) {
+		g.connection().lost(ctx, g.client)
+		g.client = nil
+		_ = g.Close(ctx)
 	}
-
-	// Log the details
-	g.log.Infof("    Not Before:", cert.NotBefore)
-	g.log.Infof("    Not After:", cert.NotAfter)
-	g.log.Infof("    DNS Names:", cert.DNSNames)
-	g.log.Infof("    IP Addresses:", cert.IPAddresses)
-	g.log.Infof("    URIs:", cert.URIs)
+	return service.ErrNotConnected
 }
 
 func (g *OPCUATriInput) detectTriggerNodeIDs(ctx context.Context) error {
@@ -1007,12 +815,18 @@ func (g *OPCUATriInput) detectTriggerNodeIDs(ctx context.Context) error {
 		g.log.Infof("Browsing trigger nodeID: %s", id.String())
 
 		// Browse the OPC-UA server's node tree and print the results.
-		nodes, err := tBrowse(ctx, g.client.Node(id), "", 0, g.log)
+		nodes, err := g.tBrowse(ctx, id)
 		if err != nil {
 			g.log.Errorf("Browsing failed: %s")
 			return err
 		}
 
+		// Browsed nodes are monitored and read like the configured node they were found under
+		for _, node := range nodes {
+			g.subscription.inherit(id, node.TNodeID)
+			g.poll.inherit(id, node.TNodeID)
+		}
+
 		// Add the trigger nodes to the tNodeList
 		tNodeList = append(tNodeList, nodes...)
 	}
@@ -1046,7 +860,7 @@ func (g *OPCUATriInput) detectBatchTriggerNodeIDs(ctx context.Context) error {
 			g.log.Infof("Browsing batch trigger nodeID: %s", id.String())
 
 			// Browse the OPC-UA server's node tree and print the results.
-			nodes, err := tBrowse(ctx, g.client.Node(id), "", 0, g.log)
+			nodes, err := g.tBrowse(ctx, id)
 			if err != nil {
 				g.log.Errorf("Browsing failed: %s")
 				return err
@@ -1070,7 +884,9 @@ func (g *OPCUATriInput) detectBatchTriggerNodeIDs(ctx context.Context) error {
 	return nil
 }
 
-func (g *OPCUATriInput) ReadTriggerBatchPull(ctx context.Context, node TNodeDef, nodeID string) (map[string]string, service.AckFunc, error) {
+// ReadTriggerBatchPull reads the batch nodes of a trigger node. With the retry badQualityPolicy, a batch with values
+// that are not Good is read again up to badQualityRetries times.
+func (g *OPCUATriInput) ReadTriggerBatchPull(ctx context.Context, node TNodeDef, nodeID string) ([]batchValue, service.AckFunc, error) {
 	if g.client == nil {
 		return nil, nil, errors.New("client is nil")
 	}
@@ -1078,9 +894,44 @@ func (g *OPCUATriInput) ReadTriggerBatchPull(ctx context.Context, node TNodeDef,
 	tBatchNodesKey := g.tNodesMapping[nodeID]
 	tBatchNodeIDs := g.batchTNodeList[tBatchNodesKey]
 
+	for attempt := 0; ; attempt++ {
+		batch, err := g.readBatch(ctx, tBatchNodeIDs, g.poll.timing(node.TNodeID).maxAge)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		batchQuality := qualityGood
+		for _, v := range batch {
+			batchQuality = worseQuality(batchQuality, quality(v.value.Status))
+		}
+		if batchQuality == qualityGood || g.quality.policy != qualityPolicyRetry || attempt >= g.quality.retries {
+			return batch, func(ctx context.Context, err error) error {
+				// Nacks are retried automatically when we use service.AutoRetryNacks
+				return nil
+			}, nil
+		}
+
+		g.log.Warnf("The batch of trigger node %s has the quality %s, reading it again in %s", nodeID, batchQuality, g.quality.retryInterval)
+		timer := time.NewTimer(g.quality.retryInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// readBatch reads the values of batch nodes, with the maxAge of their trigger node.
+func (g *OPCUATriInput) readBatch(ctx context.Context, tBatchNodeIDs []TNodeDef, maxAge time.Duration) ([]batchValue, error) {
 	// g.log.Infof("Trigger Batch Nodes: ", tBatchNodeIDs)
 	// Read all values in NodeList and return each of them as a message with the node's path as the metadata
 
+	// a trigger without batch nodes only emits its own value
+	if len(tBatchNodeIDs) == 0 {
+		return []batchValue{}, nil
+	}
+
 	// Create first a list of all the values to read
 	var nodesToRead []*ua.ReadValueID
 
@@ -1090,74 +941,66 @@ func (g *OPCUATriInput) ReadTriggerBatchPull(ctx context.Context, node TNodeDef,
 		})
 	}
 
-	if len(tBatchNodeIDs) > 100 {
-		g.log.Warnf("Reading more than 100 nodes with pull method. The request might fail as it can take too much time. Recommendation: use subscribeEnabled: true instead for better performance")
-	}
-
 	req := &ua.ReadRequest{
-		MaxAge:             2000,
+		MaxAge:             float64(maxAge.Milliseconds()),
 		NodesToRead:        nodesToRead,
 		TimestampsToReturn: ua.TimestampsToReturnBoth,
 	}
 
-	resp, err := g.client.Read(ctx, req)
+	resp, err := g.limits.read(ctx, g.client, req)
 	if err != nil {
 		g.log.Errorf("Read failed: %s", err)
-		// if the error is StatusBadSessionIDInvalid, the session has been closed
-		// and we need to reconnect.
-		switch err {
-		case ua.StatusBadSessionIDInvalid:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadCommunicationError:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadConnectionClosed:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadTimeout:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadConnectionRejected:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
-		case ua.StatusBadServerNotConnected:
-			g.client.Close(ctx)
-			g.client = nil
-			return nil, nil, service.ErrNotConnected
+		// if the session has been closed, e.g. StatusBadSessionIDInvalid,
+		// we need to reconnect.
+		if isConnectionError(err) {
+			return nil, g.connectionLost(ctx)
 		}
 
 		// return error and stop executing this function.
-		return nil, nil, err
+		return nil, err
 	}
-
-	if resp.Results[0].Status != ua.StatusOK {
-		g.log.Errorf("Status not OK: %v", resp.Results[0].Status)
+	if len(resp.Results) != len(tBatchNodeIDs) {
+		return nil, fmt.Errorf("expected %d results, got %d", len(tBatchNodeIDs), len(resp.Results))
 	}
 
-	// Create a message with the node's path as the metadata
-	msgs := make(map[string]string, 0)
+	batch := make([]batchValue, 0, len(tBatchNodeIDs))
 
 	for i, node := range tBatchNodeIDs {
-		value := resp.Results[i].Value
-		if value == nil {
-			g.log.Errorf("Received nil from batch trigger node: %s", node.TNodeID.String())
-			continue
+		value := resp.Results[i]
+		if value.Status != ua.StatusOK {
+			g.log.Debugf("Status of batch trigger node %s not OK: %v", node.TNodeID.String(), value.Status)
 		}
-		nodeID, change := g.fetchMessages(value, node, node.TNodeID.String())
-		if nodeID != "" {
-			msgs[nodeID] = change
+		batch = append(batch, batchValue{
+			node:  node,
+			name:  g.tBatchNodeNameMapping[node.TNodeID.String()],
+			value: value,
+		})
+	}
+	return batch, nil
+}
+
+// batchPayload returns the trigger value and the values of its batch, keyed by their names, with their status and timestamps.
+func (g *OPCUATriInput) batchPayload(value *ua.DataValue, nodeID string, batch []batchValue, batchQuality string) map[string]interface{} {
+	trigger := g.dataTypes.dataValueJSON(value)
+	trigger["nodeID"] = nodeID
+
+	values := make(map[string]interface{}, len(batch))
+	for _, v := range batch {
+		batchNodeID := v.node.TNodeID.String()
+		name := v.name
+		if name == "" {
+			name = batchNodeID
 		}
+		item := g.dataTypes.dataValueJSON(v.value)
+		item["nodeID"] = batchNodeID
+		values[name] = item
+	}
+
+	return map[string]interface{}{
+		"trigger": trigger,
+		"values":  values,
+		"quality": batchQuality,
 	}
-	return msgs, func(ctx context.Context, err error) error {
-		// Nacks are retried automatically when we use service.AutoRetryNacks
-		return nil
-	}, nil
 }
 
 func (g *OPCUATriInput) ReadTriggerBatchSubscribe(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
@@ -1171,6 +1014,9 @@ func (g *OPCUATriInput) ReadTriggerBatchSubscribe(ctx context.Context) (service.
 		// Received a result, check for error
 		if res.Error != nil {
 			g.log.Errorf("ReadBatchSubscribe error: %s", res.Error)
+			if isConnectionError(res.Error) {
+				return nil, nil, g.connectionLost(ctx)
+			}
 			return nil, nil, res.Error
 		}
 
@@ -1195,12 +1041,11 @@ func (g *OPCUATriInput) ReadTriggerBatchSubscribe(ctx context.Context) (service.
 				handleID := item.ClientHandle
 
 				if uint32(len(g.tNodeList)) >= handleID {
-					pullMessages, ack, err := g.ReadTriggerBatchPull(ctx, g.tNodeList[handleID], g.tNodeList[handleID].TNodeID.String())
+					batch, ack, err := g.ReadTriggerBatchPull(ctx, g.tNodeList[handleID], g.tNodeList[handleID].TNodeID.String())
 					if err != nil {
 						return msgs, ack, err
 					}
-					// g.log.Infof("Pull Messages: ", pullMessages)
-					message := g.createMessageFromValue(item.Value.Value, g.tNodeList[handleID], g.tNodeList[handleID].TNodeID.String(), pullMessages)
+					message := g.createMessageFromValue(item.Value, g.tNodeList[handleID], g.tNodeList[handleID].TNodeID.String(), batch)
 					if message != nil {
 						msgs = append(msgs, message)
 					}
@@ -1215,6 +1060,9 @@ func (g *OPCUATriInput) ReadTriggerBatchSubscribe(ctx context.Context) (service.
 			return nil
 		}, nil
 
+	case <-g.watch.lostChan():
+		return nil, nil, g.connectionLost(ctx)
+
 	case _, ok := <-ctx.Done():
 		if !ok {
 			g.log.Errorf("timeout channel was closed")
@@ -1225,3 +1073,107 @@ func (g *OPCUATriInput) ReadTriggerBatchSubscribe(ctx context.Context) (service.
 		return nil, nil, errors.New("timeout waiting for response")
 	}
 }
+
+// ReadTriggerBatchPoll reads the trigger nodes at their pollRate, grouped by their timing like the nodes of the opcua
+// input. For every trigger node that changed according to its dataChangeTrigger, it reads the batch nodes of the
+// trigger via ReadTriggerBatchPull and creates the combined message. Polls without changes do not return an empty
+// batch, but wait for the next poll.
+func (g *OPCUATriInput) ReadTriggerBatchPoll(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
+	if len(g.tNodeList) == 0 {
+		g.log.Errorf("Did not poll any nodes. This can happen if the nodes that are selected are incompatible with this benthos version. Aborting...")
+		return nil, nil, fmt.Errorf("no valid nodes selected")
+	}
+	if g.lastTriggerValues == nil {
+		g.lastTriggerValues = make(map[string]*ua.DataValue)
+	}
+	if g.schedule == nil {
+		nodeIDs := make([]*ua.NodeID, 0, len(g.tNodeList))
+		for _, node := range g.tNodeList {
+			nodeIDs = append(nodeIDs, node.TNodeID)
+		}
+		g.schedule = g.poll.schedule(nodeIDs)
+	}
+
+	for {
+		due, err := g.schedule.wait(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if g.client == nil {
+			return nil, nil, errors.New("client is nil")
+		}
+		if g.watch.isLost() {
+			return nil, nil, g.connectionLost(ctx)
+		}
+
+		msgs := service.MessageBatch{}
+		// the values of the changed trigger nodes are only stored once all their batches are read, so that a failed
+		// read reports all changes of this poll again on the next poll
+		changed := make(map[string]*ua.DataValue)
+
+		for _, group := range due {
+			nodesToRead := make([]*ua.ReadValueID, 0, len(group.nodes))
+			for _, i := range group.nodes {
+				nodesToRead = append(nodesToRead, &ua.ReadValueID{
+					NodeID: g.tNodeList[i].TNodeID,
+				})
+			}
+
+			req := &ua.ReadRequest{
+				MaxAge:             float64(group.timing.maxAge.Milliseconds()),
+				NodesToRead:        nodesToRead,
+				TimestampsToReturn: ua.TimestampsToReturnBoth,
+			}
+
+			resp, err := g.limits.read(ctx, g.client, req)
+			if err != nil {
+				g.log.Errorf("Read failed: %s", err)
+				// if the session has been closed, e.g. StatusBadSessionIDInvalid,
+				// we need to reconnect.
+				if isConnectionError(err) {
+					return nil, nil, g.connectionLost(ctx)
+				}
+
+				// return error and stop executing this function.
+				return nil, nil, err
+			}
+			if len(resp.Results) != len(group.nodes) {
+				return nil, nil, fmt.Errorf("expected %d results, got %d", len(group.nodes), len(resp.Results))
+			}
+
+			for j, i := range group.nodes {
+				tNode := g.tNodeList[i]
+				nodeID := tNode.TNodeID.String()
+				value := resp.Results[j]
+				if !g.subscription.changed(tNode.TNodeID, g.lastTriggerValues[nodeID], value) {
+					continue
+				}
+				changed[nodeID] = value
+				if value.Value == nil {
+					g.log.Errorf("Received nil from trigger node %s with status %v", nodeID, value.Status)
+					continue
+				}
+
+				batch, _, err := g.ReadTriggerBatchPull(ctx, tNode, nodeID)
+				if err != nil {
+					return nil, nil, err
+				}
+
+				message := g.createMessageFromValue(value, tNode, nodeID, batch)
+				if message != nil {
+					msgs = append(msgs, message)
+				}
+			}
+		}
+		for nodeID, value := range changed {
+			g.lastTriggerValues[nodeID] = value
+		}
+
+		if len(msgs) > 0 {
+			return msgs, func(ctx context.Context, err error) error {
+				// Nacks are retried automatically when we use service.AutoRetryNacks
+				return nil
+			}, nil
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package opcua_plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTriggerInput connects an opcuatrigger input to the server of a test server output.
+func newTestTriggerInput(t *testing.T, ctx context.Context, out *OPCUAServerOutput, yaml string) *OPCUATriInput {
+	t.Helper()
+	conf, err := OPCUATriConfigSpec.ParseYAML(fmt.Sprintf(`
+endpoint: opc.tcp://%s
+securityMode: None
+securityPolicy: None
+%s`, out.server.listener.Addr(), yaml), nil)
+	require.NoError(t, err)
+	in, err := newOPCUATriInput(conf, service.MockResources())
+	require.NoError(t, err)
+	require.NoError(t, in.Connect(ctx))
+	return in
+}
+
+// triggerNodeIDs returns the trigger node IDs of a batch.
+func triggerNodeIDs(batch service.MessageBatch) []string {
+	var nodeIDs []string
+	for _, msg := range batch {
+		nodeID, _ := msg.MetaGet("nodeID")
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	return nodeIDs
+}
+
+func TestTriggerPollFailedBatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+	writeTestValues(t, ctx, out, "line1", map[string]string{"partDone": "1", "weight": "12.5", "toolChanged": "1"})
+	// the batch of the second trigger has no value yet, so it is read again until the read is cancelled
+	out.server.mu.Lock()
+	_, err := out.server.space.variable([]string{"line1", "tool"}, "float64", false)
+	out.server.mu.Unlock()
+	require.NoError(t, err)
+
+	in := newTestTriggerInput(t, ctx, out, `
+pollRate: 50
+badQualityPolicy: retry
+badQualityRetries: 1
+badQualityRetryInterval: 60000
+tNodeIDs:
+  - '{"1": [{"node": "ns=1;s=line1/partDone", "group": "line1"}]}'
+  - '{"2": [{"node": "ns=1;s=line1/toolChanged", "group": "line1"}]}'
+tBatchNodeIDs:
+  - '{"1": [{"node": "ns=1;s=line1/weight", "name": "weight"}]}'
+  - '{"2": [{"node": "ns=1;s=line1/tool", "name": "tool"}]}'
+`)
+	defer in.Close(ctx)
+
+	readCtx, cancelRead := context.WithTimeout(ctx, 500*time.Millisecond)
+	_, _, err = in.ReadBatch(readCtx)
+	cancelRead()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the change of the first trigger is not lost with the failed batch of the second one
+	writeTestValues(t, ctx, out, "line1", map[string]string{"tool": "3"})
+	batch, ack, err := in.ReadBatch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, ack(ctx, nil))
+	assert.ElementsMatch(t, []string{"ns=1;s=line1/partDone", "ns=1;s=line1/toolChanged"}, triggerNodeIDs(batch))
+}
+
+func TestTriggerPollRates(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+	writeTestValues(t, ctx, out, "line1", map[string]string{"partDone": "1", "shiftEnd": "1", "weight": "12.5"})
+
+	in := newTestTriggerInput(t, ctx, out, `
+pollRate: 50
+tNodeIDs:
+  - '{"1": [{"node": "ns=1;s=line1/partDone", "group": "line1"}]}'
+  - '{"2": [{"node": "ns=1;s=line1/shiftEnd", "group": "line1", "pollRate": "3600000", "maxAge": "0"}]}'
+tBatchNodeIDs:
+  - '{"1": [{"node": "ns=1;s=line1/weight", "name": "weight"}]}'
+  - '{"2": [{"node": "ns=1;s=line1/weight", "name": "weight"}]}'
+`)
+	defer in.Close(ctx)
+	assert.Equal(t, pollTiming{rate: time.Hour}, in.poll.timing(in.tNodeList[1].TNodeID))
+
+	// the first poll reports all trigger nodes
+	batch, _, err := in.ReadBatch(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"ns=1;s=line1/partDone", "ns=1;s=line1/shiftEnd"}, triggerNodeIDs(batch))
+
+	// the slow trigger is not read again within its pollRate
+	writeTestValues(t, ctx, out, "line1", map[string]string{"partDone": "2", "shiftEnd": "2"})
+	batch, _, err = in.ReadBatch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ns=1;s=line1/partDone"}, triggerNodeIDs(batch))
+}
+
+func TestTriggerWithoutBatchNodes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+	writeTestValues(t, ctx, out, "line1", map[string]string{"partDone": "1", "weight": "12.5"})
+
+	// the second trigger has no batch nodes
+	in := newTestTriggerInput(t, ctx, out, `
+pollRate: 50
+tNodeIDs:
+  - '{"1": [{"node": "ns=1;s=line1/partDone", "group": "line1"}]}'
+  - '{"2": [{"node": "ns=1;s=line1/weight", "group": "line1"}]}'
+tBatchNodeIDs:
+  - '{"1": [{"node": "ns=1;s=line1/weight", "name": "weight"}]}'
+`)
+	defer in.Close(ctx)
+
+	batch, _, err := in.ReadBatch(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"ns=1;s=line1/partDone", "ns=1;s=line1/weight"}, triggerNodeIDs(batch))
+}
+
+func TestTriggerPollConfig(t *testing.T) {
+	for _, yaml := range []string{
+		"pollRate: 0",
+		"maxAge: -1",
+		`tNodeIDs: ['{"1": [{"node": "ns=1;s=partDone", "pollRate": "fast"}]}']`,
+	} {
+		if !strings.HasPrefix(yaml, "tNodeIDs") {
+			yaml += "\ntNodeIDs: ['{\"1\": [{\"node\": \"ns=1;s=partDone\"}]}']"
+		}
+		conf, err := OPCUATriConfigSpec.ParseYAML("endpoint: opc.tcp://localhost:4840\n"+yaml, nil)
+		require.NoError(t, err)
+		_, err = newOPCUATriInput(conf, service.MockResources())
+		assert.Error(t, err, yaml)
+	}
+}
@@ -0,0 +1,176 @@
+package opcua_plugin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// operationLimits are the OperationLimits of a server that requests with many nodes are split by. 0 is no limit.
+type operationLimits struct {
+	maxNodesPerRead            int
+	maxNodesPerWrite           int
+	maxNodesPerHistoryReadData int
+	maxMonitoredItemsPerCall   int
+}
+
+// reader reads attributes of nodes, e.g. an *opcua.Client.
+type reader interface {
+	Read(ctx context.Context, req *ua.ReadRequest) (*ua.ReadResponse, error)
+}
+
+// writer writes attributes of nodes, e.g. an *opcua.Client.
+type writer interface {
+	Write(ctx context.Context, req *ua.WriteRequest) (*ua.WriteResponse, error)
+}
+
+// readOperationLimits reads the OperationLimits of the server. Limits that the server does not provide are 0.
+func readOperationLimits(ctx context.Context, c reader, log *service.Logger) operationLimits {
+	var l operationLimits
+	resp, err := c.Read(ctx, &ua.ReadRequest{
+		NodesToRead: []*ua.ReadValueID{
+			{NodeID: ua.NewNumericNodeID(0, id.Server_ServerCapabilities_OperationLimits_MaxNodesPerRead), AttributeID: ua.AttributeIDValue},
+			{NodeID: ua.NewNumericNodeID(0, id.Server_ServerCapabilities_OperationLimits_MaxNodesPerWrite), AttributeID: ua.AttributeIDValue},
+			{NodeID: ua.NewNumericNodeID(0, id.Server_ServerCapabilities_OperationLimits_MaxNodesPerHistoryReadData), AttributeID: ua.AttributeIDValue},
+			{NodeID: ua.NewNumericNodeID(0, id.Server_ServerCapabilities_OperationLimits_MaxMonitoredItemsPerCall), AttributeID: ua.AttributeIDValue},
+		},
+		TimestampsToReturn: ua.TimestampsToReturnNeither,
+	})
+	if err != nil {
+		log.Debugf("Reading the OperationLimits failed, requests are not split: %v", err)
+		return l
+	}
+	for i, limit := range []*int{&l.maxNodesPerRead, &l.maxNodesPerWrite, &l.maxNodesPerHistoryReadData, &l.maxMonitoredItemsPerCall} {
+		if i >= len(resp.Results) || resp.Results[i].Status != ua.StatusOK || resp.Results[i].Value == nil {
+			continue
+		}
+		if v, ok := resp.Results[i].Value.Value().(uint32); ok {
+			*limit = int(v)
+		}
+	}
+	log.Debugf("OperationLimits of the server: MaxNodesPerRead %d, MaxNodesPerWrite %d, MaxNodesPerHistoryReadData %d, MaxMonitoredItemsPerCall %d",
+		l.maxNodesPerRead, l.maxNodesPerWrite, l.maxNodesPerHistoryReadData, l.maxMonitoredItemsPerCall)
+	return l
+}
+
+// chunks splits n items into ranges of at most size items. A size of 0 is one range.
+func chunks(n int, size int) [][2]int {
+	if size <= 0 || n <= size {
+		return [][2]int{{0, n}}
+	}
+	var ranges [][2]int
+	for start := 0; start < n; start += size {
+		ranges = append(ranges, [2]int{start, min(start+size, n)})
+	}
+	return ranges
+}
+
+// read sends a ReadRequest in as many requests as MaxNodesPerRead requires, and returns the results of all of them.
+// A request without nodes is not sent, as servers answer it with BadNothingToDo.
+func (l operationLimits) read(ctx context.Context, c reader, req *ua.ReadRequest) (*ua.ReadResponse, error) {
+	if len(req.NodesToRead) == 0 {
+		return &ua.ReadResponse{}, nil
+	}
+	ranges := chunks(len(req.NodesToRead), l.maxNodesPerRead)
+	if len(ranges) == 1 {
+		return c.Read(ctx, req)
+	}
+
+	var resp *ua.ReadResponse
+	results := make([]*ua.DataValue, 0, len(req.NodesToRead))
+	for _, r := range ranges {
+		chunk := *req
+		chunk.NodesToRead = req.NodesToRead[r[0]:r[1]]
+		var err error
+		if resp, err = c.Read(ctx, &chunk); err != nil {
+			return nil, err
+		}
+		if len(resp.Results) != r[1]-r[0] {
+			return nil, fmt.Errorf("expected %d read results, got %d", r[1]-r[0], len(resp.Results))
+		}
+		results = append(results, resp.Results...)
+	}
+	resp.Results = results
+	return resp, nil
+}
+
+// write sends a WriteRequest in as many requests as MaxNodesPerWrite requires, and returns the results of all of them.
+func (l operationLimits) write(ctx context.Context, c writer, req *ua.WriteRequest) (*ua.WriteResponse, error) {
+	ranges := chunks(len(req.NodesToWrite), l.maxNodesPerWrite)
+	if len(ranges) == 1 {
+		return c.Write(ctx, req)
+	}
+
+	var resp *ua.WriteResponse
+	results := make([]ua.StatusCode, 0, len(req.NodesToWrite))
+	for _, r := range ranges {
+		chunk := *req
+		chunk.NodesToWrite = req.NodesToWrite[r[0]:r[1]]
+		var err error
+		if resp, err = c.Write(ctx, &chunk); err != nil {
+			return nil, err
+		}
+		if len(resp.Results) != r[1]-r[0] {
+			return nil, fmt.Errorf("expected %d write results, got %d", r[1]-r[0], len(resp.Results))
+		}
+		results = append(results, resp.Results...)
+	}
+	resp.Results = results
+	return resp, nil
+}
+
+// historyNodesPerRead returns how many nodes are read in one HistoryRead. Without a MaxNodesPerHistoryReadData, the
+// nodes are read one after another, as every node may return up to numValuesPerNode values.
+func (l operationLimits) historyNodesPerRead() int {
+	if l.maxNodesPerHistoryReadData <= 0 {
+		return 1
+	}
+	return l.maxNodesPerHistoryReadData
+}
+
+// monitor creates monitored items in as many requests as MaxMonitoredItemsPerCall requires, and returns the results
+// of all of them.
+func (l operationLimits) monitor(ctx context.Context, sub monitor, ts ua.TimestampsToReturn, items ...*ua.MonitoredItemCreateRequest) (*ua.CreateMonitoredItemsResponse, error) {
+	ranges := chunks(len(items), l.maxMonitoredItemsPerCall)
+	if len(ranges) == 1 {
+		return sub.Monitor(ctx, ts, items...)
+	}
+
+	var res *ua.CreateMonitoredItemsResponse
+	results := make([]*ua.MonitoredItemCreateResult, 0, len(items))
+	for _, r := range ranges {
+		var err error
+		if res, err = sub.Monitor(ctx, ts, items[r[0]:r[1]]...); err != nil {
+			return nil, err
+		}
+		if len(res.Results) != r[1]-r[0] {
+			return nil, fmt.Errorf("expected %d monitoring results, got %d", r[1]-r[0], len(res.Results))
+		}
+		results = append(results, res.Results...)
+	}
+	res.Results = results
+	return res, nil
+}
+
+// readFailures reports the nodes whose reads fail, when they start failing and when they are read again, instead
+// of on every read.
+type readFailures map[string]ua.StatusCode
+
+func (f readFailures) report(node string, status ua.StatusCode, log *service.Logger) {
+	failed, wasFailing := f[node]
+	if quality(status) != qualityBad {
+		if wasFailing {
+			log.Infof("Reading %s succeeds again", node)
+			delete(f, node)
+		}
+		return
+	}
+	if !wasFailing || failed != status {
+		log.Warnf("Reading %s failed: %v", node, status)
+		f[node] = status
+	}
+}
@@ -0,0 +1,156 @@
+package opcua_plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeReader answers reads with the node IDs as values, and records the sizes of the requests.
+type fakeReader struct {
+	sizes []int
+}
+
+func (r *fakeReader) Read(ctx context.Context, req *ua.ReadRequest) (*ua.ReadResponse, error) {
+	r.sizes = append(r.sizes, len(req.NodesToRead))
+	resp := &ua.ReadResponse{}
+	for _, node := range req.NodesToRead {
+		resp.Results = append(resp.Results, &ua.DataValue{Value: ua.MustVariant(node.NodeID.String())})
+	}
+	return resp, nil
+}
+
+// fakeMonitor fails the items whose client handles are odd, and records the sizes of the requests.
+type fakeMonitor struct {
+	sizes []int
+}
+
+func (m *fakeMonitor) Monitor(ctx context.Context, ts ua.TimestampsToReturn, items ...*ua.MonitoredItemCreateRequest) (*ua.CreateMonitoredItemsResponse, error) {
+	m.sizes = append(m.sizes, len(items))
+	res := &ua.CreateMonitoredItemsResponse{}
+	for _, item := range items {
+		status := ua.StatusOK
+		if item.RequestedParameters.ClientHandle%2 == 1 {
+			status = ua.StatusBadNodeIDUnknown
+		}
+		res.Results = append(res.Results, &ua.MonitoredItemCreateResult{StatusCode: status, MonitoredItemID: item.RequestedParameters.ClientHandle})
+	}
+	return res, nil
+}
+
+// fakeWriter answers writes with StatusOK, and records the sizes of the requests.
+type fakeWriter struct {
+	sizes []int
+}
+
+func (w *fakeWriter) Write(ctx context.Context, req *ua.WriteRequest) (*ua.WriteResponse, error) {
+	w.sizes = append(w.sizes, len(req.NodesToWrite))
+	resp := &ua.WriteResponse{}
+	for range req.NodesToWrite {
+		resp.Results = append(resp.Results, ua.StatusOK)
+	}
+	return resp, nil
+}
+
+func TestChunks(t *testing.T) {
+	assert.Equal(t, [][2]int{{0, 5}}, chunks(5, 0))
+	assert.Equal(t, [][2]int{{0, 5}}, chunks(5, 5))
+	assert.Equal(t, [][2]int{{0, 2}, {2, 4}, {4, 5}}, chunks(5, 2))
+	assert.Equal(t, [][2]int{{0, 0}}, chunks(0, 2))
+}
+
+func TestOperationLimitsRead(t *testing.T) {
+	req := &ua.ReadRequest{MaxAge: 2000}
+	for i := 0; i < 7; i++ {
+		req.NodesToRead = append(req.NodesToRead, &ua.ReadValueID{NodeID: ua.NewNumericNodeID(1, uint32(i))})
+	}
+
+	r := &fakeReader{}
+	resp, err := operationLimits{maxNodesPerRead: 3}.read(context.Background(), r, req)
+	require.NoError(t, err)
+	assert.Equal(t, []int{3, 3, 1}, r.sizes)
+	require.Len(t, resp.Results, 7)
+	for i, result := range resp.Results {
+		assert.Equal(t, ua.NewNumericNodeID(1, uint32(i)).String(), result.Value.Value())
+	}
+
+	r = &fakeReader{}
+	_, err = operationLimits{}.read(context.Background(), r, req)
+	require.NoError(t, err)
+	assert.Equal(t, []int{7}, r.sizes)
+
+	// nothing to read is not sent
+	r = &fakeReader{}
+	resp, err = operationLimits{maxNodesPerRead: 3}.read(context.Background(), r, &ua.ReadRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Results)
+	assert.Empty(t, r.sizes)
+}
+
+func TestOperationLimitsWrite(t *testing.T) {
+	req := &ua.WriteRequest{}
+	for i := 0; i < 5; i++ {
+		req.NodesToWrite = append(req.NodesToWrite, &ua.WriteValue{NodeID: ua.NewNumericNodeID(1, uint32(i))})
+	}
+
+	w := &fakeWriter{}
+	resp, err := operationLimits{maxNodesPerWrite: 2}.write(context.Background(), w, req)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 2, 1}, w.sizes)
+	assert.Len(t, resp.Results, 5)
+
+	w = &fakeWriter{}
+	_, err = operationLimits{}.write(context.Background(), w, req)
+	require.NoError(t, err)
+	assert.Equal(t, []int{5}, w.sizes)
+}
+
+func TestOperationLimitsMonitor(t *testing.T) {
+	var items []*ua.MonitoredItemCreateRequest
+	for i := 0; i < 5; i++ {
+		items = append(items, &ua.MonitoredItemCreateRequest{RequestedParameters: &ua.MonitoringParameters{ClientHandle: uint32(i)}})
+	}
+
+	m := &fakeMonitor{}
+	res, err := operationLimits{maxMonitoredItemsPerCall: 2}.monitor(context.Background(), m, ua.TimestampsToReturnBoth, items...)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 2, 1}, m.sizes)
+	require.Len(t, res.Results, 5)
+	for i, result := range res.Results {
+		assert.Equal(t, uint32(i), result.MonitoredItemID)
+	}
+	assert.Equal(t, ua.StatusBadNodeIDUnknown, res.Results[3].StatusCode)
+}
+
+func TestReadOperationLimits(t *testing.T) {
+	ctx := context.Background()
+	log := service.MockResources().Logger()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+	conf, err := parseConnectionConfig(testConfig(t, connectionFields(), "endpoint: opc.tcp://"+out.server.listener.Addr().String()+"\nsecurityMode: None\nsecurityPolicy: None"), service.MockResources())
+	require.NoError(t, err)
+	c, err := conf.connect(ctx, log)
+	require.NoError(t, err)
+	defer c.Close(ctx)
+
+	// the server does not provide OperationLimits, so requests are not split
+	assert.Equal(t, operationLimits{}, readOperationLimits(ctx, c, log))
+}
+
+func TestReadFailures(t *testing.T) {
+	log := service.MockResources().Logger()
+	f := readFailures{}
+
+	f.report("ns=1;i=1", ua.StatusOK, log)
+	assert.Empty(t, f)
+	f.report("ns=1;i=1", ua.StatusBadNodeIDUnknown, log)
+	assert.Equal(t, readFailures{"ns=1;i=1": ua.StatusBadNodeIDUnknown}, f)
+	f.report("ns=1;i=1", ua.StatusUncertain, log)
+	assert.Empty(t, f)
+}
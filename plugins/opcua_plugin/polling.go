@@ -0,0 +1,218 @@
+package opcua_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// pollFields are the config fields that control how often the nodes, or the trigger nodes of opcuatrigger, are read
+// when subscribeEnabled is false.
+// Both can be overridden per node entry, e.g. {"node": "ns=2;s=Temperature", "pollRate": "10000", "maxAge": "5000"}.
+func pollFields() []*service.ConfigField {
+	return []*service.ConfigField{
+		service.NewIntField("pollRate").Description("Interval in milliseconds in which the nodes are read when subscribeEnabled is false.").Default(1000),
+		service.NewIntField("maxAge").Description("Maximum age in milliseconds of the values the server may return from its cache instead of reading them from the device. 0 reads the device on every read.").Default(2000),
+	}
+}
+
+// pollTiming is how often a node is read and how old its values may be.
+type pollTiming struct {
+	rate   time.Duration
+	maxAge time.Duration
+}
+
+// defaultPollTiming is the timing of inputs without a pollConfig.
+var defaultPollTiming = pollTiming{rate: time.Second, maxAge: 2 * time.Second}
+
+// pollConfig holds the timing of the reads of the nodes. A nil pollConfig reads all nodes with the defaultPollTiming.
+type pollConfig struct {
+	defaults pollTiming
+	// nodes are the timings of node entries that override the defaults, keyed by node ID
+	nodes map[string]pollTiming
+}
+
+// parsePollConfig parses the poll fields and the overrides of the node entries.
+func parsePollConfig(conf *service.ParsedConfig, nodeEntries []string) (*pollConfig, error) {
+	pollRate, err := conf.FieldInt("pollRate")
+	if err != nil {
+		return nil, err
+	}
+	maxAge, err := conf.FieldInt("maxAge")
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := pollTiming{}.override(map[string]string{"pollRate": strconv.Itoa(pollRate), "maxAge": strconv.Itoa(maxAge)})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pollConfig{defaults: defaults}
+	if err := p.setNodes(nodeEntries); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// setNodes replaces the overrides by those of the node entries. Nodes that need resolving are
+// validated, but only stored once setNodes is called again with the resolved node entries.
+func (p *pollConfig) setNodes(nodeEntries []string) error {
+	if p == nil {
+		return nil
+	}
+
+	nodes := map[string]pollTiming{}
+	for _, nodeElements := range nodeEntries {
+		var nodeObj map[string][]map[string]string
+		if err := json.Unmarshal([]byte(nodeElements), &nodeObj); err != nil {
+			return err
+		}
+
+		for _, values := range nodeObj {
+			for _, obj := range values {
+				timing, err := p.defaults.override(obj)
+				if err != nil {
+					return fmt.Errorf("node %s: %w", obj["node"], err)
+				}
+				if needsResolving(obj["node"]) {
+					continue
+				}
+				nodeID, err := ua.ParseNodeID(obj["node"])
+				if err != nil {
+					return fmt.Errorf("invalid node %q: %w", obj["node"], err)
+				}
+				if timing != p.defaults {
+					nodes[nodeID.String()] = timing
+				}
+			}
+		}
+	}
+	p.nodes = nodes
+	return nil
+}
+
+// override returns the timing with the settings of a node entry applied.
+func (t pollTiming) override(obj map[string]string) (pollTiming, error) {
+	if s, ok := obj["pollRate"]; ok {
+		ms, err := strconv.Atoi(s)
+		if err != nil || ms <= 0 {
+			return t, fmt.Errorf("pollRate must be a positive number of milliseconds, got %q", s)
+		}
+		t.rate = time.Duration(ms) * time.Millisecond
+	}
+	if s, ok := obj["maxAge"]; ok {
+		ms, err := strconv.Atoi(s)
+		if err != nil || ms < 0 {
+			return t, fmt.Errorf("maxAge must be a non-negative number of milliseconds, got %q", s)
+		}
+		t.maxAge = time.Duration(ms) * time.Millisecond
+	}
+	return t, nil
+}
+
+// inherit applies the timing of a configured node to a node found by browsing it, e.g. the variables of a folder.
+func (p *pollConfig) inherit(root *ua.NodeID, node *ua.NodeID) {
+	if p == nil || root == nil || node == nil {
+		return
+	}
+	timing, ok := p.nodes[root.String()]
+	if !ok {
+		return
+	}
+	if _, ok := p.nodes[node.String()]; !ok {
+		p.nodes[node.String()] = timing
+	}
+}
+
+// timing returns the timing of a node.
+func (p *pollConfig) timing(nodeID *ua.NodeID) pollTiming {
+	if p == nil {
+		return defaultPollTiming
+	}
+	if timing, ok := p.nodes[nodeID.String()]; ok {
+		return timing
+	}
+	return p.defaults
+}
+
+//------------------------------------------------------------------------------
+
+// pollGroup are the nodes that are read together, as they have the same timing.
+type pollGroup struct {
+	timing pollTiming
+	// nodes are the positions of the nodes in the node list of the input
+	nodes []int
+	next  time.Time
+}
+
+// pollSchedule decides which nodes are read when. Every group is read at its own rate, like with a ticker: reads
+// that are late do not delay the following ones, and reads that are missed are skipped.
+type pollSchedule struct {
+	groups []*pollGroup
+}
+
+// schedule groups the nodes by their timing. All groups are due right away.
+func (p *pollConfig) schedule(nodeIDs []*ua.NodeID) *pollSchedule {
+	s := &pollSchedule{}
+	byTiming := map[pollTiming]*pollGroup{}
+	for i, nodeID := range nodeIDs {
+		timing := p.timing(nodeID)
+		g, ok := byTiming[timing]
+		if !ok {
+			g = &pollGroup{timing: timing}
+			byTiming[timing] = g
+			s.groups = append(s.groups, g)
+		}
+		g.nodes = append(g.nodes, i)
+	}
+	return s
+}
+
+// wait waits until at least one group is due, or until the context is cancelled, and returns the due groups.
+func (s *pollSchedule) wait(ctx context.Context) ([]*pollGroup, error) {
+	if len(s.groups) == 0 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	next := s.groups[0].next
+	for _, g := range s.groups[1:] {
+		if g.next.Before(next) {
+			next = g.next
+		}
+	}
+	if wait := time.Until(next); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	now := time.Now()
+	var due []*pollGroup
+	for _, g := range s.groups {
+		if g.next.After(now) {
+			continue
+		}
+		due = append(due, g)
+		if g.next.IsZero() {
+			g.next = now
+		}
+		g.next = g.next.Add(g.timing.rate)
+		if !g.next.After(now) {
+			// skip the reads that were missed
+			g.next = now.Add(g.timing.rate - now.Sub(g.next)%g.timing.rate)
+		}
+	}
+	return due, nil
+}
@@ -0,0 +1,149 @@
+package opcua_plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollTimingPerNode(t *testing.T) {
+	pressure := ua.NewStringNodeID(2, "Pressure")
+	temperatures := ua.NewStringNodeID(2, "Temperatures")
+	boiler := ua.NewStringNodeID(2, "Temperatures.Boiler")
+
+	p, err := parsePollConfig(testConfig(t, pollFields(), ``), []string{`{"1": [{"node": "ns=2;s=Pressure", "group": "D001"}]}`})
+	require.NoError(t, err)
+	assert.Equal(t, defaultPollTiming, p.timing(pressure))
+	var unset *pollConfig
+	assert.Equal(t, defaultPollTiming, unset.timing(pressure))
+
+	p, err = parsePollConfig(testConfig(t, pollFields(), `
+pollRate: 500
+maxAge: 0
+`), []string{`{"1": [{"node": "ns=2;s=Pressure", "group": "D001"}, {"node": "ns=2;s=Temperatures", "group": "D001", "pollRate": "10000", "maxAge": "5000"}]}`})
+	require.NoError(t, err)
+	assert.Equal(t, pollTiming{rate: 500 * time.Millisecond}, p.timing(pressure))
+	assert.Equal(t, pollTiming{rate: 10 * time.Second, maxAge: 5 * time.Second}, p.timing(temperatures))
+
+	// the variables of a folder are read like the folder
+	p.inherit(temperatures, boiler)
+	s := p.schedule([]*ua.NodeID{pressure, boiler})
+	require.Len(t, s.groups, 2)
+	assert.Equal(t, []int{0}, s.groups[0].nodes)
+	assert.Equal(t, []int{1}, s.groups[1].nodes)
+	assert.Equal(t, pollTiming{rate: 10 * time.Second, maxAge: 5 * time.Second}, s.groups[1].timing)
+
+	for _, yaml := range []string{`pollRate: 0`, `maxAge: -1`} {
+		_, err := parsePollConfig(testConfig(t, pollFields(), yaml), nil)
+		assert.Error(t, err, yaml)
+	}
+	for _, entry := range []string{
+		`{"1": [{"node": "ns=2;s=Pressure", "pollRate": "fast"}]}`,
+		`{"1": [{"node": "ns=2;s=Pressure", "maxAge": "-5"}]}`,
+	} {
+		_, err := parsePollConfig(testConfig(t, pollFields(), ``), []string{entry})
+		assert.Error(t, err, entry)
+	}
+}
+
+func TestPollSchedule(t *testing.T) {
+	p := &pollConfig{
+		defaults: pollTiming{rate: 50 * time.Millisecond},
+		nodes:    map[string]pollTiming{ua.NewNumericNodeID(1, 2).String(): {rate: time.Hour}},
+	}
+	s := p.schedule([]*ua.NodeID{ua.NewNumericNodeID(1, 1), ua.NewNumericNodeID(1, 2), ua.NewNumericNodeID(1, 3)})
+	require.Len(t, s.groups, 2)
+	assert.Equal(t, []int{0, 2}, s.groups[0].nodes)
+	assert.Equal(t, []int{1}, s.groups[1].nodes)
+
+	ctx := context.Background()
+
+	// all groups are due right away
+	due, err := s.wait(ctx)
+	require.NoError(t, err)
+	assert.Len(t, due, 2)
+
+	// then only the fast one
+	start := time.Now()
+	due, err = s.wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []*pollGroup{s.groups[0]}, due)
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+	// missed reads are skipped instead of read in a row
+	time.Sleep(180 * time.Millisecond)
+	_, err = s.wait(ctx)
+	require.NoError(t, err)
+	assert.True(t, s.groups[0].next.After(time.Now()))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	s.groups[0].next = time.Now().Add(time.Hour)
+	_, err = s.wait(cancelled)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestPollScheduleMixedRates(t *testing.T) {
+	p := &pollConfig{
+		defaults: pollTiming{rate: 30 * time.Millisecond},
+		nodes:    map[string]pollTiming{ua.NewNumericNodeID(1, 2).String(): {rate: 70 * time.Millisecond}},
+	}
+	s := p.schedule([]*ua.NodeID{ua.NewNumericNodeID(1, 1), ua.NewNumericNodeID(1, 2)})
+	require.Len(t, s.groups, 2)
+	fast, slow := s.groups[0], s.groups[1]
+
+	ctx := context.Background()
+	due, err := s.wait(ctx)
+	require.NoError(t, err)
+	require.Len(t, due, 2)
+	first := map[*pollGroup]time.Time{fast: fast.next.Add(-fast.timing.rate), slow: slow.next.Add(-slow.timing.rate)}
+
+	// every group is read at its own rate, and its reads stay on the ticks of its first read
+	reads := map[*pollGroup]int{fast: 1, slow: 1}
+	end := time.Now().Add(700 * time.Millisecond)
+	for time.Now().Before(end) {
+		due, err := s.wait(ctx)
+		require.NoError(t, err)
+		require.NotEmpty(t, due)
+		for _, g := range due {
+			reads[g]++
+			assert.Zero(t, g.next.Sub(first[g])%g.timing.rate, "the reads of a group drift")
+		}
+	}
+	assert.InDelta(t, 700/30, reads[fast], 3)
+	assert.InDelta(t, 700/70, reads[slow], 2)
+}
+
+func TestPollGroupsAgainstServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+	writeTestValues(t, ctx, out, "line1", map[string]string{"temperature": "23.5", "pressure": "1.2"})
+
+	in := newTestInput(t, ctx, out, `
+pollRate: 100
+maxAge: 0
+nodeIDs:
+  - '{"1": [{"node": "ns=1;s=line1/temperature", "group": "line1", "name": "temperature"}, {"node": "ns=1;s=line1/pressure", "group": "line1", "name": "pressure", "pollRate": "100000"}]}'
+`)
+	defer in.Close(ctx)
+
+	reads := map[string]int{}
+	for i := 0; i < 5; i++ {
+		batch, ack, err := in.ReadBatch(ctx)
+		require.NoError(t, err)
+		require.NoError(t, ack(ctx, nil))
+		for _, msg := range batch {
+			name, _ := msg.MetaGet("name")
+			reads[name]++
+		}
+	}
+	assert.Equal(t, map[string]int{"temperature": 5, "pressure": 1}, reads)
+}
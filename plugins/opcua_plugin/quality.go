@@ -0,0 +1,139 @@
+package opcua_plugin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// The qualities of a value, derived from the severity of its status code.
+const (
+	qualityGood      = "Good"
+	qualityUncertain = "Uncertain"
+	qualityBad       = "Bad"
+)
+
+// The values of the badQualityPolicy setting.
+const (
+	qualityPolicyFlag  = "flag"
+	qualityPolicyDrop  = "drop"
+	qualityPolicyRetry = "retry"
+)
+
+// The values of the timestampSource setting.
+const (
+	timestampSourceSource = "source"
+	timestampSourceServer = "server"
+	timestampSourceNone   = "none"
+)
+
+// qualityFields are the config fields that decide what happens to a batch with values that are not Good.
+func qualityFields() []*service.ConfigField {
+	return []*service.ConfigField{
+		service.NewStringEnumField("badQualityPolicy", qualityPolicyFlag, qualityPolicyDrop, qualityPolicyRetry).Description("What to do when a value of a batch is not Good: flag emits the batch with the quality metadata set, drop discards it and retry reads the batch again, and flags it if it is still not Good.").Default(qualityPolicyFlag),
+		service.NewIntField("badQualityRetries").Description("How often a batch is read again with the retry badQualityPolicy.").Default(3),
+		service.NewIntField("badQualityRetryInterval").Description("Interval in milliseconds between the reads of a batch with the retry badQualityPolicy.").Default(500),
+	}
+}
+
+// qualityConfig is the policy for batches with values that are not Good. The zero value flags them.
+type qualityConfig struct {
+	policy        string
+	retries       int
+	retryInterval time.Duration
+}
+
+func parseQualityConfig(conf *service.ParsedConfig) (qualityConfig, error) {
+	var q qualityConfig
+	var err error
+
+	if q.policy, err = conf.FieldString("badQualityPolicy"); err != nil {
+		return q, err
+	}
+	if q.retries, err = conf.FieldInt("badQualityRetries"); err != nil {
+		return q, err
+	}
+	if q.retries < 0 {
+		return q, fmt.Errorf("badQualityRetries must not be negative, got %d", q.retries)
+	}
+	retryInterval, err := conf.FieldInt("badQualityRetryInterval")
+	if err != nil {
+		return q, err
+	}
+	if retryInterval < 0 {
+		return q, fmt.Errorf("badQualityRetryInterval must not be negative, got %d", retryInterval)
+	}
+	q.retryInterval = time.Duration(retryInterval) * time.Millisecond
+	return q, nil
+}
+
+// quality returns the quality of a status code, which is given by its two most significant bits.
+func quality(code ua.StatusCode) string {
+	switch code >> 30 {
+	case 0:
+		return qualityGood
+	case 1:
+		return qualityUncertain
+	default:
+		return qualityBad
+	}
+}
+
+// worseQuality returns the worse of two qualities.
+func worseQuality(a string, b string) string {
+	rank := map[string]int{qualityGood: 0, qualityUncertain: 1, qualityBad: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// statusName returns the name of a status code without its info bits, e.g. BadNodeIdUnknown.
+func statusName(code ua.StatusCode) string {
+	if code&0xFFFF0000 == 0 {
+		return qualityGood
+	}
+	if desc, ok := ua.StatusCodes[code&0xFFFF0000]; ok {
+		return strings.TrimPrefix(desc.Name, "Status")
+	}
+	return fmt.Sprintf("0x%08X", uint32(code))
+}
+
+// dataValueJSON returns a value with its status and timestamps, ready to be marshaled to JSON.
+// Timestamps that the server did not send are left out.
+func (d *dataTypeDecoder) dataValueJSON(value *ua.DataValue) map[string]interface{} {
+	result := map[string]interface{}{
+		"value":      d.jsonValue(variantValue(value.Value)),
+		"status":     statusName(value.Status),
+		"statusCode": uint32(value.Status),
+		"quality":    quality(value.Status),
+	}
+	if !value.SourceTimestamp.IsZero() {
+		result["sourceTimestamp"] = d.jsonValue(value.SourceTimestamp)
+	}
+	if !value.ServerTimestamp.IsZero() {
+		result["serverTimestamp"] = d.jsonValue(value.ServerTimestamp)
+	}
+	return result
+}
+
+// dataValueTimestamp returns the timestamp of a value that is selected by a timestampSource: the source timestamp,
+// or the server timestamp if the source did not set one, or only the server timestamp. It is zero for none, or if
+// the server did not send the timestamp.
+func dataValueTimestamp(value *ua.DataValue, source string) time.Time {
+	switch source {
+	case timestampSourceNone:
+		return time.Time{}
+	case timestampSourceServer:
+		return value.ServerTimestamp
+	default:
+		if !value.SourceTimestamp.IsZero() {
+			return value.SourceTimestamp
+		}
+		return value.ServerTimestamp
+	}
+}
@@ -0,0 +1,191 @@
+package opcua_plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQualityConfigInvalid(t *testing.T) {
+	for _, yaml := range []string{`badQualityRetries: -1`, `badQualityRetryInterval: -1`} {
+		_, err := parseQualityConfig(testConfig(t, qualityFields(), yaml))
+		assert.Error(t, err, yaml)
+	}
+}
+
+func TestQuality(t *testing.T) {
+	assert.Equal(t, qualityGood, quality(ua.StatusOK))
+	assert.Equal(t, qualityGood, quality(ua.StatusGoodClamped))
+	assert.Equal(t, qualityUncertain, quality(ua.StatusUncertainLastUsableValue))
+	assert.Equal(t, qualityBad, quality(ua.StatusBadNodeIDUnknown))
+
+	assert.Equal(t, qualityUncertain, worseQuality(qualityGood, qualityUncertain))
+	assert.Equal(t, qualityBad, worseQuality(qualityBad, qualityUncertain))
+
+	assert.Equal(t, "Good", statusName(ua.StatusOK))
+	assert.Equal(t, "BadNodeIDUnknown", statusName(ua.StatusBadNodeIDUnknown))
+	// info bits are ignored
+	assert.Equal(t, "UncertainLastUsableValue", statusName(ua.StatusUncertainLastUsableValue|0x0400))
+}
+
+func TestTriggerBatchQuality(t *testing.T) {
+	source := time.Date(2024, 4, 6, 12, 0, 0, 0, time.UTC)
+	trigger := &ua.DataValue{Value: ua.MustVariant(true), SourceTimestamp: source, ServerTimestamp: source.Add(time.Millisecond)}
+	weight := TNodeDef{TNodeID: ua.NewStringNodeID(2, "Line1.Weight")}
+	length := TNodeDef{TNodeID: ua.NewStringNodeID(2, "Line1.Length")}
+	batch := []batchValue{
+		{node: weight, name: "weight", value: &ua.DataValue{Value: ua.MustVariant(12.5), SourceTimestamp: source}},
+		{node: length, name: "length", value: &ua.DataValue{Status: ua.StatusBadNodeIDUnknown}},
+	}
+
+	g := &OPCUATriInput{
+		log:                   service.MockResources().Logger(),
+		tNodeGroupMapping:     map[string]string{"ns=2;s=Line1.PartDone": "D001,,,,"},
+		tBatchNodeNameMapping: map[string]string{"ns=2;s=Line1.Weight": "weight", "ns=2;s=Line1.Length": "length"},
+		payloadFormat:         "json",
+	}
+
+	// bad values are flagged by default
+	msg := g.createMessageFromValue(trigger, TNodeDef{}, "ns=2;s=Line1.PartDone", batch)
+	require.NotNil(t, msg)
+	q, _ := msg.MetaGet("quality")
+	assert.Equal(t, qualityBad, q)
+	m, _ := msg.MetaGet("Message")
+	assert.Equal(t, `{"weight":"12.5"}`, m)
+	b, err := msg.AsBytes()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"trigger": {"nodeID": "ns=2;s=Line1.PartDone", "value": true, "status": "Good", "statusCode": 0, "quality": "Good",
+			"sourceTimestamp": "2024-04-06T12:00:00Z", "serverTimestamp": "2024-04-06T12:00:00.001Z"},
+		"values": {
+			"weight": {"nodeID": "ns=2;s=Line1.Weight", "value": 12.5, "status": "Good", "statusCode": 0, "quality": "Good", "sourceTimestamp": "2024-04-06T12:00:00Z"},
+			"length": {"nodeID": "ns=2;s=Line1.Length", "value": null, "status": "BadNodeIDUnknown", "statusCode": 2150891520, "quality": "Bad"}
+		},
+		"quality": "Bad"
+	}`, string(b))
+
+	// the payload stays the trigger value by default
+	g.payloadFormat = "value"
+	msg = g.createMessageFromValue(trigger, TNodeDef{}, "ns=2;s=Line1.PartDone", batch[:1])
+	require.NotNil(t, msg)
+	b, err = msg.AsBytes()
+	require.NoError(t, err)
+	assert.Equal(t, `true`, string(b))
+	q, _ = msg.MetaGet("quality")
+	assert.Equal(t, qualityGood, q)
+
+	g.quality.policy = qualityPolicyDrop
+	assert.Nil(t, g.createMessageFromValue(trigger, TNodeDef{}, "ns=2;s=Line1.PartDone", batch))
+	assert.NotNil(t, g.createMessageFromValue(trigger, TNodeDef{}, "ns=2;s=Line1.PartDone", batch[:1]))
+}
+
+func TestValueTimestampsAndStatus(t *testing.T) {
+	source := time.Date(2024, 4, 6, 12, 0, 0, 0, time.UTC)
+	value := &ua.DataValue{Value: ua.MustVariant(12.5), Status: ua.StatusUncertainLastUsableValue, SourceTimestamp: source, ServerTimestamp: source.Add(time.Millisecond)}
+
+	assert.Equal(t, source, dataValueTimestamp(value, timestampSourceSource))
+	assert.Equal(t, source.Add(time.Millisecond), dataValueTimestamp(value, timestampSourceServer))
+	assert.True(t, dataValueTimestamp(value, timestampSourceNone).IsZero())
+	// the server timestamp replaces a missing source timestamp
+	assert.Equal(t, source, dataValueTimestamp(&ua.DataValue{ServerTimestamp: source}, timestampSourceSource))
+
+	g := &OPCUAInput{
+		log:              service.MockResources().Logger(),
+		nodeGroupMapping: map[string]string{"ns=2;s=Weight": "D001,,,,Weight"},
+		timestampSource:  timestampSourceSource,
+	}
+
+	msg := g.createMessageFromValue(value, NodeDef{}, "ns=2;s=Weight", nil)
+	require.NotNil(t, msg)
+	b, err := msg.AsBytes()
+	require.NoError(t, err)
+	assert.Equal(t, `12.5`, string(b))
+	for key, expected := range map[string]string{
+		"status":          "UncertainLastUsableValue",
+		"statusCode":      "1083179008",
+		"quality":         qualityUncertain,
+		"sourceTimestamp": "2024-04-06T12:00:00Z",
+		"serverTimestamp": "2024-04-06T12:00:00.001Z",
+		"timestamp_ms":    "1712404800000",
+	} {
+		v, _ := msg.MetaGet(key)
+		assert.Equal(t, expected, v, key)
+	}
+
+	g.payloadFormat = "json"
+	g.timestampSource = timestampSourceServer
+	msg = g.createMessageFromValue(value, NodeDef{}, "ns=2;s=Weight", nil)
+	require.NotNil(t, msg)
+	b, err = msg.AsBytes()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"nodeID": "ns=2;s=Weight", "value": 12.5, "status": "UncertainLastUsableValue", "statusCode": 1083179008, "quality": "Uncertain",
+		"sourceTimestamp": "2024-04-06T12:00:00Z", "serverTimestamp": "2024-04-06T12:00:00.001Z", "timestamp_ms": 1712404800001}`, string(b))
+	m, _ := msg.MetaGet("Message")
+	assert.Equal(t, `{"Weight":"12.5"}`, m)
+
+	g.timestampSource = timestampSourceNone
+	msg = g.createMessageFromValue(value, NodeDef{}, "ns=2;s=Weight", nil)
+	_, ok := msg.MetaGet("timestamp_ms")
+	assert.False(t, ok)
+}
+
+func TestTriggerBatchQualityPolicies(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+	writeTestValues(t, ctx, out, "line1", map[string]string{"partDone": "1", "weight": "12.5"})
+	// the batch contains a variable without a value, so it is not Good
+	out.server.mu.Lock()
+	_, err := out.server.space.variable([]string{"line1", "tool"}, "float64", false)
+	out.server.mu.Unlock()
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		policy  string
+		quality string
+		minWait time.Duration
+	}{
+		{policy: "flag", quality: qualityBad},
+		{policy: "retry", quality: qualityBad, minWait: 200 * time.Millisecond},
+		// dropped batches are not emitted
+		{policy: "drop"},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			in := newTestTriggerInput(t, ctx, out, `
+pollRate: 50
+badQualityPolicy: `+tc.policy+`
+badQualityRetries: 2
+badQualityRetryInterval: 100
+tNodeIDs:
+  - '{"1": [{"node": "ns=1;s=line1/partDone", "group": "line1"}]}'
+tBatchNodeIDs:
+  - '{"1": [{"node": "ns=1;s=line1/weight", "name": "weight"}, {"node": "ns=1;s=line1/tool", "name": "tool"}]}'
+`)
+			defer in.Close(ctx)
+
+			readCtx, cancelRead := context.WithTimeout(ctx, time.Second)
+			defer cancelRead()
+			start := time.Now()
+			batch, _, err := in.ReadBatch(readCtx)
+			if tc.quality == "" {
+				assert.ErrorIs(t, err, context.DeadlineExceeded)
+				return
+			}
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, time.Since(start), tc.minWait)
+			require.Len(t, batch, 1)
+			quality, _ := batch[0].MetaGet("quality")
+			assert.Equal(t, tc.quality, quality)
+			message, _ := batch[0].MetaGet("Message")
+			assert.Equal(t, `{"weight":"12.5"}`, message)
+		})
+	}
+}
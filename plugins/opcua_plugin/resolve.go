@@ -0,0 +1,198 @@
+package opcua_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// needsResolving reports whether a configured node can only be turned into a node ID on the server,
+// as it refers to its namespace by URI, e.g. nsu=urn:plc;s=Temperature, or is a browse path, e.g. /Objects/Line1/Press/Temperature.
+func needsResolving(node string) bool {
+	return strings.HasPrefix(node, "nsu=") || strings.HasPrefix(node, "/")
+}
+
+// configuredNodes returns the nodes of the node entries that need resolving.
+func configuredNodes(nodeEntries []string) ([]string, error) {
+	var nodes []string
+	for _, nodeElements := range nodeEntries {
+		var nodeObj map[string][]map[string]string
+		if err := json.Unmarshal([]byte(nodeElements), &nodeObj); err != nil {
+			return nil, err
+		}
+		for _, values := range nodeObj {
+			for _, obj := range values {
+				if needsResolving(obj["node"]) {
+					nodes = append(nodes, obj["node"])
+				}
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// resolveNodes resolves nsu= node IDs with the NamespaceArray of the server and browse paths with
+// TranslateBrowsePathsToNodeIds. It returns the node ID of every node, keyed by the configured node.
+func resolveNodes(ctx context.Context, c *opcua.Client, nodes []string, log *service.Logger) (map[string]string, error) {
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+
+	namespaces, err := c.NamespaceArray(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the NamespaceArray: %w", err)
+	}
+	log.Debugf("NamespaceArray: %v", namespaces)
+
+	resolved := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		if _, ok := resolved[node]; ok {
+			continue
+		}
+
+		var nodeID *ua.NodeID
+		if strings.HasPrefix(node, "/") {
+			nodeID, err = resolveBrowsePath(ctx, c, namespaces, node)
+		} else {
+			nodeID, err = resolveNamespaceURI(namespaces, node)
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Resolved node %s to %s", node, nodeID)
+		resolved[node] = nodeID.String()
+	}
+	return resolved, nil
+}
+
+// resolveNamespaceURI replaces the namespace URI of a nsu= node ID by its index in the NamespaceArray.
+func resolveNamespaceURI(namespaces []string, node string) (*ua.NodeID, error) {
+	nsu, identifier, ok := strings.Cut(strings.TrimPrefix(node, "nsu="), ";")
+	if !ok {
+		return nil, fmt.Errorf("invalid node %s: missing identifier", node)
+	}
+	for index, uri := range namespaces {
+		if uri == nsu {
+			return ua.ParseNodeID(fmt.Sprintf("ns=%d;%s", index, identifier))
+		}
+	}
+	return nil, fmt.Errorf("invalid node %s: namespace %s not found on the server", node, nsu)
+}
+
+// resolveBrowsePath follows a browse path from the Root folder one segment at a time. A segment may be
+// qualified with a namespace index, e.g. 2:Line1. Otherwise its BrowseName is looked up in all namespaces,
+// so that the path keeps working when the server reorders its namespaces.
+func resolveBrowsePath(ctx context.Context, c *opcua.Client, namespaces []string, path string) (*ua.NodeID, error) {
+	nodeID := ua.NewNumericNodeID(0, id.RootFolder)
+
+	for _, segment := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		if segment == "" {
+			return nil, fmt.Errorf("invalid browse path %s: empty segment", path)
+		}
+
+		var names []*ua.QualifiedName
+		if ns, name, ok := strings.Cut(segment, ":"); ok {
+			if index, err := strconv.ParseUint(ns, 10, 16); err == nil {
+				names = append(names, &ua.QualifiedName{NamespaceIndex: uint16(index), Name: name})
+			}
+		}
+		if names == nil {
+			for index := range namespaces {
+				names = append(names, &ua.QualifiedName{NamespaceIndex: uint16(index), Name: segment})
+			}
+		}
+
+		targets, err := translateBrowsePaths(ctx, c, nodeID, names)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve browse path %s: %w", path, err)
+		}
+		switch len(targets) {
+		case 0:
+			return nil, fmt.Errorf("invalid browse path %s: %s not found below %s", path, segment, nodeID)
+		case 1:
+			nodeID = targets[0]
+		default:
+			return nil, fmt.Errorf("invalid browse path %s: %s is ambiguous below %s, qualify it with a namespace index", path, segment, nodeID)
+		}
+	}
+	return nodeID, nil
+}
+
+// translateBrowsePaths returns the distinct nodes that are hierarchically referenced by start with one of the names.
+func translateBrowsePaths(ctx context.Context, c *opcua.Client, start *ua.NodeID, names []*ua.QualifiedName) ([]*ua.NodeID, error) {
+	req := &ua.TranslateBrowsePathsToNodeIDsRequest{}
+	for _, name := range names {
+		req.BrowsePaths = append(req.BrowsePaths, &ua.BrowsePath{
+			StartingNode: start,
+			RelativePath: &ua.RelativePath{
+				Elements: []*ua.RelativePathElement{{
+					ReferenceTypeID: ua.NewNumericNodeID(0, id.HierarchicalReferences),
+					IncludeSubtypes: true,
+					TargetName:      name,
+				}},
+			},
+		})
+	}
+
+	var res *ua.TranslateBrowsePathsToNodeIDsResponse
+	err := c.Send(ctx, req, func(v interface{}) error {
+		r, ok := v.(*ua.TranslateBrowsePathsToNodeIDsResponse)
+		if !ok {
+			return fmt.Errorf("unexpected response %T", v)
+		}
+		res = r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*ua.NodeID
+	seen := map[string]bool{}
+	for _, result := range res.Results {
+		// BadNoMatch just means that the node is in another namespace
+		if result.StatusCode != ua.StatusOK {
+			continue
+		}
+		for _, target := range result.Targets {
+			if target.TargetID == nil || seen[target.TargetID.NodeID.String()] {
+				continue
+			}
+			seen[target.TargetID.NodeID.String()] = true
+			targets = append(targets, target.TargetID.NodeID)
+		}
+	}
+	return targets, nil
+}
+
+// rewriteNodeEntries replaces the configured nodes of the node entries by their resolved node IDs.
+func rewriteNodeEntries(nodeEntries []string, resolved map[string]string) ([]string, error) {
+	rewritten := make([]string, 0, len(nodeEntries))
+	for _, nodeElements := range nodeEntries {
+		var nodeObj map[string][]map[string]string
+		if err := json.Unmarshal([]byte(nodeElements), &nodeObj); err != nil {
+			return nil, err
+		}
+		for _, values := range nodeObj {
+			for _, obj := range values {
+				if nodeID, ok := resolved[obj["node"]]; ok {
+					obj["node"] = nodeID
+				}
+			}
+		}
+		b, err := json.Marshal(nodeObj)
+		if err != nil {
+			return nil, err
+		}
+		rewritten = append(rewritten, string(b))
+	}
+	return rewritten, nil
+}
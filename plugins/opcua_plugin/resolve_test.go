@@ -0,0 +1,70 @@
+package opcua_plugin
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveNamespaceURI(t *testing.T) {
+	namespaces := []string{"http://opcfoundation.org/UA/", "urn:server", "urn:plc"}
+
+	nodeID, err := resolveNamespaceURI(namespaces, "nsu=urn:plc;s=Line1.Temperature")
+	require.NoError(t, err)
+	assert.Equal(t, ua.NewStringNodeID(2, "Line1.Temperature"), nodeID)
+
+	nodeID, err = resolveNamespaceURI(namespaces, "nsu=urn:server;i=1001")
+	require.NoError(t, err)
+	assert.Equal(t, "ns=1;i=1001", nodeID.String())
+
+	_, err = resolveNamespaceURI(namespaces, "nsu=urn:other;i=1001")
+	assert.Error(t, err)
+	_, err = resolveNamespaceURI(namespaces, "nsu=urn:plc")
+	assert.Error(t, err)
+}
+
+func TestResolvedNodeEntries(t *testing.T) {
+	entries := []string{
+		`{"1": [{"node": "ns=2;s=Pressure", "group": "D001"}, {"node": "nsu=urn:plc;s=Temperature", "group": "D001", "queueSize": "100"}]}`,
+		`{"2": [{"node": "/Objects/Line1/Press/Speed", "group": "D002"}]}`,
+	}
+
+	nodes, err := configuredNodes(entries)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"nsu=urn:plc;s=Temperature", "/Objects/Line1/Press/Speed"}, nodes)
+
+	// until they are resolved on connect, only the other nodes are used
+	assert.Equal(t, []*ua.NodeID{ua.NewStringNodeID(2, "Pressure")}, nonNilNodeIDs(ParseTriggerNodeIDs(entries)))
+	assert.Empty(t, nonNilNodeIDs(ParseNodeIDs(nodes)))
+	s, err := parseSubscriptionConfig(testConfig(t, subscriptionFields(), ``), entries)
+	require.NoError(t, err)
+	assert.Empty(t, s.nodes)
+
+	rewritten, err := rewriteNodeEntries(entries, map[string]string{
+		"nsu=urn:plc;s=Temperature":  "ns=3;s=Temperature",
+		"/Objects/Line1/Press/Speed": "ns=3;i=5001",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []*ua.NodeID{ua.NewStringNodeID(2, "Pressure"), ua.NewStringNodeID(3, "Temperature"), ua.MustParseNodeID("ns=3;i=5001")}, nonNilNodeIDs(ParseTriggerNodeIDs(rewritten)))
+
+	nodeGroupMapping, nodesMapping, err := parseNodeGroupMapping(rewritten)
+	require.NoError(t, err)
+	assert.Equal(t, "D002,,,,", nodeGroupMapping["ns=3;i=5001"])
+	assert.Equal(t, "1", nodesMapping["ns=3;s=Temperature"])
+
+	require.NoError(t, s.setNodes(rewritten))
+	assert.Equal(t, uint32(100), s.monitoredItem(ua.NewStringNodeID(3, "Temperature"), 0).RequestedParameters.QueueSize)
+}
+
+// nonNilNodeIDs drops the empty entries ParseNodeIDs and ParseTriggerNodeIDs start their results with.
+func nonNilNodeIDs(nodeIDs []*ua.NodeID) []*ua.NodeID {
+	var result []*ua.NodeID
+	for _, nodeID := range nodeIDs {
+		if nodeID != nil {
+			result = append(result, nodeID)
+		}
+	}
+	return result
+}
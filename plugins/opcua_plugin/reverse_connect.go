@@ -0,0 +1,351 @@
+package opcua_plugin
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua/uacp"
+)
+
+const (
+	// maxReverseHelloSize limits a ReverseHello to a ServerUri and an EndpointUrl of 4096 bytes each.
+	maxReverseHelloSize = 8 + 2*(4+4096)
+	// maxWaitingReverseConnections is the number of reverse connections that are kept until the client uses them.
+	maxWaitingReverseConnections = 16
+	// reverseHelloTimeout is the time a server has to send its ReverseHello after connecting.
+	reverseHelloTimeout = 10 * time.Second
+)
+
+// reverseConnectFields are the config fields to let servers open the connections, e.g. if only outbound connections
+// are allowed from the machine.
+func reverseConnectFields() []*service.ConfigField {
+	return []*service.ConfigField{
+		service.NewStringField("reverseConnect").Description("Address the client listens on for reverse connections, e.g. opc.tcp://0.0.0.0:4843. If set, the client does not connect to the endpoint, but waits for the server to connect and send a ReverseHello, and opens the secure channel over that connection. The endpoint is still required to identify the server, e.g. in the browse cache.").Default(""),
+		service.NewStringListField("reverseConnectServerURIs").Description("ApplicationURIs of the servers that may connect to reverseConnect. Connections of other servers are closed.").Default([]string{}),
+		service.NewIntField("reverseConnectTimeout").Description("Time in milliseconds the client waits for a reverse connection of a server before the connection attempt fails.").Default(30000),
+	}
+}
+
+// reverseConnectConfig holds the settings of reverse connect and the listener for the reverse connections, which is
+// started on the first connect. A nil reverseConnectConfig connects to the endpoint.
+type reverseConnectConfig struct {
+	listen     string
+	serverURIs map[string]bool
+	timeout    time.Duration
+
+	mu       sync.Mutex
+	listener *reverseListener
+}
+
+func parseReverseConnectConfig(conf *service.ParsedConfig) (*reverseConnectConfig, error) {
+	listen, err := conf.FieldString("reverseConnect")
+	if err != nil || listen == "" {
+		return nil, err
+	}
+	u, err := url.Parse(listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reverseConnect: %w", err)
+	}
+	if u.Scheme != "opc.tcp" || u.Host == "" {
+		return nil, fmt.Errorf("invalid reverseConnect %s, expected opc.tcp://host:port", listen)
+	}
+
+	serverURIs, err := conf.FieldStringList("reverseConnectServerURIs")
+	if err != nil {
+		return nil, err
+	}
+	if len(serverURIs) == 0 {
+		return nil, errors.New("reverseConnectServerURIs are required with reverseConnect")
+	}
+
+	timeout, err := conf.FieldInt("reverseConnectTimeout")
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("reverseConnectTimeout must be positive, got %d", timeout)
+	}
+
+	r := &reverseConnectConfig{
+		listen:     listen,
+		serverURIs: make(map[string]bool, len(serverURIs)),
+		timeout:    time.Duration(timeout) * time.Millisecond,
+	}
+	for _, uri := range serverURIs {
+		r.serverURIs[uri] = true
+	}
+	return r, nil
+}
+
+// endpoint starts to listen for reverse connections, if it does not yet, and returns the endpoint the client
+// connects to instead of the server. Every connection to it is forwarded over the next reverse connection.
+func (r *reverseConnectConfig) endpoint(log *service.Logger) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.listener == nil {
+		l, err := listenReverse(r, log)
+		if err != nil {
+			return "", err
+		}
+		r.listener = l
+		log.Infof("Waiting for reverse connections on %s", r.listen)
+	}
+	return "opc.tcp://" + r.listener.local.Addr().String(), nil
+}
+
+// close stops listening for reverse connections and closes the connections that are not used yet.
+func (r *reverseConnectConfig) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.listener != nil {
+		r.listener.close()
+		r.listener = nil
+	}
+}
+
+// reverseConnection is a connection that a server opened with a ReverseHello.
+type reverseConnection struct {
+	conn  net.Conn
+	hello *uacp.ReverseHello
+}
+
+// reverseListener accepts the reverse connections of the servers and the connections of the client on the
+// loopback interface, and forwards the client over a reverse connection.
+type reverseListener struct {
+	conf    *reverseConnectConfig
+	log     *service.Logger
+	reverse net.Listener
+	local   net.Listener
+	waiting chan *reverseConnection
+	done    chan struct{}
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func listenReverse(conf *reverseConnectConfig, log *service.Logger) (*reverseListener, error) {
+	u, err := url.Parse(conf.listen)
+	if err != nil {
+		return nil, err
+	}
+	reverse, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for reverse connections: %w", err)
+	}
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		reverse.Close()
+		return nil, err
+	}
+
+	l := &reverseListener{
+		conf:    conf,
+		log:     log,
+		reverse: reverse,
+		local:   local,
+		waiting: make(chan *reverseConnection, maxWaitingReverseConnections),
+		done:    make(chan struct{}),
+		conns:   map[net.Conn]struct{}{},
+	}
+	l.wg.Add(2)
+	go l.acceptReverse()
+	go l.acceptLocal()
+	return l, nil
+}
+
+// track registers a connection, so that it is closed with the listener. It returns false if the listener is closed.
+func (l *reverseListener) track(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.done:
+		conn.Close()
+		return false
+	default:
+	}
+	l.conns[conn] = struct{}{}
+	return true
+}
+
+func (l *reverseListener) untrack(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	conn.Close()
+	delete(l.conns, conn)
+}
+
+func (l *reverseListener) acceptReverse() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.reverse.Accept()
+		if err != nil {
+			return
+		}
+		if !l.track(conn) {
+			return
+		}
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.handleReverse(conn)
+		}()
+	}
+}
+
+// handleReverse reads the ReverseHello of a server and keeps its connection until the client uses it.
+func (l *reverseListener) handleReverse(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(reverseHelloTimeout))
+	messageType, body, err := readConnectionMessage(conn, maxReverseHelloSize)
+	if err != nil || messageType != "RHEF" {
+		l.log.Warnf("Closing reverse connection from %s without a ReverseHello: %v", conn.RemoteAddr(), err)
+		l.untrack(conn)
+		return
+	}
+	hello := &uacp.ReverseHello{}
+	if _, err := hello.Decode(body); err != nil {
+		l.log.Warnf("Closing reverse connection from %s with an invalid ReverseHello: %v", conn.RemoteAddr(), err)
+		l.untrack(conn)
+		return
+	}
+	if !l.conf.serverURIs[hello.ServerURI] {
+		l.log.Warnf("Rejecting reverse connection of server %s from %s, as it is not in reverseConnectServerURIs", hello.ServerURI, conn.RemoteAddr())
+		l.untrack(conn)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	l.log.Debugf("Accepted reverse connection of server %s with endpoint %s from %s", hello.ServerURI, hello.EndpointURL, conn.RemoteAddr())
+	select {
+	case l.waiting <- &reverseConnection{conn: conn, hello: hello}:
+	default:
+		l.log.Warnf("Closing reverse connection of server %s, as %d connections are already waiting", hello.ServerURI, maxWaitingReverseConnections)
+		l.untrack(conn)
+	}
+}
+
+func (l *reverseListener) acceptLocal() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.local.Accept()
+		if err != nil {
+			return
+		}
+		if !l.track(conn) {
+			return
+		}
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.forward(conn)
+		}()
+	}
+}
+
+// forward sends the Hello of the client over the next reverse connection, with the EndpointUrl that the server
+// announced in its ReverseHello, and then forwards all messages in both directions.
+func (l *reverseListener) forward(client net.Conn) {
+	defer l.untrack(client)
+
+	_ = client.SetDeadline(time.Now().Add(l.conf.timeout))
+	messageType, body, err := readConnectionMessage(client, maxHelloSize)
+	if err != nil || messageType != "HELF" {
+		l.log.Errorf("Failed to read the Hello of the client: %v", err)
+		return
+	}
+	hello := &uacp.Hello{}
+	if _, err := hello.Decode(body); err != nil {
+		l.log.Errorf("Failed to decode the Hello of the client: %v", err)
+		return
+	}
+
+	var server *reverseConnection
+	select {
+	case server = <-l.waiting:
+	case <-time.After(l.conf.timeout):
+		l.log.Errorf("No server connected to %s within %s", l.conf.listen, l.conf.timeout)
+		return
+	case <-l.done:
+		return
+	}
+	defer l.untrack(server.conn)
+	_ = client.SetDeadline(time.Time{})
+
+	hello.EndpointURL = server.hello.EndpointURL
+	if err := writeConnectionMessage(server.conn, "HELF", hello); err != nil {
+		l.log.Errorf("Failed to send the Hello to server %s: %v", server.hello.ServerURI, err)
+		return
+	}
+	l.log.Infof("Connecting to server %s over its reverse connection from %s", server.hello.ServerURI, server.conn.RemoteAddr())
+
+	copied := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(server.conn, client)
+		copied <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(client, server.conn)
+		copied <- struct{}{}
+	}()
+	// the connection ends when either side closes it
+	<-copied
+}
+
+func (l *reverseListener) close() {
+	l.mu.Lock()
+	close(l.done)
+	l.reverse.Close()
+	l.local.Close()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+
+	l.wg.Wait()
+}
+
+// readConnectionMessage reads a message of the OPC UA Connection Protocol, e.g. a Hello, and returns its type with
+// the chunk type, e.g. HELF, and its body.
+func readConnectionMessage(conn net.Conn, maxSize uint32) (string, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[4:])
+	if size < 8 || size > maxSize {
+		return "", nil, fmt.Errorf("invalid message size %d", size)
+	}
+	body := make([]byte, size-8)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return "", nil, err
+	}
+	return string(header[:4]), body, nil
+}
+
+func writeConnectionMessage(conn net.Conn, messageType string, msg interface{ Encode() ([]byte, error) }) error {
+	body, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+	header, err := (&uacp.Header{MessageType: messageType[:3], ChunkType: messageType[3], MessageSize: uint32(8 + len(body))}).Encode()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(header, body...))
+	return err
+}
@@ -0,0 +1,125 @@
+package opcua_plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uacp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReverseConnectConfig(t *testing.T) {
+	c, err := parseConnectionConfig(testConfig(t, connectionFields(), `endpoint: opc.tcp://localhost:4840`), service.MockResources())
+	require.NoError(t, err)
+	assert.Nil(t, c.reverse)
+
+	c, err = parseConnectionConfig(testConfig(t, connectionFields(), `
+endpoint: opc.tcp://machine:4840
+reverseConnect: opc.tcp://0.0.0.0:4843
+reverseConnectServerURIs: [urn:machine:server]
+`), service.MockResources())
+	require.NoError(t, err)
+	require.NotNil(t, c.reverse)
+	assert.True(t, c.reverse.serverURIs["urn:machine:server"])
+	assert.Equal(t, 30*time.Second, c.reverse.timeout)
+
+	for _, yaml := range []string{
+		"reverseConnect: opc.tcp://0.0.0.0:4843",
+		"reverseConnect: http://0.0.0.0:4843\nreverseConnectServerURIs: [urn:machine:server]",
+		"reverseConnect: opc.tcp://0.0.0.0:4843\nreverseConnectServerURIs: [urn:machine:server]\nreverseConnectTimeout: 0",
+	} {
+		_, err := parseConnectionConfig(testConfig(t, connectionFields(), "endpoint: opc.tcp://localhost:4840\n"+yaml), service.MockResources())
+		assert.Error(t, err, yaml)
+	}
+}
+
+// reverseConnectServer opens reverse connections to the client like a server behind a firewall: it keeps one
+// connection waiting with a ReverseHello, and forwards it to the server once the client uses it.
+func reverseConnectServer(ctx context.Context, client string, hello *uacp.ReverseHello, server string) {
+	for ctx.Err() == nil {
+		conn, err := net.Dial("tcp", client)
+		if err != nil {
+			return
+		}
+		if err := writeConnectionMessage(conn, "RHEF", hello); err != nil {
+			conn.Close()
+			return
+		}
+		first := make([]byte, 1)
+		if _, err := io.ReadFull(conn, first); err != nil {
+			conn.Close()
+			return
+		}
+		upstream, err := net.Dial("tcp", server)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer conn.Close()
+			defer upstream.Close()
+			if _, err := upstream.Write(first); err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(conn, upstream) }()
+			_, _ = io.Copy(upstream, conn)
+		}()
+	}
+}
+
+func TestReverseConnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+	msg := service.NewMessage([]byte(`23.5`))
+	msg.MetaSet("group", "line1")
+	msg.MetaSet("name", "temperature")
+	require.NoError(t, out.Write(ctx, msg))
+	serverAddr := out.server.listener.Addr().String()
+
+	conf, err := parseConnectionConfig(testConfig(t, connectionFields(), fmt.Sprintf(`
+endpoint: opc.tcp://%s
+securityMode: None
+securityPolicy: None
+reverseConnect: opc.tcp://127.0.0.1:0
+reverseConnectServerURIs: [%s]
+reverseConnectTimeout: 5000
+`, serverAddr, out.server.applicationURI)), service.MockResources())
+	require.NoError(t, err)
+	log := service.MockResources().Logger()
+	defer conf.reverse.close()
+
+	// start listening, so that the servers know where to connect to
+	_, err = conf.reverse.endpoint(log)
+	require.NoError(t, err)
+	clientAddr := conf.reverse.listener.reverse.Addr().String()
+
+	// servers that are not configured are rejected
+	conn, err := net.Dial("tcp", clientAddr)
+	require.NoError(t, err)
+	require.NoError(t, writeConnectionMessage(conn, "RHEF", &uacp.ReverseHello{ServerURI: "urn:other", EndpointURL: "opc.tcp://other:4840"}))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	conn.Close()
+
+	go reverseConnectServer(ctx, clientAddr, &uacp.ReverseHello{ServerURI: out.server.applicationURI, EndpointURL: "opc.tcp://" + serverAddr}, serverAddr)
+
+	c, err := conf.connect(ctx, log)
+	require.NoError(t, err)
+	defer c.Close(ctx)
+
+	v, err := c.Node(ua.NewStringNodeID(1, "line1/temperature")).Value(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 23.5, v.Value())
+}
@@ -0,0 +1,424 @@
+package opcua_plugin
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uatest"
+)
+
+// securityPolicyRanks orders the security policies the server supports by their strength.
+var securityPolicyRanks = map[string]uint8{
+	ua.SecurityPolicyURINone:                0,
+	ua.SecurityPolicyURIBasic128Rsa15:       1,
+	ua.SecurityPolicyURIBasic256:            2,
+	ua.SecurityPolicyURIAes128Sha256RsaOaep: 3,
+	ua.SecurityPolicyURIBasic256Sha256:      4,
+	ua.SecurityPolicyURIAes256Sha256RsaPss:  5,
+}
+
+// serverConfig holds the settings of the OPC UA server of the opcua_server output.
+type serverConfig struct {
+	endpoint         string
+	namespaceURI     string
+	securityPolicies []string
+	certificate      certificateConfig
+	users            map[string]string
+	allowAnonymous   bool
+}
+
+// uaServer is a minimal OPC UA server. It supports the services that clients need to browse, read and subscribe to
+// the variables of its address space.
+type uaServer struct {
+	conf           serverConfig
+	log            *service.Logger
+	key            *rsa.PrivateKey
+	cert           []byte
+	applicationURI string
+	endpointURL    string
+	listener       *net.TCPListener
+
+	// guards the address space, the sessions with their subscriptions and the connections
+	mu        sync.Mutex
+	space     *addressSpace
+	sessions  map[string]*serverSession
+	conns     map[*net.TCPConn]struct{}
+	nextID    uint32
+	channelID uint32
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// serverSession is a session of a client. The fields are guarded by the mutex of the server.
+type serverSession struct {
+	id         *ua.NodeID
+	authToken  *ua.NodeID
+	name       string
+	channel    *serverChannel
+	activated  bool
+	timeout    time.Duration
+	lastSeen   time.Time
+	nonce      []byte
+	clientCert []byte
+
+	subscriptions      map[uint32]*serverSubscription
+	publishRequests    []*queuedPublish
+	continuationPoints map[string]*browseContinuation
+}
+
+// queuedPublish is a publish request that waits for notifications.
+type queuedPublish struct {
+	channel   *serverChannel
+	requestID uint32
+	request   *ua.PublishRequest
+	results   []ua.StatusCode
+}
+
+// pendingResponse is a response that is sent after the mutex of the server is released.
+type pendingResponse struct {
+	channel   *serverChannel
+	requestID uint32
+	response  ua.Response
+}
+
+func (r *pendingResponse) send() {
+	r.channel.send(r.requestID, r.response)
+}
+
+// newServer loads or generates the server certificate and creates the address space.
+func newServer(conf serverConfig, log *service.Logger) (*uaServer, error) {
+	srv := &uaServer{
+		conf:     conf,
+		log:      log,
+		space:    newAddressSpace(conf.namespaceURI, time.Now()),
+		sessions: map[string]*serverSession{},
+		conns:    map[*net.TCPConn]struct{}{},
+		closed:   make(chan struct{}),
+	}
+
+	var err error
+	if srv.key, srv.cert, err = conf.certificate.loadOrGenerate(generateServerCertificate, log); err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(srv.cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse server certificate: %w", err)
+	}
+	if len(cert.URIs) == 0 {
+		return nil, fmt.Errorf("server certificate has no application URI")
+	}
+	srv.applicationURI = cert.URIs[0].String()
+
+	if !conf.certificate.verifiesPeers() {
+		log.Warnf("No client certificates are trusted, so clients can not use the endpoints with security. Add their certificates to trustedCertsDir or clientCertificateThumbprints to trust them")
+	}
+	if srv.policyEnabled(ua.SecurityPolicyURINone) {
+		log.Warnf("The None security policy is enabled, its clients are neither encrypted nor authenticated by their certificates")
+	}
+	return srv, nil
+}
+
+func generateServerCertificate() (certPEM []byte, keyPEM []byte, err error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	certPEM, keyPEM, err = uatest.GenerateCert(fmt.Sprintf("urn:benthos-umh:server:%s,%s,localhost,127.0.0.1", host, host), 2048, 24*time.Hour*365*10)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate certificate: %w", err)
+	}
+	return certPEM, keyPEM, nil
+}
+
+// start listens on the endpoint and accepts the connections of clients.
+func (srv *uaServer) start() error {
+	u, err := url.Parse(srv.conf.endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %s: %w", srv.conf.endpoint, err)
+	}
+	if u.Scheme != "opc.tcp" {
+		return fmt.Errorf("invalid endpoint %s: expected opc.tcp://host:port", srv.conf.endpoint)
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", u.Host)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %s: %w", srv.conf.endpoint, err)
+	}
+	if srv.listener, err = net.ListenTCP("tcp", addr); err != nil {
+		return err
+	}
+
+	// clients need a host name they can connect to, and the actual port if a random one was requested
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		if host, err = os.Hostname(); err != nil {
+			host = "localhost"
+		}
+	}
+	port := strconv.Itoa(srv.listener.Addr().(*net.TCPAddr).Port)
+	srv.endpointURL = "opc.tcp://" + net.JoinHostPort(host, port) + u.Path
+	srv.log.Infof("OPC UA server listening on %s as %s", srv.listener.Addr(), srv.endpointURL)
+
+	srv.wg.Add(2)
+	go srv.accept()
+	go srv.expireSessions()
+	return nil
+}
+
+func (srv *uaServer) accept() {
+	defer srv.wg.Done()
+	for {
+		conn, err := srv.listener.AcceptTCP()
+		if err != nil {
+			select {
+			case <-srv.closed:
+				return
+			default:
+			}
+			srv.log.Errorf("Failed to accept connection: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		srv.mu.Lock()
+		select {
+		case <-srv.closed:
+			srv.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		srv.conns[conn] = struct{}{}
+		srv.mu.Unlock()
+
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			srv.serve(conn)
+
+			srv.mu.Lock()
+			delete(srv.conns, conn)
+			srv.mu.Unlock()
+		}()
+	}
+}
+
+// expireSessions removes the sessions whose clients did not send requests within the session timeout.
+func (srv *uaServer) expireSessions() {
+	defer srv.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.closed:
+			return
+		case now := <-ticker.C:
+			var responses []*pendingResponse
+			srv.mu.Lock()
+			for _, sess := range srv.sessions {
+				if now.Sub(sess.lastSeen) > sess.timeout {
+					srv.log.Infof("Session %s expired", sess.name)
+					responses = append(responses, srv.closeSession(sess)...)
+				}
+			}
+			srv.mu.Unlock()
+			for _, r := range responses {
+				r.send()
+			}
+		}
+	}
+}
+
+// close stops the server and closes the connections of all clients.
+func (srv *uaServer) close() {
+	srv.mu.Lock()
+	select {
+	case <-srv.closed:
+		srv.mu.Unlock()
+		return
+	default:
+	}
+	close(srv.closed)
+	for _, sess := range srv.sessions {
+		srv.closeSession(sess)
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+
+	if srv.listener != nil {
+		srv.listener.Close()
+	}
+
+	srv.wg.Wait()
+}
+
+// closeChannel detaches the sessions of a closed channel, so that clients can activate them on a new channel.
+func (srv *uaServer) closeChannel(ch *serverChannel) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for _, sess := range srv.sessions {
+		if sess.channel == ch {
+			sess.channel = nil
+		}
+		sess.publishRequests = dropPublishRequests(sess.publishRequests, ch)
+	}
+}
+
+func dropPublishRequests(requests []*queuedPublish, ch *serverChannel) []*queuedPublish {
+	kept := requests[:0]
+	for _, pub := range requests {
+		if pub.channel != ch {
+			kept = append(kept, pub)
+		}
+	}
+	return kept
+}
+
+// closeSession deletes a session with its subscriptions. It returns the answers to the queued publish requests.
+// The mutex must be held.
+func (srv *uaServer) closeSession(sess *serverSession) []*pendingResponse {
+	for _, s := range sess.subscriptions {
+		srv.deleteSubscription(s)
+	}
+	delete(srv.sessions, nodeKey(sess.authToken))
+	return rejectPublishRequests(sess, ua.StatusBadSessionClosed)
+}
+
+// rejectPublishRequests answers the queued publish requests of a session with a status. The mutex must be held.
+func rejectPublishRequests(sess *serverSession, status ua.StatusCode) []*pendingResponse {
+	responses := make([]*pendingResponse, 0, len(sess.publishRequests))
+	for _, pub := range sess.publishRequests {
+		responses = append(responses, &pendingResponse{
+			channel:   pub.channel,
+			requestID: pub.requestID,
+			response:  serviceFault(pub.request.RequestHeader, status),
+		})
+	}
+	sess.publishRequests = nil
+	return responses
+}
+
+func (srv *uaServer) newChannelID() uint32 {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.channelID++
+	return srv.channelID
+}
+
+func (srv *uaServer) policyEnabled(policyURI string) bool {
+	for _, uri := range srv.conf.securityPolicies {
+		if uri == policyURI {
+			return true
+		}
+	}
+	return false
+}
+
+// userTokenPolicyURI is the security policy that encrypts the passwords of users on endpoints without security.
+// It is the strongest policy enabled, or None if there is none.
+func (srv *uaServer) userTokenPolicyURI() string {
+	policyURI := ua.SecurityPolicyURINone
+	for _, uri := range srv.conf.securityPolicies {
+		if securityPolicyRanks[uri] > securityPolicyRanks[policyURI] {
+			policyURI = uri
+		}
+	}
+	return policyURI
+}
+
+func (srv *uaServer) applicationDescription(endpointURL string) *ua.ApplicationDescription {
+	return &ua.ApplicationDescription{
+		ApplicationURI:  srv.applicationURI,
+		ProductURI:      "urn:benthos-umh",
+		ApplicationName: ua.NewLocalizedText("benthos-umh"),
+		ApplicationType: ua.ApplicationTypeServer,
+		DiscoveryURLs:   []string{endpointURL},
+	}
+}
+
+// endpoints describes the endpoints of the server. Every security policy except None is offered with the Sign and
+// the SignAndEncrypt mode.
+func (srv *uaServer) endpoints(endpointURL string) []*ua.EndpointDescription {
+	if endpointURL == "" {
+		endpointURL = srv.endpointURL
+	}
+
+	var endpoints []*ua.EndpointDescription
+	for _, policyURI := range srv.conf.securityPolicies {
+		modes := []ua.MessageSecurityMode{ua.MessageSecurityModeSign, ua.MessageSecurityModeSignAndEncrypt}
+		if policyURI == ua.SecurityPolicyURINone {
+			modes = []ua.MessageSecurityMode{ua.MessageSecurityModeNone}
+		}
+
+		var tokens []*ua.UserTokenPolicy
+		if srv.conf.allowAnonymous {
+			tokens = append(tokens, &ua.UserTokenPolicy{PolicyID: "Anonymous", TokenType: ua.UserTokenTypeAnonymous})
+		}
+		if len(srv.conf.users) > 0 {
+			tokenPolicyURI := policyURI
+			if policyURI == ua.SecurityPolicyURINone {
+				tokenPolicyURI = srv.userTokenPolicyURI()
+			}
+			tokens = append(tokens, &ua.UserTokenPolicy{PolicyID: "UserName", TokenType: ua.UserTokenTypeUserName, SecurityPolicyURI: tokenPolicyURI})
+		}
+
+		for _, mode := range modes {
+			level := securityPolicyRanks[policyURI] * 2
+			if mode == ua.MessageSecurityModeSignAndEncrypt {
+				level++
+			}
+			endpoints = append(endpoints, &ua.EndpointDescription{
+				EndpointURL:         endpointURL,
+				Server:              srv.applicationDescription(endpointURL),
+				ServerCertificate:   srv.cert,
+				SecurityMode:        mode,
+				SecurityPolicyURI:   policyURI,
+				UserIdentityTokens:  tokens,
+				TransportProfileURI: "http://opcfoundation.org/UA-Profile/Transport/uatcp-uasc-uabinary",
+				SecurityLevel:       level,
+			})
+		}
+	}
+	return endpoints
+}
+
+// setVariable updates the variable at the path below the Objects folder with a value of a message, creating the
+// variable for the type of the value if it does not exist yet. Values of existing variables are converted to
+// their type, so a variable keeps its DataType.
+func (srv *uaServer) setVariable(path []string, value any, sourceTimestamp time.Time) error {
+	goType, array, err := inferGoType(value)
+	if err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	n, err := srv.space.variable(path, goType, array)
+	if err != nil {
+		return err
+	}
+	variant, err := toVariant(value, n.goType)
+	if err != nil {
+		return fmt.Errorf("%s: %w", n.id.StringID(), err)
+	}
+
+	dv := &ua.DataValue{Value: variant, SourceTimestamp: sourceTimestamp, ServerTimestamp: time.Now()}
+	dv.UpdateMask()
+	n.setValue(dv)
+	return nil
+}
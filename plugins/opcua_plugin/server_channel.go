@@ -0,0 +1,580 @@
+package opcua_plugin
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uacp"
+	"github.com/gopcua/opcua/uapolicy"
+	"github.com/gopcua/opcua/uasc"
+)
+
+const (
+	// maxHelloSize limits the hello message, whose endpoint URL may have up to 4096 bytes.
+	maxHelloSize = 8 + 20 + 4 + 4096
+	// minBufferSize is the smallest buffer size a client may request.
+	minBufferSize = 8192
+	// maxChannelTokens is the number of security tokens of a channel that are accepted at the same time.
+	// The previous token stays valid until the client uses the renewed one.
+	maxChannelTokens = 2
+
+	// maxChunkedRequests is the number of requests of a channel whose chunks are buffered at the same time. Together
+	// with the limit of all buffered chunks to the maximum message size, it bounds the memory a client can take.
+	maxChunkedRequests = 4
+
+	minChannelLifetime = 10 * time.Second
+	maxChannelLifetime = time.Hour
+)
+
+// serverChannel is a secure channel of a client of the opcua_server output. Messages are read by serve, and responses
+// can be sent from any goroutine.
+type serverChannel struct {
+	srv  *uaServer
+	conn *uacp.Conn
+
+	// the limits of the messages the client accepts. 0 means no limit.
+	maxMessageSize uint32
+	maxChunkCount  uint32
+
+	// set when the channel is opened and only used by serve afterwards
+	id         uint32
+	policyURI  string
+	mode       ua.MessageSecurityMode
+	remoteCert []byte
+	asymmetric *uapolicy.EncryptionAlgorithm
+	chunks     map[uint32][][]byte
+	chunkBytes int
+
+	// guards the tokens and the sequence number, and serializes the writes
+	mu             sync.Mutex
+	tokens         map[uint32]*uapolicy.EncryptionAlgorithm
+	tokenID        uint32
+	sendTokenID    uint32
+	sequenceNumber uint32
+}
+
+// serve runs a connection of a client until it is closed.
+func (srv *uaServer) serve(tcp *net.TCPConn) {
+	defer tcp.Close()
+
+	ch, err := srv.handshake(tcp)
+	if err != nil {
+		srv.log.Debugf("Handshake with %s failed: %v", tcp.RemoteAddr(), err)
+		return
+	}
+
+	defer srv.closeChannel(ch)
+
+	for {
+		b, err := ch.conn.Receive()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				srv.log.Debugf("Failed to receive from %s: %v", tcp.RemoteAddr(), err)
+			}
+			return
+		}
+		if err := ch.receive(b); err != nil {
+			if !errors.Is(err, io.EOF) {
+				srv.log.Warnf("Closing connection of %s: %v", tcp.RemoteAddr(), err)
+				var status ua.StatusCode
+				if !errors.As(err, &status) {
+					status = ua.StatusBadTCPInternalError
+				}
+				ch.conn.SendError(status)
+			}
+			return
+		}
+	}
+}
+
+// handshake answers the hello of a client. The endpoint URL of the hello is not checked, as clients often connect
+// by another host name or address than the server advertises.
+func (srv *uaServer) handshake(tcp *net.TCPConn) (*serverChannel, error) {
+	if err := tcp.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(tcp, header); err != nil {
+		return nil, err
+	}
+	h := new(uacp.Header)
+	if _, err := h.Decode(header); err != nil {
+		return nil, err
+	}
+	if h.MessageType != "HEL" || h.ChunkType != 'F' || h.MessageSize < 8 || h.MessageSize > maxHelloSize {
+		return nil, fmt.Errorf("invalid hello %s%c with %d bytes", h.MessageType, h.ChunkType, h.MessageSize)
+	}
+	body := make([]byte, h.MessageSize-8)
+	if _, err := io.ReadFull(tcp, body); err != nil {
+		return nil, err
+	}
+	hello := new(uacp.Hello)
+	if _, err := hello.Decode(body); err != nil {
+		return nil, err
+	}
+
+	ack := &uacp.Acknowledge{
+		ReceiveBufSize: min(hello.SendBufSize, uacp.DefaultReceiveBufSize),
+		SendBufSize:    min(hello.ReceiveBufSize, uacp.DefaultSendBufSize),
+		MaxMessageSize: uacp.DefaultMaxMessageSize,
+		MaxChunkCount:  uacp.DefaultMaxChunkCount,
+	}
+	conn, err := uacp.NewConn(tcp, ack)
+	if err != nil {
+		return nil, err
+	}
+	if ack.ReceiveBufSize < minBufferSize || ack.SendBufSize < minBufferSize {
+		conn.SendError(ua.StatusBadTCPNotEnoughResources)
+		return nil, fmt.Errorf("buffer sizes %d and %d are too small", hello.SendBufSize, hello.ReceiveBufSize)
+	}
+	if err := conn.Send("ACKF", ack); err != nil {
+		return nil, err
+	}
+	if err := tcp.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return &serverChannel{
+		srv:            srv,
+		conn:           conn,
+		maxMessageSize: hello.MaxMessageSize,
+		maxChunkCount:  hello.MaxChunkCount,
+		chunks:         map[uint32][][]byte{},
+		tokens:         map[uint32]*uapolicy.EncryptionAlgorithm{},
+	}, nil
+}
+
+// receive handles a chunk of a message. It returns an error if the channel has to be closed.
+func (ch *serverChannel) receive(b []byte) error {
+	m := new(uasc.MessageChunk)
+	if _, err := m.Decode(b); err != nil {
+		return ua.StatusBadTCPMessageTypeInvalid
+	}
+
+	switch m.MessageType {
+	case "OPN":
+		return ch.open(m, b)
+	case "CLO":
+		if _, _, err := ch.verify(m, b); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+
+	sequence, data, err := ch.verify(m, b)
+	if err != nil {
+		return err
+	}
+
+	switch m.ChunkType {
+	case 'C':
+		// channels without security that are only accepted for the discovery do not need large requests
+		if ch.policyURI == ua.SecurityPolicyURINone && !ch.srv.policyEnabled(ch.policyURI) {
+			return ua.StatusBadSecurityPolicyRejected
+		}
+		if _, ok := ch.chunks[sequence.RequestID]; !ok && len(ch.chunks) >= maxChunkedRequests {
+			return ua.StatusBadTCPNotEnoughResources
+		}
+		ch.chunks[sequence.RequestID] = append(ch.chunks[sequence.RequestID], data)
+		ch.chunkBytes += len(data)
+		if len(ch.chunks[sequence.RequestID]) > uacp.DefaultMaxChunkCount || ch.chunkBytes > uacp.DefaultMaxMessageSize {
+			return ua.StatusBadTCPMessageTooLarge
+		}
+		return nil
+	case 'A':
+		ch.dropChunks(sequence.RequestID)
+		return nil
+	}
+
+	body := bytes.Join(append(ch.chunks[sequence.RequestID], data), nil)
+	ch.dropChunks(sequence.RequestID)
+	if len(body) > uacp.DefaultMaxMessageSize {
+		return ua.StatusBadTCPMessageTooLarge
+	}
+
+	_, req, err := ua.DecodeService(body)
+	if err != nil {
+		// the request header cannot be decoded, but the client matches the response by the request ID
+		ch.send(sequence.RequestID, serviceFault(nil, ua.StatusBadServiceUnsupported))
+		return nil
+	}
+	ch.srv.handle(ch, sequence.RequestID, req)
+	return nil
+}
+
+// dropChunks removes the buffered chunks of a request.
+func (ch *serverChannel) dropChunks(requestID uint32) {
+	for _, chunk := range ch.chunks[requestID] {
+		ch.chunkBytes -= len(chunk)
+	}
+	delete(ch.chunks, requestID)
+}
+
+// open handles an OpenSecureChannelRequest, which issues the security token of a new channel or renews it.
+func (ch *serverChannel) open(m *uasc.MessageChunk, b []byte) error {
+	if m.ChunkType != 'F' {
+		return ua.StatusBadTCPMessageTypeInvalid
+	}
+	policyURI := m.SecurityPolicyURI
+	// channels without security are accepted for the discovery of the endpoints, sessions require an enabled policy
+	if policyURI != ua.SecurityPolicyURINone && !ch.srv.policyEnabled(policyURI) {
+		return ua.StatusBadSecurityPolicyRejected
+	}
+	if ch.id != 0 && (m.SecureChannelID != ch.id || policyURI != ch.policyURI) {
+		return ua.StatusBadSecureChannelIDInvalid
+	}
+
+	algo, err := uapolicy.Asymmetric(policyURI, ch.srv.key, nil)
+	if policyURI != ua.SecurityPolicyURINone {
+		if !bytes.Equal(m.ReceiverCertificateThumbprint, uapolicy.Thumbprint(ch.srv.cert)) {
+			return ua.StatusBadCertificateInvalid
+		}
+		if ch.id != 0 && !bytes.Equal(m.SenderCertificate, ch.remoteCert) {
+			return ua.StatusBadCertificateInvalid
+		}
+		if ch.id == 0 {
+			if err := ch.srv.conf.certificate.verifyCertificate("client", m.SenderCertificate, ch.srv.log); err != nil {
+				ch.srv.log.Warnf("Rejected secure channel: %v", err)
+				return ua.StatusBadCertificateUntrusted
+			}
+		}
+		remoteKey, keyErr := certificatePublicKey(m.SenderCertificate)
+		if keyErr != nil {
+			return ua.StatusBadCertificateInvalid
+		}
+		algo, err = uapolicy.Asymmetric(policyURI, ch.srv.key, remoteKey)
+	}
+	if err != nil {
+		return ua.StatusBadSecurityChecksFailed
+	}
+
+	signed := policyURI != ua.SecurityPolicyURINone
+	data, err := verifyAndDecrypt(b, len(b)-len(m.Data), algo, signed, signed)
+	if err != nil {
+		return err
+	}
+	sequence := new(uasc.SequenceHeader)
+	n, err := sequence.Decode(data)
+	if err != nil {
+		return ua.StatusBadDecodingError
+	}
+	_, svc, err := ua.DecodeService(data[n:])
+	if err != nil {
+		return ua.StatusBadDecodingError
+	}
+	req, ok := svc.(*ua.OpenSecureChannelRequest)
+	if !ok {
+		return ua.StatusBadTCPMessageTypeInvalid
+	}
+
+	switch {
+	case policyURI == ua.SecurityPolicyURINone && req.SecurityMode != ua.MessageSecurityModeNone,
+		policyURI != ua.SecurityPolicyURINone && req.SecurityMode != ua.MessageSecurityModeSign && req.SecurityMode != ua.MessageSecurityModeSignAndEncrypt:
+		return ua.StatusBadSecurityModeRejected
+	case req.RequestType == ua.SecurityTokenRequestTypeIssue && ch.id != 0,
+		req.RequestType == ua.SecurityTokenRequestTypeRenew && (ch.id == 0 || req.SecurityMode != ch.mode):
+		return ua.StatusBadRequestTypeInvalid
+	case req.RequestType != ua.SecurityTokenRequestTypeIssue && req.RequestType != ua.SecurityTokenRequestTypeRenew:
+		return ua.StatusBadRequestTypeInvalid
+	}
+
+	var serverNonce []byte
+	if policyURI != ua.SecurityPolicyURINone {
+		if len(req.ClientNonce) != algo.NonceLength() {
+			return ua.StatusBadNonceInvalid
+		}
+		if serverNonce, err = algo.MakeNonce(); err != nil {
+			return err
+		}
+	}
+	symmetric, err := uapolicy.Symmetric(policyURI, serverNonce, req.ClientNonce)
+	if err != nil {
+		return ua.StatusBadSecurityChecksFailed
+	}
+
+	lifetime := time.Duration(req.RequestedLifetime) * time.Millisecond
+	switch {
+	case lifetime == 0 || lifetime > maxChannelLifetime:
+		lifetime = maxChannelLifetime
+	case lifetime < minChannelLifetime:
+		lifetime = minChannelLifetime
+	}
+
+	if ch.id == 0 {
+		ch.id = ch.srv.newChannelID()
+		ch.policyURI = policyURI
+		ch.mode = req.SecurityMode
+		ch.remoteCert = m.SenderCertificate
+	}
+	ch.asymmetric = algo
+
+	ch.mu.Lock()
+	ch.tokenID++
+	ch.tokens[ch.tokenID] = symmetric
+	delete(ch.tokens, ch.tokenID-maxChannelTokens)
+	if req.RequestType == ua.SecurityTokenRequestTypeIssue {
+		ch.sendTokenID = ch.tokenID
+	}
+	token := &ua.ChannelSecurityToken{
+		ChannelID:       ch.id,
+		TokenID:         ch.tokenID,
+		CreatedAt:       time.Now(),
+		RevisedLifetime: uint32(lifetime / time.Millisecond),
+	}
+	ch.mu.Unlock()
+
+	return ch.write("OPN", sequence.RequestID, &ua.OpenSecureChannelResponse{
+		ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK),
+		SecurityToken:  token,
+		ServerNonce:    serverNonce,
+	})
+}
+
+// certificatePublicKey returns the RSA public key of a DER encoded certificate.
+func certificatePublicKey(cert []byte) (*rsa.PublicKey, error) {
+	c, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := c.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key %T", c.PublicKey)
+	}
+	return key, nil
+}
+
+// verify checks the signature of a symmetrically secured chunk and decrypts it. It returns the sequence header
+// and the body of the chunk.
+func (ch *serverChannel) verify(m *uasc.MessageChunk, b []byte) (*uasc.SequenceHeader, []byte, error) {
+	if ch.id == 0 || m.SecureChannelID != ch.id {
+		return nil, nil, ua.StatusBadSecureChannelIDInvalid
+	}
+
+	ch.mu.Lock()
+	algo, ok := ch.tokens[m.TokenID]
+	if ok && m.TokenID == ch.tokenID {
+		// the client uses the renewed token, so the responses use it as well
+		ch.sendTokenID = m.TokenID
+	}
+	ch.mu.Unlock()
+	if !ok {
+		return nil, nil, ua.StatusBadSecureChannelTokenUnknown
+	}
+
+	data, err := verifyAndDecrypt(b, len(b)-len(m.Data), algo, ch.mode != ua.MessageSecurityModeNone, ch.mode == ua.MessageSecurityModeSignAndEncrypt)
+	if err != nil {
+		return nil, nil, err
+	}
+	sequence := new(uasc.SequenceHeader)
+	n, err := sequence.Decode(data)
+	if err != nil {
+		return nil, nil, ua.StatusBadDecodingError
+	}
+	return sequence, data[n:], nil
+}
+
+// send sends a response to a request of the channel. Responses that exceed the limits of the client are
+// replaced by a fault.
+func (ch *serverChannel) send(requestID uint32, resp ua.Response) {
+	err := ch.write("MSG", requestID, resp)
+	if errors.Is(err, ua.StatusBadResponseTooLarge) {
+		fault := serviceFault(nil, ua.StatusBadResponseTooLarge)
+		fault.ResponseHeader.RequestHandle = resp.Header().RequestHandle
+		err = ch.write("MSG", requestID, fault)
+	}
+	if err != nil {
+		ch.srv.log.Debugf("Failed to send %T to channel %d: %v", resp, ch.id, err)
+	}
+}
+
+// write encodes a message, splits it into chunks that fit the send buffer of the client and secures them.
+func (ch *serverChannel) write(messageType string, requestID uint32, svc interface{}) error {
+	typeID, err := ua.Encode(ua.NewFourByteExpandedNodeID(0, ua.ServiceTypeID(svc)))
+	if err != nil {
+		return err
+	}
+	body, err := ua.Encode(svc)
+	if err != nil {
+		return err
+	}
+	body = append(typeID, body...)
+	if ch.maxMessageSize > 0 && uint32(len(body)) > ch.maxMessageSize {
+		return ua.StatusBadResponseTooLarge
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	var securityHeader []byte
+	var algo *uapolicy.EncryptionAlgorithm
+	signed, encrypted := ch.mode != ua.MessageSecurityModeNone, ch.mode == ua.MessageSecurityModeSignAndEncrypt
+	if messageType == "OPN" {
+		var cert, thumbprint []byte
+		if ch.policyURI != ua.SecurityPolicyURINone {
+			cert, thumbprint = ch.srv.cert, uapolicy.Thumbprint(ch.remoteCert)
+		}
+		securityHeader, err = uasc.NewAsymmetricSecurityHeader(ch.policyURI, cert, thumbprint).Encode()
+		algo = ch.asymmetric
+		// OpenSecureChannel messages are always encrypted, unless the policy is None
+		signed, encrypted = ch.policyURI != ua.SecurityPolicyURINone, ch.policyURI != ua.SecurityPolicyURINone
+	} else {
+		securityHeader, err = uasc.NewSymmetricSecurityHeader(ch.sendTokenID).Encode()
+		algo = ch.tokens[ch.sendTokenID]
+	}
+	if err != nil {
+		return err
+	}
+
+	headerLength := 12 + len(securityHeader)
+	sendBufSize := int(ch.conn.SendBufSize())
+	paddingBytes := 1
+	if algo.RemoteSignatureLength() > 256 {
+		paddingBytes = 2
+	}
+	var maxBody int
+	switch {
+	case encrypted:
+		blocks := (sendBufSize - headerLength) / algo.BlockSize()
+		maxBody = blocks*algo.PlaintextBlockSize() - 8 - algo.SignatureLength() - paddingBytes - 1
+	case signed:
+		maxBody = sendBufSize - headerLength - 8 - algo.SignatureLength()
+	default:
+		maxBody = sendBufSize - headerLength - 8
+	}
+
+	chunkCount := (len(body) + maxBody - 1) / maxBody
+	if ch.maxChunkCount > 0 && uint32(chunkCount) > ch.maxChunkCount {
+		return ua.StatusBadResponseTooLarge
+	}
+
+	for len(body) > 0 {
+		chunkType := byte('F')
+		part := body
+		if len(part) > maxBody {
+			chunkType, part = 'C', part[:maxBody]
+		}
+		body = body[len(part):]
+
+		ch.sequenceNumber++
+		if ch.sequenceNumber > 1<<32-1025 {
+			// sequence numbers wrap around below 1024 as the specification requires
+			ch.sequenceNumber = 1
+		}
+		sequence, err := uasc.NewSequenceHeader(ch.sequenceNumber, requestID).Encode()
+		if err != nil {
+			return err
+		}
+
+		chunk := make([]byte, 12, headerLength+8+len(part))
+		copy(chunk, messageType)
+		chunk[3] = chunkType
+		binary.LittleEndian.PutUint32(chunk[4:], uint32(headerLength+8+len(part)))
+		binary.LittleEndian.PutUint32(chunk[8:], ch.id)
+		chunk = append(chunk, securityHeader...)
+		chunk = append(chunk, sequence...)
+		chunk = append(chunk, part...)
+
+		if chunk, err = signAndEncrypt(chunk, headerLength, algo, signed, encrypted); err != nil {
+			return err
+		}
+		if _, err := ch.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signAndEncrypt pads and signs a chunk, and encrypts it after the security header, as the uasc package of
+// the client does.
+func signAndEncrypt(b []byte, headerLength int, algo *uapolicy.EncryptionAlgorithm, signed, encrypted bool) ([]byte, error) {
+	if !signed {
+		return b, nil
+	}
+
+	var encryptedLength int
+	if encrypted {
+		plaintextBlockSize := algo.PlaintextBlockSize()
+		extraPadding := algo.RemoteSignatureLength() > 256
+		paddingBytes := 1
+		if extraPadding {
+			paddingBytes = 2
+		}
+		paddingLength := plaintextBlockSize - ((len(b[headerLength:]) + algo.SignatureLength() + paddingBytes) % plaintextBlockSize)
+		for i := 0; i <= paddingLength; i++ {
+			b = append(b, byte(paddingLength))
+		}
+		if extraPadding {
+			b = append(b, byte(paddingLength>>8))
+		}
+		encryptedLength = ((len(b[headerLength:]) + algo.SignatureLength()) / plaintextBlockSize) * algo.BlockSize()
+	} else {
+		encryptedLength = len(b[headerLength:]) + algo.SignatureLength()
+	}
+	binary.LittleEndian.PutUint32(b[4:], uint32(headerLength+encryptedLength))
+
+	signature, err := algo.Signature(b)
+	if err != nil {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	b = append(b, signature...)
+	if !encrypted {
+		return b, nil
+	}
+	p, err := algo.Encrypt(b[headerLength:])
+	if err != nil {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	return append(b[:headerLength], p...), nil
+}
+
+// verifyAndDecrypt decrypts a chunk after the security header, verifies its signature and returns the data after
+// the security header without the padding and the signature.
+func verifyAndDecrypt(r []byte, headerLength int, algo *uapolicy.EncryptionAlgorithm, signed, encrypted bool) ([]byte, error) {
+	if !signed {
+		return r[headerLength:], nil
+	}
+
+	b := make([]byte, len(r))
+	copy(b, r)
+	if encrypted {
+		p, err := algo.Decrypt(b[headerLength:])
+		if err != nil {
+			return nil, ua.StatusBadSecurityChecksFailed
+		}
+		b = append(b[:headerLength], p...)
+	}
+
+	signatureLength := algo.RemoteSignatureLength()
+	if len(b) < headerLength+signatureLength+1 {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	message, signature := b[:len(b)-signatureLength], b[len(b)-signatureLength:]
+	if err := algo.VerifySignature(message, signature); err != nil {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+
+	var paddingLength int
+	if encrypted {
+		paddingLength = int(message[len(message)-1])
+		if algo.SignatureLength() > 256 {
+			paddingLength <<= 8
+			paddingLength += int(message[len(message)-2])
+			paddingLength++
+		}
+		paddingLength++
+	}
+	if len(message)-paddingLength < headerLength {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	return message[headerLength : len(message)-paddingLength], nil
+}
@@ -0,0 +1,474 @@
+package opcua_plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// serverNode is a node in the address space of the opcua_server output.
+type serverNode struct {
+	id          *ua.NodeID
+	class       ua.NodeClass
+	browseName  *ua.QualifiedName
+	description string
+	typeDef     uint32
+	references  []serverReference
+
+	// the attributes of variables. dynamic computes the value of server variables on every read.
+	value     *ua.DataValue
+	dynamic   func() *ua.Variant
+	dataType  *ua.NodeID
+	valueRank int32
+	// goType is the type the values of the messages are converted to, as in opcua_write, e.g. float64
+	goType   string
+	monitors []*monitoredItem
+}
+
+type serverReference struct {
+	refType uint32
+	forward bool
+	target  *serverNode
+}
+
+// referenceTypeParents are the supertypes of the reference types the server knows, which are
+// needed to browse and translate browse paths with IncludeSubtypes.
+var referenceTypeParents = map[uint32]uint32{
+	id.HierarchicalReferences:    id.References,
+	id.NonHierarchicalReferences: id.References,
+	id.HasChild:                  id.HierarchicalReferences,
+	id.Organizes:                 id.HierarchicalReferences,
+	id.HasEventSource:            id.HierarchicalReferences,
+	id.HasNotifier:               id.HasEventSource,
+	id.Aggregates:                id.HasChild,
+	id.HasSubtype:                id.HasChild,
+	id.HasComponent:              id.Aggregates,
+	id.HasProperty:               id.Aggregates,
+	id.HasTypeDefinition:         id.NonHierarchicalReferences,
+	id.HasModellingRule:          id.NonHierarchicalReferences,
+	id.HasEncoding:               id.NonHierarchicalReferences,
+}
+
+func knownReferenceType(refType uint32) bool {
+	_, ok := referenceTypeParents[refType]
+	return ok || refType == id.References
+}
+
+// isReferenceType reports whether refType is of type want, or one of its subtypes if includeSubtypes is set.
+func isReferenceType(refType, want uint32, includeSubtypes bool) bool {
+	for {
+		if refType == want {
+			return true
+		}
+		if !includeSubtypes {
+			return false
+		}
+		parent, ok := referenceTypeParents[refType]
+		if !ok {
+			return false
+		}
+		refType = parent
+	}
+}
+
+// goTypeDataTypes are the DataTypes of the variables created from messages.
+var goTypeDataTypes = map[string]uint32{
+	"bool":    id.Boolean,
+	"float64": id.Double,
+	"string":  id.String,
+}
+
+// inferGoType returns the type of the variable created for a value of a message, and whether it is an array.
+// All elements of an array must have the same type.
+func inferGoType(value any) (string, bool, error) {
+	elements, array := value.([]any)
+	if !array {
+		goType, err := scalarGoType(value)
+		return goType, false, err
+	}
+	if len(elements) == 0 {
+		return "", true, errors.New("cannot create a variable for an empty array")
+	}
+
+	goType, err := scalarGoType(elements[0])
+	if err != nil {
+		return "", true, err
+	}
+	for _, element := range elements[1:] {
+		if t, err := scalarGoType(element); err != nil || t != goType {
+			return "", true, fmt.Errorf("array elements must all be of type %s", goType)
+		}
+	}
+	return goType, true, nil
+}
+
+func scalarGoType(value any) (string, error) {
+	switch value.(type) {
+	case bool:
+		return "bool", nil
+	case json.Number, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "float64", nil
+	case string:
+		return "string", nil
+	}
+	return "", fmt.Errorf("cannot create a variable for a %T", value)
+}
+
+// addressSpace holds the nodes of the server: the standard nodes of namespace 0 that clients
+// need, and the folders and variables created from messages in namespace 1.
+type addressSpace struct {
+	nodes map[string]*serverNode
+}
+
+func newAddressSpace(namespaceURI string, started time.Time) *addressSpace {
+	a := &addressSpace{nodes: map[string]*serverNode{}}
+
+	object := func(nodeID uint32, name string, typeDef uint32) *serverNode {
+		return &serverNode{
+			id:         ua.NewNumericNodeID(0, nodeID),
+			class:      ua.NodeClassObject,
+			browseName: &ua.QualifiedName{Name: name},
+			typeDef:    typeDef,
+		}
+	}
+	variable := func(nodeID uint32, name string, dataType uint32, valueRank int32, value func() *ua.Variant) *serverNode {
+		return &serverNode{
+			id:         ua.NewNumericNodeID(0, nodeID),
+			class:      ua.NodeClassVariable,
+			browseName: &ua.QualifiedName{Name: name},
+			typeDef:    id.BaseDataVariableType,
+			dynamic:    value,
+			dataType:   ua.NewNumericNodeID(0, dataType),
+			valueRank:  valueRank,
+		}
+	}
+
+	root := object(id.RootFolder, "Root", id.FolderType)
+	a.add(root, nil, 0)
+	objects := object(id.ObjectsFolder, "Objects", id.FolderType)
+	a.add(objects, root, id.Organizes)
+	a.add(object(id.TypesFolder, "Types", id.FolderType), root, id.Organizes)
+	a.add(object(id.ViewsFolder, "Views", id.FolderType), root, id.Organizes)
+
+	server := object(id.Server, "Server", id.ServerType)
+	a.add(server, objects, id.Organizes)
+	namespaces := []string{"http://opcfoundation.org/UA/", namespaceURI}
+	a.add(variable(id.Server_NamespaceArray, "NamespaceArray", id.String, 1, func() *ua.Variant {
+		return ua.MustVariant(namespaces)
+	}), server, id.HasProperty)
+	a.add(variable(id.Server_ServerArray, "ServerArray", id.String, 1, func() *ua.Variant {
+		return ua.MustVariant([]string{namespaceURI})
+	}), server, id.HasProperty)
+
+	status := variable(id.Server_ServerStatus, "ServerStatus", id.ServerStatusDataType, -1, func() *ua.Variant {
+		return ua.MustVariant(ua.NewExtensionObject(&ua.ServerStatusDataType{
+			StartTime:   started,
+			CurrentTime: time.Now(),
+			State:       ua.ServerStateRunning,
+			BuildInfo: &ua.BuildInfo{
+				ProductURI:       "urn:benthos-umh",
+				ManufacturerName: "United Manufacturing Hub",
+				ProductName:      "benthos-umh",
+			},
+			ShutdownReason: &ua.LocalizedText{},
+		}))
+	})
+	status.typeDef = id.ServerStatusType
+	a.add(status, server, id.HasComponent)
+	a.add(variable(id.Server_ServerStatus_StartTime, "StartTime", id.DateTime, -1, func() *ua.Variant {
+		return ua.MustVariant(started)
+	}), status, id.HasComponent)
+	a.add(variable(id.Server_ServerStatus_CurrentTime, "CurrentTime", id.DateTime, -1, func() *ua.Variant {
+		return ua.MustVariant(time.Now())
+	}), status, id.HasComponent)
+	a.add(variable(id.Server_ServerStatus_State, "State", id.ServerState, -1, func() *ua.Variant {
+		return ua.MustVariant(int32(ua.ServerStateRunning))
+	}), status, id.HasComponent)
+	return a
+}
+
+func nodeKey(nodeID *ua.NodeID) string {
+	if nodeID == nil {
+		return ""
+	}
+	return nodeID.String()
+}
+
+// node returns the node with the given ID, or nil.
+func (a *addressSpace) node(nodeID *ua.NodeID) *serverNode {
+	return a.nodes[nodeKey(nodeID)]
+}
+
+// add adds a node, referenced by its parent with refType.
+func (a *addressSpace) add(n *serverNode, parent *serverNode, refType uint32) {
+	a.nodes[nodeKey(n.id)] = n
+	if parent != nil {
+		parent.references = append(parent.references, serverReference{refType: refType, forward: true, target: n})
+		n.references = append(n.references, serverReference{refType: refType, forward: false, target: parent})
+	}
+}
+
+// variable returns the variable at the path below the Objects folder, in namespace 1, creating it and its folders
+// for values of goType. The node ID of a variable or folder is its path, e.g. ns=1;s=D001/temperature.
+func (a *addressSpace) variable(path []string, goType string, array bool) (*serverNode, error) {
+	parent := a.node(ua.NewNumericNodeID(0, id.ObjectsFolder))
+	for i, name := range path {
+		nodeID := ua.NewStringNodeID(1, strings.Join(path[:i+1], "/"))
+		n := a.node(nodeID)
+		last := i == len(path)-1
+
+		if n == nil {
+			n = &serverNode{
+				id:         nodeID,
+				browseName: &ua.QualifiedName{NamespaceIndex: 1, Name: name},
+			}
+			if last {
+				n.class = ua.NodeClassVariable
+				n.typeDef = id.BaseDataVariableType
+				n.goType = goType
+				n.dataType = ua.NewNumericNodeID(0, goTypeDataTypes[goType])
+				n.valueRank = -1
+				if array {
+					n.valueRank = 1
+				}
+				a.add(n, parent, id.HasComponent)
+				return n, nil
+			}
+			n.class = ua.NodeClassObject
+			n.typeDef = id.FolderType
+			a.add(n, parent, id.Organizes)
+		}
+
+		switch {
+		case last && n.class != ua.NodeClassVariable:
+			return nil, fmt.Errorf("%s is a folder", nodeID.StringID())
+		case !last && n.class != ua.NodeClassObject:
+			return nil, fmt.Errorf("%s is a variable", nodeID.StringID())
+		}
+		parent = n
+	}
+
+	if (parent.valueRank == 1) != array {
+		return nil, fmt.Errorf("%s can not change between a scalar and an array", parent.id.StringID())
+	}
+	return parent, nil
+}
+
+// setValue updates the value of a variable and samples it for the monitored items.
+func (n *serverNode) setValue(value *ua.DataValue) {
+	n.value = value
+	for _, m := range n.monitors {
+		m.sample(value)
+	}
+}
+
+// dataValue returns the value of a variable.
+func (n *serverNode) dataValue() *ua.DataValue {
+	if n.dynamic != nil {
+		now := time.Now()
+		return &ua.DataValue{Value: n.dynamic(), SourceTimestamp: now, ServerTimestamp: now}
+	}
+	if n.value == nil {
+		return &ua.DataValue{Status: ua.StatusBadWaitingForInitialData}
+	}
+	return n.value
+}
+
+// attribute returns an attribute of the node, except for the Value.
+func (n *serverNode) attribute(attributeID ua.AttributeID) (*ua.Variant, ua.StatusCode) {
+	switch attributeID {
+	case ua.AttributeIDNodeID:
+		return ua.MustVariant(n.id), ua.StatusOK
+	case ua.AttributeIDNodeClass:
+		return ua.MustVariant(int32(n.class)), ua.StatusOK
+	case ua.AttributeIDBrowseName:
+		return ua.MustVariant(n.browseName), ua.StatusOK
+	case ua.AttributeIDDisplayName:
+		return ua.MustVariant(ua.NewLocalizedText(n.browseName.Name)), ua.StatusOK
+	case ua.AttributeIDDescription:
+		return ua.MustVariant(ua.NewLocalizedText(n.description)), ua.StatusOK
+	case ua.AttributeIDWriteMask, ua.AttributeIDUserWriteMask:
+		return ua.MustVariant(uint32(0)), ua.StatusOK
+	}
+
+	switch n.class {
+	case ua.NodeClassObject:
+		if attributeID == ua.AttributeIDEventNotifier {
+			return ua.MustVariant(uint8(0)), ua.StatusOK
+		}
+	case ua.NodeClassVariable:
+		switch attributeID {
+		case ua.AttributeIDDataType:
+			return ua.MustVariant(n.dataType), ua.StatusOK
+		case ua.AttributeIDValueRank:
+			return ua.MustVariant(n.valueRank), ua.StatusOK
+		case ua.AttributeIDArrayDimensions:
+			if n.valueRank == 1 {
+				return ua.MustVariant([]uint32{0}), ua.StatusOK
+			}
+			return ua.MustVariant([]uint32{}), ua.StatusOK
+		case ua.AttributeIDAccessLevel, ua.AttributeIDUserAccessLevel:
+			return ua.MustVariant(uint8(ua.AccessLevelTypeCurrentRead)), ua.StatusOK
+		case ua.AttributeIDMinimumSamplingInterval:
+			return ua.MustVariant(float64(0)), ua.StatusOK
+		case ua.AttributeIDHistorizing:
+			return ua.MustVariant(false), ua.StatusOK
+		}
+	}
+	return nil, ua.StatusBadAttributeIDInvalid
+}
+
+// readValue reads an attribute of a node for a ReadValueID.
+func (a *addressSpace) readValue(r *ua.ReadValueID, timestamps ua.TimestampsToReturn) *ua.DataValue {
+	n := a.node(r.NodeID)
+	if n == nil {
+		return &ua.DataValue{EncodingMask: ua.DataValueStatusCode, Status: ua.StatusBadNodeIDUnknown}
+	}
+	if r.IndexRange != "" {
+		return &ua.DataValue{EncodingMask: ua.DataValueStatusCode, Status: ua.StatusBadIndexRangeInvalid}
+	}
+	if r.DataEncoding != nil && r.DataEncoding.Name != "" {
+		return &ua.DataValue{EncodingMask: ua.DataValueStatusCode, Status: ua.StatusBadDataEncodingInvalid}
+	}
+
+	if r.AttributeID == ua.AttributeIDValue {
+		if n.class != ua.NodeClassVariable {
+			return &ua.DataValue{EncodingMask: ua.DataValueStatusCode, Status: ua.StatusBadAttributeIDInvalid}
+		}
+		return withTimestamps(n.dataValue(), timestamps)
+	}
+
+	v, status := n.attribute(r.AttributeID)
+	dv := &ua.DataValue{Value: v, Status: status}
+	dv.UpdateMask()
+	return dv
+}
+
+// withTimestamps returns a copy of the value with the timestamps the client asked for.
+func withTimestamps(value *ua.DataValue, timestamps ua.TimestampsToReturn) *ua.DataValue {
+	dv := *value
+	if timestamps == ua.TimestampsToReturnServer || timestamps == ua.TimestampsToReturnNeither {
+		dv.SourceTimestamp = time.Time{}
+	}
+	if timestamps == ua.TimestampsToReturnSource || timestamps == ua.TimestampsToReturnNeither {
+		dv.ServerTimestamp = time.Time{}
+	}
+	dv.UpdateMask()
+	return &dv
+}
+
+// browse returns the references of a node that match the BrowseDescription.
+func (a *addressSpace) browse(desc *ua.BrowseDescription) ([]*ua.ReferenceDescription, ua.StatusCode) {
+	n := a.node(desc.NodeID)
+	if n == nil {
+		return nil, ua.StatusBadNodeIDUnknown
+	}
+	if desc.BrowseDirection > ua.BrowseDirectionBoth {
+		return nil, ua.StatusBadBrowseDirectionInvalid
+	}
+
+	refType := uint32(id.References)
+	if desc.ReferenceTypeID != nil && !(desc.ReferenceTypeID.Namespace() == 0 && desc.ReferenceTypeID.IntID() == 0) {
+		if desc.ReferenceTypeID.Namespace() != 0 || !knownReferenceType(desc.ReferenceTypeID.IntID()) {
+			return nil, ua.StatusBadReferenceTypeIDInvalid
+		}
+		refType = desc.ReferenceTypeID.IntID()
+	}
+
+	var refs []*ua.ReferenceDescription
+	add := func(referenceType uint32, forward bool, target *serverNode) {
+		if desc.NodeClassMask != 0 && desc.NodeClassMask&uint32(target.class) == 0 {
+			return
+		}
+		// fields that are not requested are encoded as null values
+		ref := &ua.ReferenceDescription{
+			ReferenceTypeID: ua.NewTwoByteNodeID(0),
+			NodeID:          ua.NewExpandedNodeID(target.id, "", 0),
+			BrowseName:      &ua.QualifiedName{},
+			DisplayName:     &ua.LocalizedText{},
+			TypeDefinition:  ua.NewTwoByteExpandedNodeID(0),
+		}
+		if desc.ResultMask&uint32(ua.BrowseResultMaskReferenceTypeID) != 0 {
+			ref.ReferenceTypeID = ua.NewNumericNodeID(0, referenceType)
+		}
+		if desc.ResultMask&uint32(ua.BrowseResultMaskIsForward) != 0 {
+			ref.IsForward = forward
+		}
+		if desc.ResultMask&uint32(ua.BrowseResultMaskNodeClass) != 0 {
+			ref.NodeClass = target.class
+		}
+		if desc.ResultMask&uint32(ua.BrowseResultMaskBrowseName) != 0 {
+			ref.BrowseName = target.browseName
+		}
+		if desc.ResultMask&uint32(ua.BrowseResultMaskDisplayName) != 0 {
+			ref.DisplayName = ua.NewLocalizedText(target.browseName.Name)
+		}
+		if desc.ResultMask&uint32(ua.BrowseResultMaskTypeDefinition) != 0 && target.typeDef != 0 {
+			ref.TypeDefinition = ua.NewNumericExpandedNodeID(0, target.typeDef)
+		}
+		refs = append(refs, ref)
+	}
+
+	for _, r := range n.references {
+		if r.forward && desc.BrowseDirection == ua.BrowseDirectionInverse || !r.forward && desc.BrowseDirection == ua.BrowseDirectionForward {
+			continue
+		}
+		if !isReferenceType(r.refType, refType, desc.IncludeSubtypes) {
+			continue
+		}
+		add(r.refType, r.forward, r.target)
+	}
+	return refs, ua.StatusOK
+}
+
+// translate follows a browse path from its starting node.
+func (a *addressSpace) translate(path *ua.BrowsePath) *ua.BrowsePathResult {
+	start := a.node(path.StartingNode)
+	if start == nil {
+		return &ua.BrowsePathResult{StatusCode: ua.StatusBadNodeIDUnknown}
+	}
+	if path.RelativePath == nil || len(path.RelativePath.Elements) == 0 {
+		return &ua.BrowsePathResult{StatusCode: ua.StatusBadNothingToDo}
+	}
+
+	current := []*serverNode{start}
+	for _, element := range path.RelativePath.Elements {
+		if element.TargetName == nil || element.TargetName.Name == "" {
+			return &ua.BrowsePathResult{StatusCode: ua.StatusBadBrowseNameInvalid}
+		}
+		refType := uint32(id.HierarchicalReferences)
+		if element.ReferenceTypeID != nil && element.ReferenceTypeID.IntID() != 0 {
+			refType = element.ReferenceTypeID.IntID()
+		}
+
+		var next []*serverNode
+		for _, n := range current {
+			for _, r := range n.references {
+				if r.forward == element.IsInverse || !isReferenceType(r.refType, refType, element.IncludeSubtypes) {
+					continue
+				}
+				if r.target.browseName.NamespaceIndex == element.TargetName.NamespaceIndex && r.target.browseName.Name == element.TargetName.Name {
+					next = append(next, r.target)
+				}
+			}
+		}
+		if len(next) == 0 {
+			return &ua.BrowsePathResult{StatusCode: ua.StatusBadNoMatch}
+		}
+		current = next
+	}
+
+	result := &ua.BrowsePathResult{StatusCode: ua.StatusOK}
+	for _, n := range current {
+		result.Targets = append(result.Targets, &ua.BrowsePathTarget{
+			TargetID:           ua.NewExpandedNodeID(n.id, "", 0),
+			RemainingPathIndex: 0xFFFFFFFF,
+		})
+	}
+	return result
+}
@@ -0,0 +1,456 @@
+package opcua_plugin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uacp"
+	"github.com/gopcua/opcua/uapolicy"
+)
+
+const (
+	maxSessions = 100
+	// maxContinuationPoints limits the browse results a session can page through at the same time.
+	maxContinuationPoints = 10
+
+	minSessionTimeout = 10 * time.Second
+	maxSessionTimeout = time.Hour
+)
+
+// browseContinuation holds the references that are left of a browse result.
+type browseContinuation struct {
+	references    []*ua.ReferenceDescription
+	maxReferences uint32
+}
+
+func responseHeader(req *ua.RequestHeader, status ua.StatusCode) *ua.ResponseHeader {
+	h := &ua.ResponseHeader{
+		Timestamp:          time.Now(),
+		ServiceResult:      status,
+		ServiceDiagnostics: &ua.DiagnosticInfo{},
+	}
+	if req != nil {
+		h.RequestHandle = req.RequestHandle
+	}
+	return h
+}
+
+func serviceFault(req *ua.RequestHeader, status ua.StatusCode) *ua.ServiceFault {
+	return &ua.ServiceFault{ResponseHeader: responseHeader(req, status)}
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// handle answers a request of a client.
+func (srv *uaServer) handle(ch *serverChannel, requestID uint32, req interface{}) {
+	srv.mu.Lock()
+	responses := srv.dispatch(ch, requestID, req)
+	srv.mu.Unlock()
+
+	for _, r := range responses {
+		r.send()
+	}
+}
+
+// dispatch calls the service of a request. It returns the responses to send, which are usually the response to
+// the request, but publish requests are answered later. The mutex must be held.
+func (srv *uaServer) dispatch(ch *serverChannel, requestID uint32, svc interface{}) []*pendingResponse {
+	respond := func(resp ua.Response) []*pendingResponse {
+		return []*pendingResponse{{channel: ch, requestID: requestID, response: resp}}
+	}
+
+	req, ok := svc.(ua.Request)
+	if !ok || req.Header() == nil {
+		return respond(serviceFault(nil, ua.StatusBadServiceUnsupported))
+	}
+	header := req.Header()
+
+	// services without a session
+	switch r := req.(type) {
+	case *ua.GetEndpointsRequest:
+		return respond(&ua.GetEndpointsResponse{ResponseHeader: responseHeader(header, ua.StatusOK), Endpoints: srv.endpoints(r.EndpointURL)})
+	case *ua.FindServersRequest:
+		return respond(srv.findServers(r))
+	case *ua.CreateSessionRequest:
+		return respond(srv.createSession(ch, r))
+	case *ua.ActivateSessionRequest:
+		return respond(srv.activateSession(ch, r))
+	}
+
+	sess, status := srv.session(ch, header)
+	if status != ua.StatusOK {
+		return respond(serviceFault(header, status))
+	}
+	sess.lastSeen = time.Now()
+
+	switch r := req.(type) {
+	case *ua.CloseSessionRequest:
+		srv.log.Infof("Session %s closed", sess.name)
+		// subscriptions cannot be transferred, so they are always deleted
+		return append(srv.closeSession(sess), respond(&ua.CloseSessionResponse{ResponseHeader: responseHeader(header, ua.StatusOK)})...)
+	case *ua.ReadRequest:
+		return respond(srv.read(r))
+	case *ua.WriteRequest:
+		return respond(srv.write(r))
+	case *ua.BrowseRequest:
+		return respond(srv.browse(sess, r))
+	case *ua.BrowseNextRequest:
+		return respond(srv.browseNext(sess, r))
+	case *ua.TranslateBrowsePathsToNodeIDsRequest:
+		return respond(srv.translateBrowsePaths(r))
+	case *ua.CreateSubscriptionRequest:
+		return respond(srv.createSubscription(sess, r))
+	case *ua.ModifySubscriptionRequest:
+		return respond(srv.modifySubscription(sess, r))
+	case *ua.SetPublishingModeRequest:
+		return respond(srv.setPublishingMode(sess, r))
+	case *ua.DeleteSubscriptionsRequest:
+		responses := respond(srv.deleteSubscriptions(sess, r))
+		if len(sess.subscriptions) == 0 {
+			// publish requests are only queued while the session has subscriptions
+			responses = append(responses, rejectPublishRequests(sess, ua.StatusBadNoSubscription)...)
+		}
+		return responses
+	case *ua.CreateMonitoredItemsRequest:
+		return respond(srv.createMonitoredItems(sess, r))
+	case *ua.ModifyMonitoredItemsRequest:
+		return respond(srv.modifyMonitoredItems(sess, r))
+	case *ua.SetMonitoringModeRequest:
+		return respond(srv.setMonitoringMode(sess, r))
+	case *ua.DeleteMonitoredItemsRequest:
+		return respond(srv.deleteMonitoredItems(sess, r))
+	case *ua.PublishRequest:
+		return srv.publish(ch, requestID, sess, r)
+	case *ua.RepublishRequest:
+		return respond(srv.republish(sess, r))
+	}
+	return respond(serviceFault(header, ua.StatusBadServiceUnsupported))
+}
+
+// session returns the activated session of a request.
+func (srv *uaServer) session(ch *serverChannel, header *ua.RequestHeader) (*serverSession, ua.StatusCode) {
+	if header.AuthenticationToken == nil {
+		return nil, ua.StatusBadSessionIDInvalid
+	}
+	sess, ok := srv.sessions[nodeKey(header.AuthenticationToken)]
+	switch {
+	case !ok:
+		return nil, ua.StatusBadSessionIDInvalid
+	case sess.channel != ch:
+		return nil, ua.StatusBadSecureChannelIDInvalid
+	case !sess.activated:
+		return nil, ua.StatusBadSessionNotActivated
+	}
+	return sess, ua.StatusOK
+}
+
+func (srv *uaServer) findServers(req *ua.FindServersRequest) ua.Response {
+	resp := &ua.FindServersResponse{ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK), Servers: []*ua.ApplicationDescription{}}
+	matches := len(req.ServerURIs) == 0
+	for _, uri := range req.ServerURIs {
+		matches = matches || uri == srv.applicationURI
+	}
+	if matches {
+		resp.Servers = append(resp.Servers, srv.applicationDescription(srv.endpointURL))
+	}
+	return resp
+}
+
+func (srv *uaServer) createSession(ch *serverChannel, req *ua.CreateSessionRequest) ua.Response {
+	if ch.id == 0 {
+		return serviceFault(req.RequestHeader, ua.StatusBadSecureChannelIDInvalid)
+	}
+	if !srv.policyEnabled(ch.policyURI) {
+		return serviceFault(req.RequestHeader, ua.StatusBadSecurityPolicyRejected)
+	}
+	if len(srv.sessions) >= maxSessions {
+		return serviceFault(req.RequestHeader, ua.StatusBadTooManySessions)
+	}
+
+	signature := &ua.SignatureData{}
+	if ch.policyURI != ua.SecurityPolicyURINone {
+		// the session belongs to the certificate that the channel verified
+		if !bytes.Equal(req.ClientCertificate, ch.remoteCert) {
+			return serviceFault(req.RequestHeader, ua.StatusBadCertificateInvalid)
+		}
+		if len(req.ClientNonce) < 32 {
+			return serviceFault(req.RequestHeader, ua.StatusBadNonceInvalid)
+		}
+		remoteKey, err := certificatePublicKey(ch.remoteCert)
+		if err != nil {
+			return serviceFault(req.RequestHeader, ua.StatusBadCertificateInvalid)
+		}
+		algo, err := uapolicy.Asymmetric(ch.policyURI, srv.key, remoteKey)
+		if err != nil {
+			return serviceFault(req.RequestHeader, ua.StatusBadSecurityChecksFailed)
+		}
+		// the server proves that it owns its certificate by signing the certificate and nonce of the client
+		sig, err := algo.Signature(append(append([]byte{}, req.ClientCertificate...), req.ClientNonce...))
+		if err != nil {
+			return serviceFault(req.RequestHeader, ua.StatusBadSecurityChecksFailed)
+		}
+		signature = &ua.SignatureData{Algorithm: algo.SignatureURI(), Signature: sig}
+	}
+
+	timeout := time.Duration(req.RequestedSessionTimeout * float64(time.Millisecond))
+	switch {
+	case timeout < minSessionTimeout:
+		timeout = minSessionTimeout
+	case timeout > maxSessionTimeout:
+		timeout = maxSessionTimeout
+	}
+
+	srv.nextID++
+	sess := &serverSession{
+		id:                 ua.NewNumericNodeID(1, srv.nextID),
+		authToken:          ua.NewByteStringNodeID(0, randomBytes(32)),
+		name:               req.SessionName,
+		channel:            ch,
+		timeout:            timeout,
+		lastSeen:           time.Now(),
+		nonce:              randomBytes(32),
+		clientCert:         req.ClientCertificate,
+		subscriptions:      map[uint32]*serverSubscription{},
+		continuationPoints: map[string]*browseContinuation{},
+	}
+	srv.sessions[nodeKey(sess.authToken)] = sess
+
+	return &ua.CreateSessionResponse{
+		ResponseHeader:        responseHeader(req.RequestHeader, ua.StatusOK),
+		SessionID:             sess.id,
+		AuthenticationToken:   sess.authToken,
+		RevisedSessionTimeout: float64(timeout / time.Millisecond),
+		ServerNonce:           sess.nonce,
+		ServerCertificate:     srv.cert,
+		ServerEndpoints:       srv.endpoints(req.EndpointURL),
+		ServerSignature:       signature,
+		MaxRequestMessageSize: uacp.DefaultMaxMessageSize,
+	}
+}
+
+// activateSession authenticates the user of a session. Sessions can be activated again on a new channel after
+// the connection was lost.
+func (srv *uaServer) activateSession(ch *serverChannel, req *ua.ActivateSessionRequest) ua.Response {
+	if req.RequestHeader.AuthenticationToken == nil {
+		return serviceFault(req.RequestHeader, ua.StatusBadSessionIDInvalid)
+	}
+	sess, ok := srv.sessions[nodeKey(req.RequestHeader.AuthenticationToken)]
+	if !ok || !sess.activated && sess.channel != ch {
+		return serviceFault(req.RequestHeader, ua.StatusBadSessionIDInvalid)
+	}
+	if !srv.policyEnabled(ch.policyURI) {
+		return serviceFault(req.RequestHeader, ua.StatusBadSecurityPolicyRejected)
+	}
+
+	if ch.policyURI != ua.SecurityPolicyURINone {
+		if !bytes.Equal(ch.remoteCert, sess.clientCert) {
+			return serviceFault(req.RequestHeader, ua.StatusBadSecurityChecksFailed)
+		}
+		remoteKey, err := certificatePublicKey(ch.remoteCert)
+		if err != nil {
+			return serviceFault(req.RequestHeader, ua.StatusBadCertificateInvalid)
+		}
+		algo, err := uapolicy.Asymmetric(ch.policyURI, srv.key, remoteKey)
+		if err != nil {
+			return serviceFault(req.RequestHeader, ua.StatusBadSecurityChecksFailed)
+		}
+		if req.ClientSignature == nil || algo.VerifySignature(append(append([]byte{}, srv.cert...), sess.nonce...), req.ClientSignature.Signature) != nil {
+			return serviceFault(req.RequestHeader, ua.StatusBadApplicationSignatureInvalid)
+		}
+	}
+
+	user, status := srv.authenticate(ch, sess, req.UserIdentityToken)
+	if status != ua.StatusOK {
+		srv.log.Warnf("Rejected user %q of session %s: %s", user, sess.name, status)
+		return serviceFault(req.RequestHeader, status)
+	}
+
+	if sess.channel != ch {
+		// publish requests of the previous channel cannot be answered anymore
+		sess.publishRequests = dropPublishRequests(sess.publishRequests, sess.channel)
+	}
+	sess.channel = ch
+	sess.activated = true
+	sess.lastSeen = time.Now()
+	sess.nonce = randomBytes(32)
+	srv.log.Infof("Session %s activated for %s", sess.name, user)
+
+	return &ua.ActivateSessionResponse{
+		ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK),
+		ServerNonce:    sess.nonce,
+		Results:        make([]ua.StatusCode, len(req.ClientSoftwareCertificates)),
+	}
+}
+
+// authenticate checks the identity token of a session. It returns the name of the user for logging.
+func (srv *uaServer) authenticate(ch *serverChannel, sess *serverSession, token *ua.ExtensionObject) (string, ua.StatusCode) {
+	// a missing token means anonymous
+	if token == nil || token.Value == nil {
+		token = ua.NewExtensionObject(&ua.AnonymousIdentityToken{})
+	}
+
+	switch t := token.Value.(type) {
+	case *ua.AnonymousIdentityToken:
+		if !srv.conf.allowAnonymous {
+			return "anonymous", ua.StatusBadIdentityTokenRejected
+		}
+		return "anonymous", ua.StatusOK
+
+	case *ua.UserNameIdentityToken:
+		password, status := srv.decryptPassword(ch, sess, t)
+		if status != ua.StatusOK {
+			return t.UserName, status
+		}
+		expected, ok := srv.conf.users[t.UserName]
+		if !ok || subtle.ConstantTimeCompare(password, []byte(expected)) != 1 {
+			return t.UserName, ua.StatusBadUserAccessDenied
+		}
+		return t.UserName, ua.StatusOK
+	}
+	return "", ua.StatusBadIdentityTokenInvalid
+}
+
+// decryptPassword returns the password of a user name token. Passwords are encrypted with the policy of the channel,
+// or with the policy of the user token on channels without security, together with the last nonce of the server.
+func (srv *uaServer) decryptPassword(ch *serverChannel, sess *serverSession, t *ua.UserNameIdentityToken) ([]byte, ua.StatusCode) {
+	policyURI := ch.policyURI
+	if policyURI == ua.SecurityPolicyURINone {
+		policyURI = srv.userTokenPolicyURI()
+	}
+
+	if t.EncryptionAlgorithm == "" {
+		// plain passwords are only accepted if they cannot be read by others or no policy is available to encrypt them
+		if policyURI != ua.SecurityPolicyURINone && ch.mode != ua.MessageSecurityModeSignAndEncrypt {
+			return nil, ua.StatusBadIdentityTokenInvalid
+		}
+		return t.Password, ua.StatusOK
+	}
+
+	algo, err := uapolicy.Asymmetric(policyURI, srv.key, nil)
+	if err != nil || t.EncryptionAlgorithm != algo.EncryptionURI() {
+		return nil, ua.StatusBadIdentityTokenInvalid
+	}
+	plain, err := algo.Decrypt(t.Password)
+	if err != nil || len(plain) < 4 {
+		return nil, ua.StatusBadIdentityTokenInvalid
+	}
+	length := int(binary.LittleEndian.Uint32(plain))
+	if length > len(plain)-4 || length < len(sess.nonce) {
+		return nil, ua.StatusBadIdentityTokenInvalid
+	}
+	secret := plain[4 : 4+length]
+	password, nonce := secret[:length-len(sess.nonce)], secret[length-len(sess.nonce):]
+	if !bytes.Equal(nonce, sess.nonce) {
+		return nil, ua.StatusBadIdentityTokenInvalid
+	}
+	return password, ua.StatusOK
+}
+
+func (srv *uaServer) read(req *ua.ReadRequest) ua.Response {
+	switch {
+	case len(req.NodesToRead) == 0:
+		return serviceFault(req.RequestHeader, ua.StatusBadNothingToDo)
+	case req.MaxAge < 0:
+		return serviceFault(req.RequestHeader, ua.StatusBadMaxAgeInvalid)
+	case req.TimestampsToReturn > ua.TimestampsToReturnNeither:
+		return serviceFault(req.RequestHeader, ua.StatusBadTimestampsToReturnInvalid)
+	}
+
+	results := make([]*ua.DataValue, len(req.NodesToRead))
+	for i, r := range req.NodesToRead {
+		results[i] = srv.space.readValue(r, req.TimestampsToReturn)
+	}
+	return &ua.ReadResponse{ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK), Results: results}
+}
+
+// write rejects all writes, as the variables are only updated by the messages of the pipeline.
+func (srv *uaServer) write(req *ua.WriteRequest) ua.Response {
+	if len(req.NodesToWrite) == 0 {
+		return serviceFault(req.RequestHeader, ua.StatusBadNothingToDo)
+	}
+	results := make([]ua.StatusCode, len(req.NodesToWrite))
+	for i, w := range req.NodesToWrite {
+		results[i] = ua.StatusBadNotWritable
+		if srv.space.node(w.NodeID) == nil {
+			results[i] = ua.StatusBadNodeIDUnknown
+		}
+	}
+	return &ua.WriteResponse{ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK), Results: results}
+}
+
+func (srv *uaServer) browse(sess *serverSession, req *ua.BrowseRequest) ua.Response {
+	if len(req.NodesToBrowse) == 0 {
+		return serviceFault(req.RequestHeader, ua.StatusBadNothingToDo)
+	}
+	if req.View != nil && req.View.ViewID != nil && !(req.View.ViewID.Namespace() == 0 && req.View.ViewID.IntID() == 0) {
+		return serviceFault(req.RequestHeader, ua.StatusBadViewIDUnknown)
+	}
+
+	results := make([]*ua.BrowseResult, len(req.NodesToBrowse))
+	for i, desc := range req.NodesToBrowse {
+		refs, status := srv.space.browse(desc)
+		if status != ua.StatusOK {
+			results[i] = &ua.BrowseResult{StatusCode: status}
+			continue
+		}
+		results[i] = sess.page(refs, req.RequestedMaxReferencesPerNode)
+	}
+	return &ua.BrowseResponse{ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK), Results: results}
+}
+
+func (srv *uaServer) browseNext(sess *serverSession, req *ua.BrowseNextRequest) ua.Response {
+	if len(req.ContinuationPoints) == 0 {
+		return serviceFault(req.RequestHeader, ua.StatusBadNothingToDo)
+	}
+
+	results := make([]*ua.BrowseResult, len(req.ContinuationPoints))
+	for i, cp := range req.ContinuationPoints {
+		c, ok := sess.continuationPoints[string(cp)]
+		if !ok {
+			results[i] = &ua.BrowseResult{StatusCode: ua.StatusBadContinuationPointInvalid}
+			continue
+		}
+		delete(sess.continuationPoints, string(cp))
+		if req.ReleaseContinuationPoints {
+			results[i] = &ua.BrowseResult{StatusCode: ua.StatusOK}
+			continue
+		}
+		results[i] = sess.page(c.references, c.maxReferences)
+	}
+	return &ua.BrowseNextResponse{ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK), Results: results}
+}
+
+// page returns at most maxReferences references and keeps the others for BrowseNext. 0 means no limit.
+func (sess *serverSession) page(refs []*ua.ReferenceDescription, maxReferences uint32) *ua.BrowseResult {
+	if maxReferences == 0 || uint32(len(refs)) <= maxReferences {
+		return &ua.BrowseResult{StatusCode: ua.StatusOK, References: append([]*ua.ReferenceDescription{}, refs...)}
+	}
+	if len(sess.continuationPoints) >= maxContinuationPoints {
+		return &ua.BrowseResult{StatusCode: ua.StatusBadNoContinuationPoints}
+	}
+
+	cp := randomBytes(16)
+	sess.continuationPoints[string(cp)] = &browseContinuation{references: refs[maxReferences:], maxReferences: maxReferences}
+	return &ua.BrowseResult{StatusCode: ua.StatusOK, ContinuationPoint: cp, References: refs[:maxReferences]}
+}
+
+func (srv *uaServer) translateBrowsePaths(req *ua.TranslateBrowsePathsToNodeIDsRequest) ua.Response {
+	if len(req.BrowsePaths) == 0 {
+		return serviceFault(req.RequestHeader, ua.StatusBadNothingToDo)
+	}
+	results := make([]*ua.BrowsePathResult, len(req.BrowsePaths))
+	for i, path := range req.BrowsePaths {
+		results[i] = srv.space.translate(path)
+	}
+	return &ua.TranslateBrowsePathsToNodeIDsResponse{ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK), Results: results}
+}
@@ -0,0 +1,543 @@
+package opcua_plugin
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+const (
+	// maxQueuedPublishRequests limits the publish requests a session may queue.
+	maxQueuedPublishRequests = 100
+	// maxMonitoredItemQueueSize limits the values a monitored item keeps until they are published.
+	maxMonitoredItemQueueSize = 1000
+)
+
+// serverSubscription publishes the changes of its monitored items every publishing interval. The fields are guarded
+// by the mutex of the server.
+type serverSubscription struct {
+	id               uint32
+	session          *serverSession
+	interval         time.Duration
+	lifetimeCount    uint32
+	keepAliveCount   uint32
+	maxNotifications uint32
+	enabled          bool
+	items            map[uint32]*monitoredItem
+
+	sequenceNumber   uint32
+	keepAliveCounter uint32
+	lifetimeCounter  uint32
+	stop             chan struct{}
+}
+
+// monitoredItem queues the changes of an attribute of a node until they are published.
+type monitoredItem struct {
+	id            uint32
+	node          *serverNode
+	attributeID   ua.AttributeID
+	clientHandle  uint32
+	mode          ua.MonitoringMode
+	timestamps    ua.TimestampsToReturn
+	queueSize     uint32
+	discardOldest bool
+	filter        *ua.DataChangeFilter
+
+	last  *ua.DataValue
+	queue []*ua.DataValue
+}
+
+// revise sets the monitoring parameters requested by the client.
+func (m *monitoredItem) revise(params *ua.MonitoringParameters, sub *serverSubscription) (float64, ua.StatusCode) {
+	filter := &ua.DataChangeFilter{Trigger: ua.DataChangeTriggerStatusValue}
+	if params.Filter != nil && params.Filter.Value != nil {
+		f, ok := params.Filter.Value.(*ua.DataChangeFilter)
+		switch {
+		case !ok:
+			return 0, ua.StatusBadMonitoredItemFilterUnsupported
+		case m.attributeID != ua.AttributeIDValue:
+			return 0, ua.StatusBadFilterNotAllowed
+		case f.DeadbandType == uint32(ua.DeadbandTypePercent):
+			// the variables have no EURange
+			return 0, ua.StatusBadDeadbandFilterInvalid
+		case f.DeadbandType == uint32(ua.DeadbandTypeAbsolute) && m.node.goType != "float64":
+			return 0, ua.StatusBadDeadbandFilterInvalid
+		}
+		filter = f
+	}
+	m.filter = filter
+	m.clientHandle = params.ClientHandle
+	m.discardOldest = params.DiscardOldest
+
+	m.queueSize = params.QueueSize
+	if m.queueSize == 0 {
+		m.queueSize = 1
+	}
+	if m.queueSize > maxMonitoredItemQueueSize {
+		m.queueSize = maxMonitoredItemQueueSize
+	}
+
+	// values change when messages arrive, so there is no sampling; the interval is only revised as the spec requires
+	interval := params.SamplingInterval
+	if interval < 0 {
+		interval = float64(sub.interval / time.Millisecond)
+	}
+	return interval, ua.StatusOK
+}
+
+// sample queues a value of the node if it changed according to the filter of the item.
+func (m *monitoredItem) sample(value *ua.DataValue) {
+	if m.mode == ua.MonitoringModeDisabled || m.attributeID != ua.AttributeIDValue || !m.changed(value) {
+		return
+	}
+	m.last = value
+	m.enqueue(value)
+}
+
+func (m *monitoredItem) enqueue(value *ua.DataValue) {
+	m.queue = append(m.queue, withTimestamps(value, m.timestamps))
+	if uint32(len(m.queue)) <= m.queueSize {
+		return
+	}
+	// the queue overflowed
+	if m.discardOldest {
+		m.queue = m.queue[1:]
+	} else {
+		m.queue = append(m.queue[:len(m.queue)-2], m.queue[len(m.queue)-1])
+	}
+}
+
+func (m *monitoredItem) changed(value *ua.DataValue) bool {
+	if m.last == nil {
+		return true
+	}
+	if m.last.Status != value.Status {
+		return true
+	}
+	if m.filter.Trigger == ua.DataChangeTriggerStatus {
+		return false
+	}
+	if m.filter.Trigger == ua.DataChangeTriggerStatusValueTimestamp && !m.last.SourceTimestamp.Equal(value.SourceTimestamp) {
+		return true
+	}
+
+	last, current := variantValue(m.last.Value), variantValue(value.Value)
+	if m.filter.DeadbandType == uint32(ua.DeadbandTypeAbsolute) {
+		if l, ok := last.(float64); ok {
+			if c, ok := current.(float64); ok {
+				return math.Abs(c-l) > m.filter.DeadbandValue
+			}
+		}
+	}
+	return !reflect.DeepEqual(last, current)
+}
+
+// hasNotifications reports whether the subscription has changes to publish.
+func (s *serverSubscription) hasNotifications() bool {
+	if !s.enabled {
+		return false
+	}
+	for _, m := range s.items {
+		if m.mode == ua.MonitoringModeReporting && len(m.queue) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// notifications takes the queued changes of the items, at most maxNotifications if set, and reports
+// whether more are left.
+func (s *serverSubscription) notifications() ([]*ua.MonitoredItemNotification, bool) {
+	ids := make([]uint32, 0, len(s.items))
+	for itemID := range s.items {
+		ids = append(ids, itemID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var notifications []*ua.MonitoredItemNotification
+	for _, itemID := range ids {
+		m := s.items[itemID]
+		if m.mode != ua.MonitoringModeReporting {
+			continue
+		}
+		for len(m.queue) > 0 {
+			if s.maxNotifications > 0 && uint32(len(notifications)) == s.maxNotifications {
+				return notifications, true
+			}
+			notifications = append(notifications, &ua.MonitoredItemNotification{ClientHandle: m.clientHandle, Value: m.queue[0]})
+			m.queue = m.queue[1:]
+		}
+	}
+	return notifications, false
+}
+
+// cycle runs a publishing cycle. It returns the response to a queued publish request if the subscription has
+// notifications or has to send a keepalive, and reports whether the subscription expired as the client
+// sent no publish requests during its lifetime.
+func (s *serverSubscription) cycle() (*pendingResponse, bool) {
+	sess := s.session
+	if len(sess.publishRequests) == 0 {
+		s.lifetimeCounter++
+		if s.keepAliveCounter < s.keepAliveCount {
+			s.keepAliveCounter++
+		}
+		return nil, s.lifetimeCounter >= s.lifetimeCount
+	}
+	s.lifetimeCounter = 0
+
+	message := &ua.NotificationMessage{PublishTime: time.Now()}
+	more := false
+	if s.hasNotifications() {
+		var notifications []*ua.MonitoredItemNotification
+		notifications, more = s.notifications()
+		s.sequenceNumber++
+		message.SequenceNumber = s.sequenceNumber
+		message.NotificationData = []*ua.ExtensionObject{ua.NewExtensionObject(&ua.DataChangeNotification{MonitoredItems: notifications})}
+	} else {
+		s.keepAliveCounter++
+		if s.keepAliveCounter < s.keepAliveCount {
+			return nil, false
+		}
+		// keepalives carry the next sequence number without using it
+		message.SequenceNumber = s.sequenceNumber + 1
+	}
+	s.keepAliveCounter = 0
+
+	pub := sess.publishRequests[0]
+	sess.publishRequests = sess.publishRequests[1:]
+	return &pendingResponse{
+		channel:   pub.channel,
+		requestID: pub.requestID,
+		response: &ua.PublishResponse{
+			ResponseHeader:           responseHeader(pub.request.RequestHeader, ua.StatusOK),
+			SubscriptionID:           s.id,
+			AvailableSequenceNumbers: []uint32{},
+			MoreNotifications:        more,
+			NotificationMessage:      message,
+			Results:                  pub.results,
+		},
+	}, false
+}
+
+// revise sets the publishing parameters requested by the client.
+func (s *serverSubscription) revise(interval float64, lifetimeCount, keepAliveCount, maxNotifications uint32) {
+	switch {
+	case interval <= 0 || math.IsNaN(interval):
+		s.interval = time.Second
+	case interval < 50:
+		s.interval = 50 * time.Millisecond
+	case interval > float64(time.Hour/time.Millisecond):
+		s.interval = time.Hour
+	default:
+		s.interval = time.Duration(interval * float64(time.Millisecond))
+	}
+
+	s.keepAliveCount = keepAliveCount
+	if s.keepAliveCount == 0 {
+		s.keepAliveCount = 10
+	}
+	// the lifetime must be at least three keepalives
+	s.lifetimeCount = lifetimeCount
+	if s.lifetimeCount < 3*s.keepAliveCount {
+		s.lifetimeCount = 3 * s.keepAliveCount
+	}
+	s.maxNotifications = maxNotifications
+}
+
+// run runs the publishing cycles of a subscription until it is deleted.
+func (srv *uaServer) run(s *serverSubscription) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	interval := s.interval
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		srv.mu.Lock()
+		resp, expired := s.cycle()
+		if expired {
+			srv.log.Infof("Subscription %d of session %s expired", s.id, s.session.name)
+			srv.deleteSubscription(s)
+		}
+		if s.interval != interval {
+			interval = s.interval
+			ticker.Reset(interval)
+		}
+		srv.mu.Unlock()
+
+		if resp != nil {
+			resp.send()
+		}
+	}
+}
+
+// deleteSubscription stops a subscription and removes its monitored items. The mutex must be held.
+func (srv *uaServer) deleteSubscription(s *serverSubscription) {
+	for _, m := range s.items {
+		m.node.monitors = removeMonitor(m.node.monitors, m)
+	}
+	delete(s.session.subscriptions, s.id)
+	close(s.stop)
+}
+
+func removeMonitor(monitors []*monitoredItem, m *monitoredItem) []*monitoredItem {
+	for i, monitor := range monitors {
+		if monitor == m {
+			return append(monitors[:i], monitors[i+1:]...)
+		}
+	}
+	return monitors
+}
+
+func (srv *uaServer) createSubscription(sess *serverSession, req *ua.CreateSubscriptionRequest) ua.Response {
+	srv.nextID++
+	s := &serverSubscription{
+		id:      srv.nextID,
+		session: sess,
+		enabled: req.PublishingEnabled,
+		items:   map[uint32]*monitoredItem{},
+		stop:    make(chan struct{}),
+	}
+	s.revise(req.RequestedPublishingInterval, req.RequestedLifetimeCount, req.RequestedMaxKeepAliveCount, req.MaxNotificationsPerPublish)
+	// the first cycle sends a keepalive, so that the client knows that the subscription works
+	s.keepAliveCounter = s.keepAliveCount
+	sess.subscriptions[s.id] = s
+	go srv.run(s)
+
+	return &ua.CreateSubscriptionResponse{
+		ResponseHeader:            responseHeader(req.RequestHeader, ua.StatusOK),
+		SubscriptionID:            s.id,
+		RevisedPublishingInterval: float64(s.interval / time.Millisecond),
+		RevisedLifetimeCount:      s.lifetimeCount,
+		RevisedMaxKeepAliveCount:  s.keepAliveCount,
+	}
+}
+
+func (srv *uaServer) modifySubscription(sess *serverSession, req *ua.ModifySubscriptionRequest) ua.Response {
+	s, ok := sess.subscriptions[req.SubscriptionID]
+	if !ok {
+		return serviceFault(req.RequestHeader, ua.StatusBadSubscriptionIDInvalid)
+	}
+	s.revise(req.RequestedPublishingInterval, req.RequestedLifetimeCount, req.RequestedMaxKeepAliveCount, req.MaxNotificationsPerPublish)
+	return &ua.ModifySubscriptionResponse{
+		ResponseHeader:            responseHeader(req.RequestHeader, ua.StatusOK),
+		RevisedPublishingInterval: float64(s.interval / time.Millisecond),
+		RevisedLifetimeCount:      s.lifetimeCount,
+		RevisedMaxKeepAliveCount:  s.keepAliveCount,
+	}
+}
+
+func (srv *uaServer) setPublishingMode(sess *serverSession, req *ua.SetPublishingModeRequest) ua.Response {
+	if len(req.SubscriptionIDs) == 0 {
+		return serviceFault(req.RequestHeader, ua.StatusBadNothingToDo)
+	}
+	results := make([]ua.StatusCode, len(req.SubscriptionIDs))
+	for i, subID := range req.SubscriptionIDs {
+		s, ok := sess.subscriptions[subID]
+		if !ok {
+			results[i] = ua.StatusBadSubscriptionIDInvalid
+			continue
+		}
+		s.enabled = req.PublishingEnabled
+		results[i] = ua.StatusOK
+	}
+	return &ua.SetPublishingModeResponse{ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK), Results: results}
+}
+
+func (srv *uaServer) deleteSubscriptions(sess *serverSession, req *ua.DeleteSubscriptionsRequest) ua.Response {
+	if len(req.SubscriptionIDs) == 0 {
+		return serviceFault(req.RequestHeader, ua.StatusBadNothingToDo)
+	}
+	results := make([]ua.StatusCode, len(req.SubscriptionIDs))
+	for i, subID := range req.SubscriptionIDs {
+		s, ok := sess.subscriptions[subID]
+		if !ok {
+			results[i] = ua.StatusBadSubscriptionIDInvalid
+			continue
+		}
+		srv.deleteSubscription(s)
+		results[i] = ua.StatusOK
+	}
+	return &ua.DeleteSubscriptionsResponse{ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK), Results: results}
+}
+
+func (srv *uaServer) createMonitoredItems(sess *serverSession, req *ua.CreateMonitoredItemsRequest) ua.Response {
+	s, ok := sess.subscriptions[req.SubscriptionID]
+	if !ok {
+		return serviceFault(req.RequestHeader, ua.StatusBadSubscriptionIDInvalid)
+	}
+	if len(req.ItemsToCreate) == 0 {
+		return serviceFault(req.RequestHeader, ua.StatusBadNothingToDo)
+	}
+	if req.TimestampsToReturn > ua.TimestampsToReturnNeither {
+		return serviceFault(req.RequestHeader, ua.StatusBadTimestampsToReturnInvalid)
+	}
+
+	results := make([]*ua.MonitoredItemCreateResult, len(req.ItemsToCreate))
+	for i, item := range req.ItemsToCreate {
+		results[i] = srv.createMonitoredItem(s, item, req.TimestampsToReturn)
+	}
+	return &ua.CreateMonitoredItemsResponse{ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK), Results: results}
+}
+
+func (srv *uaServer) createMonitoredItem(s *serverSubscription, item *ua.MonitoredItemCreateRequest, timestamps ua.TimestampsToReturn) *ua.MonitoredItemCreateResult {
+	if item.ItemToMonitor == nil || item.RequestedParameters == nil {
+		return &ua.MonitoredItemCreateResult{StatusCode: ua.StatusBadNothingToDo}
+	}
+	// reading the attribute validates the node, the attribute, the index range and the encoding
+	value := srv.space.readValue(item.ItemToMonitor, timestamps)
+	switch value.Status {
+	case ua.StatusBadNodeIDUnknown, ua.StatusBadAttributeIDInvalid, ua.StatusBadIndexRangeInvalid, ua.StatusBadDataEncodingInvalid:
+		return &ua.MonitoredItemCreateResult{StatusCode: value.Status}
+	}
+	if item.MonitoringMode > ua.MonitoringModeReporting {
+		return &ua.MonitoredItemCreateResult{StatusCode: ua.StatusBadMonitoringModeInvalid}
+	}
+
+	srv.nextID++
+	m := &monitoredItem{
+		id:          srv.nextID,
+		node:        srv.space.node(item.ItemToMonitor.NodeID),
+		attributeID: item.ItemToMonitor.AttributeID,
+		mode:        item.MonitoringMode,
+		timestamps:  timestamps,
+	}
+	interval, status := m.revise(item.RequestedParameters, s)
+	if status != ua.StatusOK {
+		return &ua.MonitoredItemCreateResult{StatusCode: status}
+	}
+
+	s.items[m.id] = m
+	m.node.monitors = append(m.node.monitors, m)
+	// the current value is the first notification of every item
+	if m.mode != ua.MonitoringModeDisabled {
+		m.last = value
+		m.enqueue(value)
+	}
+	return &ua.MonitoredItemCreateResult{
+		StatusCode:              ua.StatusOK,
+		MonitoredItemID:         m.id,
+		RevisedSamplingInterval: interval,
+		RevisedQueueSize:        m.queueSize,
+	}
+}
+
+func (srv *uaServer) modifyMonitoredItems(sess *serverSession, req *ua.ModifyMonitoredItemsRequest) ua.Response {
+	s, ok := sess.subscriptions[req.SubscriptionID]
+	if !ok {
+		return serviceFault(req.RequestHeader, ua.StatusBadSubscriptionIDInvalid)
+	}
+	if len(req.ItemsToModify) == 0 {
+		return serviceFault(req.RequestHeader, ua.StatusBadNothingToDo)
+	}
+
+	results := make([]*ua.MonitoredItemModifyResult, len(req.ItemsToModify))
+	for i, item := range req.ItemsToModify {
+		m, ok := s.items[item.MonitoredItemID]
+		if !ok || item.RequestedParameters == nil {
+			results[i] = &ua.MonitoredItemModifyResult{StatusCode: ua.StatusBadMonitoredItemIDInvalid}
+			continue
+		}
+		interval, status := m.revise(item.RequestedParameters, s)
+		m.timestamps = req.TimestampsToReturn
+		results[i] = &ua.MonitoredItemModifyResult{StatusCode: status, RevisedSamplingInterval: interval, RevisedQueueSize: m.queueSize}
+	}
+	return &ua.ModifyMonitoredItemsResponse{ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK), Results: results}
+}
+
+func (srv *uaServer) setMonitoringMode(sess *serverSession, req *ua.SetMonitoringModeRequest) ua.Response {
+	s, ok := sess.subscriptions[req.SubscriptionID]
+	if !ok {
+		return serviceFault(req.RequestHeader, ua.StatusBadSubscriptionIDInvalid)
+	}
+	if len(req.MonitoredItemIDs) == 0 {
+		return serviceFault(req.RequestHeader, ua.StatusBadNothingToDo)
+	}
+	if req.MonitoringMode > ua.MonitoringModeReporting {
+		return serviceFault(req.RequestHeader, ua.StatusBadMonitoringModeInvalid)
+	}
+
+	results := make([]ua.StatusCode, len(req.MonitoredItemIDs))
+	for i, itemID := range req.MonitoredItemIDs {
+		m, ok := s.items[itemID]
+		if !ok {
+			results[i] = ua.StatusBadMonitoredItemIDInvalid
+			continue
+		}
+		m.mode = req.MonitoringMode
+		if m.mode == ua.MonitoringModeDisabled {
+			m.queue = nil
+			m.last = nil
+		}
+		results[i] = ua.StatusOK
+	}
+	return &ua.SetMonitoringModeResponse{ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK), Results: results}
+}
+
+func (srv *uaServer) deleteMonitoredItems(sess *serverSession, req *ua.DeleteMonitoredItemsRequest) ua.Response {
+	s, ok := sess.subscriptions[req.SubscriptionID]
+	if !ok {
+		return serviceFault(req.RequestHeader, ua.StatusBadSubscriptionIDInvalid)
+	}
+	if len(req.MonitoredItemIDs) == 0 {
+		return serviceFault(req.RequestHeader, ua.StatusBadNothingToDo)
+	}
+
+	results := make([]ua.StatusCode, len(req.MonitoredItemIDs))
+	for i, itemID := range req.MonitoredItemIDs {
+		m, ok := s.items[itemID]
+		if !ok {
+			results[i] = ua.StatusBadMonitoredItemIDInvalid
+			continue
+		}
+		m.node.monitors = removeMonitor(m.node.monitors, m)
+		delete(s.items, itemID)
+		results[i] = ua.StatusOK
+	}
+	return &ua.DeleteMonitoredItemsResponse{ResponseHeader: responseHeader(req.RequestHeader, ua.StatusOK), Results: results}
+}
+
+// publish queues a publish request until a subscription of the session has notifications or sends a keepalive.
+// It returns the responses to send right away.
+func (srv *uaServer) publish(ch *serverChannel, requestID uint32, sess *serverSession, req *ua.PublishRequest) []*pendingResponse {
+	if len(sess.subscriptions) == 0 {
+		return []*pendingResponse{{channel: ch, requestID: requestID, response: serviceFault(req.RequestHeader, ua.StatusBadNoSubscription)}}
+	}
+
+	// notifications are not kept for republishing, so there is nothing to acknowledge
+	results := make([]ua.StatusCode, len(req.SubscriptionAcknowledgements))
+	for i, ack := range req.SubscriptionAcknowledgements {
+		if _, ok := sess.subscriptions[ack.SubscriptionID]; !ok {
+			results[i] = ua.StatusBadSubscriptionIDInvalid
+			continue
+		}
+		results[i] = ua.StatusBadSequenceNumberUnknown
+	}
+
+	var responses []*pendingResponse
+	sess.publishRequests = append(sess.publishRequests, &queuedPublish{channel: ch, requestID: requestID, request: req, results: results})
+	if len(sess.publishRequests) > maxQueuedPublishRequests {
+		oldest := sess.publishRequests[0]
+		sess.publishRequests = sess.publishRequests[1:]
+		responses = append(responses, &pendingResponse{
+			channel:   oldest.channel,
+			requestID: oldest.requestID,
+			response:  serviceFault(oldest.request.RequestHeader, ua.StatusBadTooManyPublishRequests),
+		})
+	}
+	return responses
+}
+
+func (srv *uaServer) republish(sess *serverSession, req *ua.RepublishRequest) ua.Response {
+	if _, ok := sess.subscriptions[req.SubscriptionID]; !ok {
+		return serviceFault(req.RequestHeader, ua.StatusBadSubscriptionIDInvalid)
+	}
+	return serviceFault(req.RequestHeader, ua.StatusBadMessageNotAvailable)
+}
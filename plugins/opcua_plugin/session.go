@@ -0,0 +1,252 @@
+package opcua_plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// sessionFields are the config fields that keep a session alive and restore it after connection losses.
+func sessionFields() []*service.ConfigField {
+	return []*service.ConfigField{
+		service.NewBoolField("autoReconnect").Description("Restore the session after a connection loss: the session is reactivated, or recreated if the server closed it, its subscriptions are transferred to it and missed notifications are republished. Set to false to open a new session instead, which browses all nodes again.").Default(true),
+		service.NewIntField("reconnectInterval").Description("Interval in milliseconds between the attempts to restore the connection.").Default(5000),
+		service.NewIntField("sessionTimeout").Description("Time in milliseconds the server keeps a session, and its subscriptions, without a connection, so that it can be restored.").Default(1200000),
+		service.NewIntField("keepaliveInterval").Description("Interval in milliseconds in which the state of the server is read to detect broken connections. 0 disables the keepalive.").Default(10000),
+		service.NewIntField("keepaliveFailures").Description("Number of keepalive reads in a row that must fail before the session is considered lost and a new session is opened.").Default(3),
+	}
+}
+
+// sessionConfig holds the settings that keep a session alive. A nil sessionConfig uses the defaults of gopcua without keepalive.
+type sessionConfig struct {
+	autoReconnect     bool
+	reconnectInterval time.Duration
+	sessionTimeout    time.Duration
+	keepaliveInterval time.Duration
+	keepaliveFailures int
+}
+
+func parseSessionConfig(conf *service.ParsedConfig) (*sessionConfig, error) {
+	s := &sessionConfig{}
+	var err error
+
+	if s.autoReconnect, err = conf.FieldBool("autoReconnect"); err != nil {
+		return nil, err
+	}
+	for name, d := range map[string]*time.Duration{
+		"reconnectInterval": &s.reconnectInterval,
+		"sessionTimeout":    &s.sessionTimeout,
+		"keepaliveInterval": &s.keepaliveInterval,
+	} {
+		ms, err := conf.FieldInt(name)
+		if err != nil {
+			return nil, err
+		}
+		if ms < 0 {
+			return nil, fmt.Errorf("%s must not be negative, got %d", name, ms)
+		}
+		*d = time.Duration(ms) * time.Millisecond
+	}
+	if s.reconnectInterval == 0 {
+		return nil, fmt.Errorf("reconnectInterval must be positive")
+	}
+	if s.keepaliveFailures, err = conf.FieldInt("keepaliveFailures"); err != nil {
+		return nil, err
+	}
+	if s.keepaliveFailures < 1 {
+		return nil, fmt.Errorf("keepaliveFailures must be at least 1, got %d", s.keepaliveFailures)
+	}
+	return s, nil
+}
+
+// options returns the client options for the session settings.
+func (s *sessionConfig) options() []opcua.Option {
+	if s == nil {
+		return nil
+	}
+	opts := []opcua.Option{
+		opcua.AutoReconnect(s.autoReconnect),
+		opcua.ReconnectInterval(s.reconnectInterval),
+	}
+	if s.sessionTimeout > 0 {
+		opts = append(opts, opcua.SessionTimeout(s.sessionTimeout))
+	}
+	return opts
+}
+
+// sessionWatch watches the session of a connected client. It logs when the client restores the session and
+// reads the state of the server every keepaliveInterval, as a broken connection that was never closed is not noticed otherwise.
+type sessionWatch struct {
+	conf   *sessionConfig
+	client *opcua.Client
+	log    *service.Logger
+	cancel context.CancelFunc
+	// lost is closed once the session is considered lost and can not be restored by the client
+	lost     chan struct{}
+	lostOnce sync.Once
+}
+
+// watch starts to watch the session of a client. A nil sessionConfig does not watch the session.
+func (s *sessionConfig) watch(c *opcua.Client, log *service.Logger) *sessionWatch {
+	if s == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &sessionWatch{
+		conf:   s,
+		client: c,
+		log:    log,
+		cancel: cancel,
+		lost:   make(chan struct{}),
+	}
+	go w.run(ctx)
+	return w
+}
+
+func (w *sessionWatch) run(ctx context.Context) {
+	interval := w.conf.keepaliveInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	state := opcua.Connected
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := w.client.State()
+		if current != state {
+			switch current {
+			case opcua.Disconnected, opcua.Reconnecting:
+				if state == opcua.Connected {
+					w.log.Warnf("Connection to the OPC UA server lost, restoring the session")
+				}
+			case opcua.Connected:
+				w.log.Infof("OPC UA session restored")
+			case opcua.Closed:
+				w.log.Errorf("OPC UA connection closed, opening a new session")
+				w.setLost()
+				return
+			}
+			state = current
+			failures = 0
+		}
+
+		if current != opcua.Connected || w.conf.keepaliveInterval == 0 {
+			continue
+		}
+		if err := w.keepalive(ctx); err != nil {
+			failures++
+			w.log.Warnf("Keepalive %d of %d failed: %s", failures, w.conf.keepaliveFailures, err)
+			if failures >= w.conf.keepaliveFailures {
+				w.log.Errorf("OPC UA server does not respond, opening a new session")
+				w.setLost()
+				return
+			}
+			continue
+		}
+		failures = 0
+	}
+}
+
+// keepalive reads the state of the server.
+func (w *sessionWatch) keepalive(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, w.conf.keepaliveInterval)
+	defer cancel()
+
+	resp, err := w.client.Read(ctx, &ua.ReadRequest{
+		NodesToRead: []*ua.ReadValueID{{NodeID: ua.NewNumericNodeID(0, id.Server_ServerStatus_State), AttributeID: ua.AttributeIDValue}},
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Results) != 1 {
+		return fmt.Errorf("expected 1 result, got %d", len(resp.Results))
+	}
+	if resp.Results[0].Status != ua.StatusOK {
+		return resp.Results[0].Status
+	}
+	return nil
+}
+
+func (w *sessionWatch) setLost() {
+	w.lostOnce.Do(func() { close(w.lost) })
+}
+
+// lostChan returns a channel that is closed once the session is lost, or nil if the session is not watched.
+func (w *sessionWatch) lostChan() <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+	return w.lost
+}
+
+// isLost reports whether the session is lost and can not be restored by the client.
+func (w *sessionWatch) isLost() bool {
+	select {
+	case <-w.lostChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// stop stops watching the session.
+func (w *sessionWatch) stop() {
+	if w != nil {
+		w.cancel()
+	}
+}
+
+// restored waits for the client to restore the session after a failed service call. It returns false if the
+// client does not restore the session, e.g. because autoReconnect is disabled or the call failed
+// without losing the connection, and a new session has to be opened.
+func (w *sessionWatch) restored(ctx context.Context) bool {
+	if w == nil || !w.conf.autoReconnect {
+		return false
+	}
+
+	// the client notices a connection loss shortly after the failed call
+	deadline := time.Now().Add(w.conf.reconnectInterval)
+	reconnecting := false
+	for {
+		if w.isLost() {
+			return false
+		}
+		switch w.client.State() {
+		case opcua.Connected:
+			if reconnecting {
+				return true
+			}
+			if time.Now().After(deadline) {
+				return false
+			}
+		case opcua.Disconnected, opcua.Reconnecting:
+			reconnecting = true
+		default:
+			return false
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-w.lostChan():
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package opcua_plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionDefaults(t *testing.T) {
+	s, err := parseSessionConfig(testConfig(t, sessionFields(), ``))
+	require.NoError(t, err)
+
+	// the defaults are those of gopcua, so that configs without the fields keep their sessions
+	assert.Equal(t, opcua.DefaultClientConfig().AutoReconnect, s.autoReconnect)
+	assert.Equal(t, opcua.DefaultClientConfig().ReconnectInterval, s.reconnectInterval)
+	assert.Equal(t, opcua.DefaultSessionConfig().SessionTimeout, s.sessionTimeout)
+	assert.Len(t, s.options(), 3)
+
+	// without a session timeout, the one of gopcua is used
+	s, err = parseSessionConfig(testConfig(t, sessionFields(), `sessionTimeout: 0`))
+	require.NoError(t, err)
+	assert.Len(t, s.options(), 2)
+
+	var unset *sessionConfig
+	assert.Nil(t, unset.options())
+
+	for _, yaml := range []string{`reconnectInterval: 0`, `sessionTimeout: -1`, `keepaliveFailures: 0`} {
+		_, err := parseSessionConfig(testConfig(t, sessionFields(), yaml))
+		assert.Error(t, err, yaml)
+	}
+}
+
+func TestSessionWatch(t *testing.T) {
+	log := service.MockResources().Logger()
+
+	var unwatched *sessionWatch
+	assert.False(t, unwatched.isLost())
+	assert.False(t, unwatched.restored(context.Background()))
+	unwatched.stop()
+
+	c, err := opcua.NewClient("opc.tcp://localhost:4840")
+	require.NoError(t, err)
+
+	// a closed client does not restore its session
+	s := &sessionConfig{autoReconnect: true, reconnectInterval: time.Second, keepaliveInterval: 10 * time.Millisecond, keepaliveFailures: 1}
+	w := s.watch(c, log)
+	defer w.stop()
+	select {
+	case <-w.lostChan():
+	case <-time.After(time.Second):
+		t.Fatal("the session of a closed client is not lost")
+	}
+	assert.True(t, w.isLost())
+	assert.False(t, w.restored(context.Background()))
+}
+
+func TestSubscriptionRestoredAfterConnectionLoss(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+	writeTestValues(t, ctx, out, "line1", map[string]string{"temperature": "20.5"})
+
+	in := newTestInput(t, ctx, out, `
+subscribeEnabled: true
+publishingInterval: 50
+reconnectInterval: 100
+nodeIDs:
+  - '{"1": [{"node": "ns=1;s=line1/temperature", "group": "line1", "name": "temperature"}]}'
+`)
+	defer in.Close(ctx)
+
+	// the input keeps its client while the client restores the session, so it never has to connect again
+	nextValue := func() string {
+		for {
+			batch, ack, err := in.ReadBatch(ctx)
+			require.NoError(t, err)
+			require.NoError(t, ack(ctx, nil))
+			if len(batch) > 0 {
+				b, err := batch[len(batch)-1].AsBytes()
+				require.NoError(t, err)
+				return string(b)
+			}
+		}
+	}
+	assert.Equal(t, "20.5", nextValue())
+
+	// the connection breaks, the server keeps the session and its subscription for the client to restore
+	out.server.mu.Lock()
+	for conn := range out.server.conns {
+		conn.Close()
+	}
+	out.server.mu.Unlock()
+	writeTestValues(t, ctx, out, "line1", map[string]string{"temperature": "21.5"})
+
+	assert.Equal(t, "21.5", nextValue())
+
+	// the client restored its subscription in a single session, the previous session is not left on the server
+	out.server.mu.Lock()
+	defer out.server.mu.Unlock()
+	require.Len(t, out.server.sessions, 1)
+	for _, sess := range out.server.sessions {
+		assert.Len(t, sess.subscriptions, 1)
+	}
+}
@@ -0,0 +1,590 @@
+// Copyright 2023 UMH Systems GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opcua_plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// sharedConnectionKey is the key under which an opcua_connection resource returns its ID. Benthos wraps cache
+// resources, so the components look the connection up by this ID instead of by the resource itself.
+const sharedConnectionKey = "opcua_connection_id"
+
+var OPCUAConnectionConfigSpec = service.NewConfigSpec().
+	Summary("A connection to an OPC-UA server that several OPC-UA inputs, processors and outputs share, by setting their connection field to the label of this cache resource. Created & maintained by the United Manufacturing Hub. About us: www.umh.app").
+	Description("The components use one session and secure channel, which is opened when the first of them connects and closed when the last of them is closed. " +
+		"Their subscriptions with the same parameters are multiplexed over one subscription, and they share the browse cache. " +
+		"This helps with servers that limit the number of sessions, e.g. servers embedded in PLCs. The resource can not be used as a general purpose cache.").
+	Fields(endpointFields()...).
+	Fields(browseCacheFields()...)
+
+func init() {
+	err := service.RegisterCache(
+		"opcua_connection", OPCUAConnectionConfigSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.Cache, error) {
+			mgr.Logger().Infof("Created & maintained by the United Manufacturing Hub. About us: www.umh.app")
+			return newSharedConnection(conf, mgr)
+		})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// sharedConnections are the opcua_connection resources by their IDs.
+var sharedConnections = struct {
+	sync.Mutex
+	byID map[string]*sharedConnection
+}{byID: map[string]*sharedConnection{}}
+
+// connectionField is the config field of the components to use the session of an opcua_connection resource.
+func connectionField() *service.ConfigField {
+	return service.NewStringField("connection").Description("Label of an opcua_connection cache resource whose session is used instead of opening one. The endpoint, authentication, security, certificate, session and reverse connect fields are then taken from the resource.").Default("")
+}
+
+//------------------------------------------------------------------------------
+
+// sharedConnection is an opcua_connection resource. It owns the session, which its users share.
+type sharedConnection struct {
+	id          string
+	conf        connectionConfig
+	browseCache *browseCache
+	log         *service.Logger
+
+	mu     sync.Mutex
+	client *opcua.Client
+	users  map[*connectionRef]struct{}
+	// groups are the subscriptions by their parameters
+	groups map[opcua.SubscriptionParameters]*subscriptionGroup
+	handle uint32
+}
+
+func newSharedConnection(conf *service.ParsedConfig, mgr *service.Resources) (*sharedConnection, error) {
+	endpoint, err := conf.FieldString("endpoint")
+	if err != nil {
+		return nil, err
+	}
+	if endpoint == "" {
+		return nil, errors.New("endpoint is required")
+	}
+	c, err := parseEndpointConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := parseBrowseCache(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	s := &sharedConnection{
+		id:          hex.EncodeToString(id),
+		conf:        c,
+		browseCache: cache,
+		log:         mgr.Logger(),
+		users:       map[*connectionRef]struct{}{},
+		groups:      map[opcua.SubscriptionParameters]*subscriptionGroup{},
+	}
+
+	sharedConnections.Lock()
+	sharedConnections.byID[s.id] = s
+	sharedConnections.Unlock()
+	return s, nil
+}
+
+func (s *sharedConnection) Get(ctx context.Context, key string) ([]byte, error) {
+	if key == sharedConnectionKey {
+		return []byte(s.id), nil
+	}
+	return nil, service.ErrKeyNotFound
+}
+
+func (s *sharedConnection) Set(ctx context.Context, key string, value []byte, ttl *time.Duration) error {
+	return errors.New("opcua_connection does not store values")
+}
+
+func (s *sharedConnection) Add(ctx context.Context, key string, value []byte, ttl *time.Duration) error {
+	return errors.New("opcua_connection does not store values")
+}
+
+func (s *sharedConnection) Delete(ctx context.Context, key string) error {
+	return errors.New("opcua_connection does not store values")
+}
+
+func (s *sharedConnection) Close(ctx context.Context) error {
+	sharedConnections.Lock()
+	delete(sharedConnections.byID, s.id)
+	sharedConnections.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drop(ctx)
+	s.conf.reverse.close()
+	return nil
+}
+
+// acquire returns the client of the session, and opens the session if no user has opened it yet or it was lost.
+func (s *sharedConnection) acquire(ctx context.Context, r *connectionRef) (*opcua.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil && s.client.State() == opcua.Closed {
+		s.drop(ctx)
+	}
+	if s.client == nil {
+		c, err := s.conf.connect(ctx, s.log)
+		if err != nil {
+			return nil, err
+		}
+		s.client = c
+	}
+	s.users[r] = struct{}{}
+	return s.client, nil
+}
+
+// release removes the monitored items of a user. The session is closed when its last user releases it.
+func (s *sharedConnection) release(ctx context.Context, r *connectionRef) {
+	s.mu.Lock()
+	if _, ok := s.users[r]; !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.users, r)
+
+	// the subscriptions are changed after unlocking, so that the other users are not blocked by the requests
+	var cancel []subscription
+	unmonitor := map[subscription][]uint32{}
+	for key, g := range s.groups {
+		var ids []uint32
+		for handle, item := range g.items {
+			if item.subscriber.ref == r {
+				if item.monitoredItemID != 0 {
+					ids = append(ids, item.monitoredItemID)
+				}
+				delete(g.items, handle)
+			}
+		}
+		for _, sub := range g.subscribers {
+			if sub.ref == r {
+				sub.stop()
+			}
+		}
+		g.subscribers = removeSubscribers(g.subscribers, r)
+
+		if len(g.subscribers) == 0 {
+			g.stop()
+			cancel = append(cancel, g.sub)
+			delete(s.groups, key)
+		} else if len(ids) > 0 {
+			unmonitor[g.sub] = ids
+		}
+	}
+
+	last := len(s.users) == 0
+	if !last {
+		s.mu.Unlock()
+	}
+
+	for _, sub := range cancel {
+		if err := sub.Cancel(ctx); err != nil {
+			s.log.Debugf("Cancelling the shared subscription failed: %v", err)
+		}
+	}
+	if last {
+		// there is no other user to block, and the session is only closed once its subscriptions are cancelled
+		s.drop(ctx)
+		s.mu.Unlock()
+		return
+	}
+	for sub, ids := range unmonitor {
+		if _, err := sub.Unmonitor(ctx, ids...); err != nil {
+			s.log.Warnf("Removing %d monitored items from the shared subscription failed: %v", len(ids), err)
+		}
+	}
+}
+
+// lost closes the session if it is the one a user lost, so that the next acquire opens a new one.
+func (s *sharedConnection) lost(ctx context.Context, c *opcua.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == c {
+		s.log.Warnf("Shared OPC UA session lost, opening a new one on the next connect")
+		s.drop(ctx)
+	}
+}
+
+// drop closes the session and stops its subscriptions. The mutex must be held.
+func (s *sharedConnection) drop(ctx context.Context) {
+	for key, g := range s.groups {
+		g.stop()
+		for _, sub := range g.subscribers {
+			sub.stop()
+		}
+		delete(s.groups, key)
+	}
+	if s.client != nil {
+		s.client.Close(ctx)
+		s.client = nil
+	}
+}
+
+// subscribe returns a subscription of a user that shares the subscription with the same parameters.
+func (s *sharedConnection) subscribe(ctx context.Context, r *connectionRef, params *opcua.SubscriptionParameters, notifyCh chan<- *opcua.PublishNotificationData) (monitor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[r]; !ok || s.client == nil {
+		return nil, errors.New("the shared session is not connected")
+	}
+
+	var key opcua.SubscriptionParameters
+	if params != nil {
+		key = *params
+	}
+	g, ok := s.groups[key]
+	if !ok {
+		notify := make(chan *opcua.PublishNotificationData, 100)
+		// the client sets the defaults in the parameters, which would change the key
+		requested := key
+		sub, err := s.client.Subscribe(ctx, &requested, notify)
+		if err != nil {
+			return nil, err
+		}
+		g = newSubscriptionGroup(s, sub, notify)
+		s.groups[key] = g
+		go g.dispatch()
+	}
+
+	return g.add(r, notifyCh), nil
+}
+
+//------------------------------------------------------------------------------
+
+// connectionRef is the use of an opcua_connection resource by one component.
+type connectionRef struct {
+	name string
+	conn *sharedConnection
+}
+
+// parseSharedConnection returns the opcua_connection resource the connection field refers to, or nil if it is not
+// set. The endpoint is required without it.
+func parseSharedConnection(conf *service.ParsedConfig, mgr *service.Resources) (*connectionRef, error) {
+	name, err := conf.FieldString("connection")
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		endpoint, err := conf.FieldString("endpoint")
+		if err != nil {
+			return nil, err
+		}
+		if endpoint == "" {
+			return nil, errors.New("either endpoint or connection is required")
+		}
+		return nil, nil
+	}
+	if mgr == nil || !mgr.HasCache(name) {
+		return nil, fmt.Errorf("opcua_connection resource %s not found", name)
+	}
+
+	var id []byte
+	var getErr error
+	if err := mgr.AccessCache(context.Background(), name, func(c service.Cache) {
+		id, getErr = c.Get(context.Background(), sharedConnectionKey)
+	}); err != nil {
+		return nil, err
+	}
+	if getErr != nil {
+		return nil, fmt.Errorf("cache resource %s is not an opcua_connection: %w", name, getErr)
+	}
+
+	sharedConnections.Lock()
+	s, ok := sharedConnections.byID[string(id)]
+	sharedConnections.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("cache resource %s is not an opcua_connection", name)
+	}
+	return &connectionRef{name: name, conn: s}, nil
+}
+
+// config returns the connection settings of the resource, used by this component.
+func (r *connectionRef) config() connectionConfig {
+	c := r.conn.conf
+	// the resource closes its reverse connect listener itself
+	c.reverse = nil
+	c.shared = r
+	return c
+}
+
+// browseConfig returns the browse settings of a component, with the browse cache of the resource unless the
+// component has its own.
+func (r *connectionRef) browseConfig(b *browseConfig) *browseConfig {
+	if r == nil || b == nil || b.cache != nil || r.conn.browseCache == nil {
+		return b
+	}
+	shared := *b
+	shared.cache = r.conn.browseCache
+	return &shared
+}
+
+//------------------------------------------------------------------------------
+
+// monitor creates monitored items in a subscription, which may be shared with other components.
+type monitor interface {
+	Monitor(ctx context.Context, ts ua.TimestampsToReturn, items ...*ua.MonitoredItemCreateRequest) (*ua.CreateMonitoredItemsResponse, error)
+}
+
+// subscription is a subscription of a session, e.g. an *opcua.Subscription.
+type subscription interface {
+	monitor
+	Unmonitor(ctx context.Context, monitoredItemIDs ...uint32) (*ua.DeleteMonitoredItemsResponse, error)
+	Cancel(ctx context.Context) error
+}
+
+// subscriberQueueSize is the number of notifications that are buffered for a user of a shared subscription, so that
+// a user that does not keep up does not hold up the others.
+const subscriberQueueSize = 1000
+
+// subscriptionGroup is a subscription that the users of a shared session with the same subscription parameters
+// share. The client handles of the monitored items are unique in the session, and are translated back to the handles
+// of the users when the notifications are dispatched.
+type subscriptionGroup struct {
+	conn        *sharedConnection
+	sub         subscription
+	notify      chan *opcua.PublishNotificationData
+	subscribers []*sharedSubscription
+	items       map[uint32]*multiplexedItem
+	done        chan struct{}
+	stopOnce    sync.Once
+}
+
+func newSubscriptionGroup(conn *sharedConnection, sub subscription, notify chan *opcua.PublishNotificationData) *subscriptionGroup {
+	return &subscriptionGroup{
+		conn:   conn,
+		sub:    sub,
+		notify: notify,
+		items:  map[uint32]*multiplexedItem{},
+		done:   make(chan struct{}),
+	}
+}
+
+// add adds a user to the subscription, whose notifications are sent to notifyCh. The mutex of the connection must
+// be held.
+func (g *subscriptionGroup) add(r *connectionRef, notifyCh chan<- *opcua.PublishNotificationData) *sharedSubscription {
+	subscriber := &sharedSubscription{
+		group:  g,
+		ref:    r,
+		notify: notifyCh,
+		queue:  make(chan *opcua.PublishNotificationData, subscriberQueueSize),
+		done:   make(chan struct{}),
+	}
+	g.subscribers = append(g.subscribers, subscriber)
+	go subscriber.forward()
+	return subscriber
+}
+
+// multiplexedItem is a monitored item of a user in a subscriptionGroup.
+type multiplexedItem struct {
+	subscriber      *sharedSubscription
+	handle          uint32
+	monitoredItemID uint32
+}
+
+func (g *subscriptionGroup) stop() {
+	g.stopOnce.Do(func() { close(g.done) })
+}
+
+// dispatch forwards the notifications of the subscription to the users whose monitored items they are for. The
+// notifications of a user whose queue is full are dropped, instead of holding up the notifications of the others.
+func (g *subscriptionGroup) dispatch() {
+	for {
+		select {
+		case <-g.done:
+			return
+		case data := <-g.notify:
+			for sub, d := range g.split(data) {
+				select {
+				case sub.queue <- d:
+				default:
+					g.conn.log.Warnf("Dropping a notification of the shared subscription, as a user of %s does not keep up", sub.ref.name)
+				}
+			}
+		}
+	}
+}
+
+// split splits a notification by its users, with the client handles of the users.
+func (g *subscriptionGroup) split(data *opcua.PublishNotificationData) map[*sharedSubscription]*opcua.PublishNotificationData {
+	g.conn.mu.Lock()
+	defer g.conn.mu.Unlock()
+
+	result := map[*sharedSubscription]*opcua.PublishNotificationData{}
+	switch v := data.Value.(type) {
+	case *ua.DataChangeNotification:
+		for _, item := range v.MonitoredItems {
+			m, ok := g.items[item.ClientHandle]
+			if !ok {
+				continue
+			}
+			d, ok := result[m.subscriber]
+			if !ok {
+				d = &opcua.PublishNotificationData{SubscriptionID: data.SubscriptionID, Value: &ua.DataChangeNotification{}}
+				result[m.subscriber] = d
+			}
+			changes := d.Value.(*ua.DataChangeNotification)
+			translated := *item
+			translated.ClientHandle = m.handle
+			changes.MonitoredItems = append(changes.MonitoredItems, &translated)
+		}
+	case *ua.EventNotificationList:
+		for _, event := range v.Events {
+			m, ok := g.items[event.ClientHandle]
+			if !ok {
+				continue
+			}
+			d, ok := result[m.subscriber]
+			if !ok {
+				d = &opcua.PublishNotificationData{SubscriptionID: data.SubscriptionID, Value: &ua.EventNotificationList{}}
+				result[m.subscriber] = d
+			}
+			events := d.Value.(*ua.EventNotificationList)
+			translated := *event
+			translated.ClientHandle = m.handle
+			events.Events = append(events.Events, &translated)
+		}
+	default:
+		// errors and status changes concern all users
+		for _, sub := range g.subscribers {
+			result[sub] = data
+		}
+	}
+	return result
+}
+
+// sharedSubscription is the part of a subscriptionGroup that belongs to one user.
+type sharedSubscription struct {
+	group  *subscriptionGroup
+	ref    *connectionRef
+	notify chan<- *opcua.PublishNotificationData
+	// queue buffers the notifications until the user reads them from notify
+	queue    chan *opcua.PublishNotificationData
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (s *sharedSubscription) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
+// forward sends the queued notifications to the user.
+func (s *sharedSubscription) forward() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case d := <-s.queue:
+			select {
+			case s.notify <- d:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// Monitor creates the monitored items in the shared subscription, with client handles that are unique in the session.
+// The mutex of the connection is not held during the request, so that notifications are dispatched meanwhile.
+func (s *sharedSubscription) Monitor(ctx context.Context, ts ua.TimestampsToReturn, items ...*ua.MonitoredItemCreateRequest) (*ua.CreateMonitoredItemsResponse, error) {
+	conn := s.group.conn
+	conn.mu.Lock()
+
+	requests := make([]*ua.MonitoredItemCreateRequest, len(items))
+	handles := make([]uint32, len(items))
+	for i, item := range items {
+		conn.handle++
+		handles[i] = conn.handle
+
+		request := *item
+		params := ua.MonitoringParameters{}
+		if item.RequestedParameters != nil {
+			params = *item.RequestedParameters
+		}
+		local := params.ClientHandle
+		params.ClientHandle = handles[i]
+		request.RequestedParameters = &params
+		requests[i] = &request
+
+		// registered before the request, as the first notifications may arrive before the response
+		s.group.items[handles[i]] = &multiplexedItem{subscriber: s, handle: local}
+	}
+	conn.mu.Unlock()
+
+	res, err := s.group.sub.Monitor(ctx, ts, requests...)
+
+	conn.mu.Lock()
+	if err != nil {
+		for _, handle := range handles {
+			delete(s.group.items, handle)
+		}
+		conn.mu.Unlock()
+		return nil, err
+	}
+	// items of a user that was released during the request are removed again
+	var released []uint32
+	for i, handle := range handles {
+		ok := i < len(res.Results) && res.Results[i].StatusCode == ua.StatusOK
+		item, registered := s.group.items[handle]
+		switch {
+		case ok && registered:
+			item.monitoredItemID = res.Results[i].MonitoredItemID
+		case ok:
+			released = append(released, res.Results[i].MonitoredItemID)
+		default:
+			delete(s.group.items, handle)
+		}
+	}
+	conn.mu.Unlock()
+
+	if len(released) > 0 {
+		if _, err := s.group.sub.Unmonitor(ctx, released...); err != nil {
+			conn.log.Debugf("Removing %d monitored items of a released user failed: %v", len(released), err)
+		}
+	}
+	return res, nil
+}
+
+func removeSubscribers(subscribers []*sharedSubscription, r *connectionRef) []*sharedSubscription {
+	kept := subscribers[:0]
+	for _, sub := range subscribers {
+		if sub.ref != r {
+			kept = append(kept, sub)
+		}
+	}
+	return kept
+}
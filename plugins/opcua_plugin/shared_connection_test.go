@@ -0,0 +1,351 @@
+package opcua_plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/benthosdev/benthos/v4/public/components/pure"
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSharedConnection(t *testing.T) {
+	_, err := parseConnectionConfig(testConfig(t, connectionFields(), `username: operator`), service.MockResources())
+	assert.Error(t, err)
+
+	_, err = parseConnectionConfig(testConfig(t, connectionFields(), `connection: plc`), service.MockResources())
+	assert.Error(t, err)
+
+	// memory caches are no opcua_connection
+	_, err = parseConnectionConfig(testConfig(t, connectionFields(), `connection: plc`), service.MockResources(service.MockResourcesOptAddCache("plc")))
+	assert.Error(t, err)
+}
+
+// nextDataChange returns the first data change notification, failing the test after a timeout.
+func nextDataChange(t *testing.T, ctx context.Context, notifyCh chan *opcua.PublishNotificationData) *ua.MonitoredItemNotification {
+	t.Helper()
+	for {
+		select {
+		case data := <-notifyCh:
+			require.NoError(t, data.Error)
+			changes, ok := data.Value.(*ua.DataChangeNotification)
+			if !ok || len(changes.MonitoredItems) == 0 {
+				continue
+			}
+			require.Len(t, changes.MonitoredItems, 1)
+			return changes.MonitoredItems[0]
+		case <-ctx.Done():
+			t.Fatal("no data change notification received")
+			return nil
+		}
+	}
+}
+
+func TestSharedConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+	for name, value := range map[string]string{"temperature": "23.5", "pressure": "1.2"} {
+		msg := service.NewMessage([]byte(value))
+		msg.MetaSet("group", "line1")
+		msg.MetaSet("name", name)
+		require.NoError(t, out.Write(ctx, msg))
+	}
+
+	conf, err := OPCUAConnectionConfigSpec.ParseYAML(fmt.Sprintf(`
+endpoint: opc.tcp://%s
+securityMode: None
+securityPolicy: None
+`, out.server.listener.Addr()), nil)
+	require.NoError(t, err)
+	s, err := newSharedConnection(conf, service.MockResources())
+	require.NoError(t, err)
+	defer s.Close(ctx)
+
+	id, err := s.Get(ctx, sharedConnectionKey)
+	require.NoError(t, err)
+	assert.Equal(t, s.id, string(id))
+
+	log := service.MockResources().Logger()
+	first := (&connectionRef{name: "plc", conn: s}).config()
+	second := (&connectionRef{name: "plc", conn: s}).config()
+
+	c1, err := first.connect(ctx, log)
+	require.NoError(t, err)
+	c2, err := second.connect(ctx, log)
+	require.NoError(t, err)
+	assert.Same(t, c1, c2)
+	out.server.mu.Lock()
+	assert.Len(t, out.server.sessions, 1)
+	out.server.mu.Unlock()
+
+	// both users monitor with client handle 0 in the same subscription
+	params := &opcua.SubscriptionParameters{Interval: 100 * time.Millisecond}
+	notify1 := make(chan *opcua.PublishNotificationData, 10)
+	sub1, err := first.subscribe(ctx, c1, params, notify1)
+	require.NoError(t, err)
+	notify2 := make(chan *opcua.PublishNotificationData, 10)
+	sub2, err := second.subscribe(ctx, c2, params, notify2)
+	require.NoError(t, err)
+	assert.Len(t, s.groups, 1)
+
+	_, err = sub1.Monitor(ctx, ua.TimestampsToReturnBoth, opcua.NewMonitoredItemCreateRequestWithDefaults(ua.NewStringNodeID(1, "line1/temperature"), ua.AttributeIDValue, 0))
+	require.NoError(t, err)
+	_, err = sub2.Monitor(ctx, ua.TimestampsToReturnBoth, opcua.NewMonitoredItemCreateRequestWithDefaults(ua.NewStringNodeID(1, "line1/pressure"), ua.AttributeIDValue, 0))
+	require.NoError(t, err)
+	out.server.mu.Lock()
+	for _, sess := range out.server.sessions {
+		assert.Len(t, sess.subscriptions, 1)
+	}
+	out.server.mu.Unlock()
+
+	item := nextDataChange(t, ctx, notify1)
+	assert.Equal(t, uint32(0), item.ClientHandle)
+	assert.Equal(t, 23.5, item.Value.Value.Value())
+	item = nextDataChange(t, ctx, notify2)
+	assert.Equal(t, uint32(0), item.ClientHandle)
+	assert.Equal(t, 1.2, item.Value.Value.Value())
+
+	// the session stays open for the remaining user
+	first.close(ctx, c1)
+	assert.Len(t, s.groups, 1)
+	v, err := c2.Node(ua.NewStringNodeID(1, "line1/pressure")).Value(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1.2, v.Value())
+
+	second.close(ctx, c2)
+	assert.Nil(t, s.client)
+	assert.Empty(t, s.groups)
+
+	// a lost session is opened again on the next connect
+	c3, err := first.connect(ctx, log)
+	require.NoError(t, err)
+	assert.NotSame(t, c1, c3)
+	first.lost(ctx, c3)
+	assert.Nil(t, s.client)
+}
+
+func TestSharedConnectionStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+	for name, value := range map[string]string{"temperature": "23.5", "pressure": "1.2"} {
+		msg := service.NewMessage([]byte(value))
+		msg.MetaSet("group", "line1")
+		msg.MetaSet("name", name)
+		require.NoError(t, out.Write(ctx, msg))
+	}
+
+	sb := service.NewStreamBuilder()
+	require.NoError(t, sb.AddCacheYAML(fmt.Sprintf(`
+label: plc
+opcua_connection:
+  endpoint: opc.tcp://%s
+  securityMode: None
+  securityPolicy: None
+`, out.server.listener.Addr())))
+	require.NoError(t, sb.AddInputYAML(`
+broker:
+  inputs:
+    - opcua:
+        connection: plc
+        subscribeEnabled: true
+        nodeIDs: ['{"1": [{"node": "ns=1;s=line1/temperature", "group": "line1", "name": "temperature"}]}']
+    - opcua:
+        connection: plc
+        subscribeEnabled: true
+        nodeIDs: ['{"1": [{"node": "ns=1;s=line1/pressure", "group": "line1", "name": "pressure"}]}']
+`))
+
+	var mu sync.Mutex
+	received := map[string]string{}
+	require.NoError(t, sb.AddConsumerFunc(func(ctx context.Context, msg *service.Message) error {
+		name, _ := msg.MetaGet("name")
+		b, err := msg.AsBytes()
+		require.NoError(t, err)
+		mu.Lock()
+		received[name] = string(b)
+		mu.Unlock()
+		return nil
+	}))
+	stream, err := sb.Build()
+	require.NoError(t, err)
+
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- stream.Run(runCtx) }()
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 2
+	}, 20*time.Second, 100*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, map[string]string{"temperature": "23.5", "pressure": "1.2"}, received)
+	mu.Unlock()
+
+	out.server.mu.Lock()
+	assert.Len(t, out.server.sessions, 1)
+	out.server.mu.Unlock()
+
+	stop()
+	<-done
+}
+
+// blockingSubscription blocks in Monitor until unblock is closed, and records the removed monitored items.
+type blockingSubscription struct {
+	entered   chan struct{}
+	unblock   chan struct{}
+	mu        sync.Mutex
+	removed   []uint32
+	cancelled bool
+}
+
+func (s *blockingSubscription) Monitor(ctx context.Context, ts ua.TimestampsToReturn, items ...*ua.MonitoredItemCreateRequest) (*ua.CreateMonitoredItemsResponse, error) {
+	close(s.entered)
+	<-s.unblock
+	res := &ua.CreateMonitoredItemsResponse{}
+	for _, item := range items {
+		res.Results = append(res.Results, &ua.MonitoredItemCreateResult{StatusCode: ua.StatusOK, MonitoredItemID: 100 + item.RequestedParameters.ClientHandle})
+	}
+	return res, nil
+}
+
+func (s *blockingSubscription) Unmonitor(ctx context.Context, monitoredItemIDs ...uint32) (*ua.DeleteMonitoredItemsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removed = append(s.removed, monitoredItemIDs...)
+	return &ua.DeleteMonitoredItemsResponse{}, nil
+}
+
+func (s *blockingSubscription) Cancel(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancelled = true
+	return nil
+}
+
+// dataChange returns a notification with a data change of each client handle.
+func dataChange(handles ...uint32) *opcua.PublishNotificationData {
+	changes := &ua.DataChangeNotification{}
+	for _, handle := range handles {
+		changes.MonitoredItems = append(changes.MonitoredItems, &ua.MonitoredItemNotification{ClientHandle: handle, Value: &ua.DataValue{Value: ua.MustVariant(int32(handle))}})
+	}
+	return &opcua.PublishNotificationData{Value: changes}
+}
+
+func TestSharedSubscriptionMonitor(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn := &sharedConnection{
+		log:    service.MockResources().Logger(),
+		users:  map[*connectionRef]struct{}{},
+		groups: map[opcua.SubscriptionParameters]*subscriptionGroup{},
+	}
+	ref := &connectionRef{name: "plc", conn: conn}
+	conn.users[ref] = struct{}{}
+	fake := &blockingSubscription{entered: make(chan struct{}), unblock: make(chan struct{})}
+	g := newSubscriptionGroup(conn, fake, make(chan *opcua.PublishNotificationData, 10))
+	conn.groups[opcua.SubscriptionParameters{}] = g
+	go g.dispatch()
+
+	notify := make(chan *opcua.PublishNotificationData, 10)
+	conn.mu.Lock()
+	sub := g.add(ref, notify)
+	conn.mu.Unlock()
+
+	done := make(chan *ua.CreateMonitoredItemsResponse)
+	go func() {
+		res, err := sub.Monitor(ctx, ua.TimestampsToReturnBoth, opcua.NewMonitoredItemCreateRequestWithDefaults(ua.NewNumericNodeID(1, 1), ua.AttributeIDValue, 7))
+		assert.NoError(t, err)
+		done <- res
+	}()
+	<-fake.entered
+
+	// notifications are dispatched while the request is pending
+	g.notify <- dataChange(conn.handle)
+	item := nextDataChange(t, ctx, notify)
+	assert.Equal(t, uint32(7), item.ClientHandle)
+
+	// the user is released while the request is pending, so its monitored item is removed again
+	conn.release(ctx, ref)
+	assert.Empty(t, conn.groups)
+	close(fake.unblock)
+	res := <-done
+	require.Len(t, res.Results, 1)
+	assert.Equal(t, []uint32{res.Results[0].MonitoredItemID}, fake.removed)
+}
+
+func TestSubscriptionGroupSlowUser(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn := &sharedConnection{log: service.MockResources().Logger()}
+	g := newSubscriptionGroup(conn, nil, make(chan *opcua.PublishNotificationData))
+	defer g.stop()
+	go g.dispatch()
+
+	// the slow user never reads its notifications
+	conn.mu.Lock()
+	slow := g.add(&connectionRef{name: "plc", conn: conn}, make(chan *opcua.PublishNotificationData))
+	notify := make(chan *opcua.PublishNotificationData)
+	fast := g.add(&connectionRef{name: "plc", conn: conn}, notify)
+	g.items[1] = &multiplexedItem{subscriber: slow, handle: 1}
+	g.items[2] = &multiplexedItem{subscriber: fast, handle: 2}
+	conn.mu.Unlock()
+	defer slow.stop()
+	defer fast.stop()
+
+	// once the queue of the slow user is full, its notifications are dropped and the fast user still receives its own
+	for i := 0; i < 2*subscriberQueueSize; i++ {
+		select {
+		case g.notify <- dataChange(1, 2):
+		case <-ctx.Done():
+			t.Fatal("the dispatch is held up by the slow user")
+		}
+		item := nextDataChange(t, ctx, notify)
+		require.Equal(t, uint32(2), item.ClientHandle)
+	}
+}
+
+func TestFailedConnectReleasesClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out := newTestServerOutput(t, testServerConfig)
+	require.NoError(t, out.Connect(ctx))
+	defer out.Close(ctx)
+
+	conf, err := OPCUAConfigSpec.ParseYAML(fmt.Sprintf(`
+endpoint: opc.tcp://%s
+securityMode: None
+securityPolicy: None
+subscribeEnabled: true
+nodeIDs: ['{"1": [{"node": "ns=1;s=line1/missing", "group": "line1", "name": "missing"}]}']
+`, out.server.listener.Addr()), nil)
+	require.NoError(t, err)
+	in, err := newOPCUAInput(conf, service.MockResources())
+	require.NoError(t, err)
+	defer in.Close(ctx)
+
+	// every Connect tries again instead of keeping the client of a failed one
+	for i := 0; i < 2; i++ {
+		assert.Error(t, in.Connect(ctx))
+		out.server.mu.Lock()
+		assert.Empty(t, out.server.sessions)
+		out.server.mu.Unlock()
+	}
+}